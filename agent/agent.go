@@ -23,12 +23,17 @@
 package agent
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
+	auth "github.com/abbot/go-http-auth"
+
 	"github.com/pmylund/go-cache"
 	"github.com/skydive-project/skydive/analyzer"
 	"github.com/skydive-project/skydive/api"
@@ -60,10 +65,13 @@ type Agent struct {
 	FlowProbeBundle     *fprobes.FlowProbeBundle
 	FlowTableAllocator  *flow.TableAllocator
 	FlowClientPool      *analyzer.FlowClientPool
+	TopologyForwarder   *TopologyForwarder
 	OnDemandProbeServer *ondemand.OnDemandProbeServer
 	HTTPServer          *shttp.Server
 	EtcdClient          *etcd.EtcdClient
+	Membership          *etcd.EtcdMembership
 	TIDMapper           *topology.TIDMapper
+	Recorder            *graph.Recorder
 }
 
 // NewAnalyzerWSClientPool creates a new http WebSocket client Pool
@@ -92,6 +100,69 @@ func NewAnalyzerWSClientPool() *shttp.WSAsyncClientPool {
 	return wspool
 }
 
+// NewBufferFromConfig creates the buffer used while no analyzer is reachable,
+// items are spilled to the name file of agent.buffer.path if set
+func NewBufferFromConfig(name string) (*common.Buffer, error) {
+	cfg := config.GetConfig()
+
+	var path string
+	if dir := cfg.GetString("agent.buffer.path"); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, name+".buf")
+	}
+
+	return common.NewBuffer(cfg.GetInt("agent.buffer.memory_items"), path, cfg.GetInt("agent.buffer.disk_items"))
+}
+
+func (a *Agent) bufferStats(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	stats := map[string]common.BufferStats{
+		"Flows":    a.FlowClientPool.BufferStats(),
+		"Topology": a.TopologyForwarder.BufferStats(),
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		panic(err)
+	}
+}
+
+func (a *Agent) tidStats(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(a.TIDMapper.Stats()); err != nil {
+		panic(err)
+	}
+}
+
+// startPlacement sets how the master analyzer is elected, at random or on
+// a consistent hash ring of the analyzers registered in etcd
+func (a *Agent) startPlacement() (err error) {
+	switch placement := config.GetConfig().GetString("agent.placement"); placement {
+	case "random":
+		return nil
+	case "hash":
+	default:
+		return fmt.Errorf("Unknown analyzer placement: %s", placement)
+	}
+
+	if a.EtcdClient, err = etcd.NewEtcdClientFromConfig(); err != nil {
+		return err
+	}
+
+	placement := NewHashPlacement(config.GetConfig().GetString("host_id"), a.WSAsyncClientPool)
+	a.WSAsyncClientPool.SetMasterSelector(placement)
+	a.FlowClientPool.StickToMaster()
+
+	a.Membership = etcd.NewEtcdMembership(a.EtcdClient, etcd.AnalyzersMembershipPath, "")
+	a.Membership.AddListener(placement)
+	a.Membership.Start()
+
+	return nil
+}
+
 // Start the agent services
 func (a *Agent) Start() {
 	var err error
@@ -104,7 +175,11 @@ func (a *Agent) Start() {
 		os.Exit(1)
 	}
 
-	NewTopologyForwarderFromConfig(a.Graph, a.WSAsyncClientPool)
+	a.TopologyForwarder, err = NewTopologyForwarderFromConfig(a.Graph, a.WSAsyncClientPool)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to instantiate topology forwarder: %s", err.Error())
+		os.Exit(1)
+	}
 
 	a.TopologyProbeBundle, err = NewTopologyProbeBundleFromConfig(a.Graph, a.Root, a.WSAsyncClientPool)
 	if err != nil {
@@ -133,7 +208,32 @@ func (a *Agent) Start() {
 
 	packet_injector.NewServer(a.WSAsyncClientPool, a.Graph)
 
-	a.FlowClientPool = analyzer.NewFlowClientPool(a.WSAsyncClientPool)
+	flowBuffer, err := NewBufferFromConfig("flows")
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to instantiate flow buffer: %s", err.Error())
+		os.Exit(1)
+	}
+	a.FlowClientPool = analyzer.NewFlowClientPool(a.WSAsyncClientPool, flowBuffer)
+
+	if err = a.startPlacement(); err != nil {
+		logging.GetLogger().Errorf("Unable to start the analyzer placement: %s", err.Error())
+		os.Exit(1)
+	}
+
+	a.HTTPServer.RegisterRoutes([]shttp.Route{
+		{
+			Name:        "BufferStats",
+			Method:      "GET",
+			Path:        "/api/agent/buffers",
+			HandlerFunc: a.bufferStats,
+		},
+		{
+			Name:        "TIDStats",
+			Method:      "GET",
+			Path:        "/api/agent/tids",
+			HandlerFunc: a.tidStats,
+		},
+	})
 
 	a.FlowProbeBundle = fprobes.NewFlowProbeBundleFromConfig(a.TopologyProbeBundle, a.Graph, a.FlowTableAllocator, a.FlowClientPool)
 	a.FlowProbeBundle.Start()
@@ -161,9 +261,15 @@ func (a *Agent) Stop() {
 	if a.FlowClientPool != nil {
 		a.FlowClientPool.Close()
 	}
+	if a.TopologyForwarder != nil {
+		a.TopologyForwarder.Close()
+	}
 	if a.OnDemandProbeServer != nil {
 		a.OnDemandProbeServer.Stop()
 	}
+	if a.Membership != nil {
+		a.Membership.Stop()
+	}
 	if a.EtcdClient != nil {
 		a.EtcdClient.Stop()
 	}
@@ -173,29 +279,44 @@ func (a *Agent) Stop() {
 		tr.CloseIdleConnections()
 	}
 	a.TIDMapper.Stop()
+	if a.Recorder != nil {
+		a.Recorder.Stop()
+	}
 }
 
 // NewAgent instanciates a new Agent aim to launch probes (topology and flow)
-func NewAgent() *Agent {
+func NewAgent() (*Agent, error) {
 	backend, err := graph.NewMemoryBackend()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	g := graph.NewGraphFromConfig(backend)
 
-	tm := topology.NewTIDMapper(g)
-	tm.Start()
+	tm, err := topology.NewTIDMapperFromConfig(g)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load the TID store: %s", err.Error())
+	}
 
 	hserver, err := shttp.NewServerFromConfig(common.AgentService)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	if _, err = api.NewAPI(hserver, nil, common.AgentService); err != nil {
-		panic(err)
+		return nil, err
 	}
 
+	// record from the very beginning, before any probe is started
+	recorder, err := graph.NewRecorderFromConfig(g)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to record the graph events: %s", err.Error())
+	} else if recorder != nil {
+		recorder.Start()
+	}
+
+	tm.Start()
+
 	wsServer := shttp.NewWSServerFromConfig(hserver, "/ws")
 
 	tr := traversal.NewGremlinTraversalParser(g)
@@ -213,7 +334,8 @@ func NewAgent() *Agent {
 		Root:        root,
 		HTTPServer:  hserver,
 		TIDMapper:   tm,
-	}
+		Recorder:    recorder,
+	}, nil
 }
 
 // CreateRootNode creates a graph.Node based on the host properties and aims to have an unique ID
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package agent
+
+import (
+	"github.com/skydive-project/skydive/common"
+	shttp "github.com/skydive-project/skydive/http"
+	"github.com/skydive-project/skydive/logging"
+)
+
+const hashRingReplicas = 128
+
+// HashPlacement elects as master the analyzer owning the host_id of the agent
+// on a consistent hash ring of the analyzers registered in etcd. The agents
+// are then spread across the analyzers, only the agents of an analyzer
+// joining or leaving move.
+type HashPlacement struct {
+	Host string
+	pool *shttp.WSAsyncClientPool
+	ring *common.HashRing
+}
+
+// SelectMaster returns the connected analyzer owning the host, the next ones
+// on the ring take over if it is not connected
+func (p *HashPlacement) SelectMaster(clients []*shttp.WSAsyncClient) *shttp.WSAsyncClient {
+	for _, owner := range p.ring.Owners(p.Host) {
+		for _, client := range clients {
+			if client.RemoteHost() == owner {
+				return client
+			}
+		}
+	}
+
+	// no registered analyzer connected, etcd may not be reachable
+	return clients[0]
+}
+
+// OnMembersChanged rebalances the agent when an analyzer joins or leaves
+func (p *HashPlacement) OnMembersChanged(members []string) {
+	p.ring.SetMembers(members)
+
+	if owners := p.ring.Owners(p.Host); len(owners) > 0 {
+		logging.GetLogger().Infof("Analyzer %s owns the host %s", owners[0], p.Host)
+	}
+	p.pool.Rebalance()
+}
+
+// NewHashPlacement returns the placement of the host on the analyzers of
+// the pool
+func NewHashPlacement(host string, pool *shttp.WSAsyncClientPool) *HashPlacement {
+	return &HashPlacement{
+		Host: host,
+		pool: pool,
+		ring: common.NewHashRing(hashRingReplicas),
+	}
+}
@@ -23,6 +23,11 @@
 package agent
 
 import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/skydive-project/skydive/common"
 	"github.com/skydive-project/skydive/config"
 	shttp "github.com/skydive-project/skydive/http"
 	"github.com/skydive-project/skydive/logging"
@@ -31,13 +36,97 @@ import (
 
 // TopologyForwarder forwards the topology to only one analyzer. Analyzers will forward
 // messages between them in order to be synchronized. When switching from one analyzer to another one
-// the agent will do a full re-sync because some messages could have been lost.
+// the agent will do a re-sync because some messages could have been lost. Only the revisions of the
+// nodes and edges are sent first, the analyzer replies with the ones it misses.
+// While no analyzer is reachable the graph events are buffered, they are replayed
+// in order before the re-sync.
 type TopologyForwarder struct {
 	shttp.DefaultWSClientEventHandler
 	WSAsyncClientPool *shttp.WSAsyncClientPool
 	Graph             *graph.Graph
 	Host              string
+	masterLock        sync.RWMutex
 	master            *shttp.WSAsyncClient
+	buffer            *common.Buffer
+	bufferLock        sync.Mutex
+}
+
+// forward sends a message to the master analyzer, the message is buffered if
+// there is no master or if the buffered messages are not replayed yet
+func (t *TopologyForwarder) forward(msg *shttp.WSMessage) {
+	t.bufferLock.Lock()
+	defer t.bufferLock.Unlock()
+
+	if master := t.WSAsyncClientPool.MasterClient(); master != nil && master.IsConnected() && t.buffer.Len() == 0 {
+		master.SendWSMessage(msg)
+		return
+	}
+
+	if !t.buffer.Push([]byte(msg.String())) {
+		logging.GetLogger().Debugf("Topology buffer full, dropping %s message", msg.Type)
+	}
+}
+
+func (t *TopologyForwarder) replay(c *shttp.WSAsyncClient) error {
+	t.bufferLock.Lock()
+	defer t.bufferLock.Unlock()
+
+	return t.buffer.Replay(func(item []byte) error {
+		if !c.IsConnected() {
+			return errors.New("Analyzer disconnected")
+		}
+
+		var msg shttp.WSMessage
+		if err := json.Unmarshal(item, &msg); err != nil {
+			return err
+		}
+		c.SendWSMessage(&msg)
+		return nil
+	})
+}
+
+// resync replays the buffered messages then triggers a re-sync
+func (t *TopologyForwarder) resync(c *shttp.WSAsyncClient) {
+	if n := t.buffer.Len(); n > 0 {
+		logging.GetLogger().Infof("Replaying %d buffered topology messages to %s:%d", n, c.Addr, c.Port)
+		if err := t.replay(c); err != nil {
+			logging.GetLogger().Errorf("Unable to replay the topology messages to %s:%d: %s", c.Addr, c.Port, err.Error())
+			return
+		}
+	}
+
+	t.triggerResync()
+}
+
+// Close the buffer of graph events
+func (t *TopologyForwarder) Close() {
+	t.Graph.RemoveEventListener(t)
+	t.buffer.Close()
+}
+
+// BufferStats returns the statistics of the buffer of graph events
+func (t *TopologyForwarder) BufferStats() common.BufferStats {
+	return t.buffer.Stats()
+}
+
+// setMaster records the analyzer the graph is forwarded to, it returns false
+// if it was already the master
+func (t *TopologyForwarder) setMaster(c *shttp.WSAsyncClient) bool {
+	t.masterLock.Lock()
+	defer t.masterLock.Unlock()
+
+	if t.master == c {
+		return false
+	}
+	t.master = c
+	return true
+}
+
+func (t *TopologyForwarder) isMaster(c *shttp.WSAsyncClient) bool {
+	t.masterLock.RLock()
+	defer t.masterLock.RUnlock()
+
+	return t.master == c
 }
 
 func (t *TopologyForwarder) triggerResync() {
@@ -46,80 +135,137 @@ func (t *TopologyForwarder) triggerResync() {
 	t.Graph.RLock()
 	defer t.Graph.RUnlock()
 
-	// request for deletion of everything belonging to Root node
-	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.HostGraphDeletedMsgType, t.Host))
+	// the analyzer deletes the nodes and edges not listed and replies with
+	// the ones missing or stale
+	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.SyncRevisionsMsgType, t.Graph.HostRevisions(t.Host)))
+}
+
+func (t *TopologyForwarder) syncElements(r *graph.SyncRevisionsReplyMsg) {
+	t.Graph.RLock()
+	defer t.Graph.RUnlock()
+
+	// elements deleted since the revisions were sent are skipped, their
+	// deletion has already been forwarded
+	reply := &graph.SyncReplyMsg{}
+	for _, id := range r.Nodes {
+		if n := t.Graph.GetNode(id); n != nil {
+			reply.Nodes = append(reply.Nodes, n)
+		}
+	}
+	for _, id := range r.Edges {
+		if e := t.Graph.GetEdge(id); e != nil {
+			reply.Edges = append(reply.Edges, e)
+		}
+	}
+
+	logging.GetLogger().Infof("Re-sync %d nodes and %d edges for %s", len(reply.Nodes), len(reply.Edges), t.Host)
+	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.SyncReplyMsgType, reply))
+}
+
+// OnMessage websocket event handler
+func (t *TopologyForwarder) OnMessage(c *shttp.WSAsyncClient, m shttp.WSMessage) {
+	if m.Type != graph.SyncRevisionsReplyMsgType || !t.isMaster(c) {
+		return
+	}
+
+	msgType, obj, err := graph.UnmarshalWSMessage(m)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to parse the re-sync reply of %s:%d: %s", c.Addr, c.Port, err.Error())
+		return
+	}
 
-	// re-add all the nodes and edges
-	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.SyncReplyMsgType, t.Graph))
+	if msgType == graph.SyncRevisionsReplyMsgType {
+		t.syncElements(obj.(*graph.SyncRevisionsReplyMsg))
+	}
 }
 
 // OnConnected websocket event handler
 func (t *TopologyForwarder) OnConnected(c *shttp.WSAsyncClient) {
-	if c == t.WSAsyncClientPool.MasterClient() {
-		// keep a track of the current master in order to detect master disconnection
-		t.master = c
-
+	// keep a track of the current master in order to detect master disconnection
+	if c == t.WSAsyncClientPool.MasterClient() && t.setMaster(c) {
 		logging.GetLogger().Infof("Using %s:%d as master of topology forwarder", c.Addr, c.Port)
-		t.triggerResync()
+
+		// do not block the websocket client while replaying
+		go t.resync(c)
 	}
 }
 
 // OnDisconnected websocket event handler
 func (t *TopologyForwarder) OnDisconnected(c *shttp.WSAsyncClient) {
-	if c == t.master {
-		t.master = t.WSAsyncClientPool.MasterClient()
+	if !t.isMaster(c) {
+		return
+	}
 
-		// re-sync as we changed of master and some message could have lost by the previous one
-		t.triggerResync()
+	// re-sync as we changed of master and some message could have lost by the previous one
+	if master := t.WSAsyncClientPool.MasterClient(); t.setMaster(master) && master != nil {
+		go t.resync(master)
 	}
 }
 
+// OnMasterChanged websocket event handler, the agent was moved to another
+// analyzer which is re-synced unless it was already the master
+func (t *TopologyForwarder) OnMasterChanged(c *shttp.WSAsyncClient) {
+	if !t.setMaster(c) {
+		return
+	}
+
+	logging.GetLogger().Infof("Using %s:%d as master of topology forwarder", c.Addr, c.Port)
+	go t.resync(c)
+}
+
 // OnNodeUpdated websocket event handler
 func (t *TopologyForwarder) OnNodeUpdated(n *graph.Node) {
-	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.NodeUpdatedMsgType, n))
+	t.forward(shttp.NewWSMessage(graph.Namespace, graph.NodeUpdatedMsgType, n))
 }
 
 // OnNodeAdded websocket event handler
 func (t *TopologyForwarder) OnNodeAdded(n *graph.Node) {
-	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.NodeAddedMsgType, n))
+	t.forward(shttp.NewWSMessage(graph.Namespace, graph.NodeAddedMsgType, n))
 }
 
 // OnNodeDeleted websocket event handler
 func (t *TopologyForwarder) OnNodeDeleted(n *graph.Node) {
-	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.NodeDeletedMsgType, n))
+	t.forward(shttp.NewWSMessage(graph.Namespace, graph.NodeDeletedMsgType, n))
 }
 
 // OnEdgeUpdated websocket event handler
 func (t *TopologyForwarder) OnEdgeUpdated(e *graph.Edge) {
-	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.EdgeUpdatedMsgType, e))
+	t.forward(shttp.NewWSMessage(graph.Namespace, graph.EdgeUpdatedMsgType, e))
 }
 
 // OnEdgeAdded websocket event handler
 func (t *TopologyForwarder) OnEdgeAdded(e *graph.Edge) {
-	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.EdgeAddedMsgType, e))
+	t.forward(shttp.NewWSMessage(graph.Namespace, graph.EdgeAddedMsgType, e))
 }
 
 // OnEdgeDeleted websocket event handler
 func (t *TopologyForwarder) OnEdgeDeleted(e *graph.Edge) {
-	t.WSAsyncClientPool.SendWSMessageToMaster(shttp.NewWSMessage(graph.Namespace, graph.EdgeDeletedMsgType, e))
+	t.forward(shttp.NewWSMessage(graph.Namespace, graph.EdgeDeletedMsgType, e))
 }
 
 // NewTopologyForwarder is a mechanism aim to distribute all graph node notification to WebSocket client pool.
-func NewTopologyForwarder(host string, g *graph.Graph, wspool *shttp.WSAsyncClientPool) *TopologyForwarder {
+// The graph events are kept in buffer while no analyzer is reachable.
+func NewTopologyForwarder(host string, g *graph.Graph, wspool *shttp.WSAsyncClientPool, buffer *common.Buffer) *TopologyForwarder {
 	t := &TopologyForwarder{
 		WSAsyncClientPool: wspool,
 		Graph:             g,
 		Host:              host,
+		buffer:            buffer,
 	}
 
 	g.AddEventListener(t)
-	wspool.AddEventHandler(t, []string{})
+	wspool.AddEventHandler(t, []string{graph.Namespace})
 
 	return t
 }
 
 // NewTopologyForwarderFromConfig creates a TopologyForwarder from configuration
-func NewTopologyForwarderFromConfig(g *graph.Graph, wspool *shttp.WSAsyncClientPool) *TopologyForwarder {
+func NewTopologyForwarderFromConfig(g *graph.Graph, wspool *shttp.WSAsyncClientPool) (*TopologyForwarder, error) {
+	buffer, err := NewBufferFromConfig("topology")
+	if err != nil {
+		return nil, err
+	}
+
 	host := config.GetConfig().GetString("host_id")
-	return NewTopologyForwarder(host, g, wspool)
+	return NewTopologyForwarder(host, g, wspool, buffer), nil
 }
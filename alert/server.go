@@ -306,28 +306,37 @@ func (a *AlertServer) EvaluateAlerts(alerts map[string]*GremlinAlert) {
 	}
 }
 
-func (a *AlertServer) OnNodeUpdated(n *graph.Node) {
+// onGraphEvent evaluates the graph alerts, the events are received
+// asynchronously so the graph is not locked
+func (a *AlertServer) onGraphEvent() {
+	a.Graph.RLock()
+	defer a.Graph.RUnlock()
+
 	a.EvaluateAlerts(a.graphAlerts)
 }
 
+func (a *AlertServer) OnNodeUpdated(n *graph.Node) {
+	a.onGraphEvent()
+}
+
 func (a *AlertServer) OnNodeAdded(n *graph.Node) {
-	a.EvaluateAlerts(a.graphAlerts)
+	a.onGraphEvent()
 }
 
 func (a *AlertServer) OnNodeDeleted(n *graph.Node) {
-	a.EvaluateAlerts(a.graphAlerts)
+	a.onGraphEvent()
 }
 
 func (a *AlertServer) OnEdgeAdded(e *graph.Edge) {
-	a.EvaluateAlerts(a.graphAlerts)
+	a.onGraphEvent()
 }
 
 func (a *AlertServer) OnEdgeUpdated(e *graph.Edge) {
-	a.EvaluateAlerts(a.graphAlerts)
+	a.onGraphEvent()
 }
 
 func (a *AlertServer) OnEdgeDeleted(e *graph.Edge) {
-	a.EvaluateAlerts(a.graphAlerts)
+	a.onGraphEvent()
 }
 
 func parseTrigger(trigger string) (string, string) {
@@ -419,7 +428,12 @@ func (a *AlertServer) Start() {
 	a.elector.StartAndWait()
 
 	a.watcher = a.AlertHandler.AsyncWatch(a.onAPIWatcherEvent)
-	a.Graph.AddEventListener(a)
+
+	// alerts are evaluated on the current state of the graph, events can
+	// then be dropped if the evaluation is slower than the graph updates
+	options := graph.AsyncEventListenerOptions()
+	options.Policy = graph.OverflowDrop
+	a.Graph.AddEventListenerWithOptions(a, options)
 }
 
 func (a *AlertServer) Stop() {
@@ -0,0 +1,471 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/filters"
+	"github.com/skydive-project/skydive/flow"
+	"github.com/skydive-project/skydive/flow/storage"
+	shttp "github.com/skydive-project/skydive/http"
+	"github.com/skydive-project/skydive/logging"
+	"github.com/skydive-project/skydive/topology"
+	"github.com/skydive-project/skydive/topology/graph"
+)
+
+// FederationUpstream mirrors the graph of a site analyzer, the nodes and
+// edges of the site get a Site metadata. The flows of the hosts of the site
+// are looked up through the site analyzer.
+type FederationUpstream struct {
+	shttp.DefaultWSClientEventHandler
+	Site           string
+	Addr           string
+	Port           int
+	Graph          *graph.Graph
+	AuthOptions    *shttp.AuthenticationOpts
+	QueryTimeout   time.Duration
+	wsclient       *shttp.WSAsyncClient
+	hostsLock      sync.RWMutex
+	hosts          map[string]bool
+	replyChanMutex sync.RWMutex
+	replyChan      map[string]chan *shttp.WSMessage
+}
+
+// Federation connects a top-level analyzer to the analyzers of the sites
+type Federation struct {
+	Graph     *graph.Graph
+	upstreams []*FederationUpstream
+}
+
+// federatedStorage looks up the flow history in the local storage and in the
+// storage of every site
+type federatedStorage struct {
+	local     storage.Storage
+	upstreams []*FederationUpstream
+}
+
+// siteMessage decodes a graph message of the site, the Site metadata is
+// added to the nodes and edges it carries
+func (u *FederationUpstream) siteMessage(msg shttp.WSMessage) (string, interface{}, error) {
+	msgType, obj, err := graph.UnmarshalWSMessage(msg)
+	if err != nil {
+		return msgType, obj, err
+	}
+
+	switch obj := obj.(type) {
+	case *graph.Node:
+		obj.SetMetadataKey("Site", u.Site)
+	case *graph.Edge:
+		obj.SetMetadataKey("Site", u.Site)
+	case *graph.SyncReplyMsg:
+		for _, n := range obj.Nodes {
+			n.SetMetadataKey("Site", u.Site)
+		}
+		for _, e := range obj.Edges {
+			e.SetMetadataKey("Site", u.Site)
+		}
+	}
+
+	return msgType, obj, nil
+}
+
+func (u *FederationUpstream) addHost(host string) {
+	u.hostsLock.Lock()
+	u.hosts[host] = true
+	u.hostsLock.Unlock()
+}
+
+func (u *FederationUpstream) delHost(host string) {
+	u.hostsLock.Lock()
+	delete(u.hosts, host)
+	u.hostsLock.Unlock()
+}
+
+// sync replaces the mirrored graph of the site, the graph has to be locked
+func (u *FederationUpstream) sync(r *graph.SyncReplyMsg) {
+	ids := make(map[graph.Identifier]bool)
+	for _, n := range r.Nodes {
+		ids[n.ID] = true
+	}
+	for _, e := range r.Edges {
+		ids[e.ID] = true
+	}
+
+	// the elements deleted while disconnected from the site
+	site := graph.Metadata{"Site": u.Site}
+	for _, e := range u.Graph.GetEdges(site) {
+		if !ids[e.ID] {
+			u.Graph.DelEdge(e)
+		}
+	}
+	for _, n := range u.Graph.GetNodes(site) {
+		if !ids[n.ID] {
+			u.Graph.DelNode(n)
+		}
+	}
+
+	hosts := make(map[string]bool)
+	for _, n := range r.Nodes {
+		hosts[n.Host()] = true
+		if node := u.Graph.GetNode(n.ID); node == nil {
+			u.Graph.NodeAdded(n)
+		} else if node.Revision() != n.Revision() {
+			u.Graph.NodeUpdated(n)
+		}
+	}
+	for _, e := range r.Edges {
+		if edge := u.Graph.GetEdge(e.ID); edge == nil {
+			u.Graph.EdgeAdded(e)
+		} else if edge.Revision() != e.Revision() {
+			u.Graph.EdgeUpdated(e)
+		}
+	}
+
+	u.hostsLock.Lock()
+	u.hosts = hosts
+	u.hostsLock.Unlock()
+
+	logging.GetLogger().Infof("Synchronized %d nodes and %d edges of site %s", len(r.Nodes), len(r.Edges), u.Site)
+}
+
+func (u *FederationUpstream) onGraphMessage(msg shttp.WSMessage) {
+	if msg.Status >= http.StatusBadRequest {
+		logging.GetLogger().Errorf("Error returned by site %s for %s message", u.Site, msg.Type)
+		return
+	}
+
+	msgType, obj, err := u.siteMessage(msg)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to parse the %s message of site %s: %s", msg.Type, u.Site, err.Error())
+		return
+	}
+
+	u.Graph.Lock()
+	defer u.Graph.Unlock()
+
+	switch msgType {
+	case graph.SyncReplyMsgType:
+		u.sync(obj.(*graph.SyncReplyMsg))
+	case graph.HostGraphDeletedMsgType:
+		u.delHost(obj.(string))
+		u.Graph.DelHostGraph(obj.(string))
+	case graph.NodeUpdatedMsgType:
+		u.Graph.NodeUpdated(obj.(*graph.Node))
+	case graph.NodeDeletedMsgType:
+		u.Graph.NodeDeleted(obj.(*graph.Node))
+	case graph.NodeAddedMsgType:
+		n := obj.(*graph.Node)
+		u.addHost(n.Host())
+		u.Graph.NodeAdded(n)
+	case graph.EdgeUpdatedMsgType:
+		u.Graph.EdgeUpdated(obj.(*graph.Edge))
+	case graph.EdgeDeletedMsgType:
+		u.Graph.EdgeDeleted(obj.(*graph.Edge))
+	case graph.EdgeAddedMsgType:
+		u.Graph.EdgeAdded(obj.(*graph.Edge))
+	}
+}
+
+// OnMessage websocket event
+func (u *FederationUpstream) OnMessage(c *shttp.WSAsyncClient, msg shttp.WSMessage) {
+	switch msg.Namespace {
+	case graph.Namespace:
+		u.onGraphMessage(msg)
+	case FederationNamespace:
+		if msg.Type != FlowQueryReplyMsgType {
+			return
+		}
+
+		u.replyChanMutex.RLock()
+		defer u.replyChanMutex.RUnlock()
+
+		// the reply chan is buffered, a late reply is dropped
+		if ch, ok := u.replyChan[msg.UUID]; ok {
+			select {
+			case ch <- &msg:
+			default:
+			}
+		}
+	}
+}
+
+// OnConnected websocket event, the whole graph of the site is requested
+func (u *FederationUpstream) OnConnected(c *shttp.WSAsyncClient) {
+	logging.GetLogger().Infof("Connected to site %s, synchronizing its graph", u.Site)
+	c.SendWSMessage(shttp.NewWSMessage(graph.Namespace, graph.SyncRequestMsgType, graph.GraphContext{}))
+}
+
+// OnDisconnected websocket event, the mirrored graph is kept until the next
+// synchronization
+func (u *FederationUpstream) OnDisconnected(c *shttp.WSAsyncClient) {
+	logging.GetLogger().Warningf("Disconnected from site %s", u.Site)
+}
+
+// OwnsHost returns whether the host belongs to the site
+func (u *FederationUpstream) OwnsHost(host string) bool {
+	u.hostsLock.RLock()
+	defer u.hostsLock.RUnlock()
+
+	return u.hosts[host]
+}
+
+func (u *FederationUpstream) query(query *FederationFlowQuery, fsq filters.SearchQuery) (*flow.FlowSet, error) {
+	if u.wsclient == nil || !u.wsclient.IsConnected() {
+		return nil, fmt.Errorf("Site %s not connected", u.Site)
+	}
+
+	b, err := proto.Marshal(&fsq)
+	if err != nil {
+		return nil, err
+	}
+	query.SearchQuery = b
+
+	msg := shttp.NewWSMessage(FederationNamespace, FlowQueryMsgType, query)
+
+	ch := make(chan *shttp.WSMessage, 1)
+
+	u.replyChanMutex.Lock()
+	u.replyChan[msg.UUID] = ch
+	u.replyChanMutex.Unlock()
+
+	defer func() {
+		u.replyChanMutex.Lock()
+		delete(u.replyChan, msg.UUID)
+		u.replyChanMutex.Unlock()
+	}()
+
+	u.wsclient.SendWSMessage(msg)
+
+	var reply *shttp.WSMessage
+	select {
+	case reply = <-ch:
+	case <-time.After(u.QueryTimeout):
+		return nil, fmt.Errorf("Timeout while querying the flows of site %s", u.Site)
+	}
+
+	if reply.Status >= http.StatusBadRequest {
+		var reason string
+		json.Unmarshal([]byte(*reply.Obj), &reason)
+		return nil, fmt.Errorf("Site %s: %s", u.Site, reason)
+	}
+
+	if err = json.Unmarshal([]byte(*reply.Obj), &b); err != nil {
+		return nil, err
+	}
+
+	var fsr flow.FlowSearchReply
+	if err = proto.Unmarshal(b, &fsr); err != nil {
+		return nil, err
+	}
+
+	if fsr.FlowSet == nil {
+		return flow.NewFlowSet(), nil
+	}
+	return fsr.FlowSet, nil
+}
+
+// LookupFlows looks up the flows in the flow tables of the agents of the site
+func (u *FederationUpstream) LookupFlows(hnmap topology.HostNodeTIDMap, fsq filters.SearchQuery) (*flow.FlowSet, error) {
+	return u.query(&FederationFlowQuery{Hosts: hnmap}, fsq)
+}
+
+// SearchFlows searches the flows in the storage of the site
+func (u *FederationUpstream) SearchFlows(fsq filters.SearchQuery) (*flow.FlowSet, error) {
+	return u.query(&FederationFlowQuery{History: true}, fsq)
+}
+
+func (u *FederationUpstream) connect() {
+	authClient := shttp.NewAuthenticationClient(u.Addr, u.Port, u.AuthOptions)
+	u.wsclient = shttp.NewWSAsyncClientFromConfig(common.AnalyzerService, u.Addr, u.Port, "/ws", authClient)
+	u.wsclient.AddEventHandler(u, []string{graph.Namespace, FederationNamespace})
+
+	u.wsclient.Connect()
+}
+
+func (u *FederationUpstream) disconnect() {
+	if u.wsclient != nil {
+		u.wsclient.Disconnect()
+	}
+}
+
+// Start the local storage
+func (s *federatedStorage) Start() {
+	if s.local != nil {
+		s.local.Start()
+	}
+}
+
+// Stop the local storage
+func (s *federatedStorage) Stop() {
+	if s.local != nil {
+		s.local.Stop()
+	}
+}
+
+// StoreFlows stores the flows in the local storage
+func (s *federatedStorage) StoreFlows(flows []*flow.Flow) error {
+	if s.local == nil {
+		return storage.ErrNoStorageConfigured
+	}
+	return s.local.StoreFlows(flows)
+}
+
+// SearchFlows merges the flows of the local storage and of the storage of
+// every site, the sites not reachable are skipped
+func (s *federatedStorage) SearchFlows(fsq filters.SearchQuery) (*flow.FlowSet, error) {
+	type result struct {
+		flowset *flow.FlowSet
+		err     error
+	}
+
+	ch := make(chan result, len(s.upstreams))
+	for _, u := range s.upstreams {
+		go func(u *FederationUpstream) {
+			fs, err := u.SearchFlows(fsq)
+			ch <- result{fs, err}
+		}(u)
+	}
+
+	context := flow.MergeContext{
+		Sort:      fsq.Sort,
+		SortBy:    fsq.SortBy,
+		SortOrder: common.SortOrder(fsq.SortOrder),
+		Dedup:     fsq.Dedup,
+		DedupBy:   fsq.DedupBy,
+	}
+
+	flowset := flow.NewFlowSet()
+	if s.local != nil {
+		fs, err := s.local.SearchFlows(fsq)
+		if err != nil {
+			return nil, err
+		}
+		flowset.Merge(fs, context)
+	}
+
+	for range s.upstreams {
+		r := <-ch
+		if r.err != nil {
+			logging.GetLogger().Errorf("Error while looking for the flows of a site: %s", r.err.Error())
+			continue
+		}
+		flowset.Merge(r.flowset, context)
+	}
+
+	return flowset, nil
+}
+
+// SearchMetrics searches the metrics in the local storage, the metrics are
+// not federated
+func (s *federatedStorage) SearchMetrics(fsq filters.SearchQuery, metricFilter *filters.Filter) (map[string][]*common.TimedMetric, error) {
+	if s.local == nil {
+		return nil, storage.ErrNoStorageConfigured
+	}
+	return s.local.SearchMetrics(fsq, metricFilter)
+}
+
+// AddRemoteTables makes the table client look up the flows of the sites
+func (f *Federation) AddRemoteTables(tableClient *flow.TableClient) {
+	for _, u := range f.upstreams {
+		tableClient.AddRemoteTable(u)
+	}
+}
+
+// Storage returns a storage searching the flow history of the sites along
+// with the local storage, which can be nil
+func (f *Federation) Storage(local storage.Storage) storage.Storage {
+	return &federatedStorage{local: local, upstreams: f.upstreams}
+}
+
+// ConnectAll connects to the sites
+func (f *Federation) ConnectAll() {
+	for _, u := range f.upstreams {
+		u.connect()
+	}
+}
+
+// DisconnectAll disconnects from the sites
+func (f *Federation) DisconnectAll() {
+	for _, u := range f.upstreams {
+		u.disconnect()
+	}
+}
+
+func (f *Federation) addUpstream(site string, addr string, port int, authOptions *shttp.AuthenticationOpts, queryTimeout time.Duration) {
+	u := &FederationUpstream{
+		Site:         site,
+		Addr:         addr,
+		Port:         port,
+		Graph:        f.Graph,
+		AuthOptions:  authOptions,
+		QueryTimeout: queryTimeout,
+		hosts:        make(map[string]bool),
+		replyChan:    make(map[string]chan *shttp.WSMessage),
+	}
+
+	f.upstreams = append(f.upstreams, u)
+}
+
+// NewFederationFromConfig returns the federation of the sites configured,
+// nil if there is none
+func NewFederationFromConfig(g *graph.Graph) (*Federation, error) {
+	upstreams := config.GetConfig().GetStringMapString("analyzer.federation.upstreams")
+	if len(upstreams) == 0 {
+		return nil, nil
+	}
+
+	authOptions := &shttp.AuthenticationOpts{
+		Username: config.GetConfig().GetString("auth.analyzer_username"),
+		Password: config.GetConfig().GetString("auth.analyzer_password"),
+	}
+
+	queryTimeout := time.Duration(config.GetConfig().GetInt("analyzer.federation.query_timeout")) * time.Second
+
+	var sites []string
+	for site := range upstreams {
+		sites = append(sites, site)
+	}
+	sort.Strings(sites)
+
+	f := &Federation{Graph: g}
+	for _, site := range sites {
+		sa, err := common.ServiceAddressFromString(upstreams[site])
+		if err != nil {
+			return nil, errors.New("Invalid address of site " + site + ": " + err.Error())
+		}
+		f.addUpstream(site, sa.Addr, sa.Port, authOptions, queryTimeout)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/skydive-project/skydive/filters"
+	"github.com/skydive-project/skydive/flow"
+	"github.com/skydive-project/skydive/flow/storage"
+	shttp "github.com/skydive-project/skydive/http"
+	"github.com/skydive-project/skydive/topology"
+)
+
+// Namespace and message types used between a top-level analyzer and the
+// analyzers of the sites it federates
+const (
+	FederationNamespace   = "Federation"
+	FlowQueryMsgType      = "FlowQuery"
+	FlowQueryReplyMsgType = "FlowQueryReply"
+)
+
+// FederationFlowQuery is sent by a top-level analyzer to look up the flows of
+// a site, in its storage if History is set. The reply is a protobuf encoded
+// flow.FlowSearchReply.
+type FederationFlowQuery struct {
+	Hosts       topology.HostNodeTIDMap `json:",omitempty"`
+	History     bool
+	SearchQuery []byte
+}
+
+// FederationServer answers the flow queries of top-level analyzers with the
+// table client and the storage of the site
+type FederationServer struct {
+	shttp.DefaultWSServerEventHandler
+	TableClient *flow.TableClient
+	Storage     storage.Storage
+}
+
+func (f *FederationServer) searchFlows(query *FederationFlowQuery) (*flow.FlowSet, error) {
+	var fsq filters.SearchQuery
+	if err := proto.Unmarshal(query.SearchQuery, &fsq); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case query.History:
+		if f.Storage == nil {
+			return nil, storage.ErrNoStorageConfigured
+		}
+		return f.Storage.SearchFlows(fsq)
+	case query.Hosts == nil:
+		return f.TableClient.LookupFlows(fsq)
+	default:
+		return f.TableClient.LookupFlowsByNodes(query.Hosts, fsq)
+	}
+}
+
+func (f *FederationServer) flowQuery(c *shttp.WSClient, msg shttp.WSMessage) {
+	var query FederationFlowQuery
+	if err := json.Unmarshal([]byte(*msg.Obj), &query); err != nil {
+		c.SendWSMessage(msg.Reply(err.Error(), FlowQueryReplyMsgType, http.StatusBadRequest))
+		return
+	}
+
+	flowset, err := f.searchFlows(&query)
+	if err != nil {
+		c.SendWSMessage(msg.Reply(err.Error(), FlowQueryReplyMsgType, http.StatusInternalServerError))
+		return
+	}
+
+	b, err := proto.Marshal(&flow.FlowSearchReply{FlowSet: flowset})
+	if err != nil {
+		c.SendWSMessage(msg.Reply(err.Error(), FlowQueryReplyMsgType, http.StatusInternalServerError))
+		return
+	}
+
+	c.SendWSMessage(msg.Reply(b, FlowQueryReplyMsgType, http.StatusOK))
+}
+
+// OnMessage websocket event
+func (f *FederationServer) OnMessage(c *shttp.WSClient, msg shttp.WSMessage) {
+	if msg.Type == FlowQueryMsgType {
+		// the lookup waits for the agents, do not block the client
+		go f.flowQuery(c, msg)
+	}
+}
+
+// NewFederationServer returns a server answering the flow queries of the
+// top-level analyzers
+func NewFederationServer(server *shttp.WSServer, tableClient *flow.TableClient, storage storage.Storage) *FederationServer {
+	f := &FederationServer{
+		TableClient: tableClient,
+		Storage:     storage,
+	}
+	server.AddEventHandler(f, []string{FederationNamespace})
+
+	return f
+}
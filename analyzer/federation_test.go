@@ -0,0 +1,375 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/filters"
+	"github.com/skydive-project/skydive/flow"
+	shttp "github.com/skydive-project/skydive/http"
+	"github.com/skydive-project/skydive/topology/graph"
+)
+
+func newTestGraph(t *testing.T) *graph.Graph {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return graph.NewGraphFromConfig(b)
+}
+
+func newTestUpstream(site string, g *graph.Graph) *FederationUpstream {
+	f := &Federation{Graph: g}
+	f.addUpstream(site, "localhost", 0, &shttp.AuthenticationOpts{}, time.Second)
+	return f.upstreams[0]
+}
+
+func siteNodeIDs(g *graph.Graph, site string) string {
+	var ids []string
+	for _, n := range g.GetNodes(graph.Metadata{"Site": site}) {
+		ids = append(ids, string(n.ID))
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestFederationSiteMessage(t *testing.T) {
+	g := newTestGraph(t)
+	u := newTestUpstream("paris", g)
+
+	g.Lock()
+	n1 := g.NewNode(graph.Identifier("n1"), graph.Metadata{"Type": "host"}, "host1")
+	n2 := g.NewNode(graph.Identifier("n2"), graph.Metadata{"Type": "intf"}, "host1")
+	e := g.Link(n1, n2, graph.Metadata{"RelationType": "ownership"})
+	reply := &graph.SyncReplyMsg{Nodes: []*graph.Node{n1, n2}, Edges: []*graph.Edge{e}}
+	g.Unlock()
+
+	for _, msg := range []*shttp.WSMessage{
+		shttp.NewWSMessage(graph.Namespace, graph.NodeAddedMsgType, n1),
+		shttp.NewWSMessage(graph.Namespace, graph.EdgeAddedMsgType, e),
+		shttp.NewWSMessage(graph.Namespace, graph.SyncReplyMsgType, reply),
+	} {
+		msgType, obj, err := u.siteMessage(*msg)
+		if err != nil {
+			t.Fatalf("Unable to decode %s message: %s", msg.Type, err.Error())
+		}
+		if msgType != msg.Type {
+			t.Errorf("Expected %s message, got: %s", msg.Type, msgType)
+		}
+
+		var elements []interface{}
+		switch obj := obj.(type) {
+		case *graph.Node:
+			elements = append(elements, obj)
+		case *graph.Edge:
+			elements = append(elements, obj)
+		case *graph.SyncReplyMsg:
+			if len(obj.Nodes) != 2 || len(obj.Edges) != 1 {
+				t.Fatalf("Expected 2 nodes and 1 edge, got: %+v", obj)
+			}
+			for _, n := range obj.Nodes {
+				elements = append(elements, n)
+			}
+			for _, e := range obj.Edges {
+				elements = append(elements, e)
+			}
+		default:
+			t.Fatalf("Unexpected object for %s message: %+v", msg.Type, obj)
+		}
+
+		for _, element := range elements {
+			var m graph.Metadata
+			switch element := element.(type) {
+			case *graph.Node:
+				m = element.Metadata()
+			case *graph.Edge:
+				m = element.Metadata()
+			}
+			if m["Site"] != "paris" {
+				t.Errorf("Expected the Site metadata in %s message, got: %+v", msg.Type, m)
+			}
+		}
+	}
+
+	// the elements of the site graph are left untouched
+	g.RLock()
+	defer g.RUnlock()
+	if _, ok := g.GetNode(graph.Identifier("n1")).Metadata()["Site"]; ok {
+		t.Error("The Site metadata should not be set on the original node")
+	}
+}
+
+func TestFederationSync(t *testing.T) {
+	sg := newTestGraph(t)
+	g := newTestGraph(t)
+	u := newTestUpstream("paris", g)
+
+	sg.Lock()
+	n2 := sg.NewNode(graph.Identifier("n2"), graph.Metadata{"Name": "old"}, "host2")
+	sg.AddMetadata(n2, "Name", "new")
+	n3 := sg.NewNode(graph.Identifier("n3"), graph.Metadata{"Name": "n3"}, "host3")
+	e := sg.Link(n2, n3, graph.Metadata{"RelationType": "layer2"})
+	msg := shttp.NewWSMessage(graph.Namespace, graph.SyncReplyMsgType, &graph.SyncReplyMsg{Nodes: []*graph.Node{n2, n3}, Edges: []*graph.Edge{e}})
+	sg.Unlock()
+
+	g.Lock()
+	g.NewNode(graph.Identifier("n1"), graph.Metadata{"Site": "paris"}, "host1")
+	g.NewNode(graph.Identifier("n2"), graph.Metadata{"Site": "paris", "Name": "old"}, "host2")
+	g.NewNode(graph.Identifier("l1"), graph.Metadata{"Site": "london"}, "host4")
+	g.Unlock()
+	u.addHost("host1")
+
+	u.onGraphMessage(*msg)
+
+	g.RLock()
+	if ids := siteNodeIDs(g, "paris"); ids != "n2,n3" {
+		t.Errorf("Expected the nodes n2 and n3 of the site, got: %s", ids)
+	}
+	if name := g.GetNode(graph.Identifier("n2")).Metadata()["Name"]; name != "new" {
+		t.Errorf("Expected the node n2 to be updated, got: %v", name)
+	}
+	if g.GetEdge(e.ID) == nil {
+		t.Error("Expected the edge of the site to be added")
+	}
+	if ids := siteNodeIDs(g, "london"); ids != "l1" {
+		t.Errorf("Expected the nodes of the other sites to be kept, got: %s", ids)
+	}
+	g.RUnlock()
+
+	if u.OwnsHost("host1") || !u.OwnsHost("host2") || !u.OwnsHost("host3") || u.OwnsHost("host4") {
+		t.Errorf("Expected the hosts of the site to be replaced, got: %v", u.hosts)
+	}
+
+	u.onGraphMessage(*shttp.NewWSMessage(graph.Namespace, graph.HostGraphDeletedMsgType, "host3"))
+
+	g.RLock()
+	if ids := siteNodeIDs(g, "paris"); ids != "n2" {
+		t.Errorf("Expected the graph of host3 to be deleted, got: %s", ids)
+	}
+	g.RUnlock()
+
+	if u.OwnsHost("host3") || !u.OwnsHost("host2") {
+		t.Errorf("Expected host3 to be removed from the site, got: %v", u.hosts)
+	}
+}
+
+type testSite struct {
+	graph      *graph.Graph
+	httpserver *shttp.Server
+	wsserver   *shttp.WSServer
+}
+
+func newTestSite(t *testing.T, port int, store *fakeFlowStorage) *testSite {
+	s := &testSite{graph: newTestGraph(t)}
+
+	s.httpserver = shttp.NewServer("site", common.AnalyzerService, "localhost", port, shttp.NewNoAuthenticationBackend())
+	go s.httpserver.ListenAndServe()
+
+	s.wsserver = shttp.NewWSServer(s.httpserver, 10*time.Second, 100, time.Second, "/ws")
+	go s.wsserver.ListenAndServe()
+
+	graph.NewServer(s.graph, s.wsserver)
+	if store != nil {
+		NewFederationServer(s.wsserver, nil, store)
+	}
+
+	return s
+}
+
+func (s *testSite) stop() {
+	s.wsserver.Stop()
+	s.httpserver.Stop()
+}
+
+func flowUUIDs(fs *flow.FlowSet) string {
+	var uuids []string
+	for _, f := range fs.Flows {
+		uuids = append(uuids, f.UUID)
+	}
+	sort.Strings(uuids)
+	return strings.Join(uuids, ",")
+}
+
+func TestFederation(t *testing.T) {
+	paris := newTestSite(t, 59994, &fakeFlowStorage{flows: []*flow.Flow{{UUID: "paris-flow"}}})
+	defer paris.stop()
+
+	london := newTestSite(t, 59995, &fakeFlowStorage{flows: []*flow.Flow{{UUID: "london-flow"}}})
+	defer london.stop()
+
+	paris.graph.Lock()
+	paris.graph.NewNode(graph.Identifier("paris-host"), graph.Metadata{"Type": "host"}, "paris-host")
+	paris.graph.Unlock()
+
+	london.graph.Lock()
+	london.graph.NewNode(graph.Identifier("london-host"), graph.Metadata{"Type": "host"}, "london-host")
+	london.graph.Unlock()
+
+	g := newTestGraph(t)
+	f := &Federation{Graph: g}
+	f.addUpstream("paris", "localhost", 59994, &shttp.AuthenticationOpts{}, 5*time.Second)
+	f.addUpstream("london", "localhost", 59995, &shttp.AuthenticationOpts{}, 5*time.Second)
+
+	f.ConnectAll()
+	defer f.DisconnectAll()
+
+	siteNodes := func(site string) string {
+		g.RLock()
+		defer g.RUnlock()
+		return siteNodeIDs(g, site)
+	}
+
+	waitForCondition(t, "Graphs of the sites not synchronized", func() bool {
+		return siteNodes("paris") == "paris-host" && siteNodes("london") == "london-host"
+	})
+
+	parisUpstream, londonUpstream := f.upstreams[0], f.upstreams[1]
+	if !parisUpstream.OwnsHost("paris-host") || parisUpstream.OwnsHost("london-host") || !londonUpstream.OwnsHost("london-host") {
+		t.Errorf("Wrong hosts of the sites: %v, %v", parisUpstream.hosts, londonUpstream.hosts)
+	}
+
+	// the events of the sites are mirrored
+	paris.graph.Lock()
+	paris.graph.NewNode(graph.Identifier("paris-intf"), graph.Metadata{"Type": "intf"}, "paris-host2")
+	paris.graph.Unlock()
+
+	waitForCondition(t, "Node added on the site not mirrored", func() bool {
+		return siteNodes("paris") == "paris-host,paris-intf"
+	})
+	if !parisUpstream.OwnsHost("paris-host2") {
+		t.Error("Expected paris-host2 to belong to the site")
+	}
+
+	// the flow history of both sites is merged
+	fs, err := f.Storage(nil).SearchFlows(filters.SearchQuery{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if uuids := flowUUIDs(fs); uuids != "london-flow,paris-flow" {
+		t.Errorf("Expected the flows of both sites, got: %s", uuids)
+	}
+
+	paris.wsserver.BroadcastWSMessage(shttp.NewWSMessage(graph.Namespace, graph.HostGraphDeletedMsgType, "paris-host2"))
+
+	waitForCondition(t, "Host graph deleted on the site not mirrored", func() bool {
+		return siteNodes("paris") == "paris-host" && !parisUpstream.OwnsHost("paris-host2")
+	})
+}
+
+func TestFederationResync(t *testing.T) {
+	paris := newTestSite(t, 59992, nil)
+	defer paris.stop()
+
+	paris.graph.Lock()
+	n1 := paris.graph.NewNode(graph.Identifier("paris-host"), graph.Metadata{"Type": "host"}, "paris-host")
+	n2 := paris.graph.NewNode(graph.Identifier("paris-intf"), graph.Metadata{"Type": "intf"}, "paris-host")
+	e := paris.graph.Link(n1, n2, graph.Metadata{"RelationType": "ownership"})
+	paris.graph.Unlock()
+
+	g := newTestGraph(t)
+	f := &Federation{Graph: g}
+	f.addUpstream("paris", "localhost", 59992, &shttp.AuthenticationOpts{}, 5*time.Second)
+
+	f.ConnectAll()
+	defer f.DisconnectAll()
+
+	mirroredEdgeState := func() string {
+		g.RLock()
+		defer g.RUnlock()
+		if edge := g.GetEdge(e.ID); edge != nil {
+			state, _ := edge.Metadata()["State"].(string)
+			return state
+		}
+		return "missing"
+	}
+
+	waitForCondition(t, "Edge of the site not mirrored", func() bool {
+		return mirroredEdgeState() == ""
+	})
+
+	u := f.upstreams[0]
+	u.disconnect()
+	waitForCondition(t, "Site not disconnected", func() bool {
+		return !u.wsclient.IsConnected()
+	})
+
+	// the edge is updated on the site while disconnected
+	paris.graph.Lock()
+	paris.graph.AddMetadata(e, "State", "UP")
+	paris.graph.Unlock()
+
+	// the events of the site are bulked for up to a second, let them be
+	// flushed while disconnected so that only the re-sync carries the update
+	time.Sleep(1500 * time.Millisecond)
+
+	if state := mirroredEdgeState(); state != "" {
+		t.Fatalf("Expected the edge update not to be mirrored while disconnected, got: %s", state)
+	}
+
+	u.connect()
+	waitForCondition(t, "Edge updated on the site not mirrored after the re-sync", func() bool {
+		return mirroredEdgeState() == "UP"
+	})
+
+	g.RLock()
+	defer g.RUnlock()
+	if edge := g.GetEdge(e.ID); edge.Metadata()["Site"] != "paris" {
+		t.Errorf("Expected the Site metadata on the updated edge, got: %+v", edge.Metadata())
+	}
+}
+
+func TestFederationQueryTimeout(t *testing.T) {
+	// a site without federation server never replies to the queries
+	site := newTestSite(t, 59993, nil)
+	defer site.stop()
+
+	f := &Federation{Graph: newTestGraph(t)}
+	f.addUpstream("paris", "localhost", 59993, &shttp.AuthenticationOpts{}, 100*time.Millisecond)
+
+	f.ConnectAll()
+	defer f.DisconnectAll()
+
+	u := f.upstreams[0]
+	waitForCondition(t, "Site not connected", func() bool {
+		return u.wsclient.IsConnected()
+	})
+
+	start := time.Now()
+	if _, err := u.SearchFlows(filters.SearchQuery{}); err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("Expected a timeout error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("The query timeout was not honored, the query took %s", elapsed)
+	}
+
+	// the unreachable sites are skipped by the federated storage
+	fs, err := f.Storage(nil).SearchFlows(filters.SearchQuery{})
+	if err != nil || len(fs.Flows) != 0 {
+		t.Errorf("Expected no flow, got: %v, %v", fs, err)
+	}
+}
@@ -28,26 +28,36 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
 	"github.com/skydive-project/skydive/flow"
 	shttp "github.com/skydive-project/skydive/http"
 	"github.com/skydive-project/skydive/logging"
 )
 
-// FlowClientPool describes a flow client pool.
+// FlowClientPool describes a flow client pool. The flows are buffered while
+// the pool is empty and replayed once an analyzer is connected.
 type FlowClientPool struct {
 	sync.RWMutex
 	shttp.DefaultWSClientEventHandler
-	flowClients []*FlowClient
+	flowClients   []*FlowClient
+	buffer        *common.Buffer
+	replaying     int32
+	wspool        *shttp.WSAsyncClientPool
+	stickToMaster bool
 }
 
-// FlowClient descibes a flow client connection
+// FlowClient descibes a flow client connection, using the stream transport if
+// configured and supported by the analyzer
 type FlowClient struct {
 	Addr string
 	Port int
 
 	connection *FlowClientConn
+	stream     *flowStreamConn
 }
 
 func (c *FlowClient) connect() {
@@ -67,10 +77,15 @@ func (c *FlowClient) connect() {
 	c.connection = connection
 }
 
-func (c *FlowClient) close() {
+// close returns the flows sent but not acknowledged by the analyzer
+func (c *FlowClient) close() (unacked []*flow.Flow) {
+	if c.stream != nil {
+		unacked = c.stream.Close()
+	}
 	if c.connection != nil {
 		c.connection.Close()
 	}
+	return
 }
 
 // SendFlow sends a flow to the server
@@ -84,8 +99,25 @@ func (c *FlowClient) SendFlow(f *flow.Flow) error {
 		return err
 	}
 
+	return c.sendData(data)
+}
+
+func (c *FlowClient) sendData(data []byte) error {
+	if c.stream != nil {
+		f, err := flow.FromData(data)
+		if err != nil {
+			return err
+		}
+		_, err = c.stream.SendFlows([]*flow.Flow{f})
+		return err
+	}
+
+	if c.connection == nil {
+		return errors.New("Not connected")
+	}
+
 retry:
-	_, err = c.connection.Write(data)
+	_, err := c.connection.Write(data)
 	if err != nil {
 		logging.GetLogger().Errorf("flows connection to analyzer error %s : try to reconnect", err.Error())
 		c.connection.Close()
@@ -96,80 +128,252 @@ retry:
 	return nil
 }
 
-// SendFlows sends flows to the server
-func (c *FlowClient) SendFlows(flows []*flow.Flow) {
+// sendFlows returns the flows not sent
+func (c *FlowClient) sendFlows(flows []*flow.Flow) []*flow.Flow {
+	if c.stream != nil {
+		n, err := c.stream.SendFlows(flows)
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to send %d flows: %s", len(flows)-n, err.Error())
+		}
+		return flows[n:]
+	}
+
 	for _, flow := range flows {
 		err := c.SendFlow(flow)
 		if err != nil {
 			logging.GetLogger().Errorf("Unable to send flow: %s", err.Error())
 		}
 	}
+	return nil
+}
+
+// SendFlows sends flows to the server
+func (c *FlowClient) SendFlows(flows []*flow.Flow) {
+	c.sendFlows(flows)
 }
 
-// NewFlowClient creates a flow client and create a new connection to the server
+// NewFlowClient creates a flow client and create a new connection to the server,
+// the stream transport is used if agent.flow.transport is set to stream, falling
+// back to UDP or TLS if not supported by the analyzer
 func NewFlowClient(addr string, port int) *FlowClient {
 	FlowClient := &FlowClient{Addr: addr, Port: port}
+
+	if config.GetConfig().GetString("agent.flow.transport") == "stream" {
+		stream, err := newFlowStreamConnFromConfig(addr, port)
+		if err == nil {
+			FlowClient.stream = stream
+			return FlowClient
+		}
+		logging.GetLogger().Warningf("Unable to use the flow stream transport of %s:%d, falling back to datagrams: %s", addr, port, err.Error())
+	}
+
 	FlowClient.connect()
 	return FlowClient
 }
 
 // OnConnected websocket event handler
 func (p *FlowClientPool) OnConnected(c *shttp.WSAsyncClient) {
+	// the connection may wait for the analyzer, the pool is not locked meanwhile
+	fc := NewFlowClient(c.Addr, c.Port)
+
 	p.Lock()
-	defer p.Unlock()
+	found, unacked := p.removeClients(c.Addr, c.Port)
+	p.flowClients = append(p.flowClients, fc)
+	p.Unlock()
 
-	for i, fc := range p.flowClients {
-		if fc.Addr == c.Addr && fc.Port == c.Port {
-			logging.GetLogger().Warningf("Got a connected event on already connected client: %s:%d", c.Addr, c.Port)
-			fc.close()
+	if found {
+		logging.GetLogger().Warningf("Got a connected event on already connected client: %s:%d", c.Addr, c.Port)
+	}
+
+	if p.buffer != nil {
+		p.bufferFlows(unacked)
+		p.startReplay(fc)
+	}
+}
 
-			p.flowClients = append(p.flowClients[:i], p.flowClients[i+1:]...)
+// removeClients closes the clients of an analyzer and returns the flows not
+// acknowledged, the caller must hold the lock
+func (p *FlowClientPool) removeClients(addr string, port int) (found bool, unacked []*flow.Flow) {
+	clients := p.flowClients[:0]
+	for _, fc := range p.flowClients {
+		if fc.Addr == addr && fc.Port == port {
+			unacked = append(unacked, fc.close()...)
+			found = true
+			continue
 		}
+		clients = append(clients, fc)
 	}
+	p.flowClients = clients
+	return
+}
 
-	p.flowClients = append(p.flowClients, NewFlowClient(c.Addr, c.Port))
+func (p *FlowClientPool) hasClient(fc *FlowClient) bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	for _, c := range p.flowClients {
+		if c == fc {
+			return true
+		}
+	}
+	return false
 }
 
-// OnDisconnected websocket event handler
-func (p *FlowClientPool) OnDisconnected(c *shttp.WSAsyncClient) {
-	p.Lock()
-	defer p.Unlock()
+func (p *FlowClientPool) replay(fc *FlowClient) error {
+	n := p.buffer.Len()
+	if n == 0 {
+		return nil
+	}
+
+	logging.GetLogger().Infof("Replaying %d buffered flows to %s:%d", n, fc.Addr, fc.Port)
+	send := func(data []byte) error {
+		if !p.hasClient(fc) {
+			return errors.New("Analyzer disconnected")
+		}
+		return fc.sendData(data)
+	}
+
+	if err := p.buffer.Replay(send); err != nil {
+		logging.GetLogger().Errorf("Unable to replay the flows to %s:%d: %s", fc.Addr, fc.Port, err.Error())
+		return err
+	}
+	return nil
+}
 
-	for i, fc := range p.flowClients {
-		if fc.Addr == c.Addr && fc.Port == c.Port {
-			fc.close()
+// startReplay replays the buffer in background unless a replay is already
+// running. A failed replay is started again by the next flows sent.
+func (p *FlowClientPool) startReplay(fc *FlowClient) {
+	if p.buffer.Len() == 0 || !atomic.CompareAndSwapInt32(&p.replaying, 0, 1) {
+		return
+	}
+
+	go func() {
+		for {
+			err := p.replay(fc)
+			atomic.StoreInt32(&p.replaying, 0)
 
-			p.flowClients = append(p.flowClients[:i], p.flowClients[i+1:]...)
+			// flows buffered once the replay found the buffer empty
+			if err != nil || p.buffer.Len() == 0 || !atomic.CompareAndSwapInt32(&p.replaying, 0, 1) {
+				return
+			}
 		}
+	}()
+}
+
+// OnDisconnected websocket event handler, the flows not acknowledged by the
+// analyzer are buffered
+func (p *FlowClientPool) OnDisconnected(c *shttp.WSAsyncClient) {
+	p.Lock()
+	_, unacked := p.removeClients(c.Addr, c.Port)
+	p.Unlock()
+
+	if p.buffer != nil {
+		p.bufferFlows(unacked)
 	}
 }
 
-// SendFlows sends flows using a random connection
-func (p *FlowClientPool) SendFlows(flows []*flow.Flow) {
+// client returns a random client, or the one of the master analyzer if the
+// pool sticks to it
+func (p *FlowClientPool) client() *FlowClient {
 	p.RLock()
 	defer p.RUnlock()
 
 	if len(p.flowClients) == 0 {
-		return
+		return nil
 	}
 
 	fc := p.flowClients[rand.Intn(len(p.flowClients))]
-	fc.SendFlows(flows)
+	if p.stickToMaster {
+		if master := p.wspool.MasterClient(); master != nil {
+			for _, c := range p.flowClients {
+				if c.Addr == master.Addr && c.Port == master.Port {
+					return c
+				}
+			}
+		}
+	}
+	return fc
+}
+
+// SendFlows sends flows using a random connection, or the one of the master
+// analyzer if the pool sticks to it. The pool is not locked while sending as
+// the stream transport may wait for the analyzer.
+func (p *FlowClientPool) SendFlows(flows []*flow.Flow) {
+	fc := p.client()
+	if fc == nil {
+		if p.buffer != nil {
+			p.bufferFlows(flows)
+		}
+		return
+	}
+
+	// keep the order of the flows while the buffer is replayed
+	if p.buffer != nil && p.buffer.Len() > 0 {
+		p.bufferFlows(flows)
+		p.startReplay(fc)
+		return
+	}
+
+	if unsent := fc.sendFlows(flows); len(unsent) > 0 && p.buffer != nil {
+		p.bufferFlows(unsent)
+	}
 }
 
-// Close all connections
+func (p *FlowClientPool) bufferFlows(flows []*flow.Flow) {
+	for _, f := range flows {
+		data, err := f.GetData()
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to buffer flow: %s", err.Error())
+			continue
+		}
+		p.buffer.Push(data)
+	}
+}
+
+// StickToMaster sends the flows to the master analyzer only, so that the
+// analyzer owning the topology of the agent also gets its flows
+func (p *FlowClientPool) StickToMaster() {
+	p.Lock()
+	p.stickToMaster = true
+	p.Unlock()
+}
+
+// BufferStats returns the statistics of the buffer of flows
+func (p *FlowClientPool) BufferStats() common.BufferStats {
+	if p.buffer == nil {
+		return common.BufferStats{}
+	}
+	return p.buffer.Stats()
+}
+
+// Close all connections and the buffer, the flows not acknowledged are
+// buffered before
 func (p *FlowClientPool) Close() {
+	p.Lock()
+	defer p.Unlock()
+
 	for _, fc := range p.flowClients {
-		fc.close()
+		unacked := fc.close()
+		if p.buffer != nil {
+			p.bufferFlows(unacked)
+		}
+	}
+	p.flowClients = p.flowClients[:0]
+
+	if p.buffer != nil {
+		p.buffer.Close()
 	}
 }
 
 // NewFlowClientPool returns a new FlowClientPool using the websocket connections
 // to maintain the pool of client up to date according to the websocket connections
-// status.
-func NewFlowClientPool(wspool *shttp.WSAsyncClientPool) *FlowClientPool {
+// status. The flows are kept in buffer, if not nil, while no analyzer is
+// connected.
+func NewFlowClientPool(wspool *shttp.WSAsyncClientPool, buffer *common.Buffer) *FlowClientPool {
 	p := &FlowClientPool{
 		flowClients: make([]*FlowClient, 0),
+		buffer:      buffer,
+		wspool:      wspool,
 	}
 
 	wspool.AddEventHandler(p, []string{})
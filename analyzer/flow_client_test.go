@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/flow"
+)
+
+func TestFlowClientPoolReplayRetry(t *testing.T) {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ln.Close()
+
+	addr := ln.LocalAddr().(*net.UDPAddr)
+	conn, err := NewFlowClientConn(addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fc := &FlowClient{Addr: addr.IP.String(), Port: addr.Port, connection: conn}
+
+	buffer, _ := common.NewBuffer(100, "", 0)
+	p := &FlowClientPool{buffer: buffer}
+
+	// no analyzer, the flows are buffered
+	p.SendFlows(newTestFlows(3))
+
+	// the replay fails as the analyzer left meanwhile
+	p.startReplay(fc)
+	waitForCondition(t, "Replay not finished", func() bool {
+		return atomic.LoadInt32(&p.replaying) == 0
+	})
+	if n := buffer.Len(); n != 3 {
+		t.Fatalf("Expected 3 flows buffered, got: %d", n)
+	}
+
+	// the next flows sent start the replay again
+	p.Lock()
+	p.flowClients = append(p.flowClients, fc)
+	p.Unlock()
+
+	var next []*flow.Flow
+	for i := 3; i < 6; i++ {
+		next = append(next, &flow.Flow{UUID: strconv.Itoa(i)})
+	}
+	p.SendFlows(next[:2])
+	waitForCondition(t, "Buffer not replayed", func() bool {
+		return buffer.Len() == 0
+	})
+	p.SendFlows(next[2:])
+
+	data := make([]byte, 4096)
+	ln.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 6; i++ {
+		n, err := ln.Read(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		f, err := flow.FromData(data[:n])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if f.UUID != strconv.Itoa(i) {
+			t.Fatalf("Expected flow %d, got: %s", i, f.UUID)
+		}
+	}
+}
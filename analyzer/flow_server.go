@@ -48,7 +48,7 @@ import (
 // ErrFlowUDPAcceptNotSupported error the connection can't accept as it's UDP based
 var ErrFlowUDPAcceptNotSupported = errors.New("UDP connection is datagram based (not connected), accept() not supported")
 
-// FlowConnectionType describes an UDP or TLS connection
+// FlowConnectionType describes an UDP, TLS or stream connection
 type FlowConnectionType int
 
 const (
@@ -56,14 +56,18 @@ const (
 	UDP FlowConnectionType = 1 + iota
 	// TLS connection
 	TLS
+	// STREAM connection of acknowledged flow batches, over TCP or TLS
+	STREAM
 )
 
 // FlowServerConn describes a flow server connection
 type FlowServerConn struct {
-	mode      FlowConnectionType
-	udpConn   *net.UDPConn
-	tlsConn   net.Conn
-	tlsListen net.Listener
+	mode         FlowConnectionType
+	udpConn      *net.UDPConn
+	tlsConn      net.Conn
+	tlsListen    net.Listener
+	streamConn   net.Conn
+	streamListen net.Listener
 }
 
 // FlowServer describes a flow server with pipeline enhancers mechanism
@@ -73,14 +77,17 @@ type FlowServer struct {
 	Storage          storage.Storage
 	EnhancerPipeline *flow.EnhancerPipeline
 	conn             *FlowServerConn
+	streamConn       *FlowServerConn
 	state            int64
 	wgServer         sync.WaitGroup
 	wgFlowsHandlers  sync.WaitGroup
 	bulkInsert       int
 	bulkDeadline     int
+	streamQuit       chan struct{}
+	streamMaxWindow  int
 }
 
-// Mode return the connection mode UDP or TLS
+// Mode return the connection mode UDP, TLS or STREAM
 func (a *FlowServerConn) Mode() FlowConnectionType {
 	return a.mode
 }
@@ -108,6 +115,15 @@ func (a *FlowServerConn) Accept() (*FlowServerConn, error) {
 			mode:    TLS,
 			tlsConn: acceptedTLSConn,
 		}, nil
+	case STREAM:
+		streamConn, err := a.streamListen.Accept()
+		if err != nil {
+			return nil, err
+		}
+		return &FlowServerConn{
+			mode:       STREAM,
+			streamConn: streamConn,
+		}, nil
 	case UDP:
 		return a, ErrFlowUDPAcceptNotSupported
 	}
@@ -116,10 +132,15 @@ func (a *FlowServerConn) Accept() (*FlowServerConn, error) {
 
 // Cleanup stop listening on the connection
 func (a *FlowServerConn) Cleanup() {
-	if a.mode == TLS {
+	switch a.mode {
+	case TLS:
 		if err := a.tlsListen.Close(); err != nil {
 			logging.GetLogger().Errorf("Close error %v", err)
 		}
+	case STREAM:
+		if err := a.streamListen.Close(); err != nil {
+			logging.GetLogger().Errorf("Close error %v", err)
+		}
 	}
 }
 
@@ -130,6 +151,8 @@ func (a *FlowServerConn) Close() {
 		if err := a.tlsConn.Close(); err != nil {
 			logging.GetLogger().Errorf("Close error %v", err)
 		}
+	case STREAM:
+		a.streamConn.Close()
 	case UDP:
 		if err := a.udpConn.Close(); err != nil {
 			logging.GetLogger().Errorf("Close error %v", err)
@@ -140,6 +163,10 @@ func (a *FlowServerConn) Close() {
 // SetDeadline for the connection IO
 func (a *FlowServerConn) SetDeadline(t time.Time) {
 	switch a.mode {
+	case STREAM:
+		if err := a.streamConn.SetReadDeadline(t); err != nil {
+			logging.GetLogger().Errorf("SetReadDeadline %v", err)
+		}
 	case TLS:
 		if err := a.tlsConn.SetReadDeadline(t); err != nil {
 			logging.GetLogger().Errorf("SetReadDeadline %v", err)
@@ -157,6 +184,8 @@ func (a *FlowServerConn) Read(data []byte) (int, error) {
 	case TLS:
 		n, err := a.tlsConn.Read(data)
 		return n, err
+	case STREAM:
+		return a.streamConn.Read(data)
 	case UDP:
 		n, _, err := a.udpConn.ReadFromUDP(data)
 		return n, err
@@ -167,7 +196,7 @@ func (a *FlowServerConn) Read(data []byte) (int, error) {
 // Timeout return true if the connection error timeouted
 func (a *FlowServerConn) Timeout(err error) bool {
 	switch a.mode {
-	case TLS:
+	case TLS, STREAM:
 		if netErr, ok := err.(net.Error); ok {
 			return netErr.Timeout()
 		}
@@ -179,48 +208,59 @@ func (a *FlowServerConn) Timeout(err error) bool {
 	return false
 }
 
-// NewFlowServerConn create a new server listening at address
-func NewFlowServerConn(addr *net.UDPAddr) (a *FlowServerConn, err error) {
-	a = &FlowServerConn{mode: UDP}
+// flowServerTLSConfig returns the TLS configuration of the flow server, nil
+// if no certificate is configured
+func flowServerTLSConfig() *tls.Config {
 	certPEM := config.GetConfig().GetString("analyzer.X509_cert")
 	keyPEM := config.GetConfig().GetString("analyzer.X509_key")
 	clientCertPEM := config.GetConfig().GetString("agent.X509_cert")
 
-	if len(certPEM) > 0 && len(keyPEM) > 0 {
-		cert, err := tls.LoadX509KeyPair(certPEM, keyPEM)
-		if err != nil {
-			logging.GetLogger().Fatalf("Can't read X509 key pair set in config : cert '%s' key '%s'", certPEM, keyPEM)
-		}
-		rootPEM, err := ioutil.ReadFile(clientCertPEM)
-		if err != nil {
-			logging.GetLogger().Fatalf("Failed to open root certificate '%s' : %s", clientCertPEM, err.Error())
-		}
-		roots := x509.NewCertPool()
-		if ok := roots.AppendCertsFromPEM([]byte(rootPEM)); !ok {
-			logging.GetLogger().Fatalf("Failed to parse root certificate '%s'", clientCertPEM)
-		}
-		cfgTLS := &tls.Config{
-			ClientCAs:                roots,
-			ClientAuth:               tls.RequireAndVerifyClientCert,
-			Certificates:             []tls.Certificate{cert},
-			MinVersion:               tls.VersionTLS12,
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			},
-		}
-		cfgTLS.BuildNameToCertificate()
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		logging.GetLogger().Fatalf("Can't read X509 key pair set in config : cert '%s' key '%s'", certPEM, keyPEM)
+	}
+	rootPEM, err := ioutil.ReadFile(clientCertPEM)
+	if err != nil {
+		logging.GetLogger().Fatalf("Failed to open root certificate '%s' : %s", clientCertPEM, err.Error())
+	}
+	roots := x509.NewCertPool()
+	if ok := roots.AppendCertsFromPEM([]byte(rootPEM)); !ok {
+		logging.GetLogger().Fatalf("Failed to parse root certificate '%s'", clientCertPEM)
+	}
+	cfgTLS := &tls.Config{
+		ClientCAs:                roots,
+		ClientAuth:               tls.RequireAndVerifyClientCert,
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		},
+	}
+	cfgTLS.BuildNameToCertificate()
+	return cfgTLS
+}
+
+// NewFlowServerConn create a new server listening at address
+func NewFlowServerConn(addr *net.UDPAddr) (a *FlowServerConn, err error) {
+	a = &FlowServerConn{mode: UDP}
+
+	if cfgTLS := flowServerTLSConfig(); cfgTLS != nil {
 		if a.tlsListen, err = tls.Listen("tcp", fmt.Sprintf("%s:%d", common.IPToString(addr.IP), addr.Port+1), cfgTLS); err != nil {
 			return nil, err
 		}
@@ -233,6 +273,25 @@ func NewFlowServerConn(addr *net.UDPAddr) (a *FlowServerConn, err error) {
 	return a, err
 }
 
+// NewFlowStreamServerConn create a new server listening for the stream
+// connections at address port+2, using TLS if configured
+func NewFlowStreamServerConn(addr *net.UDPAddr) (a *FlowServerConn, err error) {
+	a = &FlowServerConn{mode: STREAM}
+
+	listen := fmt.Sprintf("%s:%d", common.IPToString(addr.IP), addr.Port+2)
+	if cfgTLS := flowServerTLSConfig(); cfgTLS != nil {
+		a.streamListen, err = tls.Listen("tcp", listen, cfgTLS)
+	} else {
+		a.streamListen, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logging.GetLogger().Infof("Analyzer listen agents on flow stream socket %s", listen)
+	return a, nil
+}
+
 // FlowClientConn describes a flow client connection
 type FlowClientConn struct {
 	udpConn       *net.UDPConn
@@ -260,38 +319,51 @@ func (a *FlowClientConn) Write(b []byte) (int, error) {
 	return a.udpConn.Write(b)
 }
 
-// NewFlowClientConn create a new connection to the server at address
-func NewFlowClientConn(addr *net.UDPAddr) (a *FlowClientConn, err error) {
-	a = &FlowClientConn{}
+// flowClientTLSConfig returns the TLS configuration of the flow client, nil
+// if no certificate is configured
+func flowClientTLSConfig() *tls.Config {
 	certPEM := config.GetConfig().GetString("agent.X509_cert")
 	keyPEM := config.GetConfig().GetString("agent.X509_key")
 	serverCertPEM := config.GetConfig().GetString("analyzer.X509_cert")
 	serverNamePEM := config.GetConfig().GetString("agent.X509_servername")
 
-	if len(certPEM) > 0 && len(keyPEM) > 0 {
-		cert, err := tls.LoadX509KeyPair(certPEM, keyPEM)
-		if err != nil {
-			logging.GetLogger().Fatalf("Can't read X509 key pair set in config : cert '%s' key '%s'", certPEM, keyPEM)
-			return nil, err
-		}
-		rootPEM, err := ioutil.ReadFile(serverCertPEM)
-		if err != nil {
-			logging.GetLogger().Fatalf("Failed to open root certificate '%s' : %s", serverCertPEM, err.Error())
-		}
-		roots := x509.NewCertPool()
-		if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
-			logging.GetLogger().Fatalf("Failed to parse root certificate '%s'", serverCertPEM)
-		}
-		cfgTLS := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			RootCAs:      roots,
-		}
-		if len(serverNamePEM) > 0 {
-			cfgTLS.ServerName = serverNamePEM
-		} else {
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		logging.GetLogger().Fatalf("Can't read X509 key pair set in config : cert '%s' key '%s'", certPEM, keyPEM)
+		return nil
+	}
+	rootPEM, err := ioutil.ReadFile(serverCertPEM)
+	if err != nil {
+		logging.GetLogger().Fatalf("Failed to open root certificate '%s' : %s", serverCertPEM, err.Error())
+	}
+	roots := x509.NewCertPool()
+	if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
+		logging.GetLogger().Fatalf("Failed to parse root certificate '%s'", serverCertPEM)
+	}
+	cfgTLS := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+	}
+	if len(serverNamePEM) > 0 {
+		cfgTLS.ServerName = serverNamePEM
+	}
+	cfgTLS.BuildNameToCertificate()
+	return cfgTLS
+}
+
+// NewFlowClientConn create a new connection to the server at address
+func NewFlowClientConn(addr *net.UDPAddr) (a *FlowClientConn, err error) {
+	a = &FlowClientConn{}
+
+	if cfgTLS := flowClientTLSConfig(); cfgTLS != nil {
+		serverNamePEM := cfgTLS.ServerName
+		if serverNamePEM == "" {
 			serverNamePEM = "unspecified"
 		}
-		cfgTLS.BuildNameToCertificate()
 		logging.GetLogger().Debugf("TLS client connection ... Dial %s:%d serverName %s", common.IPToString(addr.IP), addr.Port+1, serverNamePEM)
 		if a.tlsConnClient, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", common.IPToString(addr.IP), addr.Port+1), cfgTLS); err != nil {
 			logging.GetLogger().Errorf("TLS error %s:%d : %s", common.IPToString(addr.IP), addr.Port+1, err.Error())
@@ -312,12 +384,28 @@ func NewFlowClientConn(addr *net.UDPAddr) (a *FlowClientConn, err error) {
 	return a, nil
 }
 
-func (s *FlowServer) storeFlows(flows []*flow.Flow) {
-	if s.Storage != nil && len(flows) > 0 {
-		s.EnhancerPipeline.Enhance(flows)
-		s.Storage.StoreFlows(flows)
+func (s *FlowServer) storeFlows(flows []*flow.Flow) error {
+	if len(flows) == 0 {
+		return nil
+	}
+	if s.Storage == nil {
+		return storage.ErrNoStorageConfigured
+	}
+
+	s.EnhancerPipeline.Enhance(flows)
+	if err := s.Storage.StoreFlows(flows); err != nil {
+		return err
+	}
+
+	logging.GetLogger().Debugf("%d flows stored", len(flows))
+	return nil
+}
 
-		logging.GetLogger().Debugf("%d flows stored", len(flows))
+// bulkStoreFlows stores the flows received as datagrams, the flows are
+// dropped if no storage is configured
+func (s *FlowServer) bulkStoreFlows(flows []*flow.Flow) {
+	if err := s.storeFlows(flows); err != nil && err != storage.ErrNoStorageConfigured {
+		logging.GetLogger().Errorf("Unable to store %d flows: %s", len(flows), err.Error())
 	}
 }
 
@@ -330,7 +418,7 @@ func (s *FlowServer) handleFlowPacket(conn *FlowServerConn) {
 	data := make([]byte, 4096)
 
 	var flowBuffer []*flow.Flow
-	defer s.storeFlows(flowBuffer)
+	defer s.bulkStoreFlows(flowBuffer)
 
 	dlTimer := time.NewTicker(time.Duration(s.bulkDeadline) * time.Second)
 	defer dlTimer.Stop()
@@ -338,7 +426,7 @@ func (s *FlowServer) handleFlowPacket(conn *FlowServerConn) {
 	for atomic.LoadInt64(&s.state) == common.RunningState {
 		select {
 		case <-dlTimer.C:
-			s.storeFlows(flowBuffer)
+			s.bulkStoreFlows(flowBuffer)
 			flowBuffer = flowBuffer[:0]
 		default:
 			n, err := conn.Read(data)
@@ -362,14 +450,46 @@ func (s *FlowServer) handleFlowPacket(conn *FlowServerConn) {
 
 			flowBuffer = append(flowBuffer, f)
 			if len(flowBuffer) >= s.bulkInsert {
-				s.storeFlows(flowBuffer)
+				s.bulkStoreFlows(flowBuffer)
 				flowBuffer = flowBuffer[:0]
 			}
 		}
 	}
 }
 
-// Start the flow server
+// serve accepts the connections of the agents, or reads the datagrams
+func (s *FlowServer) serve(serverConn *FlowServerConn) {
+	defer s.wgServer.Done()
+
+	for atomic.LoadInt64(&s.state) == common.RunningState {
+		switch serverConn.Mode() {
+		case TLS, STREAM:
+			conn, err := serverConn.Accept()
+			if atomic.LoadInt64(&s.state) != common.RunningState {
+				break
+			}
+			if err != nil {
+				logging.GetLogger().Errorf("Accept error : %s", err.Error())
+				time.Sleep(200 * time.Millisecond)
+				continue
+			}
+
+			s.wgFlowsHandlers.Add(1)
+			if conn.Mode() == STREAM {
+				go s.handleFlowStream(conn)
+			} else {
+				go s.handleFlowPacket(conn)
+			}
+		case UDP:
+			s.wgFlowsHandlers.Add(1)
+			s.handleFlowPacket(serverConn)
+		}
+	}
+	s.wgFlowsHandlers.Wait()
+}
+
+// Start the flow server, the stream connections are accepted on port+2
+// along with the UDP or TLS ones
 func (s *FlowServer) Start() {
 	host := s.Addr + ":" + strconv.FormatInt(int64(s.Port), 10)
 	addr, err := net.ResolveUDPAddr("udp", host)
@@ -382,40 +502,31 @@ func (s *FlowServer) Start() {
 		logging.GetLogger().Errorf("Unable to start flow server: %s", err.Error())
 		return
 	}
+
+	if s.streamConn, err = NewFlowStreamServerConn(addr); err != nil {
+		logging.GetLogger().Errorf("Unable to start flow stream server: %s", err.Error())
+	}
+	s.streamQuit = make(chan struct{})
+
 	atomic.StoreInt64(&s.state, common.RunningState)
 
 	s.wgServer.Add(1)
-	go func() {
-		defer s.wgServer.Done()
-
-		for atomic.LoadInt64(&s.state) == common.RunningState {
-			switch s.conn.Mode() {
-			case TLS:
-				conn, err := s.conn.Accept()
-				if atomic.LoadInt64(&s.state) != common.RunningState {
-					break
-				}
-				if err != nil {
-					logging.GetLogger().Errorf("Accept error : %s", err.Error())
-					time.Sleep(200 * time.Millisecond)
-					continue
-				}
+	go s.serve(s.conn)
 
-				s.wgFlowsHandlers.Add(1)
-				go s.handleFlowPacket(conn)
-			case UDP:
-				s.wgFlowsHandlers.Add(1)
-				s.handleFlowPacket(s.conn)
-			}
-		}
-		s.wgFlowsHandlers.Wait()
-	}()
+	if s.streamConn != nil {
+		s.wgServer.Add(1)
+		go s.serve(s.streamConn)
+	}
 }
 
 // Stop the server
 func (s *FlowServer) Stop() {
 	if atomic.CompareAndSwapInt64(&s.state, common.RunningState, common.StoppingState) {
 		s.conn.Cleanup()
+		if s.streamConn != nil {
+			s.streamConn.Cleanup()
+		}
+		close(s.streamQuit)
 		s.wgServer.Wait()
 	}
 }
@@ -440,5 +551,6 @@ func NewFlowServer(addr string, port int, g *graph.Graph, store storage.Storage,
 		EnhancerPipeline: pipeline,
 		bulkInsert:       bulk,
 		bulkDeadline:     deadline,
+		streamMaxWindow:  config.GetConfig().GetInt("analyzer.flow_stream.max_window"),
 	}, nil
 }
@@ -0,0 +1,598 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/flow"
+	"github.com/skydive-project/skydive/flow/storage"
+	"github.com/skydive-project/skydive/logging"
+)
+
+// The stream transport sends batches of flows, as FlowSet messages, over a
+// TCP or TLS connection. Each batch has a sequence number acknowledged by the
+// analyzer once stored, the agent keeps a window of unacknowledged batches
+// and resends them after a reconnection.
+
+// frames of the stream transport, prefixed by their length and kind
+const (
+	flowStreamHello byte = 1 + iota
+	flowStreamHelloReply
+	flowStreamBatch
+	flowStreamAck
+)
+
+const (
+	flowStreamVersion  = 1
+	maxFlowStreamFrame = 64 * 1024 * 1024
+)
+
+var (
+	// ErrFlowStreamHandshake error the stream handshake failed
+	ErrFlowStreamHandshake = errors.New("Flow stream handshake failed")
+	// ErrFlowStreamClosed error the stream connection has been closed
+	ErrFlowStreamClosed = errors.New("Flow stream closed")
+)
+
+// flowStreamHandshake is sent by the agent with the options it requests, the
+// analyzer replies with the ones accepted or with the reason of the refusal
+type flowStreamHandshake struct {
+	Version     int
+	Compression string
+	Window      int
+	Error       string `json:",omitempty"`
+}
+
+func writeFlowStreamFrame(w io.Writer, kind byte, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	frame[4] = kind
+	copy(frame[5:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFlowStreamFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > maxFlowStreamFrame {
+		return 0, nil, fmt.Errorf("Flow stream frame too large: %d bytes", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+func encodeFlowStreamBatch(seq uint64, data []byte, compression string) ([]byte, error) {
+	var b bytes.Buffer
+
+	var seqBytes [8]byte
+	binary.BigEndian.PutUint64(seqBytes[:], seq)
+	b.Write(seqBytes[:])
+
+	if compression != "gzip" {
+		b.Write(data)
+		return b.Bytes(), nil
+	}
+
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decodeFlowStreamBatch(payload []byte, compression string) (uint64, []*flow.Flow, error) {
+	if len(payload) < 8 {
+		return 0, nil, errors.New("Flow stream batch too short")
+	}
+	seq := binary.BigEndian.Uint64(payload)
+	data := payload[8:]
+
+	if compression == "gzip" {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return seq, nil, err
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return seq, nil, err
+		}
+	}
+
+	var fs flow.FlowSet
+	if err := proto.Unmarshal(data, &fs); err != nil {
+		return seq, nil, err
+	}
+	return seq, fs.Flows, nil
+}
+
+func flowStreamCompression(compression string) string {
+	if compression == "gzip" {
+		return compression
+	}
+	return ""
+}
+
+// handleFlowStream reads the batches of an agent connection, each batch is
+// acknowledged once stored. The stream is refused if no storage is configured
+// so that the agent falls back to datagrams.
+func (s *FlowServer) handleFlowStream(conn *FlowServerConn) {
+	defer s.wgFlowsHandlers.Done()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	stream, remote := conn.streamConn, conn.streamConn.RemoteAddr()
+
+	// unblock the reads when the server stops
+	go func() {
+		select {
+		case <-s.streamQuit:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	kind, payload, err := readFlowStreamFrame(stream)
+	if err != nil || kind != flowStreamHello {
+		logging.GetLogger().Errorf("Flow stream handshake error from %s", remote)
+		return
+	}
+
+	var hello flowStreamHandshake
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		logging.GetLogger().Errorf("Flow stream handshake error from %s: %s", remote, err.Error())
+		return
+	}
+
+	reply := flowStreamHandshake{
+		Version:     flowStreamVersion,
+		Compression: flowStreamCompression(hello.Compression),
+		Window:      hello.Window,
+	}
+	if reply.Window <= 0 || reply.Window > s.streamMaxWindow {
+		reply.Window = s.streamMaxWindow
+	}
+	if s.Storage == nil {
+		reply.Error = storage.ErrNoStorageConfigured.Error()
+	}
+
+	payload, _ = json.Marshal(reply)
+	if err := writeFlowStreamFrame(stream, flowStreamHelloReply, payload); err != nil || reply.Error != "" {
+		return
+	}
+	logging.GetLogger().Debugf("Flow stream from %s, compression '%s', window %d", remote, reply.Compression, reply.Window)
+
+	var ack [8]byte
+	for atomic.LoadInt64(&s.state) == common.RunningState {
+		kind, payload, err := readFlowStreamFrame(stream)
+		if err != nil {
+			if err != io.EOF && atomic.LoadInt64(&s.state) == common.RunningState {
+				logging.GetLogger().Errorf("Error while reading flow stream from %s: %s", remote, err.Error())
+			}
+			return
+		}
+
+		if kind != flowStreamBatch {
+			continue
+		}
+
+		// invalid batches are acknowledged as they would be sent again otherwise
+		seq, flows, err := decodeFlowStreamBatch(payload, reply.Compression)
+		if err != nil {
+			logging.GetLogger().Errorf("Error while parsing flow batch %d from %s: %s", seq, remote, err.Error())
+		} else if err := s.storeFlows(flows); err != nil {
+			// the acknowledgements are cumulative, the connection is closed
+			// so that the agent sends the batch again
+			logging.GetLogger().Errorf("Unable to store flow batch %d from %s: %s", seq, remote, err.Error())
+			return
+		}
+
+		binary.BigEndian.PutUint64(ack[:], seq)
+		if err := writeFlowStreamFrame(stream, flowStreamAck, ack[:]); err != nil {
+			return
+		}
+	}
+}
+
+type flowStreamBatchData struct {
+	seq  uint64
+	data []byte
+}
+
+// flowStreamConn sends batches of flows to an analyzer, the batches are kept
+// until acknowledged and resent after a reconnection
+type flowStreamConn struct {
+	sync.Mutex
+	sendLock    sync.Mutex
+	addr        string
+	tlsConfig   *tls.Config
+	conn        net.Conn
+	compression string
+	window      int
+	batchSize   int
+	ackTimeout  time.Duration
+	seq         uint64
+	unacked     []flowStreamBatchData
+	acked       chan struct{}
+	quit        chan struct{}
+	closed      bool
+}
+
+func (c *flowStreamConn) dial() (conn net.Conn, err error) {
+	dialer := &net.Dialer{Timeout: c.ackTimeout}
+	if c.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	hello, _ := json.Marshal(flowStreamHandshake{
+		Version:     flowStreamVersion,
+		Compression: c.compression,
+		Window:      c.window,
+	})
+	c.Unlock()
+
+	if err = writeFlowStreamFrame(conn, flowStreamHello, hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(c.ackTimeout))
+	kind, payload, err := readFlowStreamFrame(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	var reply flowStreamHandshake
+	if err != nil || kind != flowStreamHelloReply || json.Unmarshal(payload, &reply) != nil {
+		conn.Close()
+		return nil, ErrFlowStreamHandshake
+	}
+	if reply.Error != "" || reply.Window <= 0 {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %s", ErrFlowStreamHandshake.Error(), reply.Error)
+	}
+
+	c.Lock()
+	c.compression = reply.Compression
+	c.window = reply.Window
+	c.Unlock()
+
+	return conn, nil
+}
+
+// reconnect opens a new connection and resends the unacknowledged batches,
+// the caller must hold sendLock
+func (c *flowStreamConn) reconnect() error {
+	c.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	closed := c.closed
+	c.Unlock()
+
+	if closed {
+		return ErrFlowStreamClosed
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		conn.Close()
+		return ErrFlowStreamClosed
+	}
+	c.conn = conn
+	pending := make([]flowStreamBatchData, len(c.unacked))
+	copy(pending, c.unacked)
+	c.Unlock()
+
+	go c.readAcks(conn)
+
+	if len(pending) > 0 {
+		logging.GetLogger().Infof("Resending %d flow batches to %s", len(pending), c.addr)
+	}
+	for _, batch := range pending {
+		if err := c.write(conn, batch); err != nil {
+			c.disconnected(conn)
+			return err
+		}
+	}
+	return nil
+}
+
+// disconnected forgets the connection if still the current one
+func (c *flowStreamConn) disconnected(conn net.Conn) {
+	c.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.Unlock()
+
+	conn.Close()
+}
+
+// resend reconnects to send the batches not acknowledged before the
+// connection broke, without waiting for new flows
+func (c *flowStreamConn) resend() {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	c.Lock()
+	pending := c.conn == nil && !c.closed && len(c.unacked) > 0
+	c.Unlock()
+
+	if pending {
+		if err := c.reconnect(); err != nil {
+			logging.GetLogger().Errorf("Flow stream connection to %s error: %s", c.addr, err.Error())
+		}
+	}
+}
+
+func (c *flowStreamConn) readAcks(conn net.Conn) {
+	defer func() {
+		c.disconnected(conn)
+
+		// wake up the sender waiting for the window
+		select {
+		case c.acked <- struct{}{}:
+		default:
+		}
+
+		go c.resend()
+	}()
+
+	for {
+		kind, payload, err := readFlowStreamFrame(conn)
+		if err != nil {
+			return
+		}
+
+		if kind != flowStreamAck || len(payload) != 8 {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(payload)
+
+		c.Lock()
+		i := 0
+		for i < len(c.unacked) && c.unacked[i].seq <= seq {
+			i++
+		}
+		c.unacked = c.unacked[i:]
+		c.Unlock()
+
+		select {
+		case c.acked <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *flowStreamConn) write(conn net.Conn, batch flowStreamBatchData) error {
+	c.Lock()
+	compression := c.compression
+	c.Unlock()
+
+	payload, err := encodeFlowStreamBatch(batch.seq, batch.data, compression)
+	if err != nil {
+		return err
+	}
+	return writeFlowStreamFrame(conn, flowStreamBatch, payload)
+}
+
+// waitWindow waits for a connection and a free slot in the window, the
+// connection is considered broken if no acknowledgement is received in time
+func (c *flowStreamConn) waitWindow() error {
+	for {
+		c.Lock()
+		conn, full := c.conn, len(c.unacked) >= c.window
+		c.Unlock()
+
+		if conn == nil {
+			if err := c.reconnect(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !full {
+			return nil
+		}
+
+		select {
+		case <-c.quit:
+			return ErrFlowStreamClosed
+		case <-c.acked:
+		case <-time.After(c.ackTimeout):
+			logging.GetLogger().Warningf("No flow acknowledgement from %s, reconnecting", c.addr)
+			if err := c.reconnect(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// cancel removes a batch not sent from the window, false if the batch has
+// been acknowledged meanwhile
+func (c *flowStreamConn) cancel(seq uint64) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for i, batch := range c.unacked {
+		if batch.seq == seq {
+			c.unacked = append(c.unacked[:i], c.unacked[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *flowStreamConn) sendBatch(flows []*flow.Flow) error {
+	data, err := proto.Marshal(&flow.FlowSet{Flows: flows})
+	if err != nil {
+		return err
+	}
+
+	if err := c.waitWindow(); err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.seq++
+	batch := flowStreamBatchData{seq: c.seq, data: data}
+	c.unacked = append(c.unacked, batch)
+	conn := c.conn
+	c.Unlock()
+
+	// once in the window the batch is resent by the reconnection
+	if conn == nil || c.write(conn, batch) != nil {
+		if err := c.reconnect(); err != nil {
+			if c.cancel(batch.seq) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SendFlows sends the flows by batches, returns the number of flows accepted
+// in the window of unacknowledged batches
+func (c *flowStreamConn) SendFlows(flows []*flow.Flow) (int, error) {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	for i := 0; i < len(flows); i += c.batchSize {
+		end := i + c.batchSize
+		if end > len(flows) {
+			end = len(flows)
+		}
+
+		if err := c.sendBatch(flows[i:end]); err != nil {
+			return i, err
+		}
+	}
+	return len(flows), nil
+}
+
+// Close the connection, returns the flows of the unacknowledged batches
+func (c *flowStreamConn) Close() []*flow.Flow {
+	c.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.quit)
+	}
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	unacked := c.unacked
+	c.unacked = nil
+	c.Unlock()
+
+	var flows []*flow.Flow
+	for _, batch := range unacked {
+		var fs flow.FlowSet
+		if err := proto.Unmarshal(batch.data, &fs); err != nil {
+			logging.GetLogger().Errorf("Unable to decode flow batch %d: %s", batch.seq, err.Error())
+			continue
+		}
+		flows = append(flows, fs.Flows...)
+	}
+	return flows
+}
+
+func newFlowStreamConn(addr string, tlsConfig *tls.Config, compression string, window, batchSize int, ackTimeout time.Duration) (*flowStreamConn, error) {
+	c := &flowStreamConn{
+		addr:        addr,
+		tlsConfig:   tlsConfig,
+		compression: flowStreamCompression(compression),
+		window:      window,
+		batchSize:   batchSize,
+		ackTimeout:  ackTimeout,
+		acked:       make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+	}
+	if c.batchSize <= 0 {
+		c.batchSize = 1
+	}
+
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	if err := c.reconnect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newFlowStreamConnFromConfig connects to the stream transport of the
+// analyzer at addr port+2
+func newFlowStreamConnFromConfig(addr string, port int) (*flowStreamConn, error) {
+	cfg := config.GetConfig()
+
+	return newFlowStreamConn(
+		fmt.Sprintf("%s:%d", addr, port+2),
+		flowClientTLSConfig(),
+		cfg.GetString("agent.flow.stream.compression"),
+		cfg.GetInt("agent.flow.stream.window"),
+		cfg.GetInt("agent.flow.stream.batch_size"),
+		time.Duration(cfg.GetInt("agent.flow.stream.ack_timeout"))*time.Second,
+	)
+}
@@ -0,0 +1,297 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/filters"
+	"github.com/skydive-project/skydive/flow"
+	"github.com/skydive-project/skydive/flow/storage"
+)
+
+type fakeFlowStorage struct {
+	sync.Mutex
+	flows    []*flow.Flow
+	failures int
+}
+
+func (f *fakeFlowStorage) Start() {}
+
+func (f *fakeFlowStorage) Stop() {}
+
+func (f *fakeFlowStorage) StoreFlows(flows []*flow.Flow) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("Storage failure")
+	}
+	f.flows = append(f.flows, flows...)
+	return nil
+}
+
+func (f *fakeFlowStorage) SearchFlows(fsq filters.SearchQuery) (*flow.FlowSet, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return &flow.FlowSet{Flows: f.flows}, nil
+}
+
+func (f *fakeFlowStorage) SearchMetrics(fsq filters.SearchQuery, metricFilter *filters.Filter) (map[string][]*common.TimedMetric, error) {
+	return nil, nil
+}
+
+func (f *fakeFlowStorage) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.flows)
+}
+
+func newTestFlows(n int) (flows []*flow.Flow) {
+	for i := 0; i < n; i++ {
+		flows = append(flows, &flow.Flow{UUID: strconv.Itoa(i)})
+	}
+	return
+}
+
+func waitForCondition(t *testing.T, msg string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(msg)
+}
+
+func newTestFlowStreamServer(t *testing.T, store storage.Storage, maxWindow int) (*FlowServer, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s := &FlowServer{
+		Storage:          store,
+		EnhancerPipeline: flow.NewEnhancerPipeline(),
+		conn:             &FlowServerConn{mode: STREAM, streamListen: ln},
+		state:            common.RunningState,
+		streamQuit:       make(chan struct{}),
+		streamMaxWindow:  maxWindow,
+	}
+	s.wgServer.Add(1)
+	go s.serve(s.conn)
+
+	return s, ln.Addr().String()
+}
+
+// fakeFlowStreamAnalyzer acknowledges the batches from its connection ackFrom
+// on, the sequence numbers received by each connection are reported
+func fakeFlowStreamAnalyzer(t *testing.T, ackFrom int) (string, chan [2]uint64, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	received := make(chan [2]uint64, 100)
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn, n int) {
+				defer conn.Close()
+
+				_, payload, err := readFlowStreamFrame(conn)
+				if err != nil {
+					return
+				}
+				var hello flowStreamHandshake
+				json.Unmarshal(payload, &hello)
+				payload, _ = json.Marshal(flowStreamHandshake{Version: flowStreamVersion, Window: hello.Window})
+				writeFlowStreamFrame(conn, flowStreamHelloReply, payload)
+
+				for {
+					_, payload, err := readFlowStreamFrame(conn)
+					if err != nil {
+						return
+					}
+					seq, _, _ := decodeFlowStreamBatch(payload, "")
+					received <- [2]uint64{uint64(n), seq}
+
+					if n >= ackFrom {
+						var ack [8]byte
+						binary.BigEndian.PutUint64(ack[:], seq)
+						writeFlowStreamFrame(conn, flowStreamAck, ack[:])
+					}
+				}
+			}(conn, n)
+		}
+	}()
+
+	return ln.Addr().String(), received, func() { ln.Close() }
+}
+
+func (c *flowStreamConn) unackedLen() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.unacked)
+}
+
+func TestFlowStreamAck(t *testing.T) {
+	store := &fakeFlowStorage{}
+	server, addr := newTestFlowStreamServer(t, store, 2)
+	defer server.Stop()
+
+	for _, compression := range []string{"", "gzip"} {
+		store.Lock()
+		store.flows = nil
+		store.Unlock()
+
+		c, err := newFlowStreamConn(addr, nil, compression, 8, 2, time.Second)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if c.window != 2 || c.compression != compression {
+			t.Errorf("Expected window 2 and compression '%s', got: %d '%s'", compression, c.window, c.compression)
+		}
+
+		if n, err := c.SendFlows(newTestFlows(7)); n != 7 || err != nil {
+			t.Errorf("Expected 7 flows sent, got: %d, %v", n, err)
+		}
+
+		waitForCondition(t, "Flows not acknowledged", func() bool {
+			return store.count() == 7 && c.unackedLen() == 0
+		})
+
+		if flows := c.Close(); len(flows) != 0 {
+			t.Errorf("Expected no unacknowledged flow, got: %v", flows)
+		}
+	}
+}
+
+func TestFlowStreamRefused(t *testing.T) {
+	server, addr := newTestFlowStreamServer(t, nil, 2)
+	defer server.Stop()
+
+	if _, err := newFlowStreamConn(addr, nil, "", 8, 2, time.Second); err == nil {
+		t.Error("The stream should be refused without storage")
+	}
+}
+
+func TestFlowStreamStoreError(t *testing.T) {
+	store := &fakeFlowStorage{failures: 1}
+	server, addr := newTestFlowStreamServer(t, store, 8)
+	defer server.Stop()
+
+	c, err := newFlowStreamConn(addr, nil, "", 8, 1, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	c.SendFlows(newTestFlows(2))
+
+	// the batch not stored is not acknowledged but sent again
+	waitForCondition(t, "Flows not stored after a storage error", func() bool {
+		return store.count() == 2 && c.unackedLen() == 0
+	})
+}
+
+func TestFlowStreamWindowTimeout(t *testing.T) {
+	addr, received, stop := fakeFlowStreamAnalyzer(t, 2)
+	defer stop()
+
+	c, err := newFlowStreamConn(addr, nil, "", 2, 1, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+
+	// the third batch waits for the window, the first connection never
+	// acknowledges so the client reconnects and sends the batches again
+	if n, err := c.SendFlows(newTestFlows(3)); n != 3 || err != nil {
+		t.Fatalf("Expected 3 flows sent, got: %d, %v", n, err)
+	}
+
+	var second []uint64
+	timeout := time.After(2 * time.Second)
+	for len(second) < 3 {
+		select {
+		case r := <-received:
+			if r[0] == 2 {
+				second = append(second, r[1])
+			}
+		case <-timeout:
+			t.Fatalf("Expected 3 batches on the second connection, got: %v", second)
+		}
+	}
+
+	if second[0] != 1 || second[1] != 2 || second[2] != 3 {
+		t.Errorf("Expected batches 1, 2 and 3 in order, got: %v", second)
+	}
+
+	waitForCondition(t, "Flows not acknowledged", func() bool {
+		return c.unackedLen() == 0
+	})
+}
+
+func TestFlowStreamClose(t *testing.T) {
+	addr, received, stop := fakeFlowStreamAnalyzer(t, 100)
+
+	c, err := newFlowStreamConn(addr, nil, "", 8, 1, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	c.SendFlows(newTestFlows(3))
+	for i := 0; i < 3; i++ {
+		<-received
+	}
+	stop()
+
+	// the analyzer is gone, the batches are kept for the next connection
+	c.Lock()
+	c.conn.Close()
+	c.Unlock()
+
+	if n, err := c.SendFlows(newTestFlows(1)); n != 0 || err == nil {
+		t.Errorf("Expected an error without analyzer, got: %d, %v", n, err)
+	}
+
+	if flows := c.Close(); len(flows) != 3 {
+		t.Errorf("Expected the 3 unacknowledged flows, got: %v", flows)
+	}
+}
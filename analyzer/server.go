@@ -42,24 +42,30 @@ import (
 	"github.com/skydive-project/skydive/packet_injector"
 	"github.com/skydive-project/skydive/probe"
 	"github.com/skydive-project/skydive/topology"
+	"github.com/skydive-project/skydive/topology/graph"
 	"github.com/skydive-project/skydive/topology/graph/traversal"
 )
 
 // Server describes an Analyzer servers mechanism like http, websocket, topology, ondemand probes, ...
 type Server struct {
-	HTTPServer        *shttp.Server
-	WSServer          *shttp.WSServer
-	TopologyForwarder *TopologyForwarder
-	TopologyServer    *TopologyServer
-	AlertServer       *alert.AlertServer
-	OnDemandClient    *ondemand.OnDemandProbeClient
-	FlowServer        *FlowServer
-	ProbeBundle       *probe.ProbeBundle
-	Storage           storage.Storage
-	EmbeddedEtcd      *etcd.EmbeddedEtcd
-	EtcdClient        *etcd.EtcdClient
-	wgServers         sync.WaitGroup
-	wgFlowsHandlers   sync.WaitGroup
+	HTTPServer         *shttp.Server
+	WSServer           *shttp.WSServer
+	TopologyForwarder  *TopologyForwarder
+	TopologyServer     *TopologyServer
+	AlertServer        *alert.AlertServer
+	SubscriptionServer *SubscriptionServer
+	Recorder           *graph.Recorder
+	OnDemandClient     *ondemand.OnDemandProbeClient
+	FlowServer         *FlowServer
+	FederationServer   *FederationServer
+	Federation         *Federation
+	ProbeBundle        *probe.ProbeBundle
+	Storage            storage.Storage
+	EmbeddedEtcd       *etcd.EmbeddedEtcd
+	EtcdClient         *etcd.EtcdClient
+	Membership         *etcd.EtcdMembership
+	wgServers          sync.WaitGroup
+	wgFlowsHandlers    sync.WaitGroup
 }
 
 func (s *Server) initialize() (err error) {
@@ -75,6 +81,10 @@ func (s *Server) initialize() (err error) {
 		return
 	}
 
+	if s.Recorder, err = graph.NewRecorderFromConfig(s.TopologyServer.Graph); err != nil {
+		return
+	}
+
 	if s.ProbeBundle, err = NewTopologyProbeBundleFromConfig(s.TopologyServer.Graph); err != nil {
 		return
 	}
@@ -100,6 +110,10 @@ func (s *Server) initialize() (err error) {
 		}
 	}
 
+	// registered for the agents placing themselves on a hash ring
+	s.Membership = etcd.NewEtcdMembership(s.EtcdClient, etcd.AnalyzersMembershipPath, config.GetConfig().GetString("host_id"))
+	s.Membership.Register()
+
 	var apiServer *api.Server
 	if apiServer, err = api.NewAPI(s.HTTPServer, s.EtcdClient.KeysAPI, common.AnalyzerService); err != nil {
 		return
@@ -127,15 +141,33 @@ func (s *Server) initialize() (err error) {
 		return
 	}
 
+	s.FederationServer = NewFederationServer(s.WSServer, tableClient, s.Storage)
+
+	if s.Federation, err = NewFederationFromConfig(s.TopologyServer.Graph); err != nil {
+		return
+	}
+
+	// the flows of the federated sites are looked up through their analyzer
+	flowStorage := s.Storage
+	if s.Federation != nil {
+		s.Federation.AddRemoteTables(tableClient)
+		flowStorage = s.Federation.Storage(s.Storage)
+	}
+
 	tr := traversal.NewGremlinTraversalParser(s.TopologyServer.Graph)
 	tr.AddTraversalExtension(topology.NewTopologyTraversalExtension())
-	tr.AddTraversalExtension(ftraversal.NewFlowTraversalExtension(tableClient, s.Storage))
+	tr.AddTraversalExtension(ftraversal.NewFlowTraversalExtension(tableClient, flowStorage))
+
+	s.TopologyServer.GraphServer.AddViewFilterFactory(traversal.NewGremlinViewFilterFactory(tr))
 
 	s.AlertServer = alert.NewAlertServer(alertAPIHandler, s.WSServer, tr, s.EtcdClient)
 
+	s.SubscriptionServer = NewSubscriptionServer(s.WSServer, tr)
+
 	piClient := packet_injector.NewPacketInjectorClient(s.WSServer)
 
 	s.TopologyForwarder = NewTopologyForwarderFromConfig(s.TopologyServer.Graph, s.WSServer)
+	s.TopologyServer.Forwarder = s.TopologyForwarder
 
 	api.RegisterTopologyAPI(s.HTTPServer, tr)
 
@@ -154,15 +186,28 @@ func (s *Server) Start() {
 		logging.GetLogger().Fatalf(err.Error())
 	}
 
+	if s.Recorder != nil {
+		s.Recorder.Start()
+	}
+
 	if s.Storage != nil {
 		s.Storage.Start()
 	}
 
-	s.TopologyForwarder.ConnectAll()
+	// in offline mode the topology only comes from imported snapshots
+	if !config.GetConfig().GetBool("analyzer.offline") {
+		s.TopologyForwarder.ConnectAll()
+		s.ProbeBundle.Start()
+	}
+
+	if s.Federation != nil {
+		s.Federation.ConnectAll()
+	}
 
-	s.ProbeBundle.Start()
+	s.Membership.Start()
 	s.OnDemandClient.Start()
 	s.AlertServer.Start()
+	s.SubscriptionServer.Start()
 
 	s.wgServers.Add(2)
 	go func() {
@@ -181,6 +226,9 @@ func (s *Server) Start() {
 // Stop the analyzer server
 func (s *Server) Stop() {
 	s.FlowServer.Stop()
+	if s.Federation != nil {
+		s.Federation.DisconnectAll()
+	}
 	s.WSServer.Stop()
 	s.HTTPServer.Stop()
 	if s.EmbeddedEtcd != nil {
@@ -189,9 +237,16 @@ func (s *Server) Stop() {
 	if s.Storage != nil {
 		s.Storage.Stop()
 	}
-	s.ProbeBundle.Stop()
+	if !config.GetConfig().GetBool("analyzer.offline") {
+		s.ProbeBundle.Stop()
+	}
 	s.OnDemandClient.Stop()
 	s.AlertServer.Stop()
+	s.SubscriptionServer.Stop()
+	if s.Recorder != nil {
+		s.Recorder.Stop()
+	}
+	s.Membership.Stop()
 	s.EtcdClient.Stop()
 	s.wgServers.Wait()
 	if tr, ok := http.DefaultTransport.(interface {
@@ -0,0 +1,328 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
+	shttp "github.com/skydive-project/skydive/http"
+	"github.com/skydive-project/skydive/logging"
+	"github.com/skydive-project/skydive/topology/graph"
+	"github.com/skydive-project/skydive/topology/graph/traversal"
+)
+
+// Namespace and message types of the Gremlin subscriptions
+const (
+	SubscriptionNamespace     = "Subscription"
+	SubscribeMsgType          = "Subscribe"
+	SubscribeReplyMsgType     = "SubscribeReply"
+	UnsubscribeMsgType        = "Unsubscribe"
+	SubscriptionUpdateMsgType = "SubscriptionUpdate"
+)
+
+// SubscriptionRequest describes the Gremlin query a websocket client subscribes to,
+// the UUID of the message is used as subscription ID
+type SubscriptionRequest struct {
+	GremlinQuery string
+	Bindings     map[string]interface{} `json:",omitempty"`
+}
+
+// SubscriptionUpdate describes the changes of the result of a subscribed query.
+// Nodes and edges are identified by their ID, other values by themselves.
+type SubscriptionUpdate struct {
+	ID      string
+	Added   []*json.RawMessage `json:",omitempty"`
+	Updated []*json.RawMessage `json:",omitempty"`
+	Removed []*json.RawMessage `json:",omitempty"`
+}
+
+type subscription struct {
+	sync.Mutex
+	id      string
+	client  *shttp.WSClient
+	request SubscriptionRequest
+	result  map[string]*json.RawMessage
+}
+
+// SubscriptionServer sends to the websocket clients the changes of the result
+// of the Gremlin queries they subscribed to. The graph events are coalesced,
+// the subscriptions are evaluated at most once per update interval.
+type SubscriptionServer struct {
+	sync.RWMutex
+	shttp.DefaultWSServerEventHandler
+	Graph          *graph.Graph
+	WSServer       *shttp.WSServer
+	gremlinParser  *traversal.GremlinTraversalParser
+	subscriptions  map[*shttp.WSClient]map[string]*subscription
+	changed        chan struct{}
+	quit           chan struct{}
+	updateInterval time.Duration
+}
+
+func (s *SubscriptionServer) execute(request SubscriptionRequest) (map[string]*json.RawMessage, error) {
+	ts, err := s.gremlinParser.ParseWithBindings(strings.NewReader(request.GremlinQuery), true, request.Bindings)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ts.Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	values := res.Values()
+
+	s.Graph.RLock()
+	defer s.Graph.RUnlock()
+
+	result := make(map[string]*json.RawMessage, len(values))
+	for _, value := range values {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		raw := json.RawMessage(b)
+
+		key := string(b)
+		switch value := value.(type) {
+		case *graph.Node:
+			key = string(value.ID)
+		case *graph.Edge:
+			key = string(value.ID)
+		}
+		result[key] = &raw
+	}
+
+	return result, nil
+}
+
+func (s *SubscriptionServer) update(sub *subscription) {
+	sub.Lock()
+	defer sub.Unlock()
+
+	result, err := s.execute(sub.request)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to evaluate subscription %s of %s: %s", sub.id, sub.client.Host, err.Error())
+		return
+	}
+
+	update := &SubscriptionUpdate{ID: sub.id}
+	for key, value := range result {
+		if old, ok := sub.result[key]; !ok {
+			update.Added = append(update.Added, value)
+		} else if !bytes.Equal(*old, *value) {
+			update.Updated = append(update.Updated, value)
+		}
+	}
+	for key, value := range sub.result {
+		if _, ok := result[key]; !ok {
+			update.Removed = append(update.Removed, value)
+		}
+	}
+	sub.result = result
+
+	if len(update.Added) != 0 || len(update.Updated) != 0 || len(update.Removed) != 0 {
+		sub.client.SendWSMessage(shttp.NewWSMessage(SubscriptionNamespace, SubscriptionUpdateMsgType, update))
+	}
+}
+
+func (s *SubscriptionServer) subscribe(c *shttp.WSClient, msg shttp.WSMessage) {
+	var request SubscriptionRequest
+	if err := common.JSONDecode(bytes.NewReader([]byte(*msg.Obj)), &request); err != nil {
+		c.SendWSMessage(msg.Reply(err.Error(), SubscribeReplyMsgType, http.StatusBadRequest))
+		return
+	}
+
+	if msg.UUID == "" {
+		c.SendWSMessage(msg.Reply("A message UUID is required", SubscribeReplyMsgType, http.StatusBadRequest))
+		return
+	}
+
+	sub := &subscription{id: msg.UUID, client: c, request: request}
+
+	// register the subscription before its first evaluation so that no
+	// event is missed, updates wait for the reply to be sent
+	sub.Lock()
+	defer sub.Unlock()
+
+	s.Lock()
+	if _, ok := s.subscriptions[c]; !ok {
+		s.subscriptions[c] = make(map[string]*subscription)
+	}
+	s.subscriptions[c][sub.id] = sub
+	s.Unlock()
+
+	result, err := s.execute(request)
+	if err != nil {
+		s.unsubscribe(c, sub.id)
+		c.SendWSMessage(msg.Reply(err.Error(), SubscribeReplyMsgType, http.StatusBadRequest))
+		return
+	}
+	sub.result = result
+
+	reply := &SubscriptionUpdate{ID: sub.id}
+	for _, value := range result {
+		reply.Added = append(reply.Added, value)
+	}
+	c.SendWSMessage(msg.Reply(reply, SubscribeReplyMsgType, http.StatusOK))
+}
+
+func (s *SubscriptionServer) unsubscribe(c *shttp.WSClient, id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if subs, ok := s.subscriptions[c]; ok {
+		delete(subs, id)
+		if len(subs) == 0 {
+			delete(s.subscriptions, c)
+		}
+	}
+}
+
+// OnMessage websocket event
+func (s *SubscriptionServer) OnMessage(c *shttp.WSClient, msg shttp.WSMessage) {
+	switch msg.Type {
+	case SubscribeMsgType:
+		s.subscribe(c, msg)
+	case UnsubscribeMsgType:
+		var id string
+		if err := common.JSONDecode(bytes.NewReader([]byte(*msg.Obj)), &id); err != nil {
+			logging.GetLogger().Errorf("Unable to decode unsubscribe message %v: %s", msg, err.Error())
+			return
+		}
+		s.unsubscribe(c, id)
+	}
+}
+
+// OnUnregisterClient websocket event
+func (s *SubscriptionServer) OnUnregisterClient(c *shttp.WSClient) {
+	s.Lock()
+	delete(s.subscriptions, c)
+	s.Unlock()
+}
+
+func (s *SubscriptionServer) notify() {
+	// no need to queue more than one notification as all the
+	// subscriptions are evaluated
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// OnNodeUpdated graph event
+func (s *SubscriptionServer) OnNodeUpdated(n *graph.Node) {
+	s.notify()
+}
+
+// OnNodeAdded graph event
+func (s *SubscriptionServer) OnNodeAdded(n *graph.Node) {
+	s.notify()
+}
+
+// OnNodeDeleted graph event
+func (s *SubscriptionServer) OnNodeDeleted(n *graph.Node) {
+	s.notify()
+}
+
+// OnEdgeUpdated graph event
+func (s *SubscriptionServer) OnEdgeUpdated(e *graph.Edge) {
+	s.notify()
+}
+
+// OnEdgeAdded graph event
+func (s *SubscriptionServer) OnEdgeAdded(e *graph.Edge) {
+	s.notify()
+}
+
+// OnEdgeDeleted graph event
+func (s *SubscriptionServer) OnEdgeDeleted(e *graph.Edge) {
+	s.notify()
+}
+
+func (s *SubscriptionServer) run() {
+	for {
+		select {
+		case <-s.changed:
+			var subs []*subscription
+			s.RLock()
+			for _, clientSubs := range s.subscriptions {
+				for _, sub := range clientSubs {
+					subs = append(subs, sub)
+				}
+			}
+			s.RUnlock()
+
+			for _, sub := range subs {
+				s.update(sub)
+			}
+
+			// the events received meanwhile trigger the next evaluation
+			if s.updateInterval > 0 {
+				select {
+				case <-time.After(s.updateInterval):
+				case <-s.quit:
+					return
+				}
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Start listening to graph events
+func (s *SubscriptionServer) Start() {
+	s.Graph.AddEventListener(s)
+	go s.run()
+}
+
+// Stop listening to graph events
+func (s *SubscriptionServer) Stop() {
+	s.Graph.RemoveEventListener(s)
+	s.quit <- struct{}{}
+}
+
+// NewSubscriptionServer returns a new subscription server handling the
+// subscription messages of the websocket server
+func NewSubscriptionServer(wsServer *shttp.WSServer, parser *traversal.GremlinTraversalParser) *SubscriptionServer {
+	s := &SubscriptionServer{
+		Graph:          parser.Graph,
+		WSServer:       wsServer,
+		gremlinParser:  parser,
+		subscriptions:  make(map[*shttp.WSClient]map[string]*subscription),
+		changed:        make(chan struct{}, 1),
+		quit:           make(chan struct{}),
+		updateInterval: time.Duration(config.GetConfig().GetInt("analyzer.subscription.update_interval")) * time.Second,
+	}
+	wsServer.AddEventHandler(s, []string{SubscriptionNamespace})
+
+	return s
+}
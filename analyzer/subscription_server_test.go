@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package analyzer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+	shttp "github.com/skydive-project/skydive/http"
+	"github.com/skydive-project/skydive/topology/graph"
+	"github.com/skydive-project/skydive/topology/graph/traversal"
+)
+
+type fakeSubscriptionClient struct {
+	sync.Mutex
+	shttp.DefaultWSClientEventHandler
+	connected bool
+	replies   []SubscriptionUpdate
+	updates   []SubscriptionUpdate
+}
+
+func (f *fakeSubscriptionClient) OnConnected(c *shttp.WSAsyncClient) {
+	f.Lock()
+	f.connected = true
+	f.Unlock()
+}
+
+func (f *fakeSubscriptionClient) OnMessage(c *shttp.WSAsyncClient, m shttp.WSMessage) {
+	var update SubscriptionUpdate
+	if m.Status == http.StatusOK {
+		if err := json.Unmarshal([]byte(*m.Obj), &update); err != nil {
+			return
+		}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	switch m.Type {
+	case SubscribeReplyMsgType:
+		f.replies = append(f.replies, update)
+	case SubscriptionUpdateMsgType:
+		f.updates = append(f.updates, update)
+	}
+}
+
+func (f *fakeSubscriptionClient) counts() (int, int, bool) {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.replies), len(f.updates), f.connected
+}
+
+func (f *fakeSubscriptionClient) lastUpdate() SubscriptionUpdate {
+	f.Lock()
+	defer f.Unlock()
+	return f.updates[len(f.updates)-1]
+}
+
+func valueIDs(t *testing.T, values []*json.RawMessage) string {
+	var ids []string
+	for _, value := range values {
+		var element struct{ ID string }
+		if err := json.Unmarshal([]byte(*value), &element); err != nil {
+			t.Fatal(err.Error())
+		}
+		ids = append(ids, element.ID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestSubscriptionServer(t *testing.T) {
+	b, err := graph.NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g := graph.NewGraphFromConfig(b)
+
+	g.Lock()
+	g.NewNode(graph.Identifier("intf1"), graph.Metadata{"Type": "intf"})
+	g.NewNode(graph.Identifier("host1"), graph.Metadata{"Type": "host"})
+	g.Unlock()
+
+	httpserver := shttp.NewServer("myhost", common.AnalyzerService, "localhost", 59996, shttp.NewNoAuthenticationBackend())
+
+	go httpserver.ListenAndServe()
+	defer httpserver.Stop()
+
+	wsserver := shttp.NewWSServer(httpserver, 10*time.Second, 100, time.Second, "/wstest")
+
+	go wsserver.ListenAndServe()
+	defer wsserver.Stop()
+
+	server := NewSubscriptionServer(wsserver, traversal.NewGremlinTraversalParser(g))
+	server.updateInterval = 100 * time.Millisecond
+	server.Start()
+	defer server.Stop()
+
+	wsclient := shttp.NewWSAsyncClient("myhost", common.AgentService, "localhost", 59996, "/wstest", nil)
+
+	wspool := shttp.NewWSAsyncClientPool()
+	wspool.AddWSAsyncClient(wsclient)
+
+	client := &fakeSubscriptionClient{}
+	wspool.AddEventHandler(client, []string{SubscriptionNamespace})
+
+	wsclient.Connect()
+	defer wsclient.Disconnect()
+
+	waitForCondition(t, "Client not connected", func() bool {
+		_, _, connected := client.counts()
+		return connected
+	})
+
+	request := SubscriptionRequest{GremlinQuery: "G.V().Has('Type', 'intf')"}
+	wsclient.SendWSMessage(shttp.NewWSMessage(SubscriptionNamespace, SubscribeMsgType, request, "sub1"))
+
+	// the initial result is sent in the reply
+	waitForCondition(t, "No subscription reply", func() bool {
+		replies, _, _ := client.counts()
+		return replies == 1
+	})
+	client.Lock()
+	reply := client.replies[0]
+	client.Unlock()
+	if reply.ID != "sub1" || valueIDs(t, reply.Added) != "intf1" {
+		t.Fatalf("Expected intf1 in the reply, got: %+v", reply)
+	}
+
+	// the events are coalesced in one update
+	g.Lock()
+	g.NewNode(graph.Identifier("intf2"), graph.Metadata{"Type": "intf"})
+	g.NewNode(graph.Identifier("intf3"), graph.Metadata{"Type": "intf"})
+	g.NewNode(graph.Identifier("host2"), graph.Metadata{"Type": "host"})
+	g.Unlock()
+
+	waitForCondition(t, "No added notification", func() bool {
+		_, updates, _ := client.counts()
+		return updates == 1
+	})
+	if update := client.lastUpdate(); update.ID != "sub1" || valueIDs(t, update.Added) != "intf2,intf3" || len(update.Removed) != 0 {
+		t.Fatalf("Expected intf2 and intf3 added, got: %+v", update)
+	}
+
+	g.Lock()
+	g.DelNode(g.GetNode(graph.Identifier("intf1")))
+	g.Unlock()
+
+	waitForCondition(t, "No removed notification", func() bool {
+		_, updates, _ := client.counts()
+		return updates == 2
+	})
+	if update := client.lastUpdate(); valueIDs(t, update.Removed) != "intf1" || len(update.Added) != 0 {
+		t.Fatalf("Expected intf1 removed, got: %+v", update)
+	}
+
+	// the nodes not matching the query are not notified
+	g.Lock()
+	g.DelNode(g.GetNode(graph.Identifier("host2")))
+	g.Unlock()
+
+	wsclient.SendWSMessage(shttp.NewWSMessage(SubscriptionNamespace, UnsubscribeMsgType, "sub1"))
+	waitForCondition(t, "Subscription not removed", func() bool {
+		server.RLock()
+		defer server.RUnlock()
+		return len(server.subscriptions) == 0
+	})
+
+	g.Lock()
+	g.NewNode(graph.Identifier("intf4"), graph.Metadata{"Type": "intf"})
+	g.Unlock()
+
+	time.Sleep(3 * server.updateInterval)
+	if _, updates, _ := client.counts(); updates != 2 {
+		t.Errorf("Expected no notification after unsubscribe, got: %+v", client.lastUpdate())
+	}
+}
@@ -125,17 +125,25 @@ func (p *TopologyForwarderPeer) disconnect() {
 	}
 }
 
-// OnMessage websocket event
-func (a *TopologyForwarder) OnMessage(c *shttp.WSClient, msg shttp.WSMessage) {
+// Forward a message to all the peers
+func (a *TopologyForwarder) Forward(msg *shttp.WSMessage) {
 	for _, peer := range a.peers {
-		// we forward message whether the service is not an analyzer or the HosID is not the same
-		// so that we forward all external messages to skydive and we avoid loop.
-		if peer.wsclient != nil && (c.ClientType != common.AnalyzerService || peer.host != c.Host) {
-			peer.wsclient.SendWSMessage(&msg)
+		if peer.wsclient != nil {
+			peer.wsclient.SendWSMessage(msg)
 		}
 	}
 }
 
+// OnMessage websocket event
+func (a *TopologyForwarder) OnMessage(c *shttp.WSClient, msg shttp.WSMessage) {
+	// the analyzers are all connected to each other, the messages coming from
+	// an analyzer have already been forwarded to every peer. Forwarding them
+	// again would loop with more than two analyzers.
+	if c.ClientType != common.AnalyzerService {
+		a.Forward(&msg)
+	}
+}
+
 func (a *TopologyForwarder) addPeer(addr string, port int, g *graph.Graph) {
 	peer := &TopologyForwarderPeer{
 		Addr:        addr,
@@ -23,6 +23,7 @@
 package analyzer
 
 import (
+	"net/http"
 	"sync"
 
 	"github.com/skydive-project/skydive/common"
@@ -46,6 +47,10 @@ type TopologyServer struct {
 	// map used to store agent which uses this analyzer as master
 	// basically sending graph messages
 	authors map[string]bool
+	// Forwarder notifies the other analyzers when an author leaves
+	Forwarder *TopologyForwarder
+	// in read only mode the graph is not modified by the graph messages
+	readOnly bool
 }
 
 func (t *TopologyServer) hostGraphDeleted(host string, mode int) {
@@ -76,10 +81,19 @@ func (t *TopologyServer) OnUnregisterClient(c *shttp.WSClient) {
 	t.Lock()
 	delete(t.authors, c.Host)
 	t.Unlock()
+
+	if t.Forwarder != nil {
+		t.Forwarder.Forward(shttp.NewWSMessage(graph.Namespace, graph.HostGraphDeletedMsgType, c.Host))
+	}
 }
 
 // OnGraphMessage websocket event
 func (t *TopologyServer) OnGraphMessage(c *shttp.WSClient, msg shttp.WSMessage, msgType string, obj interface{}) {
+	if t.readOnly {
+		logging.GetLogger().Debugf("Ignoring %s message from %s, topology is read only", msgType, c.Host)
+		return
+	}
+
 	// author if message coming from another client than analyzer
 	if c.ClientType != "" && c.ClientType != common.AnalyzerService {
 		t.Lock()
@@ -118,6 +132,15 @@ func (t *TopologyServer) OnGraphMessage(c *shttp.WSClient, msg shttp.WSMessage,
 
 		logging.GetLogger().Debugf("Got %s message for host %s", graph.HostGraphDeletedMsgType, host)
 
+		// the agent left another analyzer after being moved to this one
+		t.RLock()
+		_, author := t.authors[host]
+		t.RUnlock()
+
+		if author && c.ClientType == common.AnalyzerService {
+			return
+		}
+
 		t.hostGraphDeleted(obj.(string), graph.CacheOnlyMode)
 		if c.ClientType != common.AnalyzerService {
 			t.hostGraphDeleted(obj.(string), graph.PersistentOnlyMode)
@@ -126,6 +149,23 @@ func (t *TopologyServer) OnGraphMessage(c *shttp.WSClient, msg shttp.WSMessage,
 		return
 	}
 
+	// an agent sends the revisions of its nodes and edges on re-sync, the
+	// persistent backend is cleaned first if the host is unknown as the
+	// analyzer may have been restarted
+	if msgType == graph.SyncRevisionsMsgType {
+		r := obj.(*graph.SyncRevisionsMsg)
+
+		logging.GetLogger().Debugf("Got %s message for host %s", graph.SyncRevisionsMsgType, r.Host)
+
+		if len(t.Graph.HostRevisions(r.Host).Nodes) == 0 {
+			t.hostGraphDeleted(r.Host, graph.PersistentOnlyMode)
+		}
+
+		reply := t.Graph.SyncHostRevisions(r)
+		c.SendWSMessage(msg.Reply(reply, graph.SyncRevisionsReplyMsgType, http.StatusOK))
+		return
+	}
+
 	// If the message comes from analyzer we need to apply it only on cache only
 	// as it is a forwarded message.
 	if c.ClientType == common.AnalyzerService {
@@ -137,13 +177,17 @@ func (t *TopologyServer) OnGraphMessage(c *shttp.WSClient, msg shttp.WSMessage,
 	case graph.SyncReplyMsgType:
 		r := obj.(*graph.SyncReplyMsg)
 		for _, n := range r.Nodes {
-			if t.Graph.GetNode(n.ID) == nil {
+			if node := t.Graph.GetNode(n.ID); node == nil {
 				t.Graph.NodeAdded(n)
+			} else if node.Revision() != n.Revision() {
+				t.Graph.NodeUpdated(n)
 			}
 		}
 		for _, e := range r.Edges {
-			if t.Graph.GetEdge(e.ID) == nil {
+			if edge := t.Graph.GetEdge(e.ID); edge == nil {
 				t.Graph.EdgeAdded(e)
+			} else if edge.Revision() != e.Revision() {
+				t.Graph.EdgeUpdated(e)
 			}
 		}
 	case graph.NodeUpdatedMsgType:
@@ -200,8 +244,15 @@ func NewTopologyServer(host string, server *shttp.WSServer) (*TopologyServer, er
 	return t, nil
 }
 
-// NewTopologyServerFromConfig create a new topology server based on configuration
+// NewTopologyServerFromConfig create a new topology server based on configuration,
+// the topology is read only in offline mode
 func NewTopologyServerFromConfig(server *shttp.WSServer) (*TopologyServer, error) {
 	host := config.GetConfig().GetString("host_id")
-	return NewTopologyServer(host, server)
+	t, err := NewTopologyServer(host, server)
+	if err != nil {
+		return nil, err
+	}
+	t.readOnly = config.GetConfig().GetBool("analyzer.offline")
+
+	return t, nil
 }
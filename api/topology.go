@@ -23,28 +23,46 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/abbot/go-http-auth"
+	"golang.org/x/net/context"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
 	shttp "github.com/skydive-project/skydive/http"
+	"github.com/skydive-project/skydive/logging"
 	"github.com/skydive-project/skydive/topology/graph"
 	"github.com/skydive-project/skydive/topology/graph/traversal"
-	"github.com/skydive-project/skydive/validator"
 )
 
 // TopologyAPI expose the topology query API
 type TopologyAPI struct {
 	gremlinParser *traversal.GremlinTraversalParser
+	offline       bool
 }
 
-// TopologyParam topology API parameter
+// TopologyParam topology API parameter, the query is not validated as
+// it can only be parsed along with its bindings
 type TopologyParam struct {
-	GremlinQuery string `json:"GremlinQuery,omitempty" valid:"isGremlinExpr"`
+	GremlinQuery string                 `json:"GremlinQuery,omitempty"`
+	Bindings     map[string]interface{} `json:"Bindings,omitempty"`
+	Explain      bool                   `json:"Explain,omitempty"`
+	Timeout      string                 `json:"Timeout,omitempty"`
+}
+
+// TopologyExplain topology API answer when the explain mode is requested
+type TopologyExplain struct {
+	Result  interface{}
+	Profile *traversal.TraversalProfile
 }
 
 func (t *TopologyAPI) graphToDot(w http.ResponseWriter, g *graph.Graph) {
@@ -111,16 +129,118 @@ func (t *TopologyAPI) topologyIndex(w http.ResponseWriter, r *auth.Authenticated
 	}
 }
 
+func (t *TopologyAPI) topologyHistory(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	g := t.gremlinParser.Graph
+	g.RLock()
+	defer g.RUnlock()
+
+	stats, err := g.GetHistoryStats()
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		panic(err)
+	}
+}
+
+func (t *TopologyAPI) topologyListeners(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	stats := t.gremlinParser.Graph.GetEventListenerStats()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		panic(err)
+	}
+}
+
+func (t *TopologyAPI) topologyExport(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	g := t.gremlinParser.Graph
+	g.RLock()
+	defer g.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(g.Snapshot()); err != nil {
+		panic(err)
+	}
+}
+
+func (t *TopologyAPI) topologyImport(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if !t.offline {
+		writeError(w, http.StatusForbidden, errors.New("Snapshots can only be imported by an analyzer in offline mode"))
+		return
+	}
+
+	snapshot, err := graph.DecodeSnapshot(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	g := t.gremlinParser.Graph
+	g.Lock()
+	defer g.Unlock()
+
+	if err := g.LoadSnapshot(snapshot); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t *TopologyAPI) topologyReplay(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if !t.offline {
+		writeError(w, http.StatusForbidden, errors.New("Events can only be replayed by an analyzer in offline mode"))
+		return
+	}
+
+	speed := 1.0
+	if s := r.URL.Query().Get("speed"); s != "" {
+		var err error
+		if speed, err = strconv.ParseFloat(s, 64); err != nil || speed < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid replay speed: %s", s))
+			return
+		}
+	}
+
+	events, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// the graph is locked for each event, so that the replay can be watched
+	go func() {
+		if err := t.gremlinParser.Graph.Replay(bytes.NewReader(events), speed); err != nil {
+			logging.GetLogger().Errorf("Unable to replay events: %s", err.Error())
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeQueryError(w http.ResponseWriter, err error) {
+	switch err {
+	case traversal.ErrTimeout:
+		writeError(w, http.StatusGatewayTimeout, err)
+	case traversal.ErrCanceled:
+		// nobody is listening anymore
+	default:
+		writeError(w, http.StatusBadRequest, err)
+	}
+}
+
 func (t *TopologyAPI) topologySearch(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	resource := TopologyParam{}
 
 	data, _ := ioutil.ReadAll(r.Body)
 	if len(data) != 0 {
-		if err := json.Unmarshal(data, &resource); err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
-		}
-		if err := validator.Validate(resource); err != nil {
+		if err := common.JSONDecode(bytes.NewReader(data), &resource); err != nil {
 			writeError(w, http.StatusBadRequest, err)
 			return
 		}
@@ -131,19 +251,70 @@ func (t *TopologyAPI) topologySearch(w http.ResponseWriter, r *auth.Authenticate
 		return
 	}
 
-	ts, err := t.gremlinParser.Parse(strings.NewReader(resource.GremlinQuery), true)
+	ts, err := t.gremlinParser.ParseWithBindings(strings.NewReader(resource.GremlinQuery), true, resource.Bindings)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	res, err := ts.Exec()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if resource.Timeout != "" {
+		timeout, err := time.ParseDuration(resource.Timeout)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// cancel the query as soon as the client goes away
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed := notifier.CloseNotify()
+		go func() {
+			select {
+			case <-closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	if resource.Explain {
+		res, profile, err := ts.ProfileWithContext(ctx)
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(&TopologyExplain{Result: res, Profile: profile}); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	res, err := ts.ExecWithContext(ctx)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeQueryError(w, err)
 		return
 	}
 
-	if strings.Contains(r.Header.Get("Accept"), "vnd.graphviz") {
+	if format := topologyFormatFromAccept(r.Header.Get("Accept")); format != nil {
+		nodes, edges, ok := topologyElements(res)
+		if !ok {
+			writeError(w, http.StatusNotAcceptable, errors.New("Only graph and nodes can be outputted as "+format.mediaType))
+			return
+		}
+		w.Header().Set("Content-Type", format.contentType)
+		w.WriteHeader(http.StatusOK)
+		if err := format.render(w, nodes, edges); err != nil {
+			logging.GetLogger().Errorf("Unable to render topology as %s: %s", format.mediaType, err.Error())
+		}
+	} else if strings.Contains(r.Header.Get("Accept"), "vnd.graphviz") {
 		if graphTraversal, ok := res.(*traversal.GraphTraversal); ok {
 			w.Header().Set("Content-Type", "text/vnd.graphviz; charset=UTF-8")
 			w.WriteHeader(http.StatusOK)
@@ -174,6 +345,36 @@ func (t *TopologyAPI) registerEndpoints(r *shttp.Server) {
 			Path:        "/api/topology",
 			HandlerFunc: t.topologySearch,
 		},
+		{
+			Name:        "TopologyHistory",
+			Method:      "GET",
+			Path:        "/api/topology/history",
+			HandlerFunc: t.topologyHistory,
+		},
+		{
+			Name:        "TopologyListeners",
+			Method:      "GET",
+			Path:        "/api/topology/listeners",
+			HandlerFunc: t.topologyListeners,
+		},
+		{
+			Name:        "TopologyExport",
+			Method:      "GET",
+			Path:        "/api/topology/export",
+			HandlerFunc: t.topologyExport,
+		},
+		{
+			Name:        "TopologyImport",
+			Method:      "POST",
+			Path:        "/api/topology/import",
+			HandlerFunc: t.topologyImport,
+		},
+		{
+			Name:        "TopologyReplay",
+			Method:      "POST",
+			Path:        "/api/topology/replay",
+			HandlerFunc: t.topologyReplay,
+		},
 	}
 
 	r.RegisterRoutes(routes)
@@ -183,6 +384,7 @@ func (t *TopologyAPI) registerEndpoints(r *shttp.Server) {
 func RegisterTopologyAPI(r *shttp.Server, parser *traversal.GremlinTraversalParser) {
 	t := &TopologyAPI{
 		gremlinParser: parser,
+		offline:       config.GetConfig().GetBool("analyzer.offline"),
 	}
 
 	t.registerEndpoints(r)
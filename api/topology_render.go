@@ -0,0 +1,439 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skydive-project/skydive/topology/graph"
+	"github.com/skydive-project/skydive/topology/graph/traversal"
+)
+
+// topologyRenderer renders nodes and the edges linking them
+type topologyRenderer func(w io.Writer, nodes []*graph.Node, edges []*graph.Edge) error
+
+// topologyFormat describes a rendering format, selected when the Accept
+// header contains its media type
+type topologyFormat struct {
+	mediaType   string
+	contentType string
+	render      topologyRenderer
+}
+
+var topologyFormats = []topologyFormat{
+	{"graphml", "application/graphml+xml; charset=UTF-8", renderGraphML},
+	{"gexf", "application/gexf+xml; charset=UTF-8", renderGEXF},
+	{"vnd.cytoscape", "application/vnd.cytoscape+json; charset=UTF-8", renderCytoscape},
+}
+
+func topologyFormatFromAccept(accept string) *topologyFormat {
+	for i := range topologyFormats {
+		if strings.Contains(accept, topologyFormats[i].mediaType) {
+			return &topologyFormats[i]
+		}
+	}
+	return nil
+}
+
+// topologyElements returns the nodes of a query result along with the edges
+// linking them, only graphs and nodes can be rendered
+func topologyElements(res traversal.GraphTraversalStep) ([]*graph.Node, []*graph.Edge, bool) {
+	switch res := res.(type) {
+	case *traversal.GraphTraversal:
+		res.RLock()
+		defer res.RUnlock()
+		return res.Graph.GetNodes(nil), res.Graph.GetEdges(nil), true
+	case *traversal.GraphTraversalV:
+		res.GraphTraversal.RLock()
+		defer res.GraphTraversal.RUnlock()
+
+		nodes := res.GetNodes()
+		ids := make(map[graph.Identifier]bool, len(nodes))
+		for _, n := range nodes {
+			ids[n.ID] = true
+		}
+
+		var edges []*graph.Edge
+		for _, n := range nodes {
+			for _, e := range res.GraphTraversal.Graph.GetNodeEdges(n, nil) {
+				// each edge is seen from both ends, keep it once
+				if e.GetParent() == n.ID && ids[e.GetChild()] {
+					edges = append(edges, e)
+				}
+			}
+		}
+		return nodes, edges, true
+	}
+	return nil, nil, false
+}
+
+func flattenAttributes(prefix string, m map[string]interface{}, attrs map[string]interface{}) {
+	for k, v := range m {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flattenAttributes(prefix+k+".", v, attrs)
+		case graph.Metadata:
+			flattenAttributes(prefix+k+".", v, attrs)
+		default:
+			attrs[prefix+k] = v
+		}
+	}
+}
+
+// elementAttributes returns the flattened metadata of a node or an edge
+// along with its host, timestamps and revision
+func elementAttributes(e interface {
+	Metadata() graph.Metadata
+	GetField(string) (interface{}, error)
+}) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	flattenAttributes("", e.Metadata(), attrs)
+	for _, field := range []string{"Host", "CreatedAt", "UpdatedAt", "Revision"} {
+		if v, err := e.GetField(field); err == nil {
+			attrs[field] = v
+		}
+	}
+	return attrs
+}
+
+// attribute describes an attribute and its type as shared by GraphML and GEXF
+type attribute struct {
+	id   string
+	name string
+	kind string
+}
+
+func attributeKind(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "boolean"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "long"
+	case float32, float64, json.Number:
+		return "double"
+	}
+	return "string"
+}
+
+func attributeValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []interface{}, []string, map[string]interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// declareAttributes returns the attributes used by the elements, sorted by
+// name, a key whose values have different types is declared as a string
+func declareAttributes(prefix string, elements []map[string]interface{}) []*attribute {
+	byName := make(map[string]*attribute)
+	for _, attrs := range elements {
+		for k, v := range attrs {
+			kind := attributeKind(v)
+			if a, ok := byName[k]; !ok {
+				byName[k] = &attribute{name: k, kind: kind}
+			} else if a.kind != kind {
+				a.kind = "string"
+			}
+		}
+	}
+
+	var names []string
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]*attribute, len(names))
+	for i, name := range names {
+		a := byName[name]
+		a.id = fmt.Sprintf("%s%d", prefix, i)
+		list[i] = a
+	}
+	return list
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	ID     string        `xml:"id,attr"`
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+// graphMLDataList returns the values of the attributes in their declaration
+// order
+func graphMLDataList(attrs map[string]interface{}, keys []*attribute) (data []graphMLData) {
+	for _, k := range keys {
+		if v, ok := attrs[k.name]; ok {
+			data = append(data, graphMLData{Key: k.id, Value: attributeValue(v)})
+		}
+	}
+	return
+}
+
+func renderGraphML(w io.Writer, nodes []*graph.Node, edges []*graph.Edge) error {
+	nodeAttrs, edgeAttrs := nodesAttributes(nodes), edgesAttributes(edges)
+	nodeKeys := declareAttributes("n", nodeAttrs)
+	edgeKeys := declareAttributes("e", edgeAttrs)
+
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Graph: graphMLGraph{ID: "G", EdgeDefault: "directed"},
+	}
+	for _, k := range nodeKeys {
+		doc.Keys = append(doc.Keys, graphMLKey{ID: k.id, For: "node", Name: k.name, Type: k.kind})
+	}
+	for _, k := range edgeKeys {
+		doc.Keys = append(doc.Keys, graphMLKey{ID: k.id, For: "edge", Name: k.name, Type: k.kind})
+	}
+	for i, n := range nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{ID: string(n.ID), Data: graphMLDataList(nodeAttrs[i], nodeKeys)})
+	}
+	for i, e := range edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			ID:     string(e.ID),
+			Source: string(e.GetParent()),
+			Target: string(e.GetChild()),
+			Data:   graphMLDataList(edgeAttrs[i], edgeKeys),
+		})
+	}
+
+	return writeXML(w, doc)
+}
+
+type gexfAttribute struct {
+	ID    string `xml:"id,attr"`
+	Title string `xml:"title,attr"`
+	Type  string `xml:"type,attr"`
+}
+
+type gexfAttributes struct {
+	Class      string          `xml:"class,attr"`
+	Attributes []gexfAttribute `xml:"attribute"`
+}
+
+type gexfAttValue struct {
+	For   string `xml:"for,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type gexfNode struct {
+	ID        string         `xml:"id,attr"`
+	Label     string         `xml:"label,attr,omitempty"`
+	AttValues []gexfAttValue `xml:"attvalues>attvalue"`
+}
+
+type gexfEdge struct {
+	ID        string         `xml:"id,attr"`
+	Source    string         `xml:"source,attr"`
+	Target    string         `xml:"target,attr"`
+	Label     string         `xml:"label,attr,omitempty"`
+	AttValues []gexfAttValue `xml:"attvalues>attvalue"`
+}
+
+type gexfGraph struct {
+	DefaultEdgeType string           `xml:"defaultedgetype,attr"`
+	Mode            string           `xml:"mode,attr"`
+	Attributes      []gexfAttributes `xml:"attributes"`
+	Nodes           []gexfNode       `xml:"nodes>node"`
+	Edges           []gexfEdge       `xml:"edges>edge"`
+}
+
+type gexfMeta struct {
+	LastModifiedDate string `xml:"lastmodifieddate,attr"`
+	Creator          string `xml:"creator"`
+}
+
+type gexf struct {
+	XMLName xml.Name  `xml:"gexf"`
+	XMLNS   string    `xml:"xmlns,attr"`
+	Version string    `xml:"version,attr"`
+	Meta    gexfMeta  `xml:"meta"`
+	Graph   gexfGraph `xml:"graph"`
+}
+
+func gexfAttributesOf(class string, attrs []*attribute) gexfAttributes {
+	a := gexfAttributes{Class: class}
+	for _, attr := range attrs {
+		a.Attributes = append(a.Attributes, gexfAttribute{ID: attr.id, Title: attr.name, Type: attr.kind})
+	}
+	return a
+}
+
+// gexfAttValues returns the values of the attributes in their declaration
+// order
+func gexfAttValues(attrs map[string]interface{}, keys []*attribute) (values []gexfAttValue) {
+	for _, k := range keys {
+		if v, ok := attrs[k.name]; ok {
+			values = append(values, gexfAttValue{For: k.id, Value: attributeValue(v)})
+		}
+	}
+	return
+}
+
+func renderGEXF(w io.Writer, nodes []*graph.Node, edges []*graph.Edge) error {
+	nodeAttrs, edgeAttrs := nodesAttributes(nodes), edgesAttributes(edges)
+	nodeKeys := declareAttributes("n", nodeAttrs)
+	edgeKeys := declareAttributes("e", edgeAttrs)
+
+	doc := gexf{
+		XMLNS:   "http://www.gexf.net/1.2draft",
+		Version: "1.2",
+		Meta: gexfMeta{
+			LastModifiedDate: time.Now().UTC().Format("2006-01-02"),
+			Creator:          "Skydive",
+		},
+		Graph: gexfGraph{
+			DefaultEdgeType: "directed",
+			Mode:            "static",
+			Attributes: []gexfAttributes{
+				gexfAttributesOf("node", nodeKeys),
+				gexfAttributesOf("edge", edgeKeys),
+			},
+		},
+	}
+	for i, n := range nodes {
+		name, _ := n.GetFieldString("Name")
+		doc.Graph.Nodes = append(doc.Graph.Nodes, gexfNode{ID: string(n.ID), Label: name, AttValues: gexfAttValues(nodeAttrs[i], nodeKeys)})
+	}
+	for i, e := range edges {
+		relationType, _ := e.GetFieldString("RelationType")
+		doc.Graph.Edges = append(doc.Graph.Edges, gexfEdge{
+			ID:        string(e.ID),
+			Source:    string(e.GetParent()),
+			Target:    string(e.GetChild()),
+			Label:     relationType,
+			AttValues: gexfAttValues(edgeAttrs[i], edgeKeys),
+		})
+	}
+
+	return writeXML(w, doc)
+}
+
+type cytoscapeElement struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+type cytoscapeElements struct {
+	Nodes []cytoscapeElement `json:"nodes"`
+	Edges []cytoscapeElement `json:"edges"`
+}
+
+// cytoscapeData copies the metadata so that the element fields can be added
+func cytoscapeData(m graph.Metadata) map[string]interface{} {
+	data := make(map[string]interface{}, len(m)+4)
+	for k, v := range m {
+		data[k] = v
+	}
+	return data
+}
+
+// renderCytoscape renders the elements in the Cytoscape.js JSON format, the
+// metadata are kept nested within the data of the elements
+func renderCytoscape(w io.Writer, nodes []*graph.Node, edges []*graph.Edge) error {
+	elements := cytoscapeElements{Nodes: []cytoscapeElement{}, Edges: []cytoscapeElement{}}
+
+	for _, n := range nodes {
+		data := cytoscapeData(n.Metadata())
+		data["id"] = string(n.ID)
+		data["Host"] = n.Host()
+		elements.Nodes = append(elements.Nodes, cytoscapeElement{Data: data})
+	}
+	for _, e := range edges {
+		data := cytoscapeData(e.Metadata())
+		data["id"] = string(e.ID)
+		data["source"] = string(e.GetParent())
+		data["target"] = string(e.GetChild())
+		data["Host"] = e.Host()
+		elements.Edges = append(elements.Edges, cytoscapeElement{Data: data})
+	}
+
+	return json.NewEncoder(w).Encode(&struct {
+		Elements cytoscapeElements `json:"elements"`
+	}{Elements: elements})
+}
+
+func nodesAttributes(nodes []*graph.Node) []map[string]interface{} {
+	attrs := make([]map[string]interface{}, len(nodes))
+	for i, n := range nodes {
+		attrs[i] = elementAttributes(n)
+	}
+	return attrs
+}
+
+func edgesAttributes(edges []*graph.Edge) []map[string]interface{} {
+	attrs := make([]map[string]interface{}, len(edges))
+	for i, e := range edges {
+		attrs[i] = elementAttributes(e)
+	}
+	return attrs
+}
+
+func writeXML(w io.Writer, doc interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(doc)
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package api
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/topology/graph"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the renderers")
+
+const renderTestElements = `{
+	"Nodes": [
+		{
+			"ID": "node1",
+			"Host": "host<1>",
+			"CreatedAt": 1500000000000,
+			"UpdatedAt": 1500000001000,
+			"Revision": 2,
+			"Metadata": {
+				"Name": "eth0 <\"a\" & 'b'>",
+				"Type": "device",
+				"MTU": 1500,
+				"IPV4": ["10.0.0.1/24", "10.0.0.2/24"],
+				"Ovs": {"Port": {"Name": "p&1", "Number": 3}, "Bridge": "br-int"}
+			}
+		},
+		{
+			"ID": "node2",
+			"Host": "host<1>",
+			"CreatedAt": 1500000000000,
+			"UpdatedAt": 1500000000000,
+			"Revision": 1,
+			"Metadata": {
+				"Name": "br-int",
+				"Type": "ovsbridge",
+				"MTU": "auto"
+			}
+		}
+	],
+	"Edges": [
+		{
+			"ID": "edge1",
+			"Parent": "node2",
+			"Child": "node1",
+			"Host": "host<1>",
+			"CreatedAt": 1500000000000,
+			"UpdatedAt": 1500000000000,
+			"Revision": 1,
+			"Metadata": {
+				"RelationType": "layer2 & <ownership>",
+				"Weight": 1.5
+			}
+		}
+	]
+}`
+
+func renderTestGraph(t *testing.T) ([]*graph.Node, []*graph.Edge) {
+	var elements struct {
+		Nodes []interface{}
+		Edges []interface{}
+	}
+	if err := common.JSONDecode(strings.NewReader(renderTestElements), &elements); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var nodes []*graph.Node
+	for _, obj := range elements.Nodes {
+		var n graph.Node
+		if err := n.Decode(obj); err != nil {
+			t.Fatal(err.Error())
+		}
+		nodes = append(nodes, &n)
+	}
+
+	var edges []*graph.Edge
+	for _, obj := range elements.Edges {
+		var e graph.Edge
+		if err := e.Decode(obj); err != nil {
+			t.Fatal(err.Error())
+		}
+		edges = append(edges, &e)
+	}
+
+	return nodes, edges
+}
+
+// the GEXF files are dated of their generation
+var gexfDate = regexp.MustCompile(`lastmodifieddate="[0-9-]+"`)
+
+func testRenderer(t *testing.T, mediaType string, golden string) []byte {
+	format := topologyFormatFromAccept("application/" + mediaType)
+	if format == nil {
+		t.Fatalf("No renderer for %s", mediaType)
+	}
+
+	nodes, edges := renderTestGraph(t)
+
+	var buffer bytes.Buffer
+	if err := format.render(&buffer, nodes, edges); err != nil {
+		t.Fatal(err.Error())
+	}
+	got := gexfDate.ReplaceAll(buffer.Bytes(), []byte(`lastmodifieddate="2017-07-14"`))
+
+	path := filepath.Join("testdata", golden)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Expected %s, got:\n%s", path, string(got))
+	}
+
+	return got
+}
+
+func TestRenderGraphML(t *testing.T) {
+	b := testRenderer(t, "graphml", "topology.graphml")
+
+	// the escaped values are read back as they were
+	var doc graphML
+	if err := xml.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	values := make(map[string]string)
+	for _, data := range doc.Graph.Nodes[0].Data {
+		values[data.Key] = data.Value
+	}
+	for _, key := range doc.Keys {
+		if key.For == "node" {
+			values[key.Name] = values[key.ID]
+		}
+	}
+
+	if name := values["Name"]; name != `eth0 <"a" & 'b'>` {
+		t.Errorf("Expected the name to be escaped, got: %s", name)
+	}
+	if name := values["Ovs.Port.Name"]; name != "p&1" {
+		t.Errorf("Expected the nested metadata to be flattened, got: %s", name)
+	}
+}
+
+func TestRenderGEXF(t *testing.T) {
+	testRenderer(t, "gexf", "topology.gexf")
+}
+
+func TestRenderCytoscape(t *testing.T) {
+	testRenderer(t, "vnd.cytoscape", "topology.cytoscape.json")
+}
@@ -44,7 +44,10 @@ var Agent = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		config.GetConfig().Set("logging.id", "agent")
 		logging.GetLogger().Noticef("Skydive Agent %s starting...", version.Version)
-		agent := agent.NewAgent()
+		agent, err := agent.NewAgent()
+		if err != nil {
+			logging.GetLogger().Fatalf("Can't start Skydive Agent: %v", err)
+		}
 		agent.Start()
 
 		logging.GetLogger().Notice("Skydive Agent started")
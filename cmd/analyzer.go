@@ -62,4 +62,6 @@ var Analyzer = &cobra.Command{
 func init() {
 	Analyzer.Flags().String("listen", "127.0.0.1:8082", "address and port for the analyzer API")
 	config.GetConfig().BindPFlag("analyzer.listen", Analyzer.Flags().Lookup("listen"))
+	Analyzer.Flags().Bool("offline", false, "read only topology, loaded from imported snapshots")
+	config.GetConfig().BindPFlag("analyzer.offline", Analyzer.Flags().Lookup("offline"))
 }
@@ -47,14 +47,12 @@ type GremlinQueryHelper struct {
 	authOptions *shttp.AuthenticationOpts
 }
 
-// Request send a Gremlin request to the topology API
-func (g *GremlinQueryHelper) Request(query string, header http.Header) (*http.Response, error) {
+func (g *GremlinQueryHelper) request(gq api.TopologyParam, header http.Header) (*http.Response, error) {
 	client, err := api.NewRestClientFromConfig(g.authOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	gq := api.TopologyParam{GremlinQuery: query}
 	s, err := json.Marshal(gq)
 	if err != nil {
 		return nil, err
@@ -65,9 +63,8 @@ func (g *GremlinQueryHelper) Request(query string, header http.Header) (*http.Re
 	return client.Request("POST", "api/topology", contentReader, header)
 }
 
-// Query the topology API
-func (g *GremlinQueryHelper) Query(query string, values interface{}) error {
-	resp, err := g.Request(query, nil)
+func (g *GremlinQueryHelper) query(gq api.TopologyParam, values interface{}) error {
+	resp, err := g.request(gq, nil)
 	if err != nil {
 		return err
 	}
@@ -85,6 +82,31 @@ func (g *GremlinQueryHelper) Query(query string, values interface{}) error {
 	return nil
 }
 
+// Request send a Gremlin request to the topology API
+func (g *GremlinQueryHelper) Request(query string, header http.Header) (*http.Response, error) {
+	return g.request(api.TopologyParam{GremlinQuery: query}, header)
+}
+
+// Query the topology API
+func (g *GremlinQueryHelper) Query(query string, values interface{}) error {
+	return g.query(api.TopologyParam{GremlinQuery: query}, values)
+}
+
+// QueryWithBindings queries the topology API, the identifiers used in the query
+// are replaced by their value in bindings
+func (g *GremlinQueryHelper) QueryWithBindings(query string, bindings map[string]interface{}, values interface{}) error {
+	return g.query(api.TopologyParam{GremlinQuery: query, Bindings: bindings}, values)
+}
+
+// Explain the Gremlin query, returns the result along with the execution profile
+func (g *GremlinQueryHelper) Explain(query string) (*api.TopologyExplain, error) {
+	explain := &api.TopologyExplain{}
+	if err := g.query(api.TopologyParam{GremlinQuery: query, Explain: true}, explain); err != nil {
+		return nil, err
+	}
+	return explain, nil
+}
+
 // GetNodes from the Gremlin query
 func (g *GremlinQueryHelper) GetNodes(query string) ([]*graph.Node, error) {
 	var values []interface{}
@@ -24,17 +24,27 @@ package client
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 
 	"github.com/spf13/cobra"
 
+	"github.com/skydive-project/skydive/api"
 	"github.com/skydive-project/skydive/logging"
 )
 
 var (
 	gremlinQuery string
 	outputFormat string
+	explain      bool
+	diffFrom     string
+	diffTo       string
+	diffHost     string
+	snapshotFile string
+	replayFile   string
+	replaySpeed  float64
 )
 
 // TopologyCmd skydive topology root command
@@ -53,6 +63,18 @@ var TopologyRequest = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		queryHelper := NewGremlinQueryHelper(&AuthenticationOpts)
 
+		if explain {
+			if outputFormat != "json" {
+				logging.GetLogger().Fatalf("Explain mode only supports the json output format")
+			}
+			result, err := queryHelper.Explain(gremlinQuery)
+			if err != nil {
+				logging.GetLogger().Fatalf(err.Error())
+			}
+			printJSON(result)
+			return
+		}
+
 		switch outputFormat {
 		case "json":
 			var value interface{}
@@ -60,9 +82,9 @@ var TopologyRequest = &cobra.Command{
 				logging.GetLogger().Fatalf(err.Error())
 			}
 			printJSON(value)
-		case "dot":
+		case "dot", "graphml", "gexf", "cytoscape":
 			header := make(http.Header)
-			header.Set("Accept", "vnd.graphviz")
+			header.Set("Accept", formatMediaTypes[outputFormat])
 			resp, err := queryHelper.Request(gremlinQuery, header)
 			if err != nil {
 				logging.GetLogger().Fatalf(err.Error())
@@ -76,6 +98,150 @@ var TopologyRequest = &cobra.Command{
 	},
 }
 
+var formatMediaTypes = map[string]string{
+	"dot":       "vnd.graphviz",
+	"graphml":   "application/graphml+xml",
+	"gexf":      "application/gexf+xml",
+	"cytoscape": "application/vnd.cytoscape+json",
+}
+
+// TopologyDiff skydive topology diff command
+var TopologyDiff = &cobra.Command{
+	Use:   "diff",
+	Short: "changes of the topology between two points in time",
+	Long:  "changes of the topology between two points in time",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if diffFrom == "" {
+			logging.GetLogger().Fatalf("--from is required")
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		bindings := map[string]interface{}{"from": diffFrom}
+		query := "G.Diff(from)"
+		if diffTo != "" {
+			bindings["to"] = diffTo
+			query = "G.Diff(from, to)"
+		}
+		if diffHost != "" {
+			bindings["host"] = diffHost
+			query += ".Has('Host', host)"
+		}
+
+		var value interface{}
+		queryHelper := NewGremlinQueryHelper(&AuthenticationOpts)
+		if err := queryHelper.QueryWithBindings(query, bindings, &value); err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+		printJSON(value)
+	},
+}
+
+// TopologyExport skydive topology export command
+var TopologyExport = &cobra.Command{
+	Use:   "export",
+	Short: "export a snapshot of the topology",
+	Long:  "export a snapshot of the topology",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := api.NewRestClientFromConfig(&AuthenticationOpts)
+		if err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+
+		resp, err := client.Request("GET", "api/topology/export", nil, nil)
+		if err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			data, _ := ioutil.ReadAll(resp.Body)
+			logging.GetLogger().Fatalf("%s: %s", resp.Status, string(data))
+		}
+
+		out := os.Stdout
+		if snapshotFile != "" {
+			if out, err = os.Create(snapshotFile); err != nil {
+				logging.GetLogger().Fatalf(err.Error())
+			}
+			defer out.Close()
+		}
+
+		if _, err = io.Copy(out, resp.Body); err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+	},
+}
+
+// TopologyImport skydive topology import command
+var TopologyImport = &cobra.Command{
+	Use:   "import",
+	Short: "import a snapshot of the topology into an offline analyzer",
+	Long:  "import a snapshot of the topology into an offline analyzer",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if snapshotFile == "" {
+			logging.GetLogger().Fatalf("--file is required")
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(snapshotFile)
+		if err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+		defer f.Close()
+
+		client, err := api.NewRestClientFromConfig(&AuthenticationOpts)
+		if err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+
+		resp, err := client.Request("POST", "api/topology/import", f, nil)
+		if err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			data, _ := ioutil.ReadAll(resp.Body)
+			logging.GetLogger().Fatalf("%s: %s", resp.Status, string(data))
+		}
+	},
+}
+
+// TopologyReplay skydive topology replay command
+var TopologyReplay = &cobra.Command{
+	Use:   "replay",
+	Short: "replay recorded graph events into an offline analyzer",
+	Long:  "replay recorded graph events into an offline analyzer",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if replayFile == "" {
+			logging.GetLogger().Fatalf("--file is required")
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(replayFile)
+		if err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+		defer f.Close()
+
+		client, err := api.NewRestClientFromConfig(&AuthenticationOpts)
+		if err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+
+		resp, err := client.Request("POST", fmt.Sprintf("api/topology/replay?speed=%g", replaySpeed), f, nil)
+		if err != nil {
+			logging.GetLogger().Fatalf(err.Error())
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted {
+			data, _ := ioutil.ReadAll(resp.Body)
+			logging.GetLogger().Fatalf("%s: %s", resp.Status, string(data))
+		}
+	},
+}
+
 func addTopologyFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&gremlinQuery, "gremlin", "", "", "Gremlin Query")
 }
@@ -83,5 +249,21 @@ func addTopologyFlags(cmd *cobra.Command) {
 func init() {
 	TopologyCmd.AddCommand(TopologyRequest)
 	TopologyRequest.Flags().StringVarP(&gremlinQuery, "gremlin", "", "G", "Gremlin Query")
-	TopologyRequest.Flags().StringVarP(&outputFormat, "format", "", "json", "Output format (json or dot)")
+	TopologyRequest.Flags().StringVarP(&outputFormat, "format", "", "json", "Output format (json, dot, graphml, gexf or cytoscape)")
+	TopologyRequest.Flags().BoolVarP(&explain, "explain", "", false, "Report the execution profile of the query along with its result")
+
+	TopologyCmd.AddCommand(TopologyDiff)
+	TopologyDiff.Flags().StringVarP(&diffFrom, "from", "", "", "Start of the diff, in RFC1123 format or as a duration relative to now, ie: -1h")
+	TopologyDiff.Flags().StringVarP(&diffTo, "to", "", "", "End of the diff, in RFC1123 format or as a duration relative to now, defaults to now")
+	TopologyDiff.Flags().StringVarP(&diffHost, "host", "", "", "Only report the changes of the nodes and edges of this host")
+
+	TopologyCmd.AddCommand(TopologyExport)
+	TopologyExport.Flags().StringVarP(&snapshotFile, "file", "", "", "Snapshot file, standard output by default")
+
+	TopologyCmd.AddCommand(TopologyImport)
+	TopologyImport.Flags().StringVarP(&snapshotFile, "file", "", "", "Snapshot file")
+
+	TopologyCmd.AddCommand(TopologyReplay)
+	TopologyReplay.Flags().StringVarP(&replayFile, "file", "", "", "File of recorded graph events")
+	TopologyReplay.Flags().Float64VarP(&replaySpeed, "speed", "", 1, "Replay speed factor, 0 to replay as fast as possible")
 }
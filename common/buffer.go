@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+)
+
+// BufferStats describes the state of a Buffer
+type BufferStats struct {
+	Memory   int
+	Disk     int
+	Buffered int64
+	Replayed int64
+	Dropped  int64
+}
+
+// Buffer is a bounded FIFO queue of items kept in memory, the items exceeding
+// the memory capacity are spilled to a file if set. New items are dropped
+// once the buffer is full.
+type Buffer struct {
+	sync.Mutex
+	memory    [][]byte
+	maxMemory int
+	file      *os.File
+	maxDisk   int
+	disk      int
+	readOff   int64
+	writeOff  int64
+	stats     BufferStats
+}
+
+// Len returns the number of items in the buffer
+func (b *Buffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return len(b.memory) + b.disk
+}
+
+// Push adds an item at the end of the buffer, returns false if the item was
+// dropped
+func (b *Buffer) Push(item []byte) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	// once spilled, items go to the disk until it's drained to keep the order
+	if b.disk == 0 && len(b.memory) < b.maxMemory {
+		b.memory = append(b.memory, item)
+		b.stats.Buffered++
+		return true
+	}
+
+	if b.file != nil && b.disk < b.maxDisk {
+		record := make([]byte, 4+len(item))
+		binary.BigEndian.PutUint32(record, uint32(len(item)))
+		copy(record[4:], item)
+
+		if _, err := b.file.WriteAt(record, b.writeOff); err == nil {
+			b.writeOff += int64(len(record))
+			b.disk++
+			b.stats.Buffered++
+			return true
+		}
+	}
+
+	b.stats.Dropped++
+	return false
+}
+
+func (b *Buffer) peek() ([]byte, error) {
+	if len(b.memory) > 0 {
+		return b.memory[0], nil
+	}
+
+	var size [4]byte
+	if _, err := b.file.ReadAt(size[:], b.readOff); err != nil {
+		return nil, err
+	}
+
+	item := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := b.file.ReadAt(item, b.readOff+4); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (b *Buffer) remove(item []byte) {
+	b.stats.Replayed++
+
+	if len(b.memory) > 0 {
+		b.memory[0] = nil
+		b.memory = b.memory[1:]
+		return
+	}
+
+	b.readOff += int64(4 + len(item))
+	if b.disk--; b.disk == 0 {
+		b.readOff, b.writeOff = 0, 0
+		b.file.Truncate(0)
+	}
+}
+
+// Replay sends the items in order and removes them from the buffer, it stops
+// at the first item that send fails to send. Items can be pushed meanwhile
+// but only one replay must run at once.
+func (b *Buffer) Replay(send func(item []byte) error) error {
+	for {
+		b.Lock()
+		if len(b.memory)+b.disk == 0 {
+			b.Unlock()
+			return nil
+		}
+
+		item, err := b.peek()
+		b.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if err := send(item); err != nil {
+			return err
+		}
+
+		b.Lock()
+		b.remove(item)
+		b.Unlock()
+	}
+}
+
+// Stats returns the statistics of the buffer
+func (b *Buffer) Stats() BufferStats {
+	b.Lock()
+	defer b.Unlock()
+
+	stats := b.stats
+	stats.Memory = len(b.memory)
+	stats.Disk = b.disk
+	return stats
+}
+
+// Close the buffer and remove its file
+func (b *Buffer) Close() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+	b.memory, b.disk = nil, 0
+}
+
+// NewBuffer returns a buffer of maxMemory items in memory spilling up to
+// maxDisk items to the file at path, if path is not empty
+func NewBuffer(maxMemory int, path string, maxDisk int) (*Buffer, error) {
+	b := &Buffer{maxMemory: maxMemory, maxDisk: maxDisk}
+	if path != "" && maxDisk > 0 {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+		b.file = f
+	}
+	return b, nil
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func newTestBuffer(t *testing.T, maxMemory int, maxDisk int) (*Buffer, func()) {
+	dir, err := ioutil.TempDir("", "skydive-buffer")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	b, err := NewBuffer(maxMemory, filepath.Join(dir, "test.buf"), maxDisk)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return b, func() {
+		b.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func pushItems(b *Buffer, from, to int) (pushed int) {
+	for i := from; i < to; i++ {
+		if b.Push([]byte(strconv.Itoa(i))) {
+			pushed++
+		}
+	}
+	return
+}
+
+func replayItems(t *testing.T, b *Buffer) (items []string) {
+	if err := b.Replay(func(item []byte) error {
+		items = append(items, string(item))
+		return nil
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	return
+}
+
+func checkItems(t *testing.T, items []string, from, to int) {
+	if len(items) != to-from {
+		t.Fatalf("Expected %d items, got: %v", to-from, items)
+	}
+	for i, item := range items {
+		if item != strconv.Itoa(from+i) {
+			t.Fatalf("Expected items from %d to %d in order, got: %v", from, to-1, items)
+		}
+	}
+}
+
+func TestBufferSpillOrder(t *testing.T) {
+	b, cleanup := newTestBuffer(t, 3, 10)
+	defer cleanup()
+
+	if n := pushItems(b, 0, 8); n != 8 {
+		t.Fatalf("Expected 8 items buffered, got: %d", n)
+	}
+
+	if stats := b.Stats(); stats.Memory != 3 || stats.Disk != 5 {
+		t.Errorf("Expected 3 items in memory and 5 on disk, got: %+v", stats)
+	}
+
+	checkItems(t, replayItems(t, b), 0, 8)
+
+	// the file is reused once drained
+	pushItems(b, 8, 16)
+	checkItems(t, replayItems(t, b), 8, 16)
+
+	if stats := b.Stats(); b.Len() != 0 || stats.Buffered != 16 || stats.Replayed != 16 {
+		t.Errorf("Expected 16 items buffered and replayed, got: %+v", stats)
+	}
+}
+
+func TestBufferSpillWhileReplaying(t *testing.T) {
+	b, cleanup := newTestBuffer(t, 2, 10)
+	defer cleanup()
+
+	pushItems(b, 0, 3)
+
+	// items pushed while the memory is drained still follow the spilled ones
+	var items []string
+	b.Replay(func(item []byte) error {
+		items = append(items, string(item))
+		if len(items) == 1 {
+			pushItems(b, 3, 5)
+		}
+		return nil
+	})
+
+	checkItems(t, items, 0, 5)
+}
+
+func TestBufferOverflow(t *testing.T) {
+	b, cleanup := newTestBuffer(t, 2, 3)
+	defer cleanup()
+
+	if n := pushItems(b, 0, 8); n != 5 {
+		t.Fatalf("Expected 5 items buffered, got: %d", n)
+	}
+
+	if stats := b.Stats(); stats.Dropped != 3 {
+		t.Errorf("Expected 3 items dropped, got: %+v", stats)
+	}
+
+	// the newest items are dropped
+	checkItems(t, replayItems(t, b), 0, 5)
+
+	// memory only
+	b, err := NewBuffer(2, "", 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if n := pushItems(b, 0, 3); n != 2 || b.Stats().Dropped != 1 {
+		t.Errorf("Expected 2 items buffered and 1 dropped, got: %d, %+v", n, b.Stats())
+	}
+}
+
+func TestBufferPartialReplay(t *testing.T) {
+	b, cleanup := newTestBuffer(t, 2, 10)
+	defer cleanup()
+
+	pushItems(b, 0, 6)
+
+	// the send fails on the memory then on the disk items
+	for _, failAt := range []int{1, 3} {
+		var items []string
+		err := b.Replay(func(item []byte) error {
+			if len(items) == failAt {
+				return errors.New("Send failure")
+			}
+			items = append(items, string(item))
+			return nil
+		})
+
+		if err == nil {
+			t.Fatal("The replay should fail")
+		}
+
+		from := 6 - b.Len() - len(items)
+		checkItems(t, items, from, from+failAt)
+	}
+
+	// the item that failed is replayed first
+	if b.Len() != 2 {
+		t.Fatalf("Expected 2 items left, got: %d", b.Len())
+	}
+	pushItems(b, 6, 8)
+	checkItems(t, replayItems(t, b), 4, 8)
+}
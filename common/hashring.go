@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// HashRing implements consistent hashing, a key is owned by the first member
+// found after the hash of the key on the ring. Each member is placed several
+// times on the ring so that the keys are evenly spread, only the keys of a
+// member move when it joins or leaves.
+type HashRing struct {
+	sync.RWMutex
+	replicas int
+	hashes   uint32Slice
+	owners   map[uint32]string
+}
+
+// SetMembers replaces the members of the ring
+func (r *HashRing) SetMembers(members []string) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.hashes = r.hashes[:0]
+	r.owners = make(map[uint32]string)
+	for _, member := range members {
+		for i := 0; i != r.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + member))
+			if _, ok := r.owners[h]; ok {
+				continue
+			}
+			r.owners[h] = member
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Sort(r.hashes)
+}
+
+// Owners returns the members in the order they own the key, the first one
+// is the owner, the next ones take over if it leaves
+func (r *HashRing) Owners(key string) []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.hashes) == 0 {
+		return nil
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	var owners []string
+	seen := make(map[string]bool)
+	for i := 0; i != len(r.hashes); i++ {
+		owner := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if !seen[owner] {
+			seen[owner] = true
+			owners = append(owners, owner)
+		}
+	}
+
+	return owners
+}
+
+// NewHashRing returns a ring placing replicas points per member
+func NewHashRing(replicas int) *HashRing {
+	return &HashRing{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ringOwners(r *HashRing, keys int) map[string]string {
+	owners := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("host-%d", i)
+		owners[key] = r.Owners(key)[0]
+	}
+	return owners
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	r := NewHashRing(128)
+	if owners := r.Owners("host"); owners != nil {
+		t.Fatalf("Expected no owner, got: %v", owners)
+	}
+
+	members := []string{"analyzer1", "analyzer2", "analyzer3", "analyzer4"}
+	r.SetMembers(members)
+
+	count := make(map[string]int)
+	for _, owner := range ringOwners(r, 10000) {
+		count[owner]++
+	}
+
+	// each member owns roughly a quarter of the keys
+	for _, member := range members {
+		if count[member] < 1500 || count[member] > 3500 {
+			t.Errorf("Expected about 2500 keys per member, got: %v", count)
+		}
+	}
+
+	// all the members are listed once as fallback
+	owners := r.Owners("host-1")
+	if len(owners) != len(members) {
+		t.Fatalf("Expected all the members as owners, got: %v", owners)
+	}
+	seen := make(map[string]bool)
+	for _, owner := range owners {
+		if seen[owner] {
+			t.Errorf("Expected the owners only once, got: %v", owners)
+		}
+		seen[owner] = true
+	}
+}
+
+func TestHashRingKeyMovement(t *testing.T) {
+	r := NewHashRing(128)
+	r.SetMembers([]string{"analyzer1", "analyzer2", "analyzer3", "analyzer4"})
+	before := ringOwners(r, 10000)
+
+	// only the keys taken over by the new member move
+	r.SetMembers([]string{"analyzer1", "analyzer2", "analyzer3", "analyzer4", "analyzer5"})
+	after := ringOwners(r, 10000)
+
+	moved := 0
+	for key, owner := range after {
+		if owner != before[key] {
+			if owner != "analyzer5" {
+				t.Fatalf("Key %s moved from %s to %s", key, before[key], owner)
+			}
+			moved++
+		}
+	}
+	if moved < 1000 || moved > 3000 {
+		t.Errorf("Expected about 2000 keys to move to the new member, got: %d", moved)
+	}
+
+	// only the keys of the leaving member move, to their next owner
+	r.SetMembers([]string{"analyzer1", "analyzer3", "analyzer4", "analyzer5"})
+	for key, owner := range ringOwners(r, 10000) {
+		if previous := after[key]; owner != previous && previous != "analyzer2" {
+			t.Fatalf("Key %s moved from %s to %s", key, previous, owner)
+		}
+	}
+
+	// the next owner is the fallback listed by the ring before
+	r.SetMembers([]string{"analyzer1", "analyzer2", "analyzer3", "analyzer4", "analyzer5"})
+	fallback := make(map[string]string)
+	for key, owner := range after {
+		if owner == "analyzer2" {
+			fallback[key] = r.Owners(key)[1]
+		}
+	}
+	r.SetMembers([]string{"analyzer1", "analyzer3", "analyzer4", "analyzer5"})
+	for key, next := range fallback {
+		if owner := r.Owners(key)[0]; owner != next {
+			t.Errorf("Expected %s to move to %s, got: %s", key, next, owner)
+		}
+	}
+}
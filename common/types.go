@@ -301,6 +301,31 @@ func SetField(obj map[string]interface{}, k string, v interface{}) bool {
 	return true
 }
 
+var stringMapType = reflect.TypeOf(map[string]interface{}{})
+
+// ToStringMap returns i as a map[string]interface{} when i is a map whose
+// keys are strings, like the named map types of the metadata
+func ToStringMap(i interface{}) (map[string]interface{}, bool) {
+	if m, ok := i.(map[string]interface{}); ok {
+		return m, true
+	}
+
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+
+	if v.Type().ConvertibleTo(stringMapType) {
+		return v.Convert(stringMapType).Interface().(map[string]interface{}), true
+	}
+
+	m := make(map[string]interface{}, v.Len())
+	for _, key := range v.MapKeys() {
+		m[key.String()] = v.MapIndex(key).Interface()
+	}
+	return m, true
+}
+
 // GetField retrieve a value from a tree from the dot key like "a.b.c.d"
 func GetField(obj map[string]interface{}, k string) (interface{}, error) {
 	components := strings.Split(k, ".")
@@ -317,9 +342,8 @@ func GetField(obj map[string]interface{}, k string) (interface{}, error) {
 		if list, ok := i.([]interface{}); ok {
 			var results []interface{}
 			for _, v := range list {
-				switch v := v.(type) {
-				case map[string]interface{}:
-					if obj, err := GetField(v, strings.Join(components[n+1:], ".")); err == nil {
+				if m, ok := ToStringMap(v); ok {
+					if obj, err := GetField(m, strings.Join(components[n+1:], ".")); err == nil {
 						results = append(results, obj)
 					}
 				}
@@ -327,8 +351,8 @@ func GetField(obj map[string]interface{}, k string) (interface{}, error) {
 			return results, nil
 		}
 
-		if obj, ok = i.(map[string]interface{}); !ok {
-			return nil, fmt.Errorf("%s is not a map, but a %+v", component, reflect.TypeOf(obj))
+		if obj, ok = ToStringMap(i); !ok {
+			return nil, fmt.Errorf("%s is not a map, but a %+v", component, reflect.TypeOf(i))
 		}
 	}
 
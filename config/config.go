@@ -56,6 +56,7 @@ func init() {
 	cfg.SetDefault("ovs.ovsdb", "unix:///var/run/openvswitch/db.sock")
 	cfg.SetDefault("graph.backend", "memory")
 	cfg.SetDefault("graph.gremlin", "ws://127.0.0.1:8182")
+	cfg.SetDefault("graph.recorder.flush_interval", 1)
 	cfg.SetDefault("sflow.port_min", 6345)
 	cfg.SetDefault("sflow.port_max", 6355)
 	cfg.SetDefault("flow.expire", 600)
@@ -63,6 +64,9 @@ func init() {
 	cfg.SetDefault("analyzer.listen", "127.0.0.1:8082")
 	cfg.SetDefault("analyzer.storage.bulk_insert", 100)
 	cfg.SetDefault("analyzer.storage.bulk_insert_deadline", 5)
+	cfg.SetDefault("analyzer.gremlin_timeout", 30)
+	cfg.SetDefault("analyzer.subscription.update_interval", 1)
+	cfg.SetDefault("analyzer.federation.query_timeout", 10)
 	cfg.SetDefault("storage.elasticsearch.host", "127.0.0.1:9200")
 	cfg.SetDefault("storage.elasticsearch.maxconns", 10)
 	cfg.SetDefault("storage.elasticsearch.retry", 60)
@@ -71,6 +75,9 @@ func init() {
 	cfg.SetDefault("ws_pong_timeout", 5)
 	cfg.SetDefault("ws_bulk_maxmsgs", 100)
 	cfg.SetDefault("ws_bulk_maxdelay", 1)
+	cfg.SetDefault("ws_encoding", "json")
+	cfg.SetDefault("ws_queue_size", 10000)
+	cfg.SetDefault("ws_queue_policy", "disconnect")
 	cfg.SetDefault("docker.url", "unix:///var/run/docker.sock")
 	cfg.SetDefault("netns.run_path", "/var/run/netns")
 	cfg.SetDefault("etcd.data_dir", "/var/lib/skydive/etcd")
@@ -93,6 +100,16 @@ func init() {
 	cfg.SetDefault("agent.X509_servername", "")
 	cfg.SetDefault("opencontrail.mpls_udp_port", 51234)
 	cfg.SetDefault("agent.flow.stats_update", 1)
+	cfg.SetDefault("agent.buffer.memory_items", 10000)
+	cfg.SetDefault("agent.flow.transport", "datagram")
+	cfg.SetDefault("agent.flow.stream.batch_size", 100)
+	cfg.SetDefault("agent.flow.stream.window", 8)
+	cfg.SetDefault("agent.flow.stream.ack_timeout", 10)
+	cfg.SetDefault("analyzer.flow_stream.max_window", 32)
+	cfg.SetDefault("agent.buffer.disk_items", 100000)
+	cfg.SetDefault("agent.placement", "random")
+	cfg.SetDefault("agent.topology.tid.generations", false)
+	cfg.SetDefault("agent.topology.tid.retention", 604800)
 	cfg.SetDefault("analyzer.bandwidth_source", "netlink")
 	cfg.SetDefault("analyzer.bandwidth_threshold", "relative")
 	cfg.SetDefault("analyzer.bandwidth_update_rate", 5)
@@ -150,13 +167,13 @@ func checkViperSupportedExts(ext string) bool {
 	return false
 }
 
-// InitConfig with a backend
-func InitConfig(backend string, paths []string) error {
-	if len(paths) == 0 {
-		return fmt.Errorf("Empty configuration path")
-	}
+var (
+	cfgBackend string
+	cfgPaths   []string
+)
 
-	cfg.SetConfigType("yaml")
+func readConfig(v *viper.Viper, backend string, paths []string) error {
+	v.SetConfigType("yaml")
 
 	switch backend {
 	case "file":
@@ -165,7 +182,9 @@ func InitConfig(backend string, paths []string) error {
 			if err != nil {
 				return err
 			}
-			if err := cfg.MergeConfig(configFile); err != nil {
+			err = v.MergeConfig(configFile)
+			configFile.Close()
+			if err != nil {
 				return err
 			}
 		}
@@ -178,19 +197,47 @@ func InitConfig(backend string, paths []string) error {
 		if err != nil {
 			return err
 		}
-		if err := cfg.AddRemoteProvider("etcd", fmt.Sprintf("%s://%s", u.Scheme, u.Host), u.Path); err != nil {
+		if err := v.AddRemoteProvider("etcd", fmt.Sprintf("%s://%s", u.Scheme, u.Host), u.Path); err != nil {
 			return err
 		}
-		if err := cfg.ReadRemoteConfig(); err != nil {
+		if err := v.ReadRemoteConfig(); err != nil {
 			return err
 		}
 	default:
 		return fmt.Errorf("Invalid backend: %s", backend)
 	}
 
+	return nil
+}
+
+// InitConfig with a backend
+func InitConfig(backend string, paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("Empty configuration path")
+	}
+
+	if err := readConfig(cfg, backend, paths); err != nil {
+		return err
+	}
+	cfgBackend, cfgPaths = backend, paths
+
 	return checkConfig()
 }
 
+// ReadConfig reads the configuration again from its backend, without the
+// defaults. The current configuration is left untouched.
+func ReadConfig() (*viper.Viper, error) {
+	if cfgBackend == "" {
+		return nil, errors.New("Configuration not initialized")
+	}
+
+	v := viper.New()
+	if err := readConfig(v, cfgBackend, cfgPaths); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
 // GetConfig get current config
 func GetConfig() *viper.Viper {
 	return cfg
@@ -241,10 +288,27 @@ func GetEtcdServerAddrs() []string {
 	if len(etcdServers) > 0 {
 		return etcdServers
 	}
-	if addresse, err := GetOneAnalyzerServiceAddress(); err == nil {
-		return []string{"http://" + addresse.Addr + ":2379"}
+
+	// the embedded servers listen on the same port on every analyzer
+	port := 2379
+	if sa, err := common.ServiceAddressFromString(GetConfig().GetString("etcd.listen")); err == nil && sa.Port != 0 {
+		port = sa.Port
 	}
-	return []string{"http://localhost:2379"}
+
+	// the analyzers form an embedded etcd cluster only when peers are
+	// defined, use all of them
+	if len(GetConfig().GetStringMapString("etcd.peers")) > 0 {
+		if addresses, err := GetAnalyzerServiceAddresses(); err == nil && len(addresses) > 0 {
+			for _, sa := range addresses {
+				etcdServers = append(etcdServers, fmt.Sprintf("http://%s:%d", sa.Addr, port))
+			}
+			return etcdServers
+		}
+	} else if sa, err := GetOneAnalyzerServiceAddress(); err == nil {
+		return []string{fmt.Sprintf("http://%s:%d", sa.Addr, port)}
+	}
+
+	return []string{fmt.Sprintf("http://localhost:%d", port)}
 }
 
 // IsTLSenabled return true is the analyzer certificates are set
@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package config
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestGetEtcdServerAddrs(t *testing.T) {
+	defer cfg.Set("analyzers", nil)
+	defer cfg.Set("etcd.listen", cfg.GetString("etcd.listen"))
+	defer cfg.Set("etcd.peers", nil)
+
+	cfg.Set("etcd.listen", "0.0.0.0:12379")
+	if addrs := GetEtcdServerAddrs(); !reflect.DeepEqual(addrs, []string{"http://localhost:12379"}) {
+		t.Errorf("Expected the local server on the listen port, got: %v", addrs)
+	}
+
+	// without peers the analyzers run their own server, only one is used
+	cfg.Set("analyzers", []string{"10.0.0.1:8082", "10.0.0.2:8082"})
+	addrs := GetEtcdServerAddrs()
+	if len(addrs) != 1 || (addrs[0] != "http://10.0.0.1:12379" && addrs[0] != "http://10.0.0.2:12379") {
+		t.Errorf("Expected one analyzer server, got: %v", addrs)
+	}
+
+	cfg.Set("etcd.peers", map[string]string{
+		"analyzer1": "http://10.0.0.1:2380",
+		"analyzer2": "http://10.0.0.2:2380",
+	})
+	addrs = GetEtcdServerAddrs()
+	sort.Strings(addrs)
+	if !reflect.DeepEqual(addrs, []string{"http://10.0.0.1:12379", "http://10.0.0.2:12379"}) {
+		t.Errorf("Expected the servers of all the analyzers, got: %v", addrs)
+	}
+
+	cfg.Set("etcd.servers", []string{"http://etcd:2379"})
+	defer cfg.Set("etcd.servers", nil)
+	if addrs := GetEtcdServerAddrs(); !reflect.DeepEqual(addrs, []string{"http://etcd:2379"}) {
+		t.Errorf("Expected the configured servers, got: %v", addrs)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package etcd
+
+import (
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/logging"
+)
+
+const (
+	// AnalyzersMembershipPath is where the analyzers register themselves
+	AnalyzersMembershipPath = "/members/analyzer"
+	membershipTTL           = time.Second * 30
+)
+
+// EtcdMembershipListener is notified when members join or leave
+type EtcdMembershipListener interface {
+	OnMembersChanged(members []string)
+}
+
+// EtcdMembership keeps track of the members registered under a path, a
+// member is registered with a TTL as long as it is alive
+type EtcdMembership struct {
+	sync.RWMutex
+	EtcdKeyAPI etcd.KeysAPI
+	Host       string
+	path       string
+	members    []string
+	listeners  []EtcdMembershipListener
+	register   bool
+	cancel     context.CancelFunc
+	quit       chan bool
+	state      int64
+	wg         sync.WaitGroup
+}
+
+// Members returns the sorted list of the members
+func (m *EtcdMembership) Members() []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.members
+}
+
+// AddListener registers a new listener
+func (m *EtcdMembership) AddListener(l EtcdMembershipListener) {
+	m.Lock()
+	m.listeners = append(m.listeners, l)
+	m.Unlock()
+}
+
+// Register makes the host a member once started
+func (m *EtcdMembership) Register() {
+	m.register = true
+}
+
+func (m *EtcdMembership) list() ([]string, uint64, error) {
+	resp, err := m.EtcdKeyAPI.Get(context.Background(), m.path, &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		if cerr, ok := err.(etcd.Error); ok && cerr.Code == etcd.ErrorCodeKeyNotFound {
+			return nil, cerr.Index, nil
+		}
+		return nil, 0, err
+	}
+
+	var members []string
+	for _, node := range resp.Node.Nodes {
+		members = append(members, path.Base(node.Key))
+	}
+	sort.Strings(members)
+
+	return members, resp.Index, nil
+}
+
+func (m *EtcdMembership) setMembers(members []string) {
+	m.Lock()
+	if reflect.DeepEqual(m.members, members) {
+		m.Unlock()
+		return
+	}
+	m.members = members
+	listeners := m.listeners
+	m.Unlock()
+
+	logging.GetLogger().Infof("Members of %s: %v", m.path, members)
+	for _, l := range listeners {
+		l.OnMembersChanged(members)
+	}
+}
+
+// keepAlive refreshes the registration of the host until stopped
+func (m *EtcdMembership) keepAlive() {
+	defer m.wg.Done()
+
+	key := path.Join(m.path, m.Host)
+	setOptions := &etcd.SetOptions{TTL: membershipTTL}
+
+	tick := time.NewTicker(membershipTTL / 3)
+	defer tick.Stop()
+
+	for {
+		if _, err := m.EtcdKeyAPI.Set(context.Background(), key, m.Host, setOptions); err != nil {
+			logging.GetLogger().Errorf("Unable to register %s as member of %s: %s", m.Host, m.path, err.Error())
+		}
+
+		select {
+		case <-tick.C:
+		case <-m.quit:
+			m.EtcdKeyAPI.Delete(context.Background(), key, nil)
+			return
+		}
+	}
+}
+
+func (m *EtcdMembership) watch(ctx context.Context) {
+	defer m.wg.Done()
+
+	for atomic.LoadInt64(&m.state) == common.RunningState {
+		members, index, err := m.list()
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to list the members of %s: %s", m.path, err.Error())
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		m.setMembers(members)
+
+		// any change is followed by a new listing
+		watcher := m.EtcdKeyAPI.Watcher(m.path, &etcd.WatcherOptions{AfterIndex: index, Recursive: true})
+		if _, err := watcher.Next(ctx); err != nil && atomic.LoadInt64(&m.state) == common.RunningState {
+			logging.GetLogger().Errorf("Error while watching etcd: %s", err.Error())
+			time.Sleep(1 * time.Second)
+		}
+	}
+}
+
+// Start registering the host if requested and watching the members
+func (m *EtcdMembership) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	atomic.StoreInt64(&m.state, common.RunningState)
+
+	if m.register {
+		m.wg.Add(1)
+		go m.keepAlive()
+	}
+
+	m.wg.Add(1)
+	go m.watch(ctx)
+}
+
+// Stop watching and unregister the host
+func (m *EtcdMembership) Stop() {
+	if atomic.CompareAndSwapInt64(&m.state, common.RunningState, common.StoppingState) {
+		close(m.quit)
+		m.cancel()
+		m.wg.Wait()
+	}
+}
+
+// NewEtcdMembership returns the membership of the host under path
+func NewEtcdMembership(client *EtcdClient, path string, host string) *EtcdMembership {
+	return &EtcdMembership{
+		EtcdKeyAPI: client.KeysAPI,
+		Host:       host,
+		path:       path,
+		quit:       make(chan bool),
+	}
+}
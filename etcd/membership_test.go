@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package etcd
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// fakeKeysAPI is an in memory etcd keys API, watchers are woken up on any
+// change
+type fakeKeysAPI struct {
+	sync.Mutex
+	keys    map[string]string
+	index   uint64
+	changed chan struct{}
+}
+
+type fakeWatcher struct {
+	api   *fakeKeysAPI
+	after uint64
+}
+
+func (f *fakeKeysAPI) notify() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	node := &etcd.Node{Key: key, Dir: true}
+	for k, v := range f.keys {
+		if strings.HasPrefix(k, key+"/") {
+			node.Nodes = append(node.Nodes, &etcd.Node{Key: k, Value: v})
+		}
+	}
+
+	if len(node.Nodes) == 0 {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Message: "Key not found", Index: f.index}
+	}
+	return &etcd.Response{Action: "get", Node: node, Index: f.index}, nil
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.keys[key] = value
+	f.notify()
+	return &etcd.Response{Action: "set", Node: &etcd.Node{Key: key, Value: value}, Index: f.index}, nil
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.keys[key]; !ok {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Message: "Key not found", Index: f.index}
+	}
+	delete(f.keys, key)
+	f.notify()
+	return &etcd.Response{Action: "delete", Node: &etcd.Node{Key: key}, Index: f.index}, nil
+}
+
+func (f *fakeKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (f *fakeKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (f *fakeKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (f *fakeKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	return &fakeWatcher{api: f, after: opts.AfterIndex}
+}
+
+func (w *fakeWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	for {
+		w.api.Lock()
+		index, changed := w.api.index, w.api.changed
+		w.api.Unlock()
+
+		if index > w.after {
+			w.after = index
+			return &etcd.Response{Action: "set", Index: index}, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func newFakeKeysAPI() *fakeKeysAPI {
+	return &fakeKeysAPI{keys: make(map[string]string), changed: make(chan struct{})}
+}
+
+type fakeMembershipListener struct {
+	sync.Mutex
+	members []string
+}
+
+func (l *fakeMembershipListener) OnMembersChanged(members []string) {
+	l.Lock()
+	l.members = members
+	l.Unlock()
+}
+
+func waitForMembers(t *testing.T, l *fakeMembershipListener, expected []string) {
+	for i := 0; i < 100; i++ {
+		l.Lock()
+		members := l.members
+		l.Unlock()
+
+		if reflect.DeepEqual(members, expected) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Expected members %v", expected)
+}
+
+func newTestMembership(api etcd.KeysAPI, host string) *EtcdMembership {
+	return &EtcdMembership{
+		EtcdKeyAPI: api,
+		Host:       host,
+		path:       AnalyzersMembershipPath,
+		quit:       make(chan bool),
+	}
+}
+
+func TestEtcdMembership(t *testing.T) {
+	api := newFakeKeysAPI()
+
+	// an agent only watches the members
+	watcher := newTestMembership(api, "")
+	l := &fakeMembershipListener{}
+	watcher.AddListener(l)
+	watcher.Start()
+	defer watcher.Stop()
+
+	m1 := newTestMembership(api, "analyzer1")
+	m1.Register()
+	m1.Start()
+	defer m1.Stop()
+
+	m2 := newTestMembership(api, "analyzer2")
+	m2.Register()
+	m2.Start()
+
+	waitForMembers(t, l, []string{"analyzer1", "analyzer2"})
+	if members := m1.Members(); !reflect.DeepEqual(members, []string{"analyzer1", "analyzer2"}) {
+		t.Errorf("Expected the members to be listed by the analyzers too, got: %v", members)
+	}
+
+	// a stopped member unregisters itself
+	m2.Stop()
+	waitForMembers(t, l, []string{"analyzer1"})
+
+	api.Lock()
+	_, ok := api.keys[AnalyzersMembershipPath+"/analyzer2"]
+	api.Unlock()
+	if ok {
+		t.Error("Expected analyzer2 to be unregistered")
+	}
+
+	// no registered member at all
+	m1.Stop()
+	waitForMembers(t, l, nil)
+}
@@ -29,6 +29,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	etcd "github.com/coreos/etcd/client"
@@ -39,27 +41,117 @@ import (
 
 	"github.com/skydive-project/skydive/common"
 	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
 
 	"golang.org/x/net/context"
 )
 
 const (
-	memberName   = "skydive"
-	startTimeout = 10 * time.Second
+	memberName          = "skydive"
+	startTimeout        = 10 * time.Second
+	clusterStartTimeout = 60 * time.Second
+	reconcileInterval   = 30 * time.Second
 )
 
-// EmbeddedEtcd provides a single node etcd server.
+// EmbeddedEtcd provides an etcd server, either single node or member of a
+// cluster formed by the analyzers.
 type EmbeddedEtcd struct {
-	Port     int
-	listener net.Listener
-	server   *etcdserver.EtcdServer
-	dataDir  string
+	Port         int
+	Name         string
+	listener     net.Listener
+	peerListener net.Listener
+	server       *etcdserver.EtcdServer
+	membersAPI   etcd.MembersAPI
+	dataDir      string
+	peers        map[string]string
+	quit         chan bool
+	wg           sync.WaitGroup
 }
 
-// NewEmbeddedEtcd create a new embedded ETCD server
-func NewEmbeddedEtcd(sa common.ServiceAddress, dataDir string) (*EmbeddedEtcd, error) {
+func containsURL(urls []string, u string) bool {
+	for _, v := range urls {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+// hasData returns whether the member was already started with this data
+// directory, it then restarts from its WAL whatever the cluster config
+func hasData(dataDir string) bool {
+	_, err := os.Stat(filepath.Join(dataDir, "member", "wal"))
+	return err == nil
+}
+
+// joinCluster adds the member to the running cluster and returns the peer
+// URLs of the cluster members. No URL is returned if the cluster is not
+// reachable or if the member is part of the static cluster being bootstrapped.
+func joinCluster(mapi etcd.MembersAPI, name string, peerURL string) (types.URLsMap, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+
+	members, err := mapi.List(ctx)
+	if err != nil {
+		logging.GetLogger().Infof("No etcd cluster reachable, bootstrapping: %s", err.Error())
+		return nil, nil
+	}
+
+	var added bool
+	for _, m := range members {
+		if !containsURL(m.PeerURLs, peerURL) {
+			continue
+		}
+
+		switch {
+		case len(m.ClientURLs) == 0 && m.Name != "":
+			// static member not started yet
+			return nil, nil
+		case len(m.ClientURLs) == 0:
+			// added by an operator, not started yet
+			added = true
+		default:
+			// the member lost its data, it has to be replaced
+			logging.GetLogger().Warningf("Replacing etcd member %s which lost its data", m.Name)
+			if err := mapi.Remove(ctx, m.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !added {
+		logging.GetLogger().Infof("Adding etcd member %s to the cluster", name)
+		if _, err := mapi.Add(ctx, peerURL); err != nil {
+			return nil, err
+		}
+
+		if members, err = mapi.List(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	urlsMap := make(types.URLsMap)
+	for _, m := range members {
+		n := m.Name
+		if containsURL(m.PeerURLs, peerURL) {
+			n = name
+		} else if n == "" {
+			n = m.ID
+		}
+
+		if urlsMap[n], err = types.NewURLs(m.PeerURLs); err != nil {
+			return nil, err
+		}
+	}
+
+	return urlsMap, nil
+}
+
+// NewEmbeddedEtcd create a new embedded ETCD server, a member of the cluster
+// of the peers if any. The endpoints are used to join a running cluster.
+func NewEmbeddedEtcd(name string, sa common.ServiceAddress, peers map[string]string, endpoints []string, dataDir string) (*EmbeddedEtcd, error) {
 	var err error
-	se := &EmbeddedEtcd{Port: sa.Port}
+	se := &EmbeddedEtcd{Port: sa.Port, Name: name, peers: peers, quit: make(chan bool)}
 	se.listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", sa.Addr, sa.Port))
 	if err != nil {
 		return nil, err
@@ -73,27 +165,81 @@ func NewEmbeddedEtcd(sa common.ServiceAddress, dataDir string) (*EmbeddedEtcd, e
 	}
 
 	endpoint := fmt.Sprintf("http://%s:%d", sa.Addr, sa.Port)
-	peerURLs, err := types.NewURLs([]string{endpoint})
-	if err != nil {
-		se.Stop()
-		return nil, err
-	}
 
 	cfg := &etcdserver.ServerConfig{
-		Name:       memberName,
-		ClientURLs: clientURLs,
-		PeerURLs:   peerURLs,
-		DataDir:    dataDir,
-		InitialPeerURLsMap: types.URLsMap{
-			memberName: peerURLs,
-		},
+		Name:          name,
+		ClientURLs:    clientURLs,
+		DataDir:       dataDir,
 		NewCluster:    true,
 		TickMs:        100,
 		ElectionTicks: 10,
 	}
 
+	timeout := startTimeout
+	if len(peers) == 0 {
+		if cfg.PeerURLs, err = types.NewURLs([]string{endpoint}); err != nil {
+			se.Stop()
+			return nil, err
+		}
+		cfg.InitialPeerURLsMap = types.URLsMap{name: cfg.PeerURLs}
+	} else {
+		timeout = clusterStartTimeout
+
+		peerURL, ok := peers[name]
+		if !ok {
+			se.Stop()
+			return nil, fmt.Errorf("No etcd peer URL for member %s", name)
+		}
+
+		u, err := url.Parse(peerURL)
+		if err != nil {
+			se.Stop()
+			return nil, err
+		}
+
+		if se.peerListener, err = net.Listen("tcp", u.Host); err != nil {
+			se.Stop()
+			return nil, err
+		}
+
+		if cfg.PeerURLs, err = types.NewURLs([]string{peerURL}); err != nil {
+			se.Stop()
+			return nil, err
+		}
+
+		cfg.InitialPeerURLsMap = make(types.URLsMap)
+		for n, p := range peers {
+			if cfg.InitialPeerURLsMap[n], err = types.NewURLs([]string{p}); err != nil {
+				se.Stop()
+				return nil, err
+			}
+		}
+
+		if !hasData(dataDir) {
+			client, err := etcd.New(etcd.Config{
+				Endpoints:               endpoints,
+				Transport:               etcd.DefaultTransport,
+				HeaderTimeoutPerRequest: time.Second,
+			})
+			if err != nil {
+				se.Stop()
+				return nil, err
+			}
+
+			urlsMap, err := joinCluster(etcd.NewMembersAPI(client), name, peerURL)
+			if err != nil {
+				se.Stop()
+				return nil, err
+			}
+			if urlsMap != nil {
+				cfg.InitialPeerURLsMap, cfg.NewCluster = urlsMap, false
+			}
+		}
+	}
+
 	se.server, err = etcdserver.NewServer(cfg)
 	if err != nil {
+		se.Stop()
 		return nil, err
 	}
 
@@ -103,20 +249,27 @@ func NewEmbeddedEtcd(sa common.ServiceAddress, dataDir string) (*EmbeddedEtcd, e
 	go http.Serve(se.listener,
 		v2http.NewClientHandler(se.server, cfg.ReqTimeout()))
 
+	if se.peerListener != nil {
+		go http.Serve(se.peerListener, v2http.NewPeerHandler(se.server))
+	}
+
 	// Wait for etcd server to be ready
-	t := time.Now().Add(startTimeout)
+	t := time.Now().Add(timeout)
 	etcdClient, err := etcd.New(etcd.Config{
 		Endpoints:               []string{endpoint},
 		Transport:               etcd.DefaultTransport,
 		HeaderTimeoutPerRequest: time.Second,
 	})
 	if err != nil {
+		se.Stop()
 		return nil, err
 	}
 	kapi := etcd.NewKeysAPI(etcdClient)
+	se.membersAPI = etcd.NewMembersAPI(etcdClient)
 
 	for {
 		if time.Now().After(t) {
+			se.Stop()
 			return nil, errors.New("Failed to start etcd")
 		}
 		if _, err := kapi.Set(context.Background(), "/skydive", "", nil); err == nil {
@@ -125,9 +278,91 @@ func NewEmbeddedEtcd(sa common.ServiceAddress, dataDir string) (*EmbeddedEtcd, e
 		time.Sleep(time.Second)
 	}
 
+	if len(peers) != 0 {
+		se.wg.Add(1)
+		go se.reconcile()
+	}
+
 	return se, nil
 }
 
+func containsPeer(peers map[string]string, urls []string) bool {
+	for _, p := range peers {
+		if containsURL(urls, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeMembers removes the members of the cluster which were removed from
+// the peer list. The members which joined the cluster without being listed,
+// are kept.
+func removeMembers(mapi etcd.MembersAPI, previous, peers map[string]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+
+	members, err := mapi.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range members {
+		if containsPeer(previous, m.PeerURLs) && !containsPeer(peers, m.PeerURLs) {
+			logging.GetLogger().Infof("Removing etcd member %s %v, removed from the peer list", m.Name, m.PeerURLs)
+			if err := mapi.Remove(ctx, m.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readPeers reads the peer list from the configuration again
+func readPeers() (map[string]string, error) {
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.GetStringMapString("etcd.peers"), nil
+}
+
+func (se *EmbeddedEtcd) reconcile() {
+	defer se.wg.Done()
+
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// only done by the leader
+			if se.server.Leader() != se.server.ID() {
+				continue
+			}
+
+			peers, err := readPeers()
+			if err != nil {
+				logging.GetLogger().Debugf("Unable to read the etcd peers: %s", err.Error())
+				continue
+			}
+
+			if len(peers) == 0 {
+				continue
+			}
+
+			if err := removeMembers(se.membersAPI, se.peers, peers); err != nil {
+				logging.GetLogger().Errorf("Unable to remove the etcd members: %s", err.Error())
+				continue
+			}
+			se.peers = peers
+		case <-se.quit:
+			return
+		}
+	}
+}
+
 // NewEmbeddedEtcdFromConfig create a new embedded ETCD server from configuration
 func NewEmbeddedEtcdFromConfig() (*EmbeddedEtcd, error) {
 	dataDir := config.GetConfig().GetString("etcd.data_dir")
@@ -136,7 +371,17 @@ func NewEmbeddedEtcdFromConfig() (*EmbeddedEtcd, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewEmbeddedEtcd(sa, dataDir)
+
+	name := config.GetConfig().GetString("etcd.name")
+	peers := config.GetConfig().GetStringMapString("etcd.peers")
+	if name == "" {
+		name = memberName
+		if len(peers) != 0 {
+			name = config.GetConfig().GetString("host_id")
+		}
+	}
+
+	return NewEmbeddedEtcd(name, sa, peers, config.GetEtcdServerAddrs(), dataDir)
 }
 
 // Stop the embedded server
@@ -148,10 +393,17 @@ func (se *EmbeddedEtcd) Stop() error {
 		}
 	}
 
+	close(se.quit)
+	se.wg.Wait()
+
 	if se.listener != nil {
 		firstErr(se.listener.Close())
 	}
 
+	if se.peerListener != nil {
+		firstErr(se.peerListener.Close())
+	}
+
 	if se.server != nil {
 		se.server.Stop()
 	}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package etcd
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// fakeMembersAPI is an in memory etcd members API
+type fakeMembersAPI struct {
+	sync.Mutex
+	members []etcd.Member
+	nextID  int
+	err     error
+	added   []string
+	removed []string
+}
+
+func (f *fakeMembersAPI) List(ctx context.Context) ([]etcd.Member, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	return append([]etcd.Member(nil), f.members...), nil
+}
+
+func (f *fakeMembersAPI) Add(ctx context.Context, peerURL string) (*etcd.Member, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.nextID++
+	m := etcd.Member{ID: "m" + strconv.Itoa(f.nextID), PeerURLs: []string{peerURL}}
+	f.members = append(f.members, m)
+	f.added = append(f.added, peerURL)
+	return &m, nil
+}
+
+func (f *fakeMembersAPI) Remove(ctx context.Context, mID string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	for i, m := range f.members {
+		if m.ID == mID {
+			f.members = append(f.members[:i], f.members[i+1:]...)
+			f.removed = append(f.removed, mID)
+			return nil
+		}
+	}
+	return errors.New("Member not found")
+}
+
+func (f *fakeMembersAPI) Update(ctx context.Context, mID string, peerURLs []string) error {
+	return errors.New("Not implemented")
+}
+
+func (f *fakeMembersAPI) Leader(ctx context.Context) (*etcd.Member, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func newFakeMembersAPI(members ...etcd.Member) *fakeMembersAPI {
+	return &fakeMembersAPI{members: members, nextID: len(members)}
+}
+
+func startedMember(id, name, peerURL string) etcd.Member {
+	return etcd.Member{ID: id, Name: name, PeerURLs: []string{peerURL}, ClientURLs: []string{"http://" + name + ":2379"}}
+}
+
+func checkJoin(t *testing.T, mapi *fakeMembersAPI, expected map[string][]string) {
+	urlsMap, err := joinCluster(mapi, "analyzer3", "http://10.0.0.3:2380")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var got map[string][]string
+	if urlsMap != nil {
+		got = make(map[string][]string)
+		for name, urls := range urlsMap {
+			got[name] = urls.StringSlice()
+		}
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected peers %v, got: %v", expected, got)
+	}
+}
+
+func TestJoinCluster(t *testing.T) {
+	analyzer1 := startedMember("m1", "analyzer1", "http://10.0.0.1:2380")
+	analyzer2 := startedMember("m2", "analyzer2", "http://10.0.0.2:2380")
+	cluster := map[string][]string{
+		"analyzer1": {"http://10.0.0.1:2380"},
+		"analyzer2": {"http://10.0.0.2:2380"},
+		"analyzer3": {"http://10.0.0.3:2380"},
+	}
+
+	// no cluster reachable, the member bootstraps the static cluster
+	mapi := newFakeMembersAPI()
+	mapi.err = errors.New("Connection refused")
+	checkJoin(t, mapi, nil)
+
+	// static member not started yet
+	mapi = newFakeMembersAPI(analyzer1, analyzer2, etcd.Member{ID: "m3", Name: "analyzer3", PeerURLs: []string{"http://10.0.0.3:2380"}})
+	checkJoin(t, mapi, nil)
+	if len(mapi.added) != 0 {
+		t.Errorf("Expected no member added, got: %v", mapi.added)
+	}
+
+	// new member, added to the running cluster
+	mapi = newFakeMembersAPI(analyzer1, analyzer2)
+	checkJoin(t, mapi, cluster)
+	if !reflect.DeepEqual(mapi.added, []string{"http://10.0.0.3:2380"}) {
+		t.Errorf("Expected the member to be added, got: %v", mapi.added)
+	}
+
+	// member added by an operator, not added again
+	mapi = newFakeMembersAPI(analyzer1, analyzer2, etcd.Member{ID: "m3", PeerURLs: []string{"http://10.0.0.3:2380"}})
+	checkJoin(t, mapi, cluster)
+	if len(mapi.added) != 0 {
+		t.Errorf("Expected no member added, got: %v", mapi.added)
+	}
+
+	// member which lost its data, replaced
+	mapi = newFakeMembersAPI(analyzer1, analyzer2, startedMember("m3", "analyzer3", "http://10.0.0.3:2380"))
+	checkJoin(t, mapi, cluster)
+	if !reflect.DeepEqual(mapi.removed, []string{"m3"}) || !reflect.DeepEqual(mapi.added, []string{"http://10.0.0.3:2380"}) {
+		t.Errorf("Expected the member to be replaced, got removed %v and added %v", mapi.removed, mapi.added)
+	}
+}
+
+func TestRemoveMembers(t *testing.T) {
+	mapi := newFakeMembersAPI(
+		startedMember("m1", "analyzer1", "http://10.0.0.1:2380"),
+		startedMember("m2", "analyzer2", "http://10.0.0.2:2380"),
+	)
+
+	peers := map[string]string{
+		"analyzer1": "http://10.0.0.1:2380",
+		"analyzer2": "http://10.0.0.2:2380",
+	}
+
+	// a member joins while the peers of the leader are not updated yet
+	if _, err := joinCluster(mapi, "analyzer3", "http://10.0.0.3:2380"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := removeMembers(mapi, peers, peers); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mapi.removed) != 0 || len(mapi.members) != 3 {
+		t.Errorf("Expected the member which joined to be kept, got removed %v", mapi.removed)
+	}
+
+	// analyzer2 removed from the peers by the operator
+	updated := map[string]string{
+		"analyzer1": "http://10.0.0.1:2380",
+		"analyzer3": "http://10.0.0.3:2380",
+	}
+	if err := removeMembers(mapi, peers, updated); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(mapi.removed, []string{"m2"}) {
+		t.Errorf("Expected the member removed from the peers to be removed, got: %v", mapi.removed)
+	}
+
+	// nothing to remove anymore
+	if err := removeMembers(mapi, updated, updated); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(mapi.removed) != 1 {
+		t.Errorf("Expected no other member removed, got: %v", mapi.removed)
+	}
+
+	mapi.err = errors.New("Connection refused")
+	if err := removeMembers(mapi, peers, updated); err == nil {
+		t.Error("Expected an error when the members can't be listed")
+	}
+}
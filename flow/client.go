@@ -37,12 +37,21 @@ import (
 	"github.com/skydive-project/skydive/topology"
 )
 
+// RemoteTable looks up the flows of hosts which are not connected to the
+// table client, for instance the agents of a federated site
+type RemoteTable interface {
+	OwnsHost(host string) bool
+	// LookupFlows queries all the hosts of the remote table if hnmap is nil
+	LookupFlows(hnmap topology.HostNodeTIDMap, flowSearchQuery filters.SearchQuery) (*FlowSet, error)
+}
+
 // TableClient describes a mechanism to Query a flow table via flowSet in JSON
 type TableClient struct {
 	shttp.DefaultWSServerEventHandler
 	WSServer       *shttp.WSServer
 	replyChanMutex sync.RWMutex
 	replyChan      map[string]chan *json.RawMessage
+	remoteTables   []RemoteTable
 }
 
 // OnMessage event
@@ -125,15 +134,33 @@ func (f *TableClient) lookupFlows(flowset chan *FlowSet, host string, flowSearch
 	flowset <- NewFlowSet()
 }
 
+// AddRemoteTable adds a table queried for the hosts it owns
+func (f *TableClient) AddRemoteTable(r RemoteTable) {
+	f.remoteTables = append(f.remoteTables, r)
+}
+
+func (f *TableClient) lookupRemoteFlows(flowset chan *FlowSet, r RemoteTable, hnmap topology.HostNodeTIDMap, flowSearchQuery filters.SearchQuery) {
+	fs, err := r.LookupFlows(hnmap, flowSearchQuery)
+	if err != nil {
+		logging.GetLogger().Errorf("Error while looking for remote flows: %s", err.Error())
+		fs = NewFlowSet()
+	}
+	flowset <- fs
+}
+
 // LookupFlows query flow table based on a filter search query
 func (f *TableClient) LookupFlows(flowSearchQuery filters.SearchQuery) (*FlowSet, error) {
 	clients := f.WSServer.GetClientsByType(common.AgentService)
-	ch := make(chan *FlowSet, len(clients))
+	ch := make(chan *FlowSet, len(clients)+len(f.remoteTables))
 
 	for _, client := range clients {
 		go f.lookupFlows(ch, client.Host, flowSearchQuery)
 	}
 
+	for _, r := range f.remoteTables {
+		go f.lookupRemoteFlows(ch, r, nil, flowSearchQuery)
+	}
+
 	flowset := NewFlowSet()
 
 	// for sort order we assume that the SortOrder of a flowSearchQuery comes from
@@ -145,7 +172,7 @@ func (f *TableClient) LookupFlows(flowSearchQuery filters.SearchQuery) (*FlowSet
 		Dedup:     flowSearchQuery.Dedup,
 		DedupBy:   flowSearchQuery.DedupBy,
 	}
-	for i := 0; i != len(clients); i++ {
+	for i := 0; i != len(clients)+len(f.remoteTables); i++ {
 		fs := <-ch
 		flowset.Merge(fs, context)
 	}
@@ -155,14 +182,39 @@ func (f *TableClient) LookupFlows(flowSearchQuery filters.SearchQuery) (*FlowSet
 
 // LookupFlowsByNodes query flow table based on multiple nodes
 func (f *TableClient) LookupFlowsByNodes(hnmap topology.HostNodeTIDMap, flowSearchQuery filters.SearchQuery) (*FlowSet, error) {
-	ch := make(chan *FlowSet, len(hnmap))
+	// the hosts owned by a remote table are queried through it
+	remotes := make(map[RemoteTable]topology.HostNodeTIDMap)
+	local := make(topology.HostNodeTIDMap)
+	for host, tids := range hnmap {
+		owned := false
+		for _, r := range f.remoteTables {
+			if r.OwnsHost(host) {
+				if _, ok := remotes[r]; !ok {
+					remotes[r] = make(topology.HostNodeTIDMap)
+				}
+				remotes[r][host] = tids
+				owned = true
+				break
+			}
+		}
+		if !owned {
+			local[host] = tids
+		}
+	}
+
+	ch := make(chan *FlowSet, len(local)+len(remotes))
+
+	for r, rhnmap := range remotes {
+		go f.lookupRemoteFlows(ch, r, rhnmap, flowSearchQuery)
+	}
 
 	// We conserve the original filter to reuse it for each host
 	searchQuery := flowSearchQuery.Filter
-	for host, tids := range hnmap {
+	for host, tids := range local {
 		flowSearchQuery.Filter = filters.NewAndFilter(NewFilterForNodeTIDs(tids), searchQuery)
 		go f.lookupFlows(ch, host, flowSearchQuery)
 	}
+	flowSearchQuery.Filter = searchQuery
 
 	flowset := NewFlowSet()
 
@@ -175,7 +227,7 @@ func (f *TableClient) LookupFlowsByNodes(hnmap topology.HostNodeTIDMap, flowSear
 		Dedup:     flowSearchQuery.Dedup,
 		DedupBy:   flowSearchQuery.DedupBy,
 	}
-	for i := 0; i != len(hnmap); i++ {
+	for i := 0; i != len(local)+len(remotes); i++ {
 		fs := <-ch
 		flowset.Merge(fs, context)
 	}
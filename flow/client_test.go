@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package flow
+
+import (
+	"testing"
+
+	"github.com/skydive-project/skydive/filters"
+	"github.com/skydive-project/skydive/topology"
+)
+
+type fakeRemoteTable struct {
+	hosts   map[string]bool
+	queried topology.HostNodeTIDMap
+}
+
+func (r *fakeRemoteTable) OwnsHost(host string) bool {
+	return r.hosts[host]
+}
+
+func (r *fakeRemoteTable) LookupFlows(hnmap topology.HostNodeTIDMap, flowSearchQuery filters.SearchQuery) (*FlowSet, error) {
+	r.queried = hnmap
+	return &FlowSet{Flows: []*Flow{{TrackingID: "aaa"}}}, nil
+}
+
+func TestRemoteTableLookup(t *testing.T) {
+	remote := &fakeRemoteTable{hosts: map[string]bool{"host1": true, "host2": true}}
+
+	client := &TableClient{}
+	client.AddRemoteTable(remote)
+
+	hnmap := topology.HostNodeTIDMap{"host1": {"tid1"}, "host2": {"tid2"}}
+	flowset, err := client.LookupFlowsByNodes(hnmap, filters.SearchQuery{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(remote.queried) != 2 {
+		t.Errorf("Expected the hosts of the remote table to be queried at once, got %v", remote.queried)
+	}
+
+	if len(flowset.Flows) != 1 || flowset.Flows[0].TrackingID != "aaa" {
+		t.Errorf("Expected the flows of the remote table, got %v", flowset.Flows)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/skydive-project/skydive/common"
 	"github.com/skydive-project/skydive/config"
@@ -122,6 +123,10 @@ func (f *FlowTraversalStep) Out(s ...interface{}) *traversal.GraphTraversalV {
 	defer f.GraphTraversal.RUnlock()
 
 	for _, flow := range f.flowset.Flows {
+		if err := f.GraphTraversal.Canceled(); err != nil {
+			return traversal.NewGraphTraversalV(f.GraphTraversal, nodes, err)
+		}
+
 		if flow.BNodeTID != "" && flow.BNodeTID != "*" {
 			m["TID"] = flow.BNodeTID
 			if node := f.GraphTraversal.Graph.LookupFirstNode(m); node != nil {
@@ -150,6 +155,10 @@ func (f *FlowTraversalStep) In(s ...interface{}) *traversal.GraphTraversalV {
 	defer f.GraphTraversal.RUnlock()
 
 	for _, flow := range f.flowset.Flows {
+		if err := f.GraphTraversal.Canceled(); err != nil {
+			return traversal.NewGraphTraversalV(f.GraphTraversal, nodes, err)
+		}
+
 		if flow.ANodeTID != "" && flow.ANodeTID != "*" {
 			m["TID"] = flow.ANodeTID
 			if node := f.GraphTraversal.Graph.LookupFirstNode(m); node != nil {
@@ -178,6 +187,10 @@ func (f *FlowTraversalStep) Both(s ...interface{}) *traversal.GraphTraversalV {
 	defer f.GraphTraversal.RUnlock()
 
 	for _, flow := range f.flowset.Flows {
+		if err := f.GraphTraversal.Canceled(); err != nil {
+			return traversal.NewGraphTraversalV(f.GraphTraversal, nodes, err)
+		}
+
 		if flow.ANodeTID != "" && flow.ANodeTID != "*" {
 			m["TID"] = flow.ANodeTID
 			if node := f.GraphTraversal.Graph.LookupFirstNode(m); node != nil {
@@ -212,6 +225,10 @@ func (f *FlowTraversalStep) Nodes(s ...interface{}) *traversal.GraphTraversalV {
 	defer f.GraphTraversal.RUnlock()
 
 	for _, flow := range f.flowset.Flows {
+		if err := f.GraphTraversal.Canceled(); err != nil {
+			return traversal.NewGraphTraversalV(f.GraphTraversal, nodes, err)
+		}
+
 		if flow.NodeTID != "" && flow.NodeTID != "*" {
 			m["TID"] = flow.NodeTID
 			if node := f.GraphTraversal.Graph.LookupFirstNode(m); node != nil {
@@ -251,6 +268,10 @@ func (f *FlowTraversalStep) Hops(s ...interface{}) *traversal.GraphTraversalV {
 	defer f.GraphTraversal.RUnlock()
 
 	for _, fl := range f.flowset.Flows {
+		if err := f.GraphTraversal.Canceled(); err != nil {
+			return traversal.NewGraphTraversalV(f.GraphTraversal, nodes, err)
+		}
+
 		m["TID"] = fl.NodeTID
 		if node := f.GraphTraversal.Graph.LookupFirstNode(m); node != nil {
 			nodes = append(nodes, node)
@@ -356,6 +377,10 @@ func (f *FlowTraversalStep) CaptureNode(s ...interface{}) *traversal.GraphTraver
 	defer f.GraphTraversal.RUnlock()
 
 	for _, fl := range f.flowset.Flows {
+		if err := f.GraphTraversal.Canceled(); err != nil {
+			return traversal.NewGraphTraversalV(f.GraphTraversal, nodes, err)
+		}
+
 		m["TID"] = fl.NodeTID
 		if node := f.GraphTraversal.Graph.LookupFirstNode(m); node != nil {
 			nodes = append(nodes, node)
@@ -506,7 +531,10 @@ func (f *FlowTraversalStep) Metrics() *traversal.MetricsTraversalStep {
 		f.flowSearchQuery.SortOrder = string(common.SortAscending)
 
 		var err error
-		if flowMetrics, err = f.Storage.SearchMetrics(f.flowSearchQuery, metricFilter); err != nil {
+		start := time.Now()
+		flowMetrics, err = f.Storage.SearchMetrics(f.flowSearchQuery, metricFilter)
+		f.GraphTraversal.Graph.RecordBackendCall("SearchMetrics", time.Since(start))
+		if err != nil {
 			return traversal.NewMetricsTraversalStep(nil, nil, f.error)
 		}
 	} else {
@@ -536,6 +564,10 @@ func (f *FlowTraversalStep) Metrics() *traversal.MetricsTraversalStep {
 
 // Values return flows
 func (f *FlowTraversalStep) Values() []interface{} {
+	if f.flowset == nil {
+		return []interface{}{}
+	}
+
 	a := make([]interface{}, len(f.flowset.Flows))
 	for i, flow := range f.flowset.Flows {
 		a[i] = flow
@@ -724,17 +756,23 @@ func (s *FlowGremlinTraversalStep) Exec(last traversal.GraphTraversalStep) (trav
 			return &FlowTraversalStep{GraphTraversal: graphTraversal, Storage: s.Storage, flowSearchQuery: flowSearchQuery}, nil
 		}
 
-		if flowset, err = s.Storage.SearchFlows(flowSearchQuery); err != nil {
+		start := time.Now()
+		flowset, err = s.Storage.SearchFlows(flowSearchQuery)
+		graphTraversal.Graph.RecordBackendCall("SearchFlows", time.Since(start))
+		if err != nil {
 			return nil, err
 		}
 	} else {
+		start := time.Now()
 		if len(nodes) != 0 {
 			graphTraversal.RLock()
 			hnmap := topology.BuildHostNodeTIDMap(nodes)
 			graphTraversal.RUnlock()
 			flowset, err = s.TableClient.LookupFlowsByNodes(hnmap, flowSearchQuery)
+			graphTraversal.Graph.RecordBackendCall("LookupFlowsByNodes", time.Since(start))
 		} else {
 			flowset, err = s.TableClient.LookupFlows(flowSearchQuery)
+			graphTraversal.Graph.RecordBackendCall("LookupFlows", time.Since(start))
 		}
 	}
 
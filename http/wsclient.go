@@ -23,8 +23,6 @@
 package http
 
 import (
-	"encoding/json"
-	"io"
 	"math/rand"
 	"net/http"
 	"strconv"
@@ -56,7 +54,9 @@ type WSAsyncClient struct {
 	Port            int
 	Path            string
 	AuthClient      *AuthenticationClient
-	messages        chan string
+	Encoding        string // encoding requested to the server
+	encoding        string // encoding negotiated with the server
+	messages        chan *WSMessage
 	read            chan []byte
 	quit            chan bool
 	wg              sync.WaitGroup
@@ -65,12 +65,25 @@ type WSAsyncClient struct {
 	nsEventHandlers map[string][]WSClientEventHandler
 	connected       atomic.Value
 	running         atomic.Value
+	remoteHost      atomic.Value
+}
+
+// WSMasterSelector elects the master among the connected clients of a pool
+type WSMasterSelector interface {
+	SelectMaster(clients []*WSAsyncClient) *WSAsyncClient
+}
+
+// WSMasterEventHandler is notified when the master of a pool changes while
+// the previous one is still connected, for instance on rebalancing
+type WSMasterEventHandler interface {
+	OnMasterChanged(c *WSAsyncClient)
 }
 
 type WSAsyncClientPool struct {
 	sync.RWMutex
 	master            *WSAsyncClient
 	masterLock        sync.RWMutex
+	selector          WSMasterSelector
 	clients           []*WSAsyncClient
 	eventHandlers     []WSClientEventHandler
 	nsEventHandlers   map[string][]WSClientEventHandler
@@ -86,7 +99,7 @@ func (d *DefaultWSClientEventHandler) OnConnected(c *WSAsyncClient) {
 func (d *DefaultWSClientEventHandler) OnDisconnected(c *WSAsyncClient) {
 }
 
-func (c *WSAsyncClient) sendMessage(m string) {
+func (c *WSAsyncClient) SendWSMessage(m *WSMessage) {
 	if !c.IsConnected() {
 		return
 	}
@@ -94,21 +107,22 @@ func (c *WSAsyncClient) sendMessage(m string) {
 	c.messages <- m
 }
 
-func (c *WSAsyncClient) SendWSMessage(m *WSMessage) {
-	c.sendMessage(m.String())
-}
-
 func (c *WSAsyncClient) IsConnected() bool {
 	return c.connected.Load() == true
 }
 
-func (c *WSAsyncClient) send(msg string) error {
-	w, err := c.wsConn.NextWriter(websocket.TextMessage)
+// RemoteHost returns the host_id of the server, empty until connected
+func (c *WSAsyncClient) RemoteHost() string {
+	return c.remoteHost.Load().(string)
+}
+
+func (c *WSAsyncClient) send(msg *WSMessage) error {
+	w, err := c.wsConn.NextWriter(wsFrameType(c.encoding))
 	if err != nil {
 		return err
 	}
 
-	_, err = io.WriteString(w, msg)
+	_, err = w.Write(msg.Encode(c.encoding))
 	if err != nil {
 		return err
 	}
@@ -133,6 +147,9 @@ func (c *WSAsyncClient) connect() {
 		"X-Client-Type":         {c.ClientType.String()},
 		"X-Websocket-Namespace": {WilcardNamespace},
 	}
+	if c.Encoding == ProtobufEncoding {
+		headers.Set("X-Websocket-Encoding", ProtobufEncoding)
+	}
 
 	if c.AuthClient != nil {
 		if err = c.AuthClient.Authenticate(); err != nil {
@@ -153,7 +170,8 @@ func (c *WSAsyncClient) connect() {
 		d.TLSClientConfig = common.SetupTLSClientConfig(certPEM, keyPEM)
 		checkTLSConfig(d.TLSClientConfig)
 	}
-	c.wsConn, _, err = d.Dial(endpoint, headers)
+	var resp *http.Response
+	c.wsConn, resp, err = d.Dial(endpoint, headers)
 
 	if err != nil {
 		logging.GetLogger().Errorf("Unable to create a WebSocket connection %s : %s", endpoint, err.Error())
@@ -162,6 +180,16 @@ func (c *WSAsyncClient) connect() {
 	defer c.wsConn.Close()
 	c.wsConn.SetPingHandler(nil)
 
+	// servers not confirming the encoding only speak JSON
+	c.encoding = JSONEncoding
+	if resp.Header.Get("X-Websocket-Encoding") == ProtobufEncoding {
+		c.encoding = ProtobufEncoding
+	}
+	c.remoteHost.Store(resp.Header.Get("X-Host-ID"))
+
+	addWSProtobufPeer(c.encoding, 1)
+	defer addWSProtobufPeer(c.encoding, -1)
+
 	c.connected.Store(true)
 	defer c.connected.Store(false)
 
@@ -208,19 +236,22 @@ func (c *WSAsyncClient) connect() {
 				logging.GetLogger().Errorf("Error while writing to the WebSocket: %s", err.Error())
 			}
 		case m := <-c.read:
-			var msg WSMessage
-			if err := json.Unmarshal(m, &msg); err != nil {
+			msgs, err := DecodeWSMessages(m, c.encoding)
+			if err != nil {
 				logging.GetLogger().Errorf("Error while decoding WSMessage %s", err.Error())
-			} else {
-				c.RLock()
+				break
+			}
+
+			c.RLock()
+			for _, msg := range msgs {
 				for _, l := range c.nsEventHandlers[msg.Namespace] {
 					l.OnMessage(c, msg)
 				}
 				for _, l := range c.nsEventHandlers[WilcardNamespace] {
 					l.OnMessage(c, msg)
 				}
-				c.RUnlock()
 			}
+			c.RUnlock()
 		case <-c.quit:
 			return
 		}
@@ -267,19 +298,23 @@ func NewWSAsyncClient(host string, clientType common.ServiceType, addr string, p
 		Port:            port,
 		Path:            path,
 		AuthClient:      authClient,
-		messages:        make(chan string, 500),
+		Encoding:        JSONEncoding,
+		messages:        make(chan *WSMessage, 500),
 		read:            make(chan []byte, 500),
 		quit:            make(chan bool),
 		nsEventHandlers: make(map[string][]WSClientEventHandler),
 	}
 	c.connected.Store(false)
 	c.running.Store(true)
+	c.remoteHost.Store("")
 	return c
 }
 
 func NewWSAsyncClientFromConfig(clientType common.ServiceType, addr string, port int, path string, authClient *AuthenticationClient) *WSAsyncClient {
 	host := config.GetConfig().GetString("host_id")
-	return NewWSAsyncClient(host, clientType, addr, port, path, authClient)
+	c := NewWSAsyncClient(host, clientType, addr, port, path, authClient)
+	c.Encoding = config.GetConfig().GetString("ws_encoding")
+	return c
 }
 
 func (a *WSAsyncClientPool) selectMaster() *WSAsyncClient {
@@ -296,6 +331,20 @@ func (a *WSAsyncClientPool) selectMaster() *WSAsyncClient {
 		return nil
 	}
 
+	if a.selector != nil {
+		var connected []*WSAsyncClient
+		for _, client := range a.clients {
+			if client.IsConnected() {
+				connected = append(connected, client)
+			}
+		}
+
+		if len(connected) > 0 {
+			a.master = a.selector.SelectMaster(connected)
+		}
+		return a.master
+	}
+
 	index := rand.Intn(length)
 	for i := 0; i != length; i++ {
 		if client := a.clients[index]; client != nil && client.IsConnected() {
@@ -313,6 +362,35 @@ func (a *WSAsyncClientPool) selectMaster() *WSAsyncClient {
 	return a.master
 }
 
+// SetMasterSelector replaces the random election of the master
+func (a *WSAsyncClientPool) SetMasterSelector(selector WSMasterSelector) {
+	a.masterLock.Lock()
+	a.selector = selector
+	a.masterLock.Unlock()
+}
+
+// Rebalance elects the master again, the handlers implementing
+// WSMasterEventHandler are notified if it changed
+func (a *WSAsyncClientPool) Rebalance() {
+	a.masterLock.RLock()
+	previous := a.master
+	a.masterLock.RUnlock()
+
+	master := a.selectMaster()
+	if master == nil || master == previous {
+		return
+	}
+
+	a.eventHandlersLock.RLock()
+	defer a.eventHandlersLock.RUnlock()
+
+	for _, l := range a.eventHandlers {
+		if h, ok := l.(WSMasterEventHandler); ok {
+			h.OnMasterChanged(master)
+		}
+	}
+}
+
 func (a *WSAsyncClientPool) MasterClient() *WSAsyncClient {
 	a.masterLock.RLock()
 	if m := a.master; m != nil {
@@ -343,11 +421,19 @@ func (a *WSAsyncClientPool) SendWSMessageToMaster(m *WSMessage) {
 
 func (a *WSAsyncClientPool) OnConnected(c *WSAsyncClient) {
 	a.eventHandlersLock.RLock()
-	defer a.eventHandlersLock.RUnlock()
-
 	for _, l := range a.eventHandlers {
 		l.OnConnected(c)
 	}
+	a.eventHandlersLock.RUnlock()
+
+	// the newly connected client may be the one the selector prefers
+	a.masterLock.RLock()
+	selector := a.selector
+	a.masterLock.RUnlock()
+
+	if selector != nil {
+		a.Rebalance()
+	}
 }
 
 func (a *WSAsyncClientPool) OnDisconnected(c *WSAsyncClient) {
@@ -0,0 +1,263 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+
+	"github.com/skydive-project/skydive/logging"
+)
+
+// Encodings of the websocket messages, a client requests the protobuf
+// encoding with the X-Websocket-Encoding header, or parameter, and the server
+// confirms it with the same header in its response. JSON is used otherwise.
+const (
+	JSONEncoding     = "json"
+	ProtobufEncoding = "protobuf"
+)
+
+// wsMessagesField is the number of the Messages field of WSProtobufMessage
+const wsMessagesField = 6
+
+// WSProtobufObject is implemented by the objects having a native protobuf
+// encoding, used instead of JSON when a peer negotiated protobuf
+type WSProtobufObject interface {
+	MarshalProtobuf() ([]byte, error)
+}
+
+// WSProtobufDecoder decodes the native protobuf encoding of the object of a
+// message type
+type WSProtobufDecoder func(msgType string, data []byte) (interface{}, error)
+
+var wsProtobufDecoders = make(map[string]WSProtobufDecoder)
+
+// wsProtobufPeers counts the connections using the protobuf encoding, the
+// native protobuf encoding of the objects is skipped while there is none
+var wsProtobufPeers int64
+
+// RegisterWSProtobufDecoder registers the decoder of the native protobuf
+// encoded objects of a namespace, to be called at init time
+func RegisterWSProtobufDecoder(namespace string, decoder WSProtobufDecoder) {
+	wsProtobufDecoders[namespace] = decoder
+}
+
+func addWSProtobufPeer(encoding string, delta int64) {
+	if encoding == ProtobufEncoding {
+		atomic.AddInt64(&wsProtobufPeers, delta)
+	}
+}
+
+// setObj encodes the object of the message, natively if it has a protobuf
+// encoding and a peer uses it. The object is encoded right away as it may be
+// modified once the message created.
+func (g *WSMessage) setObj(v interface{}) {
+	if o, ok := v.(WSProtobufObject); ok && atomic.LoadInt64(&wsProtobufPeers) > 0 {
+		b, err := o.MarshalProtobuf()
+		if err == nil {
+			g.protobufObj = b
+			return
+		}
+		logging.GetLogger().Errorf("Unable to encode %s message with protobuf: %s", g.Type, err.Error())
+	}
+
+	b, _ := json.Marshal(v)
+	raw := json.RawMessage(b)
+	g.Obj = &raw
+}
+
+// Value returns the object of a message natively encoded with protobuf,
+// nil if the object is JSON encoded
+func (g WSMessage) Value() (interface{}, error) {
+	if g.value != nil || g.protobufObj == nil {
+		return g.value, nil
+	}
+
+	decoder, ok := wsProtobufDecoders[g.Namespace]
+	if !ok {
+		return nil, fmt.Errorf("No protobuf decoder for namespace %s", g.Namespace)
+	}
+	return decoder(g.Type, g.protobufObj)
+}
+
+// jsonObj returns the JSON encoding of the object of the message
+func (g WSMessage) jsonObj() *json.RawMessage {
+	if g.Obj != nil || g.protobufObj == nil {
+		return g.Obj
+	}
+
+	v, err := g.Value()
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to decode %s message: %s", g.Type, err.Error())
+		return nil
+	}
+
+	b, _ := json.Marshal(v)
+	raw := json.RawMessage(b)
+	return &raw
+}
+
+func wsEncoding(r *http.Request) string {
+	encoding := r.Header.Get("X-Websocket-Encoding")
+	if encoding == "" {
+		encoding = r.URL.Query().Get("x-websocket-encoding")
+	}
+
+	if encoding == ProtobufEncoding {
+		return ProtobufEncoding
+	}
+	return JSONEncoding
+}
+
+// wsFrameType returns the type of the websocket frames of an encoding
+func wsFrameType(encoding string) int {
+	if encoding == ProtobufEncoding {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+func (g WSMessage) protobuf() *WSProtobufMessage {
+	msg := &WSProtobufMessage{
+		Namespace: g.Namespace,
+		Type:      g.Type,
+		UUID:      g.UUID,
+		Status:    int64(g.Status),
+	}
+	if g.protobufObj != nil {
+		msg.ProtobufObj = g.protobufObj
+	} else if g.Obj != nil {
+		msg.Obj = []byte(*g.Obj)
+	}
+	return msg
+}
+
+func wsMessageFromProtobuf(m *WSProtobufMessage) (WSMessage, error) {
+	msg := WSMessage{
+		Namespace: m.Namespace,
+		Type:      m.Type,
+		UUID:      m.UUID,
+		Status:    int(m.Status),
+	}
+	if m.ProtobufObj != nil {
+		msg.protobufObj = m.ProtobufObj
+
+		var err error
+		if msg.value, err = msg.Value(); err != nil {
+			return msg, err
+		}
+	} else if m.Obj != nil {
+		raw := json.RawMessage(m.Obj)
+		msg.Obj = &raw
+	}
+	return msg, nil
+}
+
+// Encode the message with the given encoding
+func (g WSMessage) Encode(encoding string) []byte {
+	if encoding != ProtobufEncoding {
+		return g.Marshal()
+	}
+
+	b, _ := proto.Marshal(g.protobuf())
+	return b
+}
+
+// encodeWSBulk builds a bulk message out of encoded messages, the protobuf
+// bulk is the encoded header followed by the repeated Messages field
+func encodeWSBulk(namespace string, msgs [][]byte, encoding string) []byte {
+	if encoding != ProtobufEncoding {
+		bulkMessage := make(WSBulkMessage, len(msgs))
+		for i, msg := range msgs {
+			bulkMessage[i] = json.RawMessage(msg)
+		}
+		return NewWSMessage(namespace, BulkMsgType, bulkMessage).Marshal()
+	}
+
+	bulk := NewWSMessage(namespace, BulkMsgType, nil).protobuf()
+	bulk.Obj = nil
+
+	b, _ := proto.Marshal(bulk)
+	buf := proto.NewBuffer(b)
+	for _, msg := range msgs {
+		buf.EncodeVarint(uint64(wsMessagesField<<3 | proto.WireBytes))
+		buf.EncodeRawBytes(msg)
+	}
+	return buf.Bytes()
+}
+
+// DecodeWSMessages decodes the messages of a websocket frame, a bulk message
+// is expanded to the messages it carries
+func DecodeWSMessages(data []byte, encoding string) ([]WSMessage, error) {
+	if encoding != ProtobufEncoding {
+		var msg WSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+
+		if msg.Type != BulkMsgType || msg.Obj == nil {
+			return []WSMessage{msg}, nil
+		}
+
+		var bulkMessage WSBulkMessage
+		if err := json.Unmarshal([]byte(*msg.Obj), &bulkMessage); err != nil {
+			return nil, err
+		}
+
+		msgs := make([]WSMessage, len(bulkMessage))
+		for i, raw := range bulkMessage {
+			if err := json.Unmarshal([]byte(raw), &msgs[i]); err != nil {
+				return nil, err
+			}
+		}
+		return msgs, nil
+	}
+
+	var m WSProtobufMessage
+	if err := proto.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	if m.Type != BulkMsgType {
+		msg, err := wsMessageFromProtobuf(&m)
+		if err != nil {
+			return nil, err
+		}
+		return []WSMessage{msg}, nil
+	}
+
+	msgs := make([]WSMessage, len(m.Messages))
+	for i, pm := range m.Messages {
+		msg, err := wsMessageFromProtobuf(pm)
+		if err != nil {
+			return nil, err
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
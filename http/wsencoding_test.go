@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// fakeProtobufObject is natively encoded as its name
+type fakeProtobufObject struct {
+	Name string
+}
+
+func (f *fakeProtobufObject) MarshalProtobuf() ([]byte, error) {
+	return []byte(f.Name), nil
+}
+
+func init() {
+	RegisterWSProtobufDecoder("FakeNS", func(msgType string, data []byte) (interface{}, error) {
+		return &fakeProtobufObject{Name: string(data)}, nil
+	})
+}
+
+func TestWSProtobufObject(t *testing.T) {
+	obj := &fakeProtobufObject{Name: "obj1"}
+
+	// JSON only without protobuf peer
+	msg := NewWSMessage("FakeNS", "Fake", obj)
+	if msg.Obj == nil || msg.protobufObj != nil {
+		t.Fatal("The object should be JSON encoded without protobuf peer")
+	}
+
+	addWSProtobufPeer(ProtobufEncoding, 1)
+	defer addWSProtobufPeer(ProtobufEncoding, -1)
+
+	msg = NewWSMessage("FakeNS", "Fake", obj)
+	if msg.Obj != nil || string(msg.protobufObj) != "obj1" {
+		t.Fatalf("The object should be natively encoded, got: %v", msg)
+	}
+
+	// the object is encoded when the message is created
+	obj.Name = "obj2"
+
+	msgs, err := DecodeWSMessages(msg.Encode(ProtobufEncoding), ProtobufEncoding)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Expected one message, got: %v, %v", msgs, err)
+	}
+
+	value, err := msgs[0].Value()
+	if v, ok := value.(*fakeProtobufObject); !ok || v.Name != "obj1" || err != nil {
+		t.Errorf("Expected the decoded object, got: %v, %v", value, err)
+	}
+
+	// the JSON peers get the JSON encoding of the object
+	msgs, err = DecodeWSMessages(msg.Encode(JSONEncoding), JSONEncoding)
+	if err != nil || len(msgs) != 1 || msgs[0].Obj == nil {
+		t.Fatalf("Expected one JSON message, got: %v, %v", msgs, err)
+	}
+
+	var v fakeProtobufObject
+	if err := json.Unmarshal([]byte(*msgs[0].Obj), &v); err != nil || v.Name != "obj1" {
+		t.Errorf("Expected the JSON encoded object, got: %s, %v", string(*msgs[0].Obj), err)
+	}
+
+	// bulks carry the native encoding as well
+	bulk := encodeWSBulk("FakeNS", [][]byte{msg.Encode(ProtobufEncoding), msg.Encode(ProtobufEncoding)}, ProtobufEncoding)
+	if msgs, err = DecodeWSMessages(bulk, ProtobufEncoding); err != nil || len(msgs) != 2 {
+		t.Fatalf("Expected two messages, got: %v, %v", msgs, err)
+	}
+	if value, _ := msgs[1].Value(); value.(*fakeProtobufObject).Name != "obj1" {
+		t.Errorf("Expected the decoded object, got: %v", value)
+	}
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"sync"
+)
+
+// WSQueuePolicy defines what happens when the send queue of a websocket
+// client is full
+type WSQueuePolicy int
+
+const (
+	// WSQueueDisconnect closes the connection of the client, the client is
+	// expected to reconnect and re-sync
+	WSQueueDisconnect WSQueuePolicy = iota
+	// WSQueueDropOldest drops the oldest queued message
+	WSQueueDropOldest
+	// WSQueueCoalesce replaces the queued updates of an element by its last
+	// update, the oldest message is dropped if the queue is still full
+	WSQueueCoalesce
+)
+
+const defaultWSQueueSize = 10000
+
+func (p WSQueuePolicy) String() string {
+	switch p {
+	case WSQueueDropOldest:
+		return "drop-oldest"
+	case WSQueueCoalesce:
+		return "coalesce"
+	}
+	return "disconnect"
+}
+
+// WSClientStats describes the send queue of a websocket client
+type WSClientStats struct {
+	Host       string
+	ClientType string
+	RemoteAddr string
+	Encoding   string
+	Policy     string
+	QueueSize  int
+	Queued     int
+	MaxQueued  int
+	Sent       int64
+	Dropped    int64
+	Coalesced  int64
+}
+
+// wsQueuedMessage is a message shared by the queues of the clients it is
+// sent to, it is encoded once per encoding
+type wsQueuedMessage struct {
+	msg     *WSMessage
+	bulk    bool
+	once    [2]sync.Once
+	encoded [2][]byte
+}
+
+type wsQueueEntry struct {
+	*wsQueuedMessage
+	key string
+}
+
+// wsSendQueue is the bounded queue of the messages to be sent to a client,
+// pushing never blocks
+type wsSendQueue struct {
+	sync.Mutex
+	entries   []*wsQueueEntry
+	queued    int
+	keys      map[string]*wsQueueEntry
+	size      int
+	policy    WSQueuePolicy
+	ready     chan struct{}
+	closed    bool
+	maxQueued int
+	sent      int64
+	dropped   int64
+	coalesced int64
+}
+
+func (m *wsQueuedMessage) encode(encoding string) []byte {
+	i := 0
+	if encoding == ProtobufEncoding {
+		i = 1
+	}
+
+	m.once[i].Do(func() {
+		m.encoded[i] = m.msg.Encode(encoding)
+	})
+	return m.encoded[i]
+}
+
+// encodeWSFrame encodes the messages popped from a queue, bulk messages are
+// sent as a single bulk message
+func encodeWSFrame(msgs []*wsQueuedMessage, encoding string) []byte {
+	if !msgs[0].bulk {
+		return msgs[0].encode(encoding)
+	}
+
+	encoded := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		encoded[i] = m.encode(encoding)
+	}
+	return encodeWSBulk(msgs[0].msg.Namespace, encoded, encoding)
+}
+
+func newWSQueuedMessages(msgs []*WSMessage, bulk bool) []*wsQueuedMessage {
+	queued := make([]*wsQueuedMessage, len(msgs))
+	for i, msg := range msgs {
+		queued[i] = &wsQueuedMessage{msg: msg, bulk: bulk}
+	}
+	return queued
+}
+
+// dropOldest removes the first message still queued
+func (q *wsSendQueue) dropOldest() {
+	for len(q.entries) > 0 {
+		e := q.entries[0]
+		q.entries[0] = nil
+		q.entries = q.entries[1:]
+
+		if e.wsQueuedMessage != nil {
+			q.forget(e)
+			q.queued--
+			q.dropped++
+			return
+		}
+	}
+}
+
+func (q *wsSendQueue) compact() {
+	entries := make([]*wsQueueEntry, 0, q.queued)
+	for _, e := range q.entries {
+		if e.wsQueuedMessage != nil {
+			entries = append(entries, e)
+		}
+	}
+	q.entries = entries
+}
+
+func (q *wsSendQueue) forget(e *wsQueueEntry) {
+	if e.key != "" && q.keys[e.key] == e {
+		delete(q.keys, e.key)
+	}
+}
+
+// push adds messages to the queue, returns false if the queue overflowed and
+// the client has to be disconnected. Messages pushed to a closed queue are
+// ignored.
+func (q *wsSendQueue) push(msgs ...*wsQueuedMessage) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return true
+	}
+
+	for i, m := range msgs {
+		e := &wsQueueEntry{wsQueuedMessage: m}
+
+		if q.policy == WSQueueCoalesce && m.msg.CoalesceKey != "" {
+			e.key = m.msg.Namespace + "/" + m.msg.CoalesceKey
+			if old, ok := q.keys[e.key]; ok {
+				// keep the entry in place, it will be skipped once popped
+				old.wsQueuedMessage = nil
+				q.queued--
+				q.coalesced++
+			}
+			q.keys[e.key] = e
+		}
+
+		if q.queued >= q.size {
+			if q.policy == WSQueueDisconnect {
+				q.dropped += int64(q.queued + len(msgs) - i)
+				q.close()
+				return false
+			}
+			q.dropOldest()
+		}
+
+		// get rid of the coalesced entries
+		if len(q.entries) >= 2*q.size {
+			q.compact()
+		}
+
+		q.entries = append(q.entries, e)
+		if q.queued++; q.queued > q.maxQueued {
+			q.maxQueued = q.queued
+		}
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// pop returns the next message to be sent or, if it belongs to a bulk, the
+// next messages of the same bulk namespace up to maxBulk
+func (q *wsSendQueue) pop(maxBulk int) (msgs []*wsQueuedMessage) {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.entries) > 0 {
+		e := q.entries[0]
+		if e.wsQueuedMessage != nil {
+			if len(msgs) > 0 && (!e.bulk || !msgs[0].bulk || e.msg.Namespace != msgs[0].msg.Namespace) {
+				break
+			}
+			if len(msgs) > 0 && maxBulk > 0 && len(msgs) >= maxBulk {
+				break
+			}
+
+			msgs = append(msgs, e.wsQueuedMessage)
+			q.forget(e)
+			q.queued--
+			q.sent++
+		}
+
+		q.entries[0] = nil
+		q.entries = q.entries[1:]
+	}
+
+	return msgs
+}
+
+// close drops the queued messages, the next pushes will fail
+func (q *wsSendQueue) close() {
+	q.closed = true
+	q.entries = nil
+	q.queued = 0
+	q.keys = make(map[string]*wsQueueEntry)
+}
+
+func (q *wsSendQueue) stats(s *WSClientStats) {
+	q.Lock()
+	defer q.Unlock()
+
+	s.Policy = q.policy.String()
+	s.QueueSize = q.size
+	s.Queued = q.queued
+	s.MaxQueued = q.maxQueued
+	s.Sent = q.sent
+	s.Dropped = q.dropped
+	s.Coalesced = q.coalesced
+}
+
+func newWSSendQueue(size int, policy WSQueuePolicy) *wsSendQueue {
+	return &wsSendQueue{
+		keys:   make(map[string]*wsQueueEntry),
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
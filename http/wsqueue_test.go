@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"testing"
+)
+
+func newTestQueuedMessage(tp string, key string) *wsQueuedMessage {
+	msg := NewWSMessage("test", tp, nil)
+	msg.CoalesceKey = key
+	return &wsQueuedMessage{msg: msg, bulk: true}
+}
+
+func popTypes(q *wsSendQueue) (types []string) {
+	for _, m := range q.pop(0) {
+		types = append(types, m.msg.Type)
+	}
+	return
+}
+
+func TestWSQueueDropOldest(t *testing.T) {
+	q := newWSSendQueue(2, WSQueueDropOldest)
+
+	for _, tp := range []string{"a", "b", "c"} {
+		if !q.push(newTestQueuedMessage(tp, "")) {
+			t.Fatalf("Push should not fail with the drop-oldest policy")
+		}
+	}
+
+	if types := popTypes(q); len(types) != 2 || types[0] != "b" || types[1] != "c" {
+		t.Errorf("Expected the oldest message to be dropped, got %v", types)
+	}
+
+	var stats WSClientStats
+	q.stats(&stats)
+	if stats.Dropped != 1 || stats.Sent != 2 || stats.Queued != 0 || stats.MaxQueued != 2 {
+		t.Errorf("Wrong queue stats: %+v", stats)
+	}
+}
+
+func TestWSQueueCoalesce(t *testing.T) {
+	q := newWSSendQueue(10, WSQueueCoalesce)
+
+	q.push(newTestQueuedMessage("update1", "node1"), newTestQueuedMessage("added", ""))
+	q.push(newTestQueuedMessage("update2", "node1"))
+	q.push(newTestQueuedMessage("update3", "node2"))
+
+	if types := popTypes(q); len(types) != 3 || types[0] != "added" || types[1] != "update2" || types[2] != "update3" {
+		t.Errorf("Expected the first update to be coalesced, got %v", types)
+	}
+
+	var stats WSClientStats
+	q.stats(&stats)
+	if stats.Coalesced != 1 || stats.Sent != 3 {
+		t.Errorf("Wrong queue stats: %+v", stats)
+	}
+}
+
+func TestWSQueueDisconnect(t *testing.T) {
+	q := newWSSendQueue(2, WSQueueDisconnect)
+
+	if !q.push(newTestQueuedMessage("a", ""), newTestQueuedMessage("b", "")) {
+		t.Fatalf("Push should not fail before the queue is full")
+	}
+
+	if q.push(newTestQueuedMessage("c", "")) {
+		t.Fatalf("Push should fail once the queue is full")
+	}
+
+	if len(q.pop(0)) != 0 {
+		t.Errorf("Queue should be empty once closed")
+	}
+
+	var stats WSClientStats
+	q.stats(&stats)
+	if stats.Dropped != 3 {
+		t.Errorf("Wrong queue stats: %+v", stats)
+	}
+}
+
+func TestWSQueueBulk(t *testing.T) {
+	q := newWSSendQueue(10, WSQueueDropOldest)
+
+	single := &wsQueuedMessage{msg: NewWSMessage("test", "single", nil)}
+	q.push(newTestQueuedMessage("a", ""), newTestQueuedMessage("b", ""), newTestQueuedMessage("c", ""))
+	q.push(single, newTestQueuedMessage("d", ""))
+
+	if n := len(q.pop(2)); n != 2 {
+		t.Errorf("Expected a bulk of 2 messages, got %d", n)
+	}
+	if n := len(q.pop(2)); n != 1 {
+		t.Errorf("Expected the end of the bulk, got %d messages", n)
+	}
+	if msgs := q.pop(2); len(msgs) != 1 || msgs[0] != single {
+		t.Errorf("Expected the single message, got %v", msgs)
+	}
+
+	for _, encoding := range []string{JSONEncoding, ProtobufEncoding} {
+		msgs, err := DecodeWSMessages(encodeWSFrame(q.pop(2), encoding), encoding)
+		if err != nil || len(msgs) != 1 || msgs[0].Type != "d" {
+			t.Errorf("Wrong %s bulk decoding: %v, %v", encoding, msgs, err)
+		}
+
+		q.push(newTestQueuedMessage("d", ""))
+	}
+}
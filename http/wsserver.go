@@ -25,6 +25,8 @@ package http
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -51,9 +53,12 @@ type WSClient struct {
 	ClientType   common.ServiceType
 	conn         *websocket.Conn
 	read         chan []byte
-	send         chan []byte
+	queue        *wsSendQueue
 	server       *WSServer
 	nsSubscribed map[string]bool
+	encoding     string
+	header       http.Header
+	query        url.Values
 }
 
 type WSMessage struct {
@@ -62,6 +67,14 @@ type WSMessage struct {
 	UUID      string `json:",omitempty"`
 	Obj       *json.RawMessage
 	Status    int
+	// CoalesceKey identifies the element updated by the message, a message
+	// queued for a client is replaced by the next one with the same key if
+	// the coalesce queue policy is used
+	CoalesceKey string `json:"-"`
+	// protobufObj is the native protobuf encoding of the object, used
+	// instead of Obj, value is the object decoded from it
+	protobufObj []byte
+	value       interface{}
 }
 
 type WSBulkMessage []json.RawMessage
@@ -75,9 +88,12 @@ type WSServerEventHandler interface {
 type DefaultWSServerEventHandler struct {
 }
 
+// broadcastMessage holds either a message or a bulk of messages of the same
+// namespace, encoded once per encoding used by the clients
 type broadcastMessage struct {
 	namespace string
-	message   string
+	msg       *WSMessage
+	bulk      []*WSMessage
 }
 
 type WSServer struct {
@@ -86,6 +102,7 @@ type WSServer struct {
 	Server          *Server
 	eventHandlers   []WSServerEventHandler
 	nsEventHandlers map[string][]WSServerEventHandler
+	nsFilters       map[string]func(c *WSClient) bool
 	clients         map[*WSClient]bool
 	broadcast       chan broadcastMessage
 	quit            chan bool
@@ -95,12 +112,15 @@ type WSServer struct {
 	pingPeriod      time.Duration
 	bulkMaxMsgs     int
 	bulkMaxDelay    time.Duration
+	queueSize       int
+	queuePolicy     WSQueuePolicy
 	eventBuffer     []*WSMessage
 	wg              sync.WaitGroup
 	listening       atomic.Value
 }
 
 func (g WSMessage) Marshal() []byte {
+	g.Obj = g.jsonObj()
 	j, _ := json.Marshal(g)
 	return j
 }
@@ -110,16 +130,15 @@ func (g WSMessage) String() string {
 }
 
 func (g *WSMessage) Reply(v interface{}, kind string, status int) *WSMessage {
-	b, _ := json.Marshal(v)
-	raw := json.RawMessage(b)
-
-	return &WSMessage{
+	msg := &WSMessage{
 		Namespace: g.Namespace,
 		UUID:      g.UUID,
-		Obj:       &raw,
 		Type:      kind,
 		Status:    status,
 	}
+	msg.setObj(v)
+
+	return msg
 }
 
 func NewWSMessage(ns string, tp string, v interface{}, uuids ...string) *WSMessage {
@@ -131,16 +150,15 @@ func NewWSMessage(ns string, tp string, v interface{}, uuids ...string) *WSMessa
 		u = v4.String()
 	}
 
-	b, _ := json.Marshal(v)
-	raw := json.RawMessage(b)
-
-	return &WSMessage{
+	msg := &WSMessage{
 		Namespace: ns,
 		Type:      tp,
 		UUID:      u,
-		Obj:       &raw,
 		Status:    http.StatusOK,
 	}
+	msg.setObj(v)
+
+	return msg
 }
 
 func (d *DefaultWSServerEventHandler) OnMessage(c *WSClient, m WSMessage) {
@@ -154,32 +172,55 @@ func (d *DefaultWSServerEventHandler) OnUnregisterClient(c *WSClient) {
 
 func (c *WSClient) SendWSMessage(msg *WSMessage) bool {
 	if _, ok := c.nsSubscribed[msg.Namespace]; ok {
-		c.send <- []byte(msg.String())
+		c.enqueue(&wsQueuedMessage{msg: msg})
 		return true
 	}
 	if _, ok := c.nsSubscribed[WilcardNamespace]; ok {
-		c.send <- []byte(msg.String())
+		c.enqueue(&wsQueuedMessage{msg: msg})
 		return true
 	}
 
 	return false
 }
 
+// enqueue adds messages to the send queue of the client, the client is
+// disconnected if its queue is full and the policy says so
+func (c *WSClient) enqueue(msgs ...*wsQueuedMessage) {
+	if !c.queue.push(msgs...) {
+		logging.GetLogger().Warningf("Send queue of %s(%s) full, disconnecting", c.Host, c.conn.RemoteAddr().String())
+		c.conn.Close()
+	}
+}
+
+// Option returns the value of a header set by the client on connection or of
+// the query parameter with the same lower case name, useful for browsers
+func (c *WSClient) Option(header string) string {
+	if value := c.header.Get(header); value != "" {
+		return value
+	}
+	return c.query.Get(strings.ToLower(header))
+}
+
+// Stats returns the statistics of the send queue of the client
+func (c *WSClient) Stats() WSClientStats {
+	stats := WSClientStats{
+		Host:       c.Host,
+		ClientType: c.ClientType.String(),
+		RemoteAddr: c.conn.RemoteAddr().String(),
+		Encoding:   c.encoding,
+	}
+	c.queue.stats(&stats)
+	return stats
+}
+
 func (c *WSClient) processMessage(m []byte) {
-	var msg WSMessage
-	if err := json.Unmarshal(m, &msg); err != nil {
-		logging.GetLogger().Errorf("WSServer: Unable to parse the event %s: %s", msg, err.Error())
+	msgs, err := DecodeWSMessages(m, c.encoding)
+	if err != nil {
+		logging.GetLogger().Errorf("WSServer: Unable to parse the event from %s: %s", c.Host, err.Error())
 		return
 	}
 
-	if msg.Type == BulkMsgType {
-		var bulkMessage WSBulkMessage
-		if err := json.Unmarshal([]byte(*msg.Obj), &bulkMessage); err != nil {
-			for _, msg := range bulkMessage {
-				c.processMessage([]byte(msg))
-			}
-		}
-	} else {
+	for _, msg := range msgs {
 		for _, e := range c.server.nsEventHandlers[msg.Namespace] {
 			e.OnMessage(c, msg)
 		}
@@ -240,9 +281,11 @@ func (c *WSClient) writePump(wg *sync.WaitGroup, quit chan struct{}) {
 
 	for {
 		select {
-		case message := <-c.send:
-			if err := c.write(websocket.TextMessage, message); err != nil {
-				logging.GetLogger().Warningf("Error while writing to the websocket: %s", err.Error())
+		case <-c.queue.ready:
+			for msgs := c.queue.pop(c.server.bulkMaxMsgs); msgs != nil; msgs = c.queue.pop(c.server.bulkMaxMsgs) {
+				if err := c.write(wsFrameType(c.encoding), encodeWSFrame(msgs, c.encoding)); err != nil {
+					logging.GetLogger().Warningf("Error while writing to the websocket: %s", err.Error())
+				}
 			}
 		case <-ticker.C:
 			if err := c.write(websocket.PingMessage, []byte{}); err != nil {
@@ -285,6 +328,7 @@ func (s *WSServer) listenAndServe() {
 			for c := range s.clients {
 				c.conn.Close()
 				delete(s.clients, c)
+				addWSProtobufPeer(c.encoding, -1)
 			}
 			s.Unlock()
 			return
@@ -292,6 +336,7 @@ func (s *WSServer) listenAndServe() {
 			s.Lock()
 			s.clients[c] = true
 			s.Unlock()
+			addWSProtobufPeer(c.encoding, 1)
 			for _, e := range s.eventHandlers {
 				e.OnRegisterClient(c)
 			}
@@ -301,7 +346,10 @@ func (s *WSServer) listenAndServe() {
 			}
 			s.Lock()
 			c.conn.Close()
-			delete(s.clients, c)
+			if _, ok := s.clients[c]; ok {
+				delete(s.clients, c)
+				addWSProtobufPeer(c.encoding, -1)
+			}
 			s.Unlock()
 		case m := <-s.broadcast:
 			s.broadcastMessage(m)
@@ -320,15 +368,34 @@ func (s *WSServer) broadcastMessage(m broadcastMessage) {
 	s.RLock()
 	defer s.RUnlock()
 
+	// the messages are shared by the queues so that they are encoded once
+	msgs := newWSQueuedMessages(m.bulk, true)
+	if m.msg != nil {
+		msgs = []*wsQueuedMessage{{msg: m.msg}}
+	}
+
+	filter := s.nsFilters[m.namespace]
 	for c := range s.clients {
+		if filter != nil && !filter(c) {
+			continue
+		}
+
 		if _, ok := c.nsSubscribed[m.namespace]; ok {
-			c.send <- []byte(m.message)
+			c.enqueue(msgs...)
 		} else if _, ok := c.nsSubscribed[WilcardNamespace]; ok {
-			c.send <- []byte(m.message)
+			c.enqueue(msgs...)
 		}
 	}
 }
 
+// SetBroadcastFilter excludes from the broadcasts of a namespace the clients
+// for which filter returns false
+func (s *WSServer) SetBroadcastFilter(namespace string, filter func(c *WSClient) bool) {
+	s.Lock()
+	s.nsFilters[namespace] = filter
+	s.Unlock()
+}
+
 func nsSubscribed(r *auth.AuthenticatedRequest) map[string]bool {
 	subscribed := make(map[string]bool)
 
@@ -373,21 +440,32 @@ func (s *WSServer) serveMessages(w http.ResponseWriter, r *auth.AuthenticatedReq
 		s.RUnlock()
 	}
 
-	conn, err := websocket.Upgrade(w, &r.Request, nil, 1024, 1024)
+	// confirm the encoding so that the client can fallback to JSON with
+	// servers not supporting it, the host_id identifies the server
+	encoding := wsEncoding(&r.Request)
+	header := http.Header{
+		"X-Websocket-Encoding": {encoding},
+		"X-Host-ID":            {config.GetConfig().GetString("host_id")},
+	}
+
+	conn, err := websocket.Upgrade(w, &r.Request, header, 1024, 1024)
 	if err != nil {
 		return
 	}
 
 	c := &WSClient{
 		read:         make(chan []byte, maxMessages),
-		send:         make(chan []byte, maxMessages),
+		queue:        newWSSendQueue(s.queueSize, s.queuePolicy),
 		conn:         conn,
 		server:       s,
 		Host:         host,
 		ClientType:   common.ServiceType(r.Header.Get("X-Client-Type")),
 		nsSubscribed: nsSubscribed(r),
+		encoding:     encoding,
+		header:       r.Header,
+		query:        r.URL.Query(),
 	}
-	logging.GetLogger().Infof("New WebSocket Connection from %s : URI path %s", conn.RemoteAddr().String(), r.URL.Path)
+	logging.GetLogger().Infof("New WebSocket Connection from %s : URI path %s, encoding %s", conn.RemoteAddr().String(), r.URL.Path, encoding)
 
 	s.register <- c
 
@@ -405,25 +483,28 @@ func (s *WSServer) serveMessages(w http.ResponseWriter, r *auth.AuthenticatedReq
 	quit <- struct{}{}
 
 	close(c.read)
-	close(c.send)
+
+	c.queue.Lock()
+	c.queue.close()
+	c.queue.Unlock()
 
 	wg.Wait()
 }
 
+// broadcastMessages sends the messages as bulks of consecutive messages of
+// the same namespace
 func (s *WSServer) broadcastMessages(msgs []*WSMessage) {
-	namespace := ""
-	var bulkMessage WSBulkMessage
+	var bulk []*WSMessage
 	for _, msg := range msgs {
-		if namespace != "" && msg.Namespace != namespace {
-			s.BroadcastWSMessage(NewWSMessage(namespace, BulkMsgType, bulkMessage))
-			bulkMessage = bulkMessage[:0]
+		if len(bulk) > 0 && msg.Namespace != bulk[0].Namespace {
+			s.broadcast <- broadcastMessage{namespace: bulk[0].Namespace, bulk: bulk}
+			bulk = nil
 		}
-		b, _ := json.Marshal(msg)
-		raw := json.RawMessage(b)
-		namespace = msg.Namespace
-		bulkMessage = append(bulkMessage, raw)
+		bulk = append(bulk, msg)
+	}
+	if len(bulk) > 0 {
+		s.broadcast <- broadcastMessage{namespace: bulk[0].Namespace, bulk: bulk}
 	}
-	s.BroadcastWSMessage(NewWSMessage(namespace, BulkMsgType, bulkMessage))
 }
 
 func (s *WSServer) flushMessages() (msgs []*WSMessage) {
@@ -434,7 +515,7 @@ func (s *WSServer) flushMessages() (msgs []*WSMessage) {
 }
 
 func (s *WSServer) BroadcastWSMessage(msg *WSMessage) {
-	s.broadcast <- broadcastMessage{namespace: msg.Namespace, message: msg.String()}
+	s.broadcast <- broadcastMessage{namespace: msg.Namespace, msg: msg}
 }
 
 func (s *WSServer) QueueBroadcastWSMessage(msg *WSMessage) {
@@ -476,6 +557,26 @@ func (s *WSServer) AddEventHandler(h WSServerEventHandler, namespaces []string)
 	}
 }
 
+// GetClientsStats returns the statistics of the send queues of the clients
+func (s *WSServer) GetClientsStats() []WSClientStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	stats := make([]WSClientStats, 0, len(s.clients))
+	for c := range s.clients {
+		stats = append(stats, c.Stats())
+	}
+	return stats
+}
+
+func (s *WSServer) serveClientsStats(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(s.GetClientsStats()); err != nil {
+		panic(err)
+	}
+}
+
 func (s *WSServer) GetClientsByType(clientType common.ServiceType) (clients []*WSClient) {
 	s.RLock()
 	for client := range s.clients {
@@ -496,13 +597,24 @@ func NewWSServer(server *Server, pongWait time.Duration, bulkMaxMsgs int, bulkMa
 		unregister:      make(chan *WSClient),
 		clients:         make(map[*WSClient]bool),
 		nsEventHandlers: make(map[string][]WSServerEventHandler),
+		nsFilters:       make(map[string]func(c *WSClient) bool),
 		pongWait:        pongWait,
 		pingPeriod:      (pongWait * 8) / 10,
 		bulkMaxMsgs:     bulkMaxMsgs,
 		bulkMaxDelay:    bulkMaxDelay,
+		queueSize:       defaultWSQueueSize,
+		queuePolicy:     WSQueueDisconnect,
 	}
 
 	server.HandleFunc(endpoint, s.serveMessages)
+	server.RegisterRoutes([]Route{
+		{
+			Name:        "WSClients",
+			Method:      "GET",
+			Path:        "/api" + endpoint + "/clients",
+			HandlerFunc: s.serveClientsStats,
+		},
+	})
 
 	return s
 }
@@ -512,5 +624,21 @@ func NewWSServerFromConfig(server *Server, endpoint string) *WSServer {
 	bulkMaxMsgs := config.GetConfig().GetInt("ws_bulk_maxmsgs")
 	bulkMaxDelay := config.GetConfig().GetInt("ws_bulk_maxdelay")
 
-	return NewWSServer(server, time.Duration(pongTimeout)*time.Second, bulkMaxMsgs, time.Duration(bulkMaxDelay)*time.Second, endpoint)
+	s := NewWSServer(server, time.Duration(pongTimeout)*time.Second, bulkMaxMsgs, time.Duration(bulkMaxDelay)*time.Second, endpoint)
+
+	if size := config.GetConfig().GetInt("ws_queue_size"); size > 0 {
+		s.queueSize = size
+	}
+
+	switch policy := config.GetConfig().GetString("ws_queue_policy"); policy {
+	case "drop-oldest":
+		s.queuePolicy = WSQueueDropOldest
+	case "coalesce":
+		s.queuePolicy = WSQueueCoalesce
+	case "", "disconnect":
+	default:
+		logging.GetLogger().Errorf("Unknown websocket queue policy %s, using disconnect", policy)
+	}
+
+	return s
 }
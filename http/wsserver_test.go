@@ -67,7 +67,7 @@ func (f *fakeClientSubscriptionHandler) OnMessage(c *WSAsyncClient, m WSMessage)
 	f.received[m.Type] = true
 }
 
-func TestSubscription(t *testing.T) {
+func testSubscription(t *testing.T, encoding string) {
 	httpserver := NewServer("myhost", common.AnalyzerService, "localhost", 59999, NewNoAuthenticationBackend())
 
 	go httpserver.ListenAndServe()
@@ -82,6 +82,7 @@ func TestSubscription(t *testing.T) {
 	defer wsserver.Stop()
 
 	wsclient := NewWSAsyncClient("myhost", common.AgentService, "localhost", 59999, "/wstest", nil)
+	wsclient.Encoding = encoding
 
 	wspool := NewWSAsyncClientPool()
 	wspool.AddWSAsyncClient(wsclient)
@@ -120,3 +121,99 @@ func TestSubscription(t *testing.T) {
 		t.Error(err.Error())
 	}
 }
+
+func TestSubscription(t *testing.T) {
+	testSubscription(t, JSONEncoding)
+}
+
+func TestProtobufSubscription(t *testing.T) {
+	testSubscription(t, ProtobufEncoding)
+}
+
+type fakeMasterSelector struct {
+	port int
+}
+
+func (f *fakeMasterSelector) SelectMaster(clients []*WSAsyncClient) *WSAsyncClient {
+	for _, c := range clients {
+		if c.Port == f.port {
+			return c
+		}
+	}
+	return nil
+}
+
+type fakeMasterHandler struct {
+	DefaultWSClientEventHandler
+	changed chan *WSAsyncClient
+}
+
+func (f *fakeMasterHandler) OnMasterChanged(c *WSAsyncClient) {
+	f.changed <- c
+}
+
+func TestMasterSelector(t *testing.T) {
+	wspool := NewWSAsyncClientPool()
+
+	var clients []*WSAsyncClient
+	for _, port := range []int{59997, 59998} {
+		httpserver := NewServer("myhost", common.AnalyzerService, "localhost", port, NewNoAuthenticationBackend())
+		go httpserver.ListenAndServe()
+		defer httpserver.Stop()
+
+		wsserver := NewWSServer(httpserver, 10*time.Second, 100, time.Second, "/wstest")
+		go wsserver.ListenAndServe()
+		defer wsserver.Stop()
+
+		wsclient := NewWSAsyncClient("myhost", common.AgentService, "localhost", port, "/wstest", nil)
+		wspool.AddWSAsyncClient(wsclient)
+		clients = append(clients, wsclient)
+	}
+
+	selector := &fakeMasterSelector{port: 59997}
+	wspool.SetMasterSelector(selector)
+
+	handler := &fakeMasterHandler{changed: make(chan *WSAsyncClient, 10)}
+	wspool.AddEventHandler(handler, []string{})
+
+	wspool.ConnectAll()
+	defer wspool.DisconnectAll()
+
+	err := common.Retry(func() error {
+		for _, c := range clients {
+			if !c.IsConnected() {
+				return fmt.Errorf("Client %d not connected", c.Port)
+			}
+		}
+
+		if master := wspool.MasterClient(); master != clients[0] {
+			return fmt.Errorf("Expected the selected master, got %v", master)
+		}
+		return nil
+	}, 5, time.Second)
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if clients[0].RemoteHost() == "" {
+		t.Errorf("Expected the host_id of the server")
+	}
+
+	// drain the changes while connecting
+	for len(handler.changed) > 0 {
+		<-handler.changed
+	}
+
+	wspool.SetMasterSelector(&fakeMasterSelector{port: 59998})
+	wspool.Rebalance()
+
+	select {
+	case c := <-handler.changed:
+		if c != clients[1] {
+			t.Errorf("Expected the new master to be notified, got %d", c.Port)
+		}
+	case <-time.After(time.Second):
+		t.Error("Master change not notified")
+	}
+}
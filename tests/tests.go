@@ -380,7 +380,10 @@ func init() {
 		server := analyzer.NewServerFromConfig()
 		server.Start()
 
-		agent := agent.NewAgent()
+		agent, err := agent.NewAgent()
+		if err != nil {
+			panic(fmt.Sprintf("Failed to create the agent: %s", err.Error()))
+		}
 		agent.Start()
 
 		// TODO: check for storage status instead of sleeping
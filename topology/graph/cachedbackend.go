@@ -222,6 +222,15 @@ func (c *CachedBackend) WithContext(graph *Graph, context GraphContext) (*Graph,
 	return c.persistent.WithContext(graph, context)
 }
 
+// HistoryStats returns the statistics of the history kept in memory by the
+// persistent backend, nil if none
+func (c *CachedBackend) HistoryStats() *HistoryStats {
+	if h, ok := c.persistent.(historyBackend); ok {
+		return h.HistoryStats()
+	}
+	return nil
+}
+
 // NewCachedBackend create new graph cache mechanism
 func NewCachedBackend(persistent GraphBackend) (*CachedBackend, error) {
 	memory, err := NewMemoryBackend()
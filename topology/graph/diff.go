@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"reflect"
+)
+
+// MetadataChange describes the old and new values of a metadata key, a nil
+// value means that the key was added or removed
+type MetadataChange struct {
+	Old interface{}
+	New interface{}
+}
+
+// NodeUpdate describes a node whose metadata changed
+type NodeUpdate struct {
+	Node    *Node
+	Changes map[string]MetadataChange
+}
+
+// EdgeUpdate describes an edge whose metadata changed
+type EdgeUpdate struct {
+	Edge    *Edge
+	Changes map[string]MetadataChange
+}
+
+// GraphDiff describes the changes between two graphs
+type GraphDiff struct {
+	AddedNodes   []*Node       `json:",omitempty"`
+	RemovedNodes []*Node       `json:",omitempty"`
+	UpdatedNodes []*NodeUpdate `json:",omitempty"`
+	AddedEdges   []*Edge       `json:",omitempty"`
+	RemovedEdges []*Edge       `json:",omitempty"`
+	UpdatedEdges []*EdgeUpdate `json:",omitempty"`
+}
+
+// DiffMetadata returns the keys whose value differs between old and new
+func DiffMetadata(old, new Metadata) map[string]MetadataChange {
+	changes := make(map[string]MetadataChange)
+	for k, v := range old {
+		if nv, ok := new[k]; !ok || !reflect.DeepEqual(v, nv) {
+			changes[k] = MetadataChange{Old: v, New: nv}
+		}
+	}
+	for k, v := range new {
+		if _, ok := old[k]; !ok {
+			changes[k] = MetadataChange{New: v}
+		}
+	}
+	return changes
+}
+
+// latest revisions of the nodes indexed by ID, a time slice may return
+// several revisions of the same node
+func nodesByID(nodes []*Node) map[Identifier]*Node {
+	m := make(map[Identifier]*Node, len(nodes))
+	for _, n := range nodes {
+		if o, ok := m[n.ID]; !ok || o.revision < n.revision {
+			m[n.ID] = n
+		}
+	}
+	return m
+}
+
+func edgesByID(edges []*Edge) map[Identifier]*Edge {
+	m := make(map[Identifier]*Edge, len(edges))
+	for _, e := range edges {
+		if o, ok := m[e.ID]; !ok || o.revision < e.revision {
+			m[e.ID] = e
+		}
+	}
+	return m
+}
+
+// DiffNodes adds to the diff the nodes added, removed and updated between from and to
+func (d *GraphDiff) DiffNodes(from, to []*Node) {
+	fromNodes, toNodes := nodesByID(from), nodesByID(to)
+
+	for id, n := range toNodes {
+		o, ok := fromNodes[id]
+		if !ok {
+			d.AddedNodes = append(d.AddedNodes, n)
+		} else if changes := DiffMetadata(o.metadata, n.metadata); len(changes) != 0 {
+			d.UpdatedNodes = append(d.UpdatedNodes, &NodeUpdate{Node: n, Changes: changes})
+		}
+	}
+	for id, n := range fromNodes {
+		if _, ok := toNodes[id]; !ok {
+			d.RemovedNodes = append(d.RemovedNodes, n)
+		}
+	}
+}
+
+// DiffEdges adds to the diff the edges added, removed and updated between from and to
+func (d *GraphDiff) DiffEdges(from, to []*Edge) {
+	fromEdges, toEdges := edgesByID(from), edgesByID(to)
+
+	for id, e := range toEdges {
+		o, ok := fromEdges[id]
+		if !ok {
+			d.AddedEdges = append(d.AddedEdges, e)
+		} else if changes := DiffMetadata(o.metadata, e.metadata); len(changes) != 0 {
+			d.UpdatedEdges = append(d.UpdatedEdges, &EdgeUpdate{Edge: e, Changes: changes})
+		}
+	}
+	for id, e := range fromEdges {
+		if _, ok := toEdges[id]; !ok {
+			d.RemovedEdges = append(d.RemovedEdges, e)
+		}
+	}
+}
+
+// Diff returns the changes needed to go from the graph g to the graph to.
+// Both graphs have to be locked by the caller.
+func (g *Graph) Diff(to *Graph) *GraphDiff {
+	d := &GraphDiff{}
+	d.DiffNodes(g.GetNodes(nil), to.GetNodes(nil))
+	d.DiffEdges(g.GetEdges(nil), to.GetEdges(nil))
+	return d
+}
@@ -29,10 +29,16 @@ import (
 	"github.com/skydive-project/skydive/filters"
 )
 
-// NewFilterForMetadata create a new filter based on metadata
+// NewFilterForMetadata create a new filter based on metadata, the keys of
+// nested maps are prefixed with the key of their parent
 func NewFilterForMetadata(m Metadata) (*filters.Filter, error) {
+	return newFilterForMetadata("", m)
+}
+
+func newFilterForMetadata(prefix string, m map[string]interface{}) (*filters.Filter, error) {
 	var termFilters []*filters.Filter
 	for k, v := range m {
+		k = prefix + k
 		switch v := v.(type) {
 		case *filters.Filter:
 			termFilters = append(termFilters, v)
@@ -41,7 +47,13 @@ func NewFilterForMetadata(m Metadata) (*filters.Filter, error) {
 		case string:
 			termFilters = append(termFilters, filters.NewTermStringFilter(k, v))
 		case map[string]interface{}:
-			filters, err := NewFilterForMetadata(Metadata(v))
+			filters, err := newFilterForMetadata(k+".", v)
+			if err != nil {
+				return nil, err
+			}
+			termFilters = append(termFilters, filters)
+		case Metadata:
+			filters, err := newFilterForMetadata(k+".", v)
 			if err != nil {
 				return nil, err
 			}
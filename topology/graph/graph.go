@@ -27,6 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -135,7 +136,7 @@ type Graph struct {
 	backend              GraphBackend
 	context              GraphContext
 	host                 string
-	eventListeners       []GraphEventListener
+	eventListeners       []*eventListener
 	eventChan            chan graphEvent
 	eventConsumed        bool
 	currentEventListener GraphEventListener
@@ -200,6 +201,11 @@ func (e *graphElement) Host() string {
 	return e.host
 }
 
+// Revision returns the number of updates of the element
+func (e *graphElement) Revision() int64 {
+	return e.revision
+}
+
 func (e *graphElement) GetFieldInt64(field string) (_ int64, err error) {
 	f, err := e.GetField(field)
 	if err != nil {
@@ -280,15 +286,39 @@ func (e *graphElement) Metadata() Metadata {
 	return e.metadata.Clone()
 }
 
+// SetMetadataKey sets a metadata of an element not added to a graph yet,
+// like a decoded one, no listener is notified
+func (e *graphElement) SetMetadataKey(k string, v interface{}) {
+	if e.metadata == nil {
+		e.metadata = Metadata{}
+	}
+	e.metadata[k] = v
+}
+
+// MatchMetadata returns whether the element matches all the metadata of f.
+// The keys can be dotted paths to nested values, nested maps of f match if
+// all their values match.
 func (e *graphElement) MatchMetadata(f Metadata) bool {
+	return e.matchMetadata("", f)
+}
+
+func (e *graphElement) matchMetadata(prefix string, f map[string]interface{}) bool {
 	for k, v := range f {
 		switch v := v.(type) {
 		case *filters.Filter:
 			if !v.Eval(e) {
 				return false
 			}
+		case map[string]interface{}:
+			if !e.matchMetadata(prefix+k+".", v) {
+				return false
+			}
+		case Metadata:
+			if !e.matchMetadata(prefix+k+".", v) {
+				return false
+			}
 		default:
-			nv, ok := e.metadata[k]
+			nv, ok := e.metadataValue(prefix + k)
 			if !ok || !reflect.DeepEqual(nv, v) {
 				return false
 			}
@@ -298,6 +328,18 @@ func (e *graphElement) MatchMetadata(f Metadata) bool {
 	return true
 }
 
+// metadataValue returns the value of a top level key or of a dotted path
+func (e *graphElement) metadataValue(k string) (interface{}, bool) {
+	if v, ok := e.metadata[k]; ok {
+		return v, true
+	}
+	if !strings.Contains(k, ".") {
+		return nil, false
+	}
+	v, err := common.GetField(e.metadata, k)
+	return v, err == nil
+}
+
 func parseTime(i interface{}) (t time.Time, err error) {
 	var ms int64
 	switch i := i.(type) {
@@ -480,6 +522,7 @@ func (e *Edge) MarshalJSON() ([]byte, error) {
 		CreatedAt int64
 		UpdatedAt int64 `json:",omitempty"`
 		DeletedAt int64 `json:",omitempty"`
+		Revision  int64
 	}{
 		ID:        e.ID,
 		Metadata:  e.metadata,
@@ -489,6 +532,7 @@ func (e *Edge) MarshalJSON() ([]byte, error) {
 		CreatedAt: common.UnixMillis(e.createdAt),
 		UpdatedAt: common.UnixMillis(e.updatedAt),
 		DeletedAt: deletedAt,
+		Revision:  e.revision,
 	})
 }
 
@@ -561,6 +605,7 @@ func (g *Graph) EdgeUpdated(e *Edge) bool {
 	if edge := g.GetEdge(e.ID); edge != nil {
 		edge.metadata = e.metadata
 		edge.updatedAt = e.updatedAt
+		edge.revision = e.revision
 
 		if !g.backend.MetadataUpdated(edge) {
 			return false
@@ -1020,6 +1065,62 @@ func (g *Graph) DelHostGraph(host string) {
 	}
 }
 
+// HostRevisions returns the revisions of the nodes and edges of host
+func (g *Graph) HostRevisions(host string) *SyncRevisionsMsg {
+	r := &SyncRevisionsMsg{
+		Host:  host,
+		Nodes: make(map[Identifier]int64),
+		Edges: make(map[Identifier]int64),
+	}
+
+	for _, n := range g.GetNodes(Metadata{}) {
+		if n.host == host {
+			r.Nodes[n.ID] = n.revision
+		}
+	}
+	for _, e := range g.GetEdges(Metadata{}) {
+		if e.host == host {
+			r.Edges[e.ID] = e.revision
+		}
+	}
+	return r
+}
+
+// SyncHostRevisions deletes the nodes and edges of a host not part of its
+// revisions and returns the ones missing or with a different revision
+func (g *Graph) SyncHostRevisions(r *SyncRevisionsMsg) *SyncRevisionsReplyMsg {
+	reply := &SyncRevisionsReplyMsg{}
+	t := time.Now().UTC()
+
+	known := g.HostRevisions(r.Host)
+	for id := range known.Edges {
+		if _, ok := r.Edges[id]; !ok {
+			if e := g.GetEdge(id); e != nil {
+				g.delEdge(e, t)
+			}
+		}
+	}
+	for id := range known.Nodes {
+		if _, ok := r.Nodes[id]; !ok {
+			if n := g.GetNode(id); n != nil {
+				g.delNode(n, t)
+			}
+		}
+	}
+
+	for id, revision := range r.Nodes {
+		if rev, ok := known.Nodes[id]; !ok || rev != revision {
+			reply.Nodes = append(reply.Nodes, id)
+		}
+	}
+	for id, revision := range r.Edges {
+		if rev, ok := known.Edges[id]; !ok || rev != revision {
+			reply.Edges = append(reply.Edges, id)
+		}
+	}
+	return reply
+}
+
 // GetNodes return a list of nodes
 func (g *Graph) GetNodes(m Metadata) []*Node {
 	return g.backend.GetNodes(g.context.TimeSlice, m)
@@ -1072,55 +1173,34 @@ func (g *Graph) notifyEvent(ge graphEvent) {
 	for len(g.eventChan) > 0 {
 		ge = <-g.eventChan
 
+		// asynchronous listeners share a copy of the element
+		var copied *graphEvent
+
 		// notify only once per listener as if more than once we are in a recursion
 		// and we wont to notify a listener which generated a graph element
-		for _, g.currentEventListener = range g.eventListeners {
+		for _, el := range g.eventListeners {
 			// do not notify the listener which generated the event
-			if g.currentEventListener == ge.listener {
+			if el.listener == ge.listener {
 				continue
 			}
 
-			switch ge.kind {
-			case nodeAdded:
-				g.currentEventListener.OnNodeAdded(ge.element.(*Node))
-			case nodeUpdated:
-				g.currentEventListener.OnNodeUpdated(ge.element.(*Node))
-			case nodeDeleted:
-				g.currentEventListener.OnNodeDeleted(ge.element.(*Node))
-			case edgeAdded:
-				g.currentEventListener.OnEdgeAdded(ge.element.(*Edge))
-			case edgeUpdated:
-				g.currentEventListener.OnEdgeUpdated(ge.element.(*Edge))
-			case edgeDeleted:
-				g.currentEventListener.OnEdgeDeleted(ge.element.(*Edge))
+			if !el.options.Sync {
+				if copied == nil {
+					c := copyEvent(ge)
+					copied = &c
+				}
+				el.enqueue(*copied)
+				continue
 			}
+
+			g.currentEventListener = el.listener
+			dispatchEvent(el.listener, ge)
 		}
 	}
 	g.currentEventListener = nil
 	g.eventConsumed = false
 }
 
-// AddEventListener subscibe a new graph listener
-func (g *Graph) AddEventListener(l GraphEventListener) {
-	g.Lock()
-	defer g.Unlock()
-
-	g.eventListeners = append(g.eventListeners, l)
-}
-
-// RemoveEventListener unsubscribe a graph listener
-func (g *Graph) RemoveEventListener(l GraphEventListener) {
-	g.Lock()
-	defer g.Unlock()
-
-	for i, el := range g.eventListeners {
-		if l == el {
-			g.eventListeners = append(g.eventListeners[:i], g.eventListeners[i+1:]...)
-			break
-		}
-	}
-}
-
 // WithContext select a graph within a context
 func (g *Graph) WithContext(c GraphContext) (*Graph, error) {
 	return g.backend.WithContext(g, c)
@@ -1168,7 +1248,7 @@ func BackendFromConfig() (backend GraphBackend, err error) {
 
 	switch name {
 	case "memory":
-		backend, err = NewMemoryBackend()
+		backend, err = NewMemoryBackendFromConfig()
 	case "orientdb":
 		backend, err = NewOrientDBBackendFromConfig()
 	case "elasticsearch":
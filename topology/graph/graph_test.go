@@ -23,9 +23,20 @@
 package graph
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/skydive-project/skydive/filters"
 )
 
 func newGraph(t *testing.T) *Graph {
@@ -373,6 +384,71 @@ func TestEvents(t *testing.T) {
 	}
 }
 
+type FakeAsyncListener struct {
+	DefaultGraphListener
+	added   chan *Node
+	updated chan *Node
+	block   chan bool
+}
+
+func (f *FakeAsyncListener) OnNodeAdded(n *Node) {
+	<-f.block
+	f.added <- n
+}
+
+func (f *FakeAsyncListener) OnNodeUpdated(n *Node) {
+	f.updated <- n
+}
+
+func TestAsyncEvents(t *testing.T) {
+	g := newGraph(t)
+
+	l := &FakeAsyncListener{added: make(chan *Node, 10), updated: make(chan *Node, 10), block: make(chan bool)}
+	g.AddEventListenerWithOptions(l, EventListenerOptions{QueueSize: 1, Policy: OverflowDrop})
+
+	// the first event is consumed by the blocked listener, the second one is
+	// queued and the third one dropped
+	n := g.NewNode(GenID(), Metadata{"Value": 1})
+	for g.GetEventListenerStats()[0].Queued != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	g.NewNode(GenID(), Metadata{"Value": 2})
+	g.NewNode(GenID(), Metadata{"Value": 3})
+
+	stats := g.GetEventListenerStats()[0]
+	if stats.Sync || stats.Policy != "drop" || stats.Overflows != 1 || stats.Dropped != 1 {
+		t.Errorf("Wrong listener stats: %+v", stats)
+	}
+
+	close(l.block)
+	for _, value := range []int64{1, 2} {
+		select {
+		case added := <-l.added:
+			if v, _ := added.GetFieldInt64("Value"); v != value {
+				t.Errorf("Expected node with value %d, got %d", value, v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Didn't get the notification")
+		}
+	}
+
+	// the listener receives a copy of the node as it was when updated
+	g.AddMetadata(n, "Value", 4)
+	g.AddMetadata(n, "Value", 5)
+	updated := <-l.updated
+	if updated == n {
+		t.Error("Asynchronous listener should get a copy of the node")
+	}
+	if v, _ := updated.GetFieldInt64("Value"); v != 4 {
+		t.Errorf("Expected node with value 4, got %d", v)
+	}
+
+	g.RemoveEventListener(l)
+	if len(g.GetEventListenerStats()) != 0 {
+		t.Error("Listener should be removed")
+	}
+}
+
 type FakeRecursiveListener1 struct {
 	DefaultGraphListener
 	graph *Graph
@@ -410,3 +486,300 @@ func TestRecursiveEvents(t *testing.T) {
 		t.Error("Events are not in the right order")
 	}
 }
+
+func TestSyncHostRevisions(t *testing.T) {
+	b1, _ := NewMemoryBackend()
+	agent := NewGraph("agent", b1)
+
+	b2, _ := NewMemoryBackend()
+	analyzer := NewGraph("analyzer", b2)
+
+	n1 := agent.NewNode(Identifier("n1"), Metadata{"Name": "eth0"})
+	n2 := agent.NewNode(Identifier("n2"), Metadata{"Name": "eth1"})
+	agent.NewNode(Identifier("n3"), Metadata{"Name": "eth2"})
+	agent.NewEdge(Identifier("e1"), n1, n2, nil)
+	agent.AddMetadata(n2, "MTU", 1500)
+
+	analyzer.NewNode(Identifier("n1"), Metadata{"Name": "eth0"}, "agent")
+	analyzer.NewNode(Identifier("n2"), Metadata{"Name": "eth1"}, "agent")
+	analyzer.NewNode(Identifier("n4"), Metadata{"Name": "eth3"}, "agent")
+	analyzer.NewNode(Identifier("n5"), Metadata{"Name": "eth0"}, "other")
+
+	reply := analyzer.SyncHostRevisions(agent.HostRevisions("agent"))
+	if !reflect.DeepEqual(reply.Edges, []Identifier{"e1"}) {
+		t.Errorf("Expected edge e1 to be requested, got %v", reply.Edges)
+	}
+
+	nodes := []string{}
+	for _, id := range reply.Nodes {
+		nodes = append(nodes, string(id))
+	}
+	sort.Strings(nodes)
+	if !reflect.DeepEqual(nodes, []string{"n2", "n3"}) {
+		t.Errorf("Expected nodes n2 and n3 to be requested, got %v", nodes)
+	}
+
+	if analyzer.GetNode("n4") != nil {
+		t.Error("Node n4 unknown to the agent should be deleted")
+	}
+	if analyzer.GetNode("n5") == nil {
+		t.Error("Node n5 of another host should be kept")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	g1 := newGraph(t)
+	g2 := newGraph(t)
+
+	for _, g := range []*Graph{g1, g2} {
+		g.NewNode(Identifier("n1"), Metadata{"Name": "eth0", "State": "UP"})
+		g.NewNode(Identifier("n2"), Metadata{"Name": "eth1"})
+	}
+	g1.NewNode(Identifier("n3"), Metadata{"Name": "eth2"})
+	g1.NewEdge(Identifier("e1"), g1.GetNode("n1"), g1.GetNode("n3"), nil)
+
+	g2.SetMetadata(g2.GetNode("n1"), Metadata{"Name": "eth0", "State": "DOWN", "MTU": 1500})
+	g2.NewEdge(Identifier("e2"), g2.GetNode("n1"), g2.GetNode("n2"), nil)
+
+	d := g1.Diff(g2)
+	if len(d.AddedNodes) != 0 || len(d.RemovedNodes) != 1 || d.RemovedNodes[0].ID != "n3" {
+		t.Errorf("n3 should be removed, got: %+v", d)
+	}
+	if len(d.AddedEdges) != 1 || d.AddedEdges[0].ID != "e2" || len(d.RemovedEdges) != 1 || d.RemovedEdges[0].ID != "e1" {
+		t.Errorf("e2 should be added and e1 removed, got: %+v", d)
+	}
+	if len(d.UpdatedNodes) != 1 || d.UpdatedNodes[0].Node.ID != "n1" {
+		t.Fatalf("n1 should be updated, got: %+v", d)
+	}
+
+	expected := map[string]MetadataChange{
+		"State": {Old: "UP", New: "DOWN"},
+		"MTU":   {New: 1500},
+	}
+	if !reflect.DeepEqual(d.UpdatedNodes[0].Changes, expected) {
+		t.Errorf("Expected changes %v, got: %v", expected, d.UpdatedNodes[0].Changes)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	g := newGraph(t)
+	n1 := g.NewNode(GenID(), Metadata{"Name": "eth0", "MTU": 1500}, "host1")
+	n2 := g.NewNode(GenID(), Metadata{"Name": "eth1"}, "host2")
+	e1 := g.NewEdge(GenID(), n1, n2, Metadata{"RelationType": "layer2"})
+	g.AddMetadata(n2, "State", "UP")
+	g.AddMetadata(e1, "MTU", 1500)
+
+	b, err := json.Marshal(g.Snapshot())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snapshot, err := DecodeSnapshot(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g2 := newGraph(t)
+	g2.NewNode(GenID(), Metadata{"Name": "lo"})
+	if err := g2.LoadSnapshot(snapshot); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	n := g2.GetNode(n2.ID)
+	if n == nil || n.Host() != "host2" || n.revision != n2.revision || n.metadata["State"] != "UP" {
+		t.Errorf("Expected node %s, got: %s", n2.String(), n.String())
+	}
+
+	e := g2.GetEdge(e1.ID)
+	if e == nil || e1.revision != 2 || e.revision != e1.revision || e.metadata["MTU"] == nil {
+		t.Errorf("Expected edge %s, got: %s", e1.String(), e.String())
+	}
+
+	if len(g2.GetNodes(nil)) != 2 || len(g2.GetEdges(nil)) != 1 {
+		t.Errorf("Expected 2 nodes and 1 edge, got: %s", g2.String())
+	}
+
+	snapshot.Version = SnapshotVersion + 1
+	if err := g2.LoadSnapshot(snapshot); err == nil {
+		t.Error("Snapshot with an unsupported version should be rejected")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	g := newGraph(t)
+
+	var buffer bytes.Buffer
+	recorder := NewRecorder(g, &buffer, time.Second)
+	recorder.Start()
+
+	n1 := g.NewNode(GenID(), Metadata{"Name": "eth0"})
+	n2 := g.NewNode(GenID(), Metadata{"Name": "eth1"})
+	n3 := g.NewNode(GenID(), Metadata{"Name": "eth2"})
+	g.NewEdge(GenID(), n1, n2, nil)
+	g.NewEdge(GenID(), n1, n3, nil)
+	g.AddMetadata(n1, "State", "UP")
+	g.DelNode(n3)
+
+	recorder.Stop()
+
+	if lines := strings.Count(buffer.String(), "\n"); lines != 8 {
+		t.Errorf("Expected 8 recorded events, got: %d", lines)
+	}
+
+	g2 := newGraph(t)
+	if err := g2.Replay(&buffer, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(g2.GetNodes(nil)) != 2 || len(g2.GetEdges(nil)) != 1 {
+		t.Errorf("Expected 2 nodes and 1 edge, got: %s", g2.String())
+	}
+
+	n := g2.GetNode(n1.ID)
+	if n == nil || n.metadata["State"] != "UP" || n.revision != n1.revision {
+		t.Errorf("Expected node %s, got: %s", n1.String(), n.String())
+	}
+
+	if err := g2.Replay(strings.NewReader("{\"Type\": \"NodeAdded\"}\n"), 0); err == nil {
+		t.Error("Malformed recording should be rejected")
+	}
+}
+
+func TestRecorderFlush(t *testing.T) {
+	g := newGraph(t)
+
+	f, err := ioutil.TempFile("", "skydive-recorder")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+
+	recorder := NewRecorder(g, f, 50*time.Millisecond)
+	recorder.Start()
+	defer recorder.Stop()
+
+	g.NewNode(GenID(), Metadata{"Name": "eth0"})
+
+	// the event is written without waiting for the recorder to stop
+	for i := 0; i < 50; i++ {
+		b, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if strings.Count(string(b), "\n") == 1 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("Recorded event not flushed")
+}
+
+func TestMemoryIndexes(t *testing.T) {
+	g := newGraph(t)
+
+	n1 := g.NewNode(GenID(), Metadata{"Name": "eth0", "MAC": "00:00:00:00:00:01", "Type": "device"})
+	n2 := g.NewNode(GenID(), Metadata{"Name": "eth1", "MAC": "00:00:00:00:00:02", "Type": "device"})
+	g.NewNode(GenID(), Metadata{"Name": "br0", "Type": "bridge"})
+
+	if nodes := g.GetNodes(Metadata{"MAC": "00:00:00:00:00:02"}); len(nodes) != 1 || nodes[0].ID != n2.ID {
+		t.Errorf("Expected node %s, got: %v", n2.ID, nodes)
+	}
+
+	filter := filters.NewOrFilter(filters.NewTermStringFilter("Name", "eth0"), filters.NewTermStringFilter("Name", "br0"))
+	if nodes := g.GetNodes(Metadata{"Name": filter, "Type": "device"}); len(nodes) != 1 || nodes[0].ID != n1.ID {
+		t.Errorf("Expected node %s, got: %v", n1.ID, nodes)
+	}
+
+	if nodes := g.GetNodes(Metadata{"Host": filters.NewTermStringFilter("Host", g.host)}); len(nodes) != 3 {
+		t.Errorf("Expected 3 nodes, got: %v", nodes)
+	}
+
+	g.AddMetadata(n1, "MAC", "00:00:00:00:00:03")
+	if nodes := g.GetNodes(Metadata{"MAC": "00:00:00:00:00:01"}); len(nodes) != 0 {
+		t.Errorf("Expected no node, got: %v", nodes)
+	}
+	if nodes := g.GetNodes(Metadata{"MAC": "00:00:00:00:00:03"}); len(nodes) != 1 || nodes[0].ID != n1.ID {
+		t.Errorf("Expected node %s, got: %v", n1.ID, nodes)
+	}
+
+	g.DelNode(n2)
+	if nodes := g.GetNodes(Metadata{"Type": "device"}); len(nodes) != 1 || nodes[0].ID != n1.ID {
+		t.Errorf("Expected node %s, got: %v", n1.ID, nodes)
+	}
+}
+
+func TestLookupAllPathsCanceled(t *testing.T) {
+	g := newGraph(t)
+
+	// the loop-free paths of a complete graph can't be walked in time
+	var nodes []*Node
+	for i := 0; i < 12; i++ {
+		n := g.NewNode(GenID(), Metadata{"Value": i})
+		for _, peer := range nodes {
+			g.Link(peer, n, nil)
+		}
+		nodes = append(nodes, n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	paths, err := g.LookupAllPaths(ctx, nodes[0], Metadata{"Value": 12}, nil, 11)
+	if err != context.DeadlineExceeded || paths != nil {
+		t.Errorf("Expected the lookup to be aborted, got: %v, %v", len(paths), err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("The lookup was aborted after %s", elapsed)
+	}
+}
+
+func TestKShortestPaths(t *testing.T) {
+	g := newGraph(t)
+
+	// n1 - n2 - n4 and n1 - n3 - n4 with a direct n1 - n4 slow link
+	n1 := g.NewNode(GenID(), Metadata{"Name": "n1"})
+	n2 := g.NewNode(GenID(), Metadata{"Name": "n2"})
+	n3 := g.NewNode(GenID(), Metadata{"Name": "n3"})
+	n4 := g.NewNode(GenID(), Metadata{"Name": "n4", "Type": "host"})
+
+	g.Link(n1, n2, Metadata{"Latency": 5})
+	g.Link(n2, n4, Metadata{"Latency": 5})
+	g.Link(n1, n3, Metadata{"Latency": 1})
+	g.Link(n4, n3, Metadata{"Latency": 2})
+	g.Link(n1, n4, Metadata{"Latency": 20})
+
+	names := func(p *WeightedPath) (s []string) {
+		for _, n := range p.Nodes {
+			name, _ := n.GetFieldString("Name")
+			s = append(s, name)
+		}
+		return
+	}
+
+	paths := g.LookupKShortestPaths(n1, Metadata{"Type": "host"}, nil, "Latency", 5)
+	expected := []struct {
+		nodes  []string
+		weight float64
+	}{
+		{[]string{"n1", "n3", "n4"}, 3},
+		{[]string{"n1", "n2", "n4"}, 10},
+		{[]string{"n1", "n4"}, 20},
+	}
+
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected %d paths, got: %d", len(expected), len(paths))
+	}
+
+	for i, e := range expected {
+		if !reflect.DeepEqual(names(paths[i]), e.nodes) || paths[i].Weight != e.weight {
+			t.Errorf("Expected path %v with weight %f, got: %v with weight %f", e.nodes, e.weight, names(paths[i]), paths[i].Weight)
+		}
+	}
+
+	// without weight the direct link is the shortest
+	paths = g.LookupKShortestPaths(n1, Metadata{"Type": "host"}, nil, "", 1)
+	if len(paths) != 1 || !reflect.DeepEqual(names(paths[0]), []string{"n1", "n4"}) {
+		t.Errorf("Expected the direct path, got: %v", paths)
+	}
+}
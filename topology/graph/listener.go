@@ -0,0 +1,232 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+)
+
+// OverflowPolicy defines what happens to an event when the queue of an
+// asynchronous listener is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for the listener to consume an event, the graph
+	// stays locked meanwhile so the listener must not lock the graph
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop drops the event
+	OverflowDrop
+)
+
+const defaultListenerQueueSize = 1000
+
+func (p OverflowPolicy) String() string {
+	if p == OverflowDrop {
+		return "drop"
+	}
+	return "block"
+}
+
+// EventListenerOptions describes how the events are dispatched to a listener.
+// A synchronous listener is called while the graph is locked by the writer,
+// an asynchronous one is called from its own goroutine, without the graph
+// lock, with copies of the nodes and edges.
+type EventListenerOptions struct {
+	Sync      bool
+	QueueSize int
+	Policy    OverflowPolicy
+}
+
+// EventListenerStats describes the dispatching of the events to a listener
+type EventListenerStats struct {
+	Listener  string
+	Sync      bool
+	Policy    string `json:",omitempty"`
+	QueueSize int    `json:",omitempty"`
+	Queued    int
+	Delivered int64
+	Overflows int64
+	Dropped   int64
+}
+
+type eventListener struct {
+	listener  GraphEventListener
+	options   EventListenerOptions
+	queue     chan graphEvent
+	delivered int64
+	overflows int64
+	dropped   int64
+}
+
+func dispatchEvent(l GraphEventListener, ge graphEvent) {
+	switch ge.kind {
+	case nodeAdded:
+		l.OnNodeAdded(ge.element.(*Node))
+	case nodeUpdated:
+		l.OnNodeUpdated(ge.element.(*Node))
+	case nodeDeleted:
+		l.OnNodeDeleted(ge.element.(*Node))
+	case edgeAdded:
+		l.OnEdgeAdded(ge.element.(*Edge))
+	case edgeUpdated:
+		l.OnEdgeUpdated(ge.element.(*Edge))
+	case edgeDeleted:
+		l.OnEdgeDeleted(ge.element.(*Edge))
+	}
+}
+
+// copyEvent returns the event with a copy of its element, the asynchronous
+// listeners receive it once the graph has been unlocked and maybe modified
+func copyEvent(ge graphEvent) graphEvent {
+	switch e := ge.element.(type) {
+	case *Node:
+		ge.element = &Node{graphElement: e.snapshot()}
+	case *Edge:
+		ge.element = &Edge{graphElement: e.snapshot(), parent: e.parent, child: e.child}
+	}
+	return ge
+}
+
+func (l *eventListener) run() {
+	for ge := range l.queue {
+		dispatchEvent(l.listener, ge)
+		atomic.AddInt64(&l.delivered, 1)
+	}
+}
+
+func (l *eventListener) enqueue(ge graphEvent) {
+	select {
+	case l.queue <- ge:
+		return
+	default:
+	}
+
+	if atomic.AddInt64(&l.overflows, 1) == 1 {
+		logging.GetLogger().Warningf("Graph event queue of %T is full, policy %s", l.listener, l.options.Policy)
+	}
+
+	if l.options.Policy == OverflowDrop {
+		atomic.AddInt64(&l.dropped, 1)
+		return
+	}
+	l.queue <- ge
+}
+
+func (l *eventListener) stats() EventListenerStats {
+	stats := EventListenerStats{
+		Listener:  fmt.Sprintf("%T", l.listener),
+		Sync:      l.options.Sync,
+		Delivered: atomic.LoadInt64(&l.delivered),
+		Overflows: atomic.LoadInt64(&l.overflows),
+		Dropped:   atomic.LoadInt64(&l.dropped),
+	}
+	if !l.options.Sync {
+		stats.Policy = l.options.Policy.String()
+		stats.QueueSize = l.options.QueueSize
+		stats.Queued = len(l.queue)
+	}
+	return stats
+}
+
+func newEventListener(l GraphEventListener, options EventListenerOptions) *eventListener {
+	el := &eventListener{listener: l, options: options}
+	if !options.Sync {
+		if el.options.QueueSize <= 0 {
+			el.options.QueueSize = defaultListenerQueueSize
+		}
+		el.queue = make(chan graphEvent, el.options.QueueSize)
+		go el.run()
+	}
+	return el
+}
+
+// AsyncEventListenerOptions returns the options of the asynchronous
+// listeners set by graph.events.queue_size and graph.events.overflow_policy
+func AsyncEventListenerOptions() EventListenerOptions {
+	cfg := config.GetConfig()
+
+	options := EventListenerOptions{QueueSize: cfg.GetInt("graph.events.queue_size")}
+	switch policy := cfg.GetString("graph.events.overflow_policy"); policy {
+	case "drop":
+		options.Policy = OverflowDrop
+	case "", "block":
+	default:
+		logging.GetLogger().Errorf("Unknown graph event overflow policy %s, using block", policy)
+	}
+	return options
+}
+
+// AddEventListener subscribe a new graph listener called while the graph is
+// locked, in the order of the events, the listener can then read and modify
+// the graph
+func (g *Graph) AddEventListener(l GraphEventListener) {
+	g.AddEventListenerWithOptions(l, EventListenerOptions{Sync: true})
+}
+
+// AddAsyncEventListener subscribe a new asynchronous graph listener with the
+// options of the configuration
+func (g *Graph) AddAsyncEventListener(l GraphEventListener) {
+	g.AddEventListenerWithOptions(l, AsyncEventListenerOptions())
+}
+
+// AddEventListenerWithOptions subscribe a new graph listener
+func (g *Graph) AddEventListenerWithOptions(l GraphEventListener, options EventListenerOptions) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.eventListeners = append(g.eventListeners, newEventListener(l, options))
+}
+
+// RemoveEventListener unsubscribe a graph listener, an asynchronous listener
+// still receives the events already queued
+func (g *Graph) RemoveEventListener(l GraphEventListener) {
+	g.Lock()
+	defer g.Unlock()
+
+	for i, el := range g.eventListeners {
+		if l == el.listener {
+			if el.queue != nil {
+				close(el.queue)
+			}
+			g.eventListeners = append(g.eventListeners[:i], g.eventListeners[i+1:]...)
+			break
+		}
+	}
+}
+
+// GetEventListenerStats returns the statistics of the dispatching of the
+// events to the listeners
+func (g *Graph) GetEventListenerStats() []EventListenerStats {
+	g.RLock()
+	defer g.RUnlock()
+
+	stats := make([]EventListenerStats, len(g.eventListeners))
+	for i, el := range g.eventListeners {
+		stats[i] = el.stats()
+	}
+	return stats
+}
@@ -24,8 +24,10 @@ package graph
 
 import (
 	"errors"
+	"time"
 
 	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
 )
 
 // MemoryBackendNode a memory backend node
@@ -42,12 +44,27 @@ type MemoryBackendEdge struct {
 // MemoryBackend describes the memory backend
 type MemoryBackend struct {
 	GraphBackend
-	nodes map[Identifier]*MemoryBackendNode
-	edges map[Identifier]*MemoryBackendEdge
+	nodes   map[Identifier]*MemoryBackendNode
+	edges   map[Identifier]*MemoryBackendEdge
+	history *memoryHistory
+	indexes struct {
+		nodes *memoryIndex
+		edges *memoryIndex
+	}
 }
 
 // MetadataUpdated return true
 func (m *MemoryBackend) MetadataUpdated(i interface{}) bool {
+	if m.history != nil {
+		m.history.metadataUpdated(i)
+	}
+
+	switch i := i.(type) {
+	case *Node:
+		m.indexes.nodes.update(&i.graphElement)
+	case *Edge:
+		m.indexes.edges.update(&i.graphElement)
+	}
 	return true
 }
 
@@ -70,12 +87,25 @@ func (m *MemoryBackend) EdgeAdded(e *Edge) bool {
 	m.edges[e.ID] = edge
 	parent.edges[e.ID] = edge
 	child.edges[e.ID] = edge
+	m.indexes.edges.add(&e.graphElement)
+
+	if m.history != nil {
+		m.history.edgeAdded(e)
+	}
 
 	return true
 }
 
 // GetEdge in the graph backend
 func (m *MemoryBackend) GetEdge(i Identifier, t *common.TimeSlice) []*Edge {
+	if t != nil && m.history != nil {
+		edges := m.history.getEdge(i, t)
+		if e, ok := m.edges[i]; ok && e.inTimeSlice(t, time.Time{}) {
+			edges = append(edges, e.Edge)
+		}
+		return edges
+	}
+
 	if e, ok := m.edges[i]; ok {
 		return []*Edge{e.Edge}
 	}
@@ -84,6 +114,10 @@ func (m *MemoryBackend) GetEdge(i Identifier, t *common.TimeSlice) []*Edge {
 
 // GetEdgeNodes return a list of nodes of an edge
 func (m *MemoryBackend) GetEdgeNodes(e *Edge, t *common.TimeSlice, parentMetadata, childMetadata Metadata) ([]*Node, []*Node) {
+	if t != nil && m.history != nil {
+		return m.getEdgeNodesAt(e, t, parentMetadata, childMetadata)
+	}
+
 	var parent *MemoryBackendNode
 	if n, ok := m.nodes[e.parent]; ok && n.MatchMetadata(parentMetadata) {
 		parent = n
@@ -101,18 +135,51 @@ func (m *MemoryBackend) GetEdgeNodes(e *Edge, t *common.TimeSlice, parentMetadat
 	return []*Node{parent.Node}, []*Node{child.Node}
 }
 
+func (m *MemoryBackend) getEdgeNodesAt(e *Edge, t *common.TimeSlice, parentMetadata, childMetadata Metadata) (parents []*Node, children []*Node) {
+	for _, n := range m.GetNode(e.parent, t) {
+		if n.MatchMetadata(parentMetadata) {
+			parents = append(parents, n)
+		}
+	}
+
+	for _, n := range m.GetNode(e.child, t) {
+		if n.MatchMetadata(childMetadata) {
+			children = append(children, n)
+		}
+	}
+
+	if len(parents) == 0 || len(children) == 0 {
+		return nil, nil
+	}
+
+	return
+}
+
 // NodeAdded in the graph backend
 func (m *MemoryBackend) NodeAdded(n *Node) bool {
 	m.nodes[n.ID] = &MemoryBackendNode{
 		Node:  n,
 		edges: make(map[Identifier]*MemoryBackendEdge),
 	}
+	m.indexes.nodes.add(&n.graphElement)
+
+	if m.history != nil {
+		m.history.nodeAdded(n)
+	}
 
 	return true
 }
 
 // GetNode from the graph backend
 func (m *MemoryBackend) GetNode(i Identifier, t *common.TimeSlice) []*Node {
+	if t != nil && m.history != nil {
+		nodes := m.history.getNode(i, t)
+		if n, ok := m.nodes[i]; ok && n.inTimeSlice(t, time.Time{}) {
+			nodes = append(nodes, n.Node)
+		}
+		return nodes
+	}
+
 	if n, ok := m.nodes[i]; ok {
 		return []*Node{n.Node}
 	}
@@ -123,8 +190,15 @@ func (m *MemoryBackend) GetNode(i Identifier, t *common.TimeSlice) []*Node {
 func (m *MemoryBackend) GetNodeEdges(n *Node, t *common.TimeSlice, meta Metadata) []*Edge {
 	edges := []*Edge{}
 
+	if t != nil && m.history != nil {
+		edges = append(edges, m.history.getNodeEdges(n, t, meta)...)
+	}
+
 	if n, ok := m.nodes[n.ID]; ok {
 		for _, e := range n.edges {
+			if t != nil && m.history != nil && !e.inTimeSlice(t, time.Time{}) {
+				continue
+			}
 			if e.MatchMetadata(meta) {
 				edges = append(edges, e.Edge)
 			}
@@ -149,6 +223,11 @@ func (m *MemoryBackend) EdgeDeleted(e *Edge) bool {
 	}
 
 	delete(m.edges, e.ID)
+	m.indexes.edges.del(e.ID)
+
+	if m.history != nil {
+		m.history.edgeDeleted(e)
+	}
 
 	return true
 }
@@ -156,42 +235,157 @@ func (m *MemoryBackend) EdgeDeleted(e *Edge) bool {
 // NodeDeleted in the graph backend
 func (m *MemoryBackend) NodeDeleted(n *Node) bool {
 	delete(m.nodes, n.ID)
+	m.indexes.nodes.del(n.ID)
+
+	if m.history != nil {
+		m.history.nodeDeleted(n)
+	}
 
 	return true
 }
 
 // GetNodes from the graph backend
 func (m MemoryBackend) GetNodes(t *common.TimeSlice, metadata Metadata) (nodes []*Node) {
-	for _, n := range m.nodes {
+	if t != nil && m.history != nil {
+		nodes = m.history.getNodes(t, metadata)
+	}
+
+	match := func(n *MemoryBackendNode) {
+		if t != nil && m.history != nil && !n.inTimeSlice(t, time.Time{}) {
+			return
+		}
 		if n.MatchMetadata(metadata) {
 			nodes = append(nodes, n.Node)
 		}
 	}
+
+	if ids, ok := m.indexes.nodes.lookup(metadata); ok {
+		for id := range ids {
+			if n, ok := m.nodes[id]; ok {
+				match(n)
+			}
+		}
+		return
+	}
+
+	for _, n := range m.nodes {
+		match(n)
+	}
 	return
 }
 
 // GetEdges from the graph backend
 func (m MemoryBackend) GetEdges(t *common.TimeSlice, metadata Metadata) (edges []*Edge) {
-	for _, e := range m.edges {
+	if t != nil && m.history != nil {
+		edges = m.history.getEdges(t, metadata)
+	}
+
+	match := func(e *MemoryBackendEdge) {
+		if t != nil && m.history != nil && !e.inTimeSlice(t, time.Time{}) {
+			return
+		}
 		if e.MatchMetadata(metadata) {
 			edges = append(edges, e.Edge)
 		}
 	}
+
+	if ids, ok := m.indexes.edges.lookup(metadata); ok {
+		for id := range ids {
+			if e, ok := m.edges[id]; ok {
+				match(e)
+			}
+		}
+		return
+	}
+
+	for _, e := range m.edges {
+		match(e)
+	}
 	return
 }
 
 // WithContext return a graph based on context
 func (m *MemoryBackend) WithContext(graph *Graph, context GraphContext) (*Graph, error) {
-	if context.TimeSlice != nil {
-		return nil, errors.New("Memory backend does not support history")
+	if context.TimeSlice == nil {
+		return graph, nil
 	}
-	return graph, nil
+
+	if m.history == nil {
+		return nil, errors.New("Memory backend history is not enabled")
+	}
+
+	return &Graph{
+		backend: graph.backend,
+		context: context,
+		host:    graph.host,
+	}, nil
 }
 
-// NewMemoryBackend create a new graph memory backend
+// HistoryStats returns the statistics of the history, nil if not enabled
+func (m *MemoryBackend) HistoryStats() *HistoryStats {
+	if m.history == nil {
+		return nil
+	}
+	return m.history.stats()
+}
+
+// SetIndexes replaces the metadata keys indexed by the backend, the lookups
+// on these keys, by value or term filter, use the indexes
+func (m *MemoryBackend) SetIndexes(keys []string) {
+	m.indexes.nodes = newMemoryIndex(keys)
+	for _, n := range m.nodes {
+		m.indexes.nodes.add(&n.graphElement)
+	}
+
+	m.indexes.edges = newMemoryIndex(keys)
+	for _, e := range m.edges {
+		m.indexes.edges.add(&e.graphElement)
+	}
+}
+
+// NewMemoryBackend create a new graph memory backend indexing the
+// DefaultMemoryIndexes keys
 func NewMemoryBackend() (*MemoryBackend, error) {
-	return &MemoryBackend{
+	m := &MemoryBackend{
 		nodes: make(map[Identifier]*MemoryBackendNode),
 		edges: make(map[Identifier]*MemoryBackendEdge),
-	}, nil
+	}
+	m.SetIndexes(DefaultMemoryIndexes)
+	return m, nil
+}
+
+// NewMemoryBackendWithHistory create a new graph memory backend keeping the
+// previous revisions of the nodes and edges during duration and up to
+// maxRevisions revisions, a zero value meaning no limit
+func NewMemoryBackendWithHistory(duration time.Duration, maxRevisions int) (*MemoryBackend, error) {
+	if duration <= 0 && maxRevisions <= 0 {
+		return nil, errors.New("Memory backend history requires a duration or a number of revisions")
+	}
+
+	m, _ := NewMemoryBackend()
+	m.history = newMemoryHistory(duration, maxRevisions)
+
+	return m, nil
+}
+
+// NewMemoryBackendFromConfig create a new graph memory backend, with history
+// and indexes if configured
+func NewMemoryBackendFromConfig() (m *MemoryBackend, err error) {
+	cfg := config.GetConfig()
+	duration := time.Duration(cfg.GetInt("graph.memory.history_duration")) * time.Second
+	maxRevisions := cfg.GetInt("graph.memory.history_revisions")
+
+	if duration <= 0 && maxRevisions <= 0 {
+		m, err = NewMemoryBackend()
+	} else {
+		m, err = NewMemoryBackendWithHistory(duration, maxRevisions)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.IsSet("graph.memory.indexes") {
+		m.SetIndexes(cfg.GetStringSlice("graph.memory.indexes"))
+	}
+	return m, nil
 }
@@ -0,0 +1,358 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+)
+
+// HistoryStats describes the history kept in memory by a graph backend, Size
+// is an estimation in bytes of the memory used by the revisions, including
+// the copies of the current revisions
+type HistoryStats struct {
+	MaxDuration  time.Duration
+	MaxRevisions int
+	Revisions    int
+	Size         int64
+	Oldest       int64 `json:",omitempty"`
+}
+
+type historyBackend interface {
+	HistoryStats() *HistoryStats
+}
+
+// GetHistoryStats returns the statistics of the history kept in memory by the
+// graph backend
+func (g *Graph) GetHistoryStats() (*HistoryStats, error) {
+	if h, ok := g.backend.(historyBackend); ok {
+		if stats := h.HistoryStats(); stats != nil {
+			return stats, nil
+		}
+	}
+	return nil, errors.New("Graph backend does not keep any history in memory")
+}
+
+type memoryRevision struct {
+	node       *Node
+	edge       *Edge
+	archivedAt time.Time
+	size       int64
+}
+
+// memoryHistory keeps the previous revisions of the nodes and edges, the
+// oldest ones are dropped when they exceed the duration or the number of
+// revisions. The updates are done with the graph lock held, the lookups with
+// the read lock only, lookupLock serializes them as they expire revisions.
+type memoryHistory struct {
+	lookupLock   sync.Mutex
+	duration     time.Duration
+	maxRevisions int
+	current      map[Identifier]*memoryRevision
+	nodes        map[Identifier][]*memoryRevision
+	edges        map[Identifier][]*memoryRevision
+	nodeEdges    map[Identifier]map[Identifier]bool
+	queue        []*memoryRevision
+	size         int64
+}
+
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Metadata:
+		return Metadata(copyMap(v))
+	case map[string]interface{}:
+		return copyMap(v)
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = copyValue(e)
+		}
+		return l
+	}
+	return v
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+// the metadata of the elements are updated in place, a deep copy of the
+// current revision is kept so that it can be archived on the next update
+func (e *graphElement) snapshot() graphElement {
+	c := *e
+	c.metadata = Metadata(copyMap(e.metadata))
+	return c
+}
+
+func (e *graphElement) inTimeSlice(t *common.TimeSlice, archivedAt time.Time) bool {
+	if common.UnixMillis(e.createdAt) > t.Last || common.UnixMillis(e.updatedAt) > t.Last {
+		return false
+	}
+	if !e.deletedAt.IsZero() && common.UnixMillis(e.deletedAt) <= t.Start {
+		return false
+	}
+	return archivedAt.IsZero() || common.UnixMillis(archivedAt) > t.Start
+}
+
+// valueSize estimates the memory used by a metadata value, the size of the
+// scalars is counted as a word
+func valueSize(v interface{}) (size int64) {
+	switch v := v.(type) {
+	case string:
+		return int64(len(v))
+	case Metadata:
+		return valueSize(map[string]interface{}(v))
+	case map[string]interface{}:
+		for k, e := range v {
+			size += int64(len(k)) + valueSize(e)
+		}
+	case []interface{}:
+		for _, e := range v {
+			size += valueSize(e)
+		}
+	case []string:
+		for _, e := range v {
+			size += int64(len(e))
+		}
+	default:
+		size = 8
+	}
+	return
+}
+
+// the size of a revision is estimated from its identifiers and metadata
+func (e *graphElement) size() int64 {
+	return int64(len(e.ID)+len(e.host)) + valueSize(e.metadata)
+}
+
+func (h *memoryHistory) setCurrent(id Identifier, r *memoryRevision, size int64) {
+	r.size = size
+	h.size += size
+	h.current[id] = r
+}
+
+func (h *memoryHistory) nodeAdded(n *Node) {
+	r := &memoryRevision{node: &Node{graphElement: n.snapshot()}}
+	h.setCurrent(n.ID, r, r.node.size())
+}
+
+func (h *memoryHistory) edgeAdded(e *Edge) {
+	r := &memoryRevision{edge: &Edge{graphElement: e.snapshot(), parent: e.parent, child: e.child}}
+	h.setCurrent(e.ID, r, r.edge.size()+int64(len(e.parent)+len(e.child)))
+}
+
+func (h *memoryHistory) metadataUpdated(i interface{}) {
+	switch i := i.(type) {
+	case *Node:
+		h.archive(i.ID, i.updatedAt, time.Time{})
+		h.nodeAdded(i)
+	case *Edge:
+		h.archive(i.ID, i.updatedAt, time.Time{})
+		h.edgeAdded(i)
+	}
+}
+
+func (h *memoryHistory) nodeDeleted(n *Node) {
+	h.archive(n.ID, n.deletedAt, n.deletedAt)
+}
+
+func (h *memoryHistory) edgeDeleted(e *Edge) {
+	h.archive(e.ID, e.deletedAt, e.deletedAt)
+}
+
+func (h *memoryHistory) archive(id Identifier, at time.Time, deletedAt time.Time) {
+	r, ok := h.current[id]
+	if !ok {
+		return
+	}
+	delete(h.current, id)
+
+	if at.IsZero() {
+		at = time.Now().UTC()
+	}
+	r.archivedAt = at
+
+	if r.node != nil {
+		r.node.deletedAt = deletedAt
+		h.nodes[id] = append(h.nodes[id], r)
+	} else {
+		r.edge.deletedAt = deletedAt
+		h.edges[id] = append(h.edges[id], r)
+		for _, n := range []Identifier{r.edge.parent, r.edge.child} {
+			if _, ok := h.nodeEdges[n]; !ok {
+				h.nodeEdges[n] = make(map[Identifier]bool)
+			}
+			h.nodeEdges[n][id] = true
+		}
+	}
+
+	h.queue = append(h.queue, r)
+	h.expire(time.Now().UTC())
+}
+
+// expire drops the oldest revisions, being the oldest of the queue they are
+// also the oldest of their element
+func (h *memoryHistory) expire(now time.Time) {
+	for len(h.queue) > 0 {
+		r := h.queue[0]
+		if (h.maxRevisions <= 0 || len(h.queue) <= h.maxRevisions) &&
+			(h.duration <= 0 || now.Sub(r.archivedAt) <= h.duration) {
+			return
+		}
+		h.queue[0] = nil
+		h.queue = h.queue[1:]
+		h.size -= r.size
+
+		if r.node != nil {
+			id := r.node.ID
+			if h.nodes[id] = h.nodes[id][1:]; len(h.nodes[id]) == 0 {
+				delete(h.nodes, id)
+			}
+			continue
+		}
+
+		id := r.edge.ID
+		if h.edges[id] = h.edges[id][1:]; len(h.edges[id]) == 0 {
+			delete(h.edges, id)
+			for _, n := range []Identifier{r.edge.parent, r.edge.child} {
+				if delete(h.nodeEdges[n], id); len(h.nodeEdges[n]) == 0 {
+					delete(h.nodeEdges, n)
+				}
+			}
+		}
+	}
+}
+
+// lookup expires the revisions so that the duration is enforced even without
+// any graph update, the caller has to release lookupLock
+func (h *memoryHistory) lookup() {
+	h.lookupLock.Lock()
+	h.expire(time.Now().UTC())
+}
+
+func (h *memoryHistory) getNode(i Identifier, t *common.TimeSlice) (nodes []*Node) {
+	h.lookup()
+	defer h.lookupLock.Unlock()
+
+	for _, r := range h.nodes[i] {
+		if r.node.inTimeSlice(t, r.archivedAt) {
+			nodes = append(nodes, r.node)
+		}
+	}
+	return
+}
+
+func (h *memoryHistory) edgeRevisions(i Identifier, t *common.TimeSlice) (edges []*Edge) {
+	for _, r := range h.edges[i] {
+		if r.edge.inTimeSlice(t, r.archivedAt) {
+			edges = append(edges, r.edge)
+		}
+	}
+	return
+}
+
+func (h *memoryHistory) getEdge(i Identifier, t *common.TimeSlice) []*Edge {
+	h.lookup()
+	defer h.lookupLock.Unlock()
+
+	return h.edgeRevisions(i, t)
+}
+
+func (h *memoryHistory) getNodeEdges(n *Node, t *common.TimeSlice, m Metadata) (edges []*Edge) {
+	h.lookup()
+	defer h.lookupLock.Unlock()
+
+	for id := range h.nodeEdges[n.ID] {
+		for _, e := range h.edgeRevisions(id, t) {
+			if e.MatchMetadata(m) {
+				edges = append(edges, e)
+			}
+		}
+	}
+	return
+}
+
+func (h *memoryHistory) getNodes(t *common.TimeSlice, m Metadata) (nodes []*Node) {
+	h.lookup()
+	defer h.lookupLock.Unlock()
+
+	for _, revisions := range h.nodes {
+		for _, r := range revisions {
+			if r.node.inTimeSlice(t, r.archivedAt) && r.node.MatchMetadata(m) {
+				nodes = append(nodes, r.node)
+			}
+		}
+	}
+	return
+}
+
+func (h *memoryHistory) getEdges(t *common.TimeSlice, m Metadata) (edges []*Edge) {
+	h.lookup()
+	defer h.lookupLock.Unlock()
+
+	for _, revisions := range h.edges {
+		for _, r := range revisions {
+			if r.edge.inTimeSlice(t, r.archivedAt) && r.edge.MatchMetadata(m) {
+				edges = append(edges, r.edge)
+			}
+		}
+	}
+	return
+}
+
+func (h *memoryHistory) stats() *HistoryStats {
+	h.lookup()
+	defer h.lookupLock.Unlock()
+
+	stats := &HistoryStats{
+		MaxDuration:  h.duration,
+		MaxRevisions: h.maxRevisions,
+		Revisions:    len(h.queue),
+		Size:         h.size,
+	}
+	if len(h.queue) > 0 {
+		stats.Oldest = common.UnixMillis(h.queue[0].archivedAt)
+	}
+	return stats
+}
+
+func newMemoryHistory(duration time.Duration, maxRevisions int) *memoryHistory {
+	return &memoryHistory{
+		duration:     duration,
+		maxRevisions: maxRevisions,
+		current:      make(map[Identifier]*memoryRevision),
+		nodes:        make(map[Identifier][]*memoryRevision),
+		edges:        make(map[Identifier][]*memoryRevision),
+		nodeEdges:    make(map[Identifier]map[Identifier]bool),
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/skydive-project/skydive/filters"
+)
+
+// DefaultMemoryIndexes metadata keys indexed by default by the memory backend
+var DefaultMemoryIndexes = []string{"MAC", "TID", "IPV4", "Name", "Type", "Host"}
+
+// memoryIndex indexes the elements by the values of some of their fields.
+// Only strings and numbers are indexed, numbers and strings holding an
+// integer are also indexed by their integer value so that the term filters
+// find the same elements as when evaluated.
+type memoryIndex struct {
+	keys     map[string]map[string]map[Identifier]bool
+	elements map[Identifier]map[string][]string
+}
+
+// the index is only an hint, the elements it returns are always matched
+// against the metadata afterwards
+func indexValues(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return []string{"s:" + v, "i:" + strconv.FormatInt(i, 10)}
+		}
+		return []string{"s:" + v}
+	case int:
+		return []string{"i:" + strconv.FormatInt(int64(v), 10)}
+	case int32:
+		return []string{"i:" + strconv.FormatInt(int64(v), 10)}
+	case int64:
+		return []string{"i:" + strconv.FormatInt(v, 10)}
+	case uint:
+		return []string{"i:" + strconv.FormatInt(int64(v), 10)}
+	case uint32:
+		return []string{"i:" + strconv.FormatInt(int64(v), 10)}
+	case uint64:
+		return []string{"i:" + strconv.FormatInt(int64(v), 10)}
+	case float32:
+		return []string{"i:" + strconv.FormatInt(int64(v), 10)}
+	case float64:
+		return []string{"i:" + strconv.FormatInt(int64(v), 10)}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return []string{"i:" + strconv.FormatInt(i, 10)}
+		}
+		if f, err := v.Float64(); err == nil {
+			return []string{"i:" + strconv.FormatInt(int64(f), 10)}
+		}
+	}
+	return nil
+}
+
+func isElementField(key string) bool {
+	switch key {
+	case "ID", "Host", "CreatedAt", "UpdatedAt", "DeletedAt", "Revision":
+		return true
+	}
+	return false
+}
+
+func (x *memoryIndex) add(e *graphElement) {
+	// the element may be added again with the same ID, a snapshot for
+	// instance, its previous values must not stay in the index
+	x.del(e.ID)
+
+	values := make(map[string][]string)
+	for key, index := range x.keys {
+		v, err := e.GetField(key)
+		if err != nil {
+			continue
+		}
+		for _, value := range indexValues(v) {
+			ids, ok := index[value]
+			if !ok {
+				ids = make(map[Identifier]bool)
+				index[value] = ids
+			}
+			ids[e.ID] = true
+			values[key] = append(values[key], value)
+		}
+	}
+	x.elements[e.ID] = values
+}
+
+func (x *memoryIndex) del(id Identifier) {
+	for key, values := range x.elements[id] {
+		index := x.keys[key]
+		for _, value := range values {
+			if delete(index[value], id); len(index[value]) == 0 {
+				delete(index, value)
+			}
+		}
+	}
+	delete(x.elements, id)
+}
+
+// update has to be called once the metadata have been modified, the
+// previous values are known thanks to the elements map
+func (x *memoryIndex) update(e *graphElement) {
+	x.add(e)
+}
+
+func (x *memoryIndex) lookupValues(key string, values []string) (map[Identifier]bool, bool) {
+	index, ok := x.keys[key]
+	if !ok {
+		return nil, false
+	}
+
+	if len(values) == 1 {
+		return index[values[0]], true
+	}
+
+	ids := make(map[Identifier]bool)
+	for _, value := range values {
+		for id := range index[value] {
+			ids[id] = true
+		}
+	}
+	return ids, true
+}
+
+// lookupFilter returns the elements that may match the filter, false if the
+// filter can't use the index
+func (x *memoryIndex) lookupFilter(f *filters.Filter) (map[Identifier]bool, bool) {
+	switch {
+	case f.TermStringFilter != nil:
+		return x.lookupValues(f.TermStringFilter.Key, []string{"s:" + f.TermStringFilter.Value})
+	case f.TermInt64Filter != nil:
+		return x.lookupValues(f.TermInt64Filter.Key, indexValues(f.TermInt64Filter.Value))
+	case f.BoolFilter != nil:
+		switch f.BoolFilter.Op {
+		case filters.BoolFilterOp_AND:
+			return x.lookupSmallest(f.BoolFilter.Filters)
+		case filters.BoolFilterOp_OR:
+			union := make(map[Identifier]bool)
+			for _, filter := range f.BoolFilter.Filters {
+				ids, ok := x.lookupFilter(filter)
+				if !ok {
+					return nil, false
+				}
+				for id := range ids {
+					union[id] = true
+				}
+			}
+			return union, true
+		}
+	}
+	return nil, false
+}
+
+func (x *memoryIndex) lookupSmallest(list []*filters.Filter) (ids map[Identifier]bool, found bool) {
+	for _, filter := range list {
+		if i, ok := x.lookupFilter(filter); ok && (!found || len(i) < len(ids)) {
+			ids, found = i, true
+		}
+	}
+	return
+}
+
+// lookup returns the elements that may match the metadata, false if none of
+// the metadata can use the index
+func (x *memoryIndex) lookup(m Metadata) (ids map[Identifier]bool, found bool) {
+	for k, v := range m {
+		var i map[Identifier]bool
+		var ok bool
+
+		switch v := v.(type) {
+		case *filters.Filter:
+			i, ok = x.lookupFilter(v)
+		case string, int, int32, int64, uint, uint32, uint64, float32, float64:
+			// plain values are compared to the metadata, not to the fields
+			if isElementField(k) {
+				continue
+			}
+			values := indexValues(v)
+			if _, isString := v.(string); isString {
+				values = values[:1]
+			}
+			i, ok = x.lookupValues(k, values)
+		}
+
+		if ok && (!found || len(i) < len(ids)) {
+			ids, found = i, true
+		}
+	}
+	return
+}
+
+func newMemoryIndex(keys []string) *memoryIndex {
+	x := &memoryIndex{
+		keys:     make(map[string]map[string]map[Identifier]bool),
+		elements: make(map[Identifier]map[string][]string),
+	}
+	for _, key := range keys {
+		x.keys[key] = make(map[string]map[Identifier]bool)
+	}
+	return x
+}
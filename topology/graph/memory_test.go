@@ -24,6 +24,9 @@ package graph
 
 import (
 	"testing"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
 )
 
 func TestAddEdgeMissingNode(t *testing.T) {
@@ -45,3 +48,124 @@ func TestAddEdgeMissingNode(t *testing.T) {
 		t.Error("Edge inserted with missing nodes")
 	}
 }
+
+func TestIndexReAddedNode(t *testing.T) {
+	b, err := NewMemoryBackend()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g := NewGraphFromConfig(b)
+
+	n := g.NewNode(Identifier("n1"), Metadata{"Name": "eth0", "Type": "device"})
+
+	// same ID added again with other metadata, as a snapshot can do
+	g.NewNode(Identifier("n1"), Metadata{"Name": "eth1", "Type": "device"})
+
+	if nodes := g.GetNodes(Metadata{"Name": "eth0"}); len(nodes) != 0 {
+		t.Errorf("Expected no node, got: %v", nodes)
+	}
+
+	g.DelNode(n)
+	if nodes := g.GetNodes(Metadata{"Type": "device"}); len(nodes) != 0 {
+		t.Errorf("Expected no node, got: %v", nodes)
+	}
+	if nodes := g.GetNodes(Metadata{"Name": "eth1"}); len(nodes) != 0 {
+		t.Errorf("Expected no node, got: %v", nodes)
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	b, err := NewMemoryBackendWithHistory(time.Hour, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g := NewGraphFromConfig(b)
+
+	t0 := time.Now().UTC().Add(-10 * time.Minute)
+	n := g.newNode(Identifier("n1"), Metadata{"State": "UP"}, t0)
+	g.addMetadata(n, "State", "DOWN", t0.Add(time.Minute))
+	g.delNode(n, t0.Add(2*time.Minute))
+
+	stateAt := func(at time.Time) interface{} {
+		ms := common.UnixMillis(at)
+		gc, err := g.WithContext(GraphContext{TimeSlice: common.NewTimeSlice(ms, ms)})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if n := gc.GetNode("n1"); n != nil {
+			return n.metadata["State"]
+		}
+		return nil
+	}
+
+	if state := stateAt(t0.Add(30 * time.Second)); state != "UP" {
+		t.Errorf("Expected state UP, got: %v", state)
+	}
+	if state := stateAt(t0.Add(90 * time.Second)); state != "DOWN" {
+		t.Errorf("Expected state DOWN, got: %v", state)
+	}
+	if state := stateAt(t0.Add(3 * time.Minute)); state != nil {
+		t.Errorf("Expected node to be deleted, got: %v", state)
+	}
+
+	stats, err := g.GetHistoryStats()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stats.Revisions != 2 || stats.Size == 0 {
+		t.Errorf("Expected 2 revisions, got: %+v", stats)
+	}
+
+	// the revisions are estimated from their identifier and metadata
+	if size := int64(2*(len("n1State")+len(n.Host())) + len("UP") + len("DOWN")); stats.Size != size {
+		t.Errorf("Expected a size of %d, got: %d", size, stats.Size)
+	}
+
+	b, _ = NewMemoryBackendWithHistory(0, 1)
+	g = NewGraphFromConfig(b)
+	n = g.newNode(Identifier("n1"), Metadata{"State": "UP"}, t0)
+	g.addMetadata(n, "State", "DOWN", t0.Add(time.Minute))
+	g.delNode(n, t0.Add(2*time.Minute))
+
+	if stats, _ = g.GetHistoryStats(); stats.Revisions != 1 {
+		t.Errorf("Expected 1 revision, got: %+v", stats)
+	}
+	if state := stateAt(t0.Add(30 * time.Second)); state != nil {
+		t.Errorf("Expected first revision to be expired, got: %v", state)
+	}
+}
+
+func TestMemoryHistoryExpireIdle(t *testing.T) {
+	b, err := NewMemoryBackendWithHistory(200*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g := NewGraphFromConfig(b)
+
+	now := time.Now().UTC()
+	n := g.newNode(Identifier("n1"), Metadata{"State": "UP"}, now)
+	g.addMetadata(n, "State", "DOWN", now)
+
+	ms := common.UnixMillis(now)
+	gc, err := g.WithContext(GraphContext{TimeSlice: common.NewTimeSlice(ms-1000, ms)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if stats, _ := g.GetHistoryStats(); stats.Revisions != 1 {
+		t.Fatalf("Expected 1 revision, got: %+v", stats)
+	}
+	if nodes := gc.GetNodes(Metadata{"State": "UP"}); len(nodes) != 1 {
+		t.Fatalf("Expected the archived revision, got: %v", nodes)
+	}
+
+	// no graph update, the revision expires on the next lookup
+	time.Sleep(400 * time.Millisecond)
+
+	if nodes := gc.GetNodes(Metadata{"State": "UP"}); len(nodes) != 0 {
+		t.Errorf("Expected the revision to be expired, got: %v", nodes)
+	}
+	if stats, _ := g.GetHistoryStats(); stats.Revisions != 0 || stats.Size != n.size() {
+		t.Errorf("Expected only the current revision, got: %+v", stats)
+	}
+}
@@ -36,18 +36,23 @@ const (
 	SyncRequestMsgType      = "SyncRequest"
 	SyncReplyMsgType        = "SyncReply"
 	HostGraphDeletedMsgType = "HostGraphDeleted"
-	NodeUpdatedMsgType      = "NodeUpdated"
-	NodeDeletedMsgType      = "NodeDeleted"
-	NodeAddedMsgType        = "NodeAdded"
-	EdgeUpdatedMsgType      = "EdgeUpdated"
-	EdgeDeletedMsgType      = "EdgeDeleted"
-	EdgeAddedMsgType        = "EdgeAdded"
+	// SyncRevisionsMsgType is sent by an agent with the revisions of its
+	// nodes and edges, the reply lists the ones to be sent
+	SyncRevisionsMsgType      = "SyncRevisions"
+	SyncRevisionsReplyMsgType = "SyncRevisionsReply"
+	NodeUpdatedMsgType        = "NodeUpdated"
+	NodeDeletedMsgType        = "NodeDeleted"
+	NodeAddedMsgType          = "NodeAdded"
+	EdgeUpdatedMsgType        = "EdgeUpdated"
+	EdgeDeletedMsgType        = "EdgeDeleted"
+	EdgeAddedMsgType          = "EdgeAdded"
 )
 
 // Graph error message
 var (
-	ErrSyncRequestMalFormed  = errors.New("SyncRequestMsg malformed")
-	ErrSyncReplyMsgMalFormed = errors.New("SyncReplyMsg malformed")
+	ErrSyncRequestMalFormed   = errors.New("SyncRequestMsg malformed")
+	ErrSyncReplyMsgMalFormed  = errors.New("SyncReplyMsg malformed")
+	ErrSyncRevisionsMalFormed = errors.New("SyncRevisionsMsg malformed")
 )
 
 // SyncReplyMsg describes graph syncho message
@@ -56,8 +61,28 @@ type SyncReplyMsg struct {
 	Edges []*Edge
 }
 
+// SyncRevisionsMsg describes the revisions of the nodes and edges of a host
+type SyncRevisionsMsg struct {
+	Host  string
+	Nodes map[Identifier]int64
+	Edges map[Identifier]int64
+}
+
+// SyncRevisionsReplyMsg lists the nodes and edges missing or stale
+type SyncRevisionsReplyMsg struct {
+	Nodes []Identifier
+	Edges []Identifier
+}
+
 // UnmarshalWSMessage deserialize the websocket message
 func UnmarshalWSMessage(msg shttp.WSMessage) (string, interface{}, error) {
+	// nodes, edges and sync replies may be natively encoded with protobuf
+	if value, err := msg.Value(); err != nil {
+		return "", msg, err
+	} else if value != nil {
+		return msg.Type, value, nil
+	}
+
 	var obj interface{}
 	if err := common.JSONDecode(bytes.NewReader([]byte(*msg.Obj)), &obj); err != nil {
 		return "", msg, err
@@ -124,6 +149,18 @@ func UnmarshalWSMessage(msg shttp.WSMessage) (string, interface{}, error) {
 		return msg.Type, result, nil
 	case HostGraphDeletedMsgType:
 		return msg.Type, obj, nil
+	case SyncRevisionsMsgType:
+		var revisions SyncRevisionsMsg
+		if err := json.Unmarshal([]byte(*msg.Obj), &revisions); err != nil || revisions.Host == "" {
+			return "", msg, ErrSyncRevisionsMalFormed
+		}
+		return msg.Type, &revisions, nil
+	case SyncRevisionsReplyMsgType:
+		var reply SyncRevisionsReplyMsg
+		if err := json.Unmarshal([]byte(*msg.Obj), &reply); err != nil {
+			return "", msg, ErrSyncRevisionsMalFormed
+		}
+		return msg.Type, &reply, nil
 	case NodeUpdatedMsgType, NodeDeletedMsgType, NodeAddedMsgType:
 		var node Node
 		if err := node.Decode(obj); err != nil {
@@ -25,6 +25,7 @@ package graph
 import (
 	"encoding/json"
 	"net/http"
+	"reflect"
 	"testing"
 
 	shttp "github.com/skydive-project/skydive/http"
@@ -115,3 +116,123 @@ func TestHost(t *testing.T) {
 		t.Error("Should raise an error")
 	}
 }
+
+func TestSyncRevisions(t *testing.T) {
+	raw := json.RawMessage([]byte(`{"Host": "agent", "Nodes": {"aaa": 2}, "Edges": {"bbb": 1}}`))
+
+	msg := shttp.WSMessage{
+		Namespace: Namespace,
+		Type:      SyncRevisionsMsgType,
+		UUID:      "aaa",
+		Obj:       &raw,
+		Status:    http.StatusOK,
+	}
+
+	_, obj, err := UnmarshalWSMessage(msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r := obj.(*SyncRevisionsMsg)
+	if r.Host != "agent" || r.Nodes["aaa"] != 2 || r.Edges["bbb"] != 1 {
+		t.Errorf("Wrong revisions: %+v", r)
+	}
+
+	raw = json.RawMessage([]byte(`{"Nodes": {"aaa": 2}}`))
+	if _, _, err := UnmarshalWSMessage(msg); err == nil {
+		t.Error("Should raise an error if Host is missing")
+	}
+}
+
+// wireMessage returns the message as received by a peer using the JSON
+// encoding
+func wireMessage(t *testing.T, msg *shttp.WSMessage) shttp.WSMessage {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var m shttp.WSMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err.Error())
+	}
+	if m.Obj == nil {
+		t.Fatalf("Message %s not JSON encoded", msg.Type)
+	}
+	return m
+}
+
+func wireObject(t *testing.T, msgType string, v interface{}) interface{} {
+	_, obj, err := UnmarshalWSMessage(wireMessage(t, shttp.NewWSMessage(Namespace, msgType, v)))
+	if err != nil {
+		t.Fatalf("Unable to decode %s message: %s", msgType, err.Error())
+	}
+	return obj
+}
+
+// applySyncReply applies a sync reply as the analyzer does, the elements
+// with a different revision are updated
+func applySyncReply(g *Graph, r *SyncReplyMsg) {
+	for _, n := range r.Nodes {
+		if node := g.GetNode(n.ID); node == nil {
+			g.NodeAdded(n)
+		} else if node.Revision() != n.Revision() {
+			g.NodeUpdated(n)
+		}
+	}
+	for _, e := range r.Edges {
+		if edge := g.GetEdge(e.ID); edge == nil {
+			g.EdgeAdded(e)
+		} else if edge.Revision() != e.Revision() {
+			g.EdgeUpdated(e)
+		}
+	}
+}
+
+func TestSyncRevisionsMessages(t *testing.T) {
+	b1, _ := NewMemoryBackend()
+	agent := NewGraph("agent", b1)
+
+	b2, _ := NewMemoryBackend()
+	analyzer := NewGraph("analyzer", b2)
+
+	n1 := agent.NewNode(Identifier("n1"), Metadata{"Name": "eth0"})
+	n2 := agent.NewNode(Identifier("n2"), Metadata{"Name": "eth1"})
+	n3 := agent.NewNode(Identifier("n3"), Metadata{"Name": "eth2"})
+	e1 := agent.NewEdge(Identifier("e1"), n1, n2, Metadata{"RelationType": "layer2"})
+	agent.NewEdge(Identifier("e2"), n1, n3, Metadata{"RelationType": "layer2"})
+
+	// the whole graph of the agent is sent first
+	reply := &SyncReplyMsg{Nodes: agent.GetNodes(nil), Edges: agent.GetEdges(nil)}
+	applySyncReply(analyzer, wireObject(t, SyncReplyMsgType, reply).(*SyncReplyMsg))
+
+	if e := analyzer.GetEdge("e1"); e == nil || e.Revision() != e1.Revision() {
+		t.Fatalf("Expected the revision %d of e1, got: %v", e1.Revision(), e)
+	}
+
+	// the agent updates its graph while disconnected
+	agent.AddMetadata(n2, "MTU", 1500)
+	agent.AddMetadata(e1, "State", "UP")
+
+	revisions := wireObject(t, SyncRevisionsMsgType, agent.HostRevisions("agent")).(*SyncRevisionsMsg)
+	stale := wireObject(t, SyncRevisionsReplyMsgType, analyzer.SyncHostRevisions(revisions)).(*SyncRevisionsReplyMsg)
+
+	if !reflect.DeepEqual(stale.Nodes, []Identifier{"n2"}) || !reflect.DeepEqual(stale.Edges, []Identifier{"e1"}) {
+		t.Fatalf("Expected only n2 and e1 to be stale, got: %+v", stale)
+	}
+
+	reply = &SyncReplyMsg{Nodes: []*Node{agent.GetNode("n2")}, Edges: []*Edge{agent.GetEdge("e1")}}
+	applySyncReply(analyzer, wireObject(t, SyncReplyMsgType, reply).(*SyncReplyMsg))
+
+	if e := analyzer.GetEdge("e1"); e.Revision() != e1.Revision() || e.Metadata()["State"] != "UP" {
+		t.Errorf("Expected e1 to be updated, got: %s", e.String())
+	}
+	if n := analyzer.GetNode("n2"); n.Revision() != n2.Revision() || n.Metadata()["MTU"] == nil {
+		t.Errorf("Expected n2 to be updated, got: %s", n.String())
+	}
+
+	revisions = wireObject(t, SyncRevisionsMsgType, agent.HostRevisions("agent")).(*SyncRevisionsMsg)
+	if stale = analyzer.SyncHostRevisions(revisions); len(stale.Nodes) != 0 || len(stale.Edges) != 0 {
+		t.Errorf("Expected no stale element once synchronized, got: %+v", stale)
+	}
+}
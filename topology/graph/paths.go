@@ -0,0 +1,514 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/skydive-project/skydive/common"
+)
+
+// WeightedPath describes a path, the nodes traversed, the edges linking them
+// and the sum of the weights of the edges
+type WeightedPath struct {
+	Nodes  []*Node
+	Edges  []*Edge
+	Weight float64
+}
+
+func (p *WeightedPath) key() string {
+	ids := make([]string, len(p.Edges)+1)
+	ids[0] = string(p.Nodes[0].ID)
+	for i, e := range p.Edges {
+		ids[i+1] = string(e.ID)
+	}
+	return strings.Join(ids, "/")
+}
+
+// shorter orders the paths by weight then by number of hops
+func (p *WeightedPath) shorter(o *WeightedPath) bool {
+	if p.Weight != o.Weight {
+		return p.Weight < o.Weight
+	}
+	return len(p.Edges) < len(o.Edges)
+}
+
+// EdgeWeight returns the weight of an edge, the value of the metadata key,
+// 1 if key is empty or if the edge has no such metadata. An edge with a
+// negative or invalid weight can't be traversed.
+func EdgeWeight(e *Edge, key string) (float64, bool) {
+	if key == "" {
+		return 1, true
+	}
+
+	v, err := e.GetField(key)
+	if err != nil {
+		return 1, true
+	}
+
+	w, err := common.ToFloat64(v)
+	if err != nil || w < 0 {
+		return 0, false
+	}
+	return w, true
+}
+
+type pathNeighbor struct {
+	edge   *Edge
+	node   *Node
+	weight float64
+}
+
+// neighbors returns the nodes linked to n, whatever the direction of the edges
+func (g *Graph) neighbors(n *Node, em Metadata, weight string) (neighbors []pathNeighbor) {
+	t := g.context.TimeSlice
+	for _, e := range g.backend.GetNodeEdges(n, t, em) {
+		w, ok := EdgeWeight(e, weight)
+		if !ok {
+			continue
+		}
+
+		parents, children := g.backend.GetEdgeNodes(e, t, nil, nil)
+		if len(parents) == 0 || len(children) == 0 {
+			continue
+		}
+
+		neighbor := children[0]
+		if neighbor.ID == n.ID {
+			neighbor = parents[0]
+		}
+		if neighbor.ID != n.ID {
+			neighbors = append(neighbors, pathNeighbor{edge: e, node: neighbor, weight: w})
+		}
+	}
+	return
+}
+
+type pathItem struct {
+	node   *Node
+	weight float64
+	hops   int
+}
+
+type pathQueue []*pathItem
+
+func (q pathQueue) Len() int      { return len(q) }
+func (q pathQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q pathQueue) Less(i, j int) bool {
+	if q[i].weight != q[j].weight {
+		return q[i].weight < q[j].weight
+	}
+	return q[i].hops < q[j].hops
+}
+
+func (q *pathQueue) Push(x interface{}) {
+	*q = append(*q, x.(*pathItem))
+}
+
+func (q *pathQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+type pathHop struct {
+	from   *Node
+	edge   *Edge
+	weight float64
+}
+
+// lookupWeightedPath returns the lightest path from n to the first node
+// matching m, without traversing the given nodes and edges
+func (g *Graph) lookupWeightedPath(n *Node, m Metadata, em Metadata, weight string, removedNodes, removedEdges map[Identifier]bool) *WeightedPath {
+	hops := map[Identifier]*pathHop{n.ID: {}}
+	done := make(map[Identifier]bool)
+	queue := &pathQueue{{node: n}}
+
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(*pathItem)
+		if done[item.node.ID] {
+			continue
+		}
+		done[item.node.ID] = true
+
+		if item.node.MatchMetadata(m) {
+			path := &WeightedPath{Weight: item.weight}
+			for node := item.node; node != nil; node = hops[node.ID].from {
+				path.Nodes = append([]*Node{node}, path.Nodes...)
+				if e := hops[node.ID].edge; e != nil {
+					path.Edges = append([]*Edge{e}, path.Edges...)
+				}
+			}
+			return path
+		}
+
+		for _, neighbor := range g.neighbors(item.node, em, weight) {
+			id := neighbor.node.ID
+			if done[id] || removedNodes[id] || removedEdges[neighbor.edge.ID] {
+				continue
+			}
+
+			w := item.weight + neighbor.weight
+			if h, ok := hops[id]; ok && h.weight <= w {
+				continue
+			}
+			hops[id] = &pathHop{from: item.node, edge: neighbor.edge, weight: w}
+			heap.Push(queue, &pathItem{node: neighbor.node, weight: w, hops: item.hops + 1})
+		}
+	}
+
+	return nil
+}
+
+// LookupKShortestPaths returns up to k loop-free paths from n to nodes
+// matching m, the lightest first. The edges have to match em, their weight
+// is the value of the weight metadata key, see EdgeWeight. The paths are
+// computed with the Yen algorithm.
+func (g *Graph) LookupKShortestPaths(n *Node, m Metadata, em Metadata, weight string, k int) (paths []*WeightedPath) {
+	shortest := g.lookupWeightedPath(n, m, em, weight, nil, nil)
+	if shortest == nil || k <= 0 {
+		return nil
+	}
+	paths = append(paths, shortest)
+
+	found := map[string]bool{shortest.key(): true}
+	var candidates []*WeightedPath
+
+	for len(paths) < k {
+		last := paths[len(paths)-1]
+
+		for i := 0; i < len(last.Edges); i++ {
+			spurNode := last.Nodes[i]
+			rootNodes, rootEdges := last.Nodes[:i+1], last.Edges[:i]
+
+			// the edges leaving the root of the paths already found are
+			// removed so that the spur path differs from them
+			removedEdges := make(map[Identifier]bool)
+			for _, p := range paths {
+				if len(p.Edges) > i && sameEdges(p.Edges[:i], rootEdges) {
+					removedEdges[p.Edges[i].ID] = true
+				}
+			}
+
+			removedNodes := make(map[Identifier]bool)
+			for _, node := range rootNodes[:i] {
+				removedNodes[node.ID] = true
+			}
+
+			spur := g.lookupWeightedPath(spurNode, m, em, weight, removedNodes, removedEdges)
+			if spur == nil {
+				continue
+			}
+
+			path := &WeightedPath{
+				Nodes:  append(append([]*Node{}, rootNodes[:i]...), spur.Nodes...),
+				Edges:  append(append([]*Edge{}, rootEdges...), spur.Edges...),
+				Weight: spur.Weight,
+			}
+			for _, e := range rootEdges {
+				w, _ := EdgeWeight(e, weight)
+				path.Weight += w
+			}
+
+			if key := path.key(); !found[key] {
+				found[key] = true
+				candidates = append(candidates, path)
+			}
+		}
+
+		if len(candidates) == 0 {
+			break
+		}
+
+		best := 0
+		for i, c := range candidates {
+			if c.shorter(candidates[best]) {
+				best = i
+			}
+		}
+		paths = append(paths, candidates[best])
+		candidates = append(candidates[:best], candidates[best+1:]...)
+	}
+
+	return paths
+}
+
+func sameEdges(e1, e2 []*Edge) bool {
+	if len(e1) != len(e2) {
+		return false
+	}
+	for i := range e1 {
+		if e1[i].ID != e2[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+// LookupAllPaths returns the loop-free paths, of at most maxDepth edges, from
+// n to nodes matching m. The edges have to match em and a path stops at the
+// first node matching m. The lookup is aborted once ctx is done.
+func (g *Graph) LookupAllPaths(ctx context.Context, n *Node, m Metadata, em Metadata, maxDepth int) (paths [][]*Node, err error) {
+	visited := map[Identifier]bool{n.ID: true}
+	path := []*Node{n}
+
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		default:
+		}
+		if err != nil {
+			return
+		}
+
+		if node.MatchMetadata(m) {
+			paths = append(paths, append([]*Node{}, path...))
+			return
+		}
+
+		if len(path) > maxDepth {
+			return
+		}
+
+		for _, neighbor := range g.neighbors(node, em, "") {
+			if visited[neighbor.node.ID] {
+				continue
+			}
+
+			visited[neighbor.node.ID] = true
+			path = append(path, neighbor.node)
+			walk(neighbor.node)
+			path = path[:len(path)-1]
+			delete(visited, neighbor.node.ID)
+		}
+	}
+	walk(n)
+
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// IsReachable returns whether a node matching m can be reached from one of
+// the nodes, through edges matching em
+func (g *Graph) IsReachable(nodes []*Node, m Metadata, em Metadata) bool {
+	visited := make(map[Identifier]bool)
+	for _, n := range nodes {
+		visited[n.ID] = true
+	}
+
+	for len(nodes) > 0 {
+		var next []*Node
+		for _, n := range nodes {
+			if n.MatchMetadata(m) {
+				return true
+			}
+
+			for _, neighbor := range g.neighbors(n, em, "") {
+				if !visited[neighbor.node.ID] {
+					visited[neighbor.node.ID] = true
+					next = append(next, neighbor.node)
+				}
+			}
+		}
+		nodes = next
+	}
+
+	return false
+}
+
+// Metadata set on the copies of the nodes and edges returned by the graph
+// analysis, the elements of the graph are left untouched
+const (
+	ComponentIDMetadata = "ComponentID"
+	CriticalMetadata    = "Critical"
+)
+
+// markNode returns a copy of the node with an additional metadata
+func markNode(n *Node, k string, v interface{}) *Node {
+	c := &Node{graphElement: n.graphElement}
+	c.metadata = n.metadata.Clone()
+	c.metadata[k] = v
+	return c
+}
+
+// markEdge returns a copy of the edge with an additional metadata
+func markEdge(e *Edge, k string, v interface{}) *Edge {
+	c := &Edge{graphElement: e.graphElement, parent: e.parent, child: e.child}
+	c.metadata = e.metadata.Clone()
+	c.metadata[k] = v
+	return c
+}
+
+// Component describes a connected component, its nodes and edges are marked
+// with its ID
+type Component struct {
+	ID    int
+	Nodes []*Node
+	Edges []*Edge
+}
+
+// subgraph returns, for each node, its neighbors among the given nodes
+func (g *Graph) subgraph(nodes []*Node, em Metadata) map[Identifier][]pathNeighbor {
+	in := make(map[Identifier]bool, len(nodes))
+	for _, n := range nodes {
+		in[n.ID] = true
+	}
+
+	adjacency := make(map[Identifier][]pathNeighbor, len(nodes))
+	for _, n := range nodes {
+		for _, neighbor := range g.neighbors(n, em, "") {
+			if in[neighbor.node.ID] {
+				adjacency[n.ID] = append(adjacency[n.ID], neighbor)
+			}
+		}
+	}
+	return adjacency
+}
+
+// ConnectedComponents returns the connected components of the subgraph made
+// of the nodes and the edges, matching em, linking them. The components are
+// sorted by decreasing number of nodes, their ID being their rank.
+func (g *Graph) ConnectedComponents(nodes []*Node, em Metadata) (components []*Component) {
+	adjacency := g.subgraph(nodes, em)
+	visited := make(map[Identifier]bool, len(nodes))
+
+	for _, n := range nodes {
+		if visited[n.ID] {
+			continue
+		}
+		visited[n.ID] = true
+
+		component := &Component{}
+		edges := make(map[Identifier]bool)
+		for stack := []*Node{n}; len(stack) > 0; {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			component.Nodes = append(component.Nodes, node)
+
+			for _, neighbor := range adjacency[node.ID] {
+				if !edges[neighbor.edge.ID] {
+					edges[neighbor.edge.ID] = true
+					component.Edges = append(component.Edges, neighbor.edge)
+				}
+				if !visited[neighbor.node.ID] {
+					visited[neighbor.node.ID] = true
+					stack = append(stack, neighbor.node)
+				}
+			}
+		}
+		components = append(components, component)
+	}
+
+	sort.Stable(componentSorter(components))
+	for i, c := range components {
+		c.ID = i
+		for j, n := range c.Nodes {
+			c.Nodes[j] = markNode(n, ComponentIDMetadata, i)
+		}
+		for j, e := range c.Edges {
+			c.Edges[j] = markEdge(e, ComponentIDMetadata, i)
+		}
+	}
+	return
+}
+
+type componentSorter []*Component
+
+func (s componentSorter) Len() int           { return len(s) }
+func (s componentSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s componentSorter) Less(i, j int) bool { return len(s[i].Nodes) > len(s[j].Nodes) }
+
+// CriticalElements returns the articulation points and the bridges of the
+// subgraph made of the nodes and the edges, matching em, linking them, that
+// is the nodes and the edges whose removal increases the number of
+// connected components. They are returned as copies marked as critical.
+func (g *Graph) CriticalElements(nodes []*Node, em Metadata) (articulations []*Node, bridges []*Edge) {
+	adjacency := g.subgraph(nodes, em)
+	disc := make(map[Identifier]int, len(nodes))
+	low := make(map[Identifier]int, len(nodes))
+	isArticulation := make(map[Identifier]bool)
+	counter := 0
+
+	var visit func(n *Node, parentEdge Identifier)
+	visit = func(n *Node, parentEdge Identifier) {
+		counter++
+		disc[n.ID], low[n.ID] = counter, counter
+
+		children := 0
+		for _, neighbor := range adjacency[n.ID] {
+			// parallel edges are distinguished by their ID
+			if neighbor.edge.ID == parentEdge {
+				continue
+			}
+
+			id := neighbor.node.ID
+			if _, ok := disc[id]; ok {
+				if disc[id] < low[n.ID] {
+					low[n.ID] = disc[id]
+				}
+				continue
+			}
+
+			children++
+			visit(neighbor.node, neighbor.edge.ID)
+			if low[id] < low[n.ID] {
+				low[n.ID] = low[id]
+			}
+
+			if parentEdge != "" && low[id] >= disc[n.ID] {
+				isArticulation[n.ID] = true
+			}
+			if low[id] > disc[n.ID] {
+				bridges = append(bridges, markEdge(neighbor.edge, CriticalMetadata, true))
+			}
+		}
+
+		if parentEdge == "" && children > 1 {
+			isArticulation[n.ID] = true
+		}
+	}
+
+	for _, n := range nodes {
+		if _, ok := disc[n.ID]; !ok {
+			visit(n, "")
+		}
+	}
+
+	for _, n := range nodes {
+		if isArticulation[n.ID] {
+			articulations = append(articulations, markNode(n, CriticalMetadata, true))
+			delete(isArticulation, n.ID)
+		}
+	}
+	return
+}
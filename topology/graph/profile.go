@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+)
+
+// BackendCall describes the number of calls made to a backend method and
+// the total time spent in it
+type BackendCall struct {
+	Count    int
+	Duration time.Duration
+}
+
+// BackendCallRecorder records the backend calls made through a graph
+type BackendCallRecorder struct {
+	sync.Mutex
+	calls map[string]BackendCall
+}
+
+// Record a call to the backend method name
+func (r *BackendCallRecorder) Record(name string, d time.Duration) {
+	r.Lock()
+	call := r.calls[name]
+	call.Count++
+	call.Duration += d
+	r.calls[name] = call
+	r.Unlock()
+}
+
+// Flush returns the calls recorded so far and resets the recorder
+func (r *BackendCallRecorder) Flush() map[string]BackendCall {
+	r.Lock()
+	defer r.Unlock()
+
+	calls := r.calls
+	r.calls = make(map[string]BackendCall)
+	return calls
+}
+
+// NewBackendCallRecorder returns a new empty recorder
+func NewBackendCallRecorder() *BackendCallRecorder {
+	return &BackendCallRecorder{calls: make(map[string]BackendCall)}
+}
+
+type recordingBackend struct {
+	GraphBackend
+	recorder *BackendCallRecorder
+}
+
+func (b *recordingBackend) GetNode(i Identifier, at *common.TimeSlice) []*Node {
+	defer b.record("GetNode", time.Now())
+	return b.GraphBackend.GetNode(i, at)
+}
+
+func (b *recordingBackend) GetNodeEdges(n *Node, at *common.TimeSlice, m Metadata) []*Edge {
+	defer b.record("GetNodeEdges", time.Now())
+	return b.GraphBackend.GetNodeEdges(n, at, m)
+}
+
+func (b *recordingBackend) GetEdge(i Identifier, at *common.TimeSlice) []*Edge {
+	defer b.record("GetEdge", time.Now())
+	return b.GraphBackend.GetEdge(i, at)
+}
+
+func (b *recordingBackend) GetEdgeNodes(e *Edge, at *common.TimeSlice, parentMetadata, childMetadata Metadata) ([]*Node, []*Node) {
+	defer b.record("GetEdgeNodes", time.Now())
+	return b.GraphBackend.GetEdgeNodes(e, at, parentMetadata, childMetadata)
+}
+
+func (b *recordingBackend) GetNodes(t *common.TimeSlice, m Metadata) []*Node {
+	defer b.record("GetNodes", time.Now())
+	return b.GraphBackend.GetNodes(t, m)
+}
+
+func (b *recordingBackend) GetEdges(t *common.TimeSlice, m Metadata) []*Edge {
+	defer b.record("GetEdges", time.Now())
+	return b.GraphBackend.GetEdges(t, m)
+}
+
+func (b *recordingBackend) record(name string, start time.Time) {
+	b.recorder.Record(name, time.Since(start))
+}
+
+// WithBackendCallRecorder returns a read only view of the graph recording
+// every backend lookup into r. The view does not share the lock of g, the
+// caller has to lock g itself.
+func (g *Graph) WithBackendCallRecorder(r *BackendCallRecorder) *Graph {
+	return &Graph{
+		backend: &recordingBackend{GraphBackend: g.backend, recorder: r},
+		context: g.context,
+		host:    g.host,
+	}
+}
+
+// RecordBackendCall records a call made to an external storage on behalf of
+// the graph, a no-op if the graph does not record its backend calls
+func (g *Graph) RecordBackendCall(name string, d time.Duration) {
+	if b, ok := g.backend.(*recordingBackend); ok {
+		b.recorder.Record(name, d)
+	}
+}
@@ -0,0 +1,383 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/skydive-project/skydive/common"
+	shttp "github.com/skydive-project/skydive/http"
+)
+
+func init() {
+	shttp.RegisterWSProtobufDecoder(Namespace, decodeProtobufObject)
+}
+
+func protobufMetadataValue(i interface{}) (*ProtobufMetadataValue, error) {
+	switch v := i.(type) {
+	case nil:
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_NULL}, nil
+	case string:
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_STRING, String_: v}, nil
+	case bool:
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_BOOL, Bool: v}, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_INT, Int: n}, nil
+		}
+		if f, err := v.Float64(); err == nil {
+			return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_FLOAT, Float: f}, nil
+		}
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_STRING, String_: v.String()}, nil
+	case Metadata:
+		return protobufMetadataMap(v)
+	case map[string]interface{}:
+		return protobufMetadataMap(v)
+	case json.Marshaler:
+		return protobufMetadataJSON(v)
+	}
+
+	value := reflect.ValueOf(i)
+	switch value.Kind() {
+	case reflect.String:
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_STRING, String_: value.String()}, nil
+	case reflect.Bool:
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_BOOL, Bool: value.Bool()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_INT, Int: value.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := value.Uint(); u <= math.MaxInt64 {
+			return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_INT, Int: int64(u)}, nil
+		}
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_FLOAT, Float: float64(value.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		// as with JSON, integral numbers are decoded as int64
+		if f := value.Float(); f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+			return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_INT, Int: int64(f)}, nil
+		}
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_FLOAT, Float: value.Float()}, nil
+	case reflect.Slice, reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		list := make([]*ProtobufMetadataValue, value.Len())
+		for j := range list {
+			v, err := protobufMetadataValue(value.Index(j).Interface())
+			if err != nil {
+				return nil, err
+			}
+			list[j] = v
+		}
+		return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_LIST, List: list}, nil
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			break
+		}
+		m := make(map[string]interface{}, value.Len())
+		for _, k := range value.MapKeys() {
+			m[k.String()] = value.MapIndex(k).Interface()
+		}
+		return protobufMetadataMap(m)
+	}
+
+	return protobufMetadataJSON(i)
+}
+
+// protobufMetadataJSON encodes the values without protobuf equivalent
+func protobufMetadataJSON(i interface{}) (*ProtobufMetadataValue, error) {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_JSON, JSON: b}, nil
+}
+
+func protobufMetadataMap(m map[string]interface{}) (*ProtobufMetadataValue, error) {
+	pm, err := protobufMetadata(m)
+	if err != nil {
+		return nil, err
+	}
+	return &ProtobufMetadataValue{Kind: ProtobufMetadataKind_MAP, Map: pm}, nil
+}
+
+func protobufMetadata(m map[string]interface{}) (*ProtobufMetadata, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	fields := make([]*ProtobufMetadataEntry, 0, len(m))
+	for k, v := range m {
+		value, err := protobufMetadataValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to encode metadata %s: %s", k, err.Error())
+		}
+		fields = append(fields, &ProtobufMetadataEntry{Key: k, Value: value})
+	}
+	return &ProtobufMetadata{Fields: fields}, nil
+}
+
+func decodeProtobufMetadataValue(v *ProtobufMetadataValue) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch v.Kind {
+	case ProtobufMetadataKind_NULL:
+		return nil, nil
+	case ProtobufMetadataKind_STRING:
+		return v.String_, nil
+	case ProtobufMetadataKind_INT:
+		return v.Int, nil
+	case ProtobufMetadataKind_FLOAT:
+		return v.Float, nil
+	case ProtobufMetadataKind_BOOL:
+		return v.Bool, nil
+	case ProtobufMetadataKind_MAP:
+		m, err := decodeProtobufMetadata(v.Map)
+		if m == nil && err == nil {
+			m = make(map[string]interface{})
+		}
+		return m, err
+	case ProtobufMetadataKind_LIST:
+		list := make([]interface{}, len(v.List))
+		for i, item := range v.List {
+			value, err := decodeProtobufMetadataValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	case ProtobufMetadataKind_JSON:
+		var value interface{}
+		if err := common.JSONDecode(bytes.NewReader(v.JSON), &value); err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{"": value}
+		decodeMap(m)
+		return m[""], nil
+	}
+
+	return nil, fmt.Errorf("Unknown metadata kind: %d", v.Kind)
+}
+
+func decodeProtobufMetadata(pm *ProtobufMetadata) (map[string]interface{}, error) {
+	if pm == nil {
+		return nil, nil
+	}
+
+	m := make(map[string]interface{}, len(pm.Fields))
+	for _, field := range pm.Fields {
+		value, err := decodeProtobufMetadataValue(field.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode metadata %s: %s", field.Key, err.Error())
+		}
+		m[field.Key] = value
+	}
+	return m, nil
+}
+
+func unixMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return common.UnixMillis(t)
+}
+
+func millisTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// decodeProtobuf fills the element with the fields common to nodes and
+// edges, times follow the JSON decoding
+func (e *graphElement) decodeProtobuf(id string, metadata *ProtobufMetadata, host string, createdAt, updatedAt, deletedAt, revision int64) (err error) {
+	e.ID = Identifier(id)
+	e.host = host
+	e.createdAt = millisTime(createdAt)
+	e.updatedAt = e.createdAt
+	if updatedAt != 0 {
+		e.updatedAt = millisTime(updatedAt)
+	}
+	if deletedAt != 0 {
+		e.deletedAt = millisTime(deletedAt)
+	}
+	e.revision = revision
+
+	e.metadata, err = decodeProtobufMetadata(metadata)
+	return err
+}
+
+func (n *Node) protobuf() (*ProtobufNode, error) {
+	metadata, err := protobufMetadata(n.metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProtobufNode{
+		ID:        string(n.ID),
+		Metadata:  metadata,
+		Host:      n.host,
+		CreatedAt: common.UnixMillis(n.createdAt),
+		UpdatedAt: common.UnixMillis(n.updatedAt),
+		DeletedAt: unixMillis(n.deletedAt),
+		Revision:  n.revision,
+	}, nil
+}
+
+// MarshalProtobuf serialize the node with protobuf
+func (n *Node) MarshalProtobuf() ([]byte, error) {
+	pn, err := n.protobuf()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(pn)
+}
+
+func (n *Node) decodeProtobuf(pn *ProtobufNode) error {
+	return n.graphElement.decodeProtobuf(pn.ID, pn.Metadata, pn.Host, pn.CreatedAt, pn.UpdatedAt, pn.DeletedAt, pn.Revision)
+}
+
+func (e *Edge) protobuf() (*ProtobufEdge, error) {
+	metadata, err := protobufMetadata(e.metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProtobufEdge{
+		ID:        string(e.ID),
+		Metadata:  metadata,
+		Parent:    string(e.parent),
+		Child:     string(e.child),
+		Host:      e.host,
+		CreatedAt: common.UnixMillis(e.createdAt),
+		UpdatedAt: common.UnixMillis(e.updatedAt),
+		DeletedAt: unixMillis(e.deletedAt),
+		Revision:  e.revision,
+	}, nil
+}
+
+// MarshalProtobuf serialize the edge with protobuf
+func (e *Edge) MarshalProtobuf() ([]byte, error) {
+	pe, err := e.protobuf()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(pe)
+}
+
+func (e *Edge) decodeProtobuf(pe *ProtobufEdge) error {
+	e.parent = Identifier(pe.Parent)
+	e.child = Identifier(pe.Child)
+	return e.graphElement.decodeProtobuf(pe.ID, pe.Metadata, pe.Host, pe.CreatedAt, pe.UpdatedAt, pe.DeletedAt, pe.Revision)
+}
+
+// MarshalProtobuf serialize the nodes and edges with protobuf
+func (s *SyncReplyMsg) MarshalProtobuf() ([]byte, error) {
+	reply := &ProtobufSyncReply{
+		Nodes: make([]*ProtobufNode, len(s.Nodes)),
+		Edges: make([]*ProtobufEdge, len(s.Edges)),
+	}
+
+	var err error
+	for i, n := range s.Nodes {
+		if reply.Nodes[i], err = n.protobuf(); err != nil {
+			return nil, err
+		}
+	}
+	for i, e := range s.Edges {
+		if reply.Edges[i], err = e.protobuf(); err != nil {
+			return nil, err
+		}
+	}
+
+	return proto.Marshal(reply)
+}
+
+// MarshalProtobuf serialize the graph as a SyncReplyMsg with protobuf
+func (g *Graph) MarshalProtobuf() ([]byte, error) {
+	reply := &SyncReplyMsg{
+		Nodes: g.GetNodes(Metadata{}),
+		Edges: g.GetEdges(Metadata{}),
+	}
+	return reply.MarshalProtobuf()
+}
+
+// decodeProtobufObject decodes the natively encoded objects of the graph
+// messages
+func decodeProtobufObject(msgType string, data []byte) (interface{}, error) {
+	switch msgType {
+	case NodeAddedMsgType, NodeUpdatedMsgType, NodeDeletedMsgType:
+		var pn ProtobufNode
+		if err := proto.Unmarshal(data, &pn); err != nil {
+			return nil, err
+		}
+
+		node := &Node{}
+		if err := node.decodeProtobuf(&pn); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case EdgeAddedMsgType, EdgeUpdatedMsgType, EdgeDeletedMsgType:
+		var pe ProtobufEdge
+		if err := proto.Unmarshal(data, &pe); err != nil {
+			return nil, err
+		}
+
+		edge := &Edge{}
+		if err := edge.decodeProtobuf(&pe); err != nil {
+			return nil, err
+		}
+		return edge, nil
+	case SyncReplyMsgType:
+		var reply ProtobufSyncReply
+		if err := proto.Unmarshal(data, &reply); err != nil {
+			return nil, err
+		}
+
+		result := &SyncReplyMsg{}
+		for _, pn := range reply.Nodes {
+			node := &Node{}
+			if err := node.decodeProtobuf(pn); err != nil {
+				return nil, err
+			}
+			result.Nodes = append(result.Nodes, node)
+		}
+		for _, pe := range reply.Edges {
+			edge := &Edge{}
+			if err := edge.decodeProtobuf(pe); err != nil {
+				return nil, err
+			}
+			result.Edges = append(result.Edges, edge)
+		}
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("No protobuf encoding for %s messages", msgType)
+}
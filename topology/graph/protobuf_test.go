@@ -0,0 +1,236 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/skydive-project/skydive/common"
+)
+
+type protobufTestStats struct {
+	RxBytes int64
+	TxBytes int64
+}
+
+func protobufTestMetadata() Metadata {
+	return Metadata{
+		"Name":     "eth0",
+		"Type":     "device",
+		"MTU":      1500,
+		"IfIndex":  uint32(2),
+		"Speed":    float64(1000),
+		"Ratio":    0.25,
+		"Up":       true,
+		"Master":   nil,
+		"IPV4":     []string{"10.0.0.1/24", "10.0.0.2/24"},
+		"Ovs":      Metadata{"Port": map[string]interface{}{"ID": "p1", "Number": 3}},
+		"Labels":   map[string]string{"app": "web"},
+		"Stats":    &protobufTestStats{RxBytes: 10, TxBytes: 20},
+		"Features": []interface{}{"tso", 1, 2.5},
+	}
+}
+
+func jsonDecodeElement(t *testing.T, b []byte, e interface {
+	Decode(i interface{}) error
+}) {
+	var obj interface{}
+	if err := common.JSONDecode(bytes.NewReader(b), &obj); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := e.Decode(obj); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestProtobufNodeRoundTrip(t *testing.T) {
+	g := newGraph(t)
+	n := g.NewNode(GenID(), protobufTestMetadata(), "host1")
+	g.AddMetadata(n, "Name", "eth1")
+	g.DelNode(n)
+
+	b, err := n.MarshalProtobuf()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	obj, err := decodeProtobufObject(NodeUpdatedMsgType, b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pn := obj.(*Node)
+
+	jb, _ := n.MarshalJSON()
+	var jn Node
+	jsonDecodeElement(t, jb, &jn)
+
+	// the same node as decoded from JSON
+	if pn.ID != jn.ID || pn.host != jn.host || pn.revision != jn.revision || pn.revision != n.revision ||
+		!pn.createdAt.Equal(jn.createdAt) || !pn.updatedAt.Equal(jn.updatedAt) || !pn.deletedAt.Equal(jn.deletedAt) {
+		t.Errorf("Expected %s, got %s", jn.String(), pn.String())
+	}
+
+	// lists are not decoded by JSON, only compare their encoding
+	for _, k := range []string{"IPV4", "Features"} {
+		pl, _ := json.Marshal(pn.metadata[k])
+		jl, _ := json.Marshal(jn.metadata[k])
+		if !bytes.Equal(pl, jl) {
+			t.Errorf("Expected %s for %s, got %s", string(jl), k, string(pl))
+		}
+		delete(pn.metadata, k)
+		delete(jn.metadata, k)
+	}
+
+	if !reflect.DeepEqual(pn.metadata, jn.metadata) {
+		t.Errorf("Expected metadata %v, got %v", jn.metadata, pn.metadata)
+	}
+
+	if v := pn.metadata["MTU"]; v != int64(1500) {
+		t.Errorf("Expected MTU as int64, got %v (%T)", v, v)
+	}
+	if v := pn.metadata["Ratio"]; v != 0.25 {
+		t.Errorf("Expected Ratio as float64, got %v (%T)", v, v)
+	}
+}
+
+func TestProtobufEdgeRoundTrip(t *testing.T) {
+	g := newGraph(t)
+	n1 := g.NewNode(GenID(), Metadata{"Type": "device"})
+	n2 := g.NewNode(GenID(), Metadata{"Type": "device"})
+	e := g.NewEdge(GenID(), n1, n2, Metadata{"RelationType": "layer2", "Weight": 3})
+
+	b, err := e.MarshalProtobuf()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	obj, err := decodeProtobufObject(EdgeAddedMsgType, b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pe := obj.(*Edge)
+
+	if pe.ID != e.ID || pe.parent != n1.ID || pe.child != n2.ID || pe.revision != e.revision {
+		t.Errorf("Expected %s, got %s", e.String(), pe.String())
+	}
+
+	expected := map[string]interface{}{"RelationType": "layer2", "Weight": int64(3)}
+	if !reflect.DeepEqual(map[string]interface{}(pe.metadata), expected) {
+		t.Errorf("Expected metadata %v, got %v", expected, pe.metadata)
+	}
+
+	// no metadata as with JSON
+	e = g.NewEdge(GenID(), n2, n1, nil)
+	b, _ = e.MarshalProtobuf()
+	obj, _ = decodeProtobufObject(EdgeAddedMsgType, b)
+	if m := obj.(*Edge).metadata; len(m) != 0 {
+		t.Errorf("Expected no metadata, got %v", m)
+	}
+}
+
+func TestProtobufSyncReply(t *testing.T) {
+	g := newGraph(t)
+	n1 := g.NewNode(GenID(), Metadata{"Type": "host"})
+	n2 := g.NewNode(GenID(), Metadata{"Type": "netns"})
+	g.Link(n1, n2, Metadata{"RelationType": "ownership"})
+
+	b, err := g.MarshalProtobuf()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	obj, err := decodeProtobufObject(SyncReplyMsgType, b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	reply := obj.(*SyncReplyMsg)
+	if len(reply.Nodes) != 2 || len(reply.Edges) != 1 {
+		t.Fatalf("Expected 2 nodes and 1 edge, got: %v", reply)
+	}
+
+	g2 := newGraph(t)
+	for _, n := range reply.Nodes {
+		g2.NodeAdded(n)
+	}
+	for _, e := range reply.Edges {
+		g2.EdgeAdded(e)
+	}
+
+	if n := g2.LookupFirstChild(g2.GetNode(n1.ID), Metadata{"Type": "netns"}); n == nil || n.ID != n2.ID {
+		t.Errorf("Expected %s linked to %s", n1.ID, n2.ID)
+	}
+
+	if _, err := decodeProtobufObject(SyncRequestMsgType, b); err == nil {
+		t.Error("Sync requests have no protobuf encoding")
+	}
+}
+
+func benchmarkNode(b *testing.B) *Node {
+	g, err := NewMemoryBackend()
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	return NewGraphFromConfig(g).NewNode(GenID(), protobufTestMetadata(), "host1")
+}
+
+func BenchmarkNodeJSON(b *testing.B) {
+	n := benchmarkNode(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := n.MarshalJSON()
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+
+		var obj interface{}
+		if err := common.JSONDecode(bytes.NewReader(data), &obj); err != nil {
+			b.Fatal(err.Error())
+		}
+
+		var node Node
+		if err := node.Decode(obj); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkNodeProtobuf(b *testing.B) {
+	n := benchmarkNode(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := n.MarshalProtobuf()
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+
+		if _, err := decodeProtobufObject(NodeUpdatedMsgType, data); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+)
+
+// RecordedEvent describes a graph event of a recording, Type is one of the
+// node and edge message types and Time is in nanoseconds
+type RecordedEvent struct {
+	Time int64
+	Type string
+	Obj  *json.RawMessage
+}
+
+// Recorder writes the graph events to a stream, one JSON event per line, so
+// that they can be replayed later. The stream is flushed periodically.
+type Recorder struct {
+	sync.Mutex
+	Graph         *Graph
+	writer        *bufio.Writer
+	closer        io.Closer
+	flushInterval time.Duration
+	quit          chan bool
+	wg            sync.WaitGroup
+}
+
+func (r *Recorder) record(msgType string, obj interface{ JSONRawMessage() *json.RawMessage }) {
+	r.Lock()
+	defer r.Unlock()
+
+	b, err := json.Marshal(&RecordedEvent{
+		Time: time.Now().UTC().UnixNano(),
+		Type: msgType,
+		Obj:  obj.JSONRawMessage(),
+	})
+	if err == nil {
+		b = append(b, '\n')
+		_, err = r.writer.Write(b)
+	}
+	if err == nil && r.flushInterval <= 0 {
+		err = r.writer.Flush()
+	}
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to record %s event: %s", msgType, err.Error())
+	}
+}
+
+// OnNodeUpdated event
+func (r *Recorder) OnNodeUpdated(n *Node) {
+	r.record(NodeUpdatedMsgType, n)
+}
+
+// OnNodeAdded event
+func (r *Recorder) OnNodeAdded(n *Node) {
+	r.record(NodeAddedMsgType, n)
+}
+
+// OnNodeDeleted event
+func (r *Recorder) OnNodeDeleted(n *Node) {
+	r.record(NodeDeletedMsgType, n)
+}
+
+// OnEdgeUpdated event
+func (r *Recorder) OnEdgeUpdated(e *Edge) {
+	r.record(EdgeUpdatedMsgType, e)
+}
+
+// OnEdgeAdded event
+func (r *Recorder) OnEdgeAdded(e *Edge) {
+	r.record(EdgeAddedMsgType, e)
+}
+
+// OnEdgeDeleted event
+func (r *Recorder) OnEdgeDeleted(e *Edge) {
+	r.record(EdgeDeletedMsgType, e)
+}
+
+func (r *Recorder) flush() {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.writer.Buffered() == 0 {
+		return
+	}
+	if err := r.writer.Flush(); err != nil {
+		logging.GetLogger().Errorf("Unable to flush recorded events: %s", err.Error())
+	}
+}
+
+func (r *Recorder) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// Start recording the graph events
+func (r *Recorder) Start() {
+	r.Graph.AddEventListener(r)
+
+	if r.flushInterval > 0 {
+		r.wg.Add(1)
+		go r.run()
+	}
+}
+
+// Stop recording and flush the stream
+func (r *Recorder) Stop() {
+	r.Graph.RemoveEventListener(r)
+
+	close(r.quit)
+	r.wg.Wait()
+
+	r.flush()
+	if r.closer != nil {
+		r.closer.Close()
+	}
+}
+
+// NewRecorder returns a new recorder writing the events of g to w, the
+// stream is flushed every flushInterval or after every event if not positive
+func NewRecorder(g *Graph, w io.Writer, flushInterval time.Duration) *Recorder {
+	r := &Recorder{
+		Graph:         g,
+		writer:        bufio.NewWriter(w),
+		flushInterval: flushInterval,
+		quit:          make(chan bool),
+	}
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	return r
+}
+
+// NewRecorderFromConfig returns a new recorder writing to the file set by
+// graph.recorder.file, nil if not set
+func NewRecorderFromConfig(g *Graph) (*Recorder, error) {
+	path := config.GetConfig().GetString("graph.recorder.file")
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	flushInterval := time.Duration(config.GetConfig().GetInt("graph.recorder.flush_interval")) * time.Second
+
+	return NewRecorder(g, f, flushInterval), nil
+}
+
+func decodeRecordedElement(event *RecordedEvent) (interface{}, error) {
+	var obj interface{}
+	if err := common.JSONDecode(bytes.NewReader([]byte(*event.Obj)), &obj); err != nil {
+		return nil, err
+	}
+
+	switch event.Type {
+	case NodeAddedMsgType, NodeUpdatedMsgType, NodeDeletedMsgType:
+		var node Node
+		if err := node.Decode(obj); err != nil {
+			return nil, err
+		}
+		return &node, nil
+	case EdgeAddedMsgType, EdgeUpdatedMsgType, EdgeDeletedMsgType:
+		var edge Edge
+		if err := edge.Decode(obj); err != nil {
+			return nil, err
+		}
+		return &edge, nil
+	}
+
+	return nil, fmt.Errorf("Unknown recorded event type: %s", event.Type)
+}
+
+func (g *Graph) applyRecordedEvent(msgType string, obj interface{}) {
+	g.Lock()
+	defer g.Unlock()
+
+	switch msgType {
+	case NodeAddedMsgType:
+		g.NodeAdded(obj.(*Node))
+	case NodeUpdatedMsgType:
+		g.NodeUpdated(obj.(*Node))
+	case NodeDeletedMsgType:
+		g.NodeDeleted(obj.(*Node))
+	case EdgeAddedMsgType:
+		g.EdgeAdded(obj.(*Edge))
+	case EdgeUpdatedMsgType:
+		g.EdgeUpdated(obj.(*Edge))
+	case EdgeDeletedMsgType:
+		g.EdgeDeleted(obj.(*Edge))
+	}
+}
+
+// Replay feeds the graph with the events recorded in r. The delays between
+// the events are respected and divided by speed, a speed of 0 replays the
+// events as fast as possible.
+func (g *Graph) Replay(r io.Reader, speed float64) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	var last int64
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var event RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Obj == nil {
+			return fmt.Errorf("Malformed recorded event at line %d", line)
+		}
+
+		obj, err := decodeRecordedElement(&event)
+		if err != nil {
+			return fmt.Errorf("Malformed recorded event at line %d: %s", line, err.Error())
+		}
+
+		if speed > 0 && last != 0 && event.Time > last {
+			time.Sleep(time.Duration(float64(event.Time-last) / speed))
+		}
+		last = event.Time
+
+		g.applyRecordedEvent(event.Type, obj)
+	}
+
+	return scanner.Err()
+}
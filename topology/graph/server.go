@@ -24,6 +24,7 @@ package graph
 
 import (
 	"net/http"
+	"sync"
 
 	shttp "github.com/skydive-project/skydive/http"
 	"github.com/skydive-project/skydive/logging"
@@ -39,12 +40,18 @@ type ServerEventHandler interface {
 	OnGraphMessage(c *shttp.WSClient, m shttp.WSMessage, msgType string, obj interface{})
 }
 
-// Server describes a graph server based on websocket
+// Server describes a graph server based on websocket. Clients requesting a
+// view filter on connection only receive the events of their view.
 type Server struct {
 	shttp.DefaultWSServerEventHandler
-	WSServer      *shttp.WSServer
-	Graph         *Graph
-	eventHandlers []ServerEventHandler
+	WSServer       *shttp.WSServer
+	Graph          *Graph
+	eventHandlers  []ServerEventHandler
+	viewFactories  []ViewFilterFactory
+	views          map[*shttp.WSClient]*clientView
+	viewsLock      sync.RWMutex
+	viewsChanged   chan struct{}
+	viewsUpdaterOn sync.Once
 }
 
 // OnMessage event
@@ -55,19 +62,27 @@ func (s *Server) OnMessage(c *shttp.WSClient, msg shttp.WSMessage) {
 		return
 	}
 
-	s.Graph.RLock()
-	switch msgType {
-	case SyncRequestMsgType:
-		status := http.StatusOK
-		graph, err := s.Graph.WithContext(obj.(GraphContext))
-		if err != nil {
-			logging.GetLogger().Errorf("Graph: unable to get a graph with context %+v: %s", obj.(GraphContext), err.Error())
-			graph, status = nil, http.StatusBadRequest
+	s.viewsLock.RLock()
+	view, filtered := s.views[c]
+	s.viewsLock.RUnlock()
+
+	if filtered && msgType == SyncRequestMsgType {
+		view.sync(s.Graph, msg, obj.(GraphContext))
+	} else {
+		s.Graph.RLock()
+		switch msgType {
+		case SyncRequestMsgType:
+			status := http.StatusOK
+			graph, err := s.Graph.WithContext(obj.(GraphContext))
+			if err != nil {
+				logging.GetLogger().Errorf("Graph: unable to get a graph with context %+v: %s", obj.(GraphContext), err.Error())
+				graph, status = nil, http.StatusBadRequest
+			}
+			reply := msg.Reply(graph, SyncReplyMsgType, status)
+			c.SendWSMessage(reply)
 		}
-		reply := msg.Reply(graph, SyncReplyMsgType, status)
-		c.SendWSMessage(reply)
+		s.Graph.RUnlock()
 	}
-	s.Graph.RUnlock()
 
 	for _, h := range s.eventHandlers {
 		h.OnGraphMessage(c, msg, msgType, obj)
@@ -76,32 +91,130 @@ func (s *Server) OnMessage(c *shttp.WSClient, msg shttp.WSMessage) {
 
 // OnNodeUpdated event
 func (s *Server) OnNodeUpdated(n *Node) {
-	s.WSServer.QueueBroadcastWSMessage(shttp.NewWSMessage(Namespace, NodeUpdatedMsgType, n))
+	msg := shttp.NewWSMessage(Namespace, NodeUpdatedMsgType, n)
+	msg.CoalesceKey = string(n.ID)
+	s.WSServer.QueueBroadcastWSMessage(msg)
+	s.notifyViews(func(v *clientView) []*shttp.WSMessage { return v.nodeChanged(s.Graph, n) })
 }
 
 // OnNodeAdded event
 func (s *Server) OnNodeAdded(n *Node) {
 	s.WSServer.QueueBroadcastWSMessage(shttp.NewWSMessage(Namespace, NodeAddedMsgType, n))
+	s.notifyViews(func(v *clientView) []*shttp.WSMessage { return v.nodeChanged(s.Graph, n) })
 }
 
 // OnNodeDeleted event
 func (s *Server) OnNodeDeleted(n *Node) {
 	s.WSServer.QueueBroadcastWSMessage(shttp.NewWSMessage(Namespace, NodeDeletedMsgType, n))
+	s.notifyViews(func(v *clientView) []*shttp.WSMessage { return v.nodeDeleted(n) })
 }
 
 // OnEdgeUpdated event
 func (s *Server) OnEdgeUpdated(e *Edge) {
-	s.WSServer.QueueBroadcastWSMessage(shttp.NewWSMessage(Namespace, EdgeUpdatedMsgType, e))
+	msg := shttp.NewWSMessage(Namespace, EdgeUpdatedMsgType, e)
+	msg.CoalesceKey = string(e.ID)
+	s.WSServer.QueueBroadcastWSMessage(msg)
+	s.notifyViews(func(v *clientView) []*shttp.WSMessage { return v.edgeChanged(e) })
 }
 
 // OnEdgeAdded event
 func (s *Server) OnEdgeAdded(e *Edge) {
 	s.WSServer.QueueBroadcastWSMessage(shttp.NewWSMessage(Namespace, EdgeAddedMsgType, e))
+	s.notifyViews(func(v *clientView) []*shttp.WSMessage { return v.edgeChanged(e) })
 }
 
 // OnEdgeDeleted event
 func (s *Server) OnEdgeDeleted(e *Edge) {
 	s.WSServer.QueueBroadcastWSMessage(shttp.NewWSMessage(Namespace, EdgeDeletedMsgType, e))
+	s.notifyViews(func(v *clientView) []*shttp.WSMessage { return v.edgeDeleted(e) })
+}
+
+// AddViewFilterFactory registers a factory of the view filters requested by
+// the clients
+func (s *Server) AddViewFilterFactory(f ViewFilterFactory) {
+	s.viewFactories = append(s.viewFactories, f)
+}
+
+// OnRegisterClient websocket event, creates the view of the client if it
+// requested a filter
+func (s *Server) OnRegisterClient(c *shttp.WSClient) {
+	for _, f := range s.viewFactories {
+		filter, err := f(c)
+		if err != nil {
+			logging.GetLogger().Errorf("Invalid view filter from %s: %s", c.Host, err.Error())
+			c.SendWSMessage(shttp.NewWSMessage(Namespace, FilterErrorMsgType, err.Error()))
+		} else if filter == nil {
+			continue
+		}
+
+		s.viewsLock.Lock()
+		s.views[c] = newClientView(c, filter)
+		s.viewsLock.Unlock()
+
+		s.viewsUpdaterOn.Do(func() { go s.updateViews() })
+		return
+	}
+}
+
+// OnUnregisterClient websocket event
+func (s *Server) OnUnregisterClient(c *shttp.WSClient) {
+	s.viewsLock.Lock()
+	delete(s.views, c)
+	s.viewsLock.Unlock()
+}
+
+// unfiltered returns whether the client receives all the graph events
+func (s *Server) unfiltered(c *shttp.WSClient) bool {
+	s.viewsLock.RLock()
+	defer s.viewsLock.RUnlock()
+
+	_, ok := s.views[c]
+	return !ok
+}
+
+// notifyViews updates the incremental views with the messages returned by
+// update, the other views are evaluated again by the views updater
+func (s *Server) notifyViews(update func(v *clientView) []*shttp.WSMessage) {
+	s.viewsLock.RLock()
+	defer s.viewsLock.RUnlock()
+
+	changed := false
+	for _, view := range s.views {
+		if !view.incremental() {
+			changed = true
+			continue
+		}
+
+		for _, msg := range update(view) {
+			view.client.SendWSMessage(msg)
+		}
+	}
+
+	// the views are all evaluated, no need to queue more than one
+	// notification
+	if changed {
+		select {
+		case s.viewsChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Server) updateViews() {
+	for range s.viewsChanged {
+		var views []*clientView
+		s.viewsLock.RLock()
+		for _, view := range s.views {
+			if !view.incremental() {
+				views = append(views, view)
+			}
+		}
+		s.viewsLock.RUnlock()
+
+		for _, view := range views {
+			view.update(s.Graph)
+		}
+	}
 }
 
 // AddEventHandler subscribe a new graph server event handler
@@ -112,12 +225,16 @@ func (s *Server) AddEventHandler(h ServerEventHandler) {
 // NewServer create a new graph server based on a websocket server
 func NewServer(g *Graph, server *shttp.WSServer) *Server {
 	s := &Server{
-		Graph:    g,
-		WSServer: server,
+		Graph:        g,
+		WSServer:     server,
+		views:        make(map[*shttp.WSClient]*clientView),
+		viewsChanged: make(chan struct{}, 1),
 	}
+	s.AddViewFilterFactory(NewMetadataViewFilterFactory(g))
 
 	s.Graph.AddEventListener(s)
 	server.AddEventHandler(s, []string{Namespace})
+	server.SetBroadcastFilter(Namespace, s.unfiltered)
 
 	return s
 }
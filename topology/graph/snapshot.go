@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+)
+
+// SnapshotVersion version of the snapshot format
+const SnapshotVersion = 1
+
+// ErrSnapshotMalFormed error while decoding a snapshot
+var ErrSnapshotMalFormed = errors.New("Snapshot malformed")
+
+// Snapshot describes the whole content of a graph at a given time
+type Snapshot struct {
+	Version int
+	Host    string
+	Time    int64
+	Nodes   []*Node
+	Edges   []*Edge
+}
+
+// Snapshot returns the content of the graph, the caller has to lock the graph
+func (g *Graph) Snapshot() *Snapshot {
+	return &Snapshot{
+		Version: SnapshotVersion,
+		Host:    g.host,
+		Time:    common.UnixMillis(time.Now().UTC()),
+		Nodes:   g.GetNodes(Metadata{}),
+		Edges:   g.GetEdges(Metadata{}),
+	}
+}
+
+// LoadSnapshot replaces the content of the graph by the one of the snapshot,
+// the caller has to lock the graph
+func (g *Graph) LoadSnapshot(s *Snapshot) error {
+	if s.Version != SnapshotVersion {
+		return fmt.Errorf("Unsupported snapshot version %d, expected %d", s.Version, SnapshotVersion)
+	}
+
+	for _, n := range g.GetNodes(Metadata{}) {
+		g.DelNode(n)
+	}
+
+	for _, n := range s.Nodes {
+		if !g.AddNode(n) {
+			return fmt.Errorf("Unable to load node %s", n.ID)
+		}
+	}
+
+	for _, e := range s.Edges {
+		if !g.AddEdge(e) {
+			return fmt.Errorf("Unable to load edge %s", e.ID)
+		}
+	}
+
+	return nil
+}
+
+func decodeSnapshotElements(obj map[string]interface{}, key string, decode func(interface{}) error) error {
+	i, ok := obj[key]
+	if !ok || i == nil {
+		return nil
+	}
+
+	elements, ok := i.([]interface{})
+	if !ok {
+		return ErrSnapshotMalFormed
+	}
+
+	for _, e := range elements {
+		if err := decode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeSnapshot reads a snapshot
+func DecodeSnapshot(r io.Reader) (*Snapshot, error) {
+	var obj map[string]interface{}
+	if err := common.JSONDecode(r, &obj); err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{}
+
+	version, err := common.ToInt64(obj["Version"])
+	if err != nil {
+		return nil, ErrSnapshotMalFormed
+	}
+	s.Version = int(version)
+
+	if host, ok := obj["Host"].(string); ok {
+		s.Host = host
+	}
+
+	if t, ok := obj["Time"]; ok {
+		if s.Time, err = common.ToInt64(t); err != nil {
+			return nil, ErrSnapshotMalFormed
+		}
+	}
+
+	err = decodeSnapshotElements(obj, "Nodes", func(i interface{}) error {
+		var node Node
+		if err := node.Decode(i); err != nil {
+			return err
+		}
+		s.Nodes = append(s.Nodes, &node)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = decodeSnapshotElements(obj, "Edges", func(i interface{}) error {
+		var edge Edge
+		if err := edge.Decode(i); err != nil {
+			return err
+		}
+		s.Edges = append(s.Edges, &edge)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
@@ -31,6 +31,8 @@ import (
 	"time"
 
 	"github.com/mitchellh/hashstructure"
+	"golang.org/x/net/context"
+
 	"github.com/skydive-project/skydive/common"
 	"github.com/skydive-project/skydive/filters"
 	"github.com/skydive-project/skydive/topology/graph"
@@ -69,6 +71,8 @@ type GraphTraversal struct {
 	error              error
 	currentStepContext GraphStepContext
 	lockGraph          bool
+	lockedGraph        *graph.Graph
+	ctx                context.Context
 }
 
 // GraphTraversalV traversal steps on nodes
@@ -400,20 +404,38 @@ type Since struct {
 
 // NewGraphTraversal create a new graph traversal
 func NewGraphTraversal(g *graph.Graph, lockGraph bool) *GraphTraversal {
-	return &GraphTraversal{Graph: g, lockGraph: lockGraph}
+	return &GraphTraversal{Graph: g, lockGraph: lockGraph, lockedGraph: g}
 }
 
 // RLock read lock the graph
 func (t *GraphTraversal) RLock() {
 	if t.lockGraph {
-		t.Graph.RLock()
+		t.lockedGraph.RLock()
 	}
 }
 
 // RUnlock read unlock the graph
 func (t *GraphTraversal) RUnlock() {
 	if t.lockGraph {
-		t.Graph.RUnlock()
+		t.lockedGraph.RUnlock()
+	}
+}
+
+// Canceled returns an error if the execution of the query has been canceled
+// or has exceeded its deadline
+func (t *GraphTraversal) Canceled() error {
+	if t == nil || t.ctx == nil {
+		return nil
+	}
+
+	select {
+	case <-t.ctx.Done():
+		if t.ctx.Err() == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		return ErrCanceled
+	default:
+		return nil
 	}
 }
 
@@ -488,7 +510,7 @@ func (t *GraphTraversal) Context(s ...interface{}) *GraphTraversal {
 		return &GraphTraversal{error: err}
 	}
 
-	return &GraphTraversal{Graph: g}
+	return &GraphTraversal{Graph: g, ctx: t.ctx}
 }
 
 // V step : [node ID]
@@ -877,6 +899,10 @@ func (tv *GraphTraversalV) Dedup(s ...interface{}) *GraphTraversalV {
 
 nodeLoop:
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalV{error: err}
+		}
+
 		if it.Done() {
 			break
 		}
@@ -960,6 +986,10 @@ func (tv *GraphTraversalV) ShortestPathTo(m graph.Metadata, e graph.Metadata) *G
 
 	visited := make(map[graph.Identifier]bool)
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalShortestPath{error: err}
+		}
+
 		if _, ok := visited[n.ID]; !ok {
 			path := tv.GraphTraversal.Graph.LookupShortestPath(n, m, e)
 			if len(path) > 0 {
@@ -970,6 +1000,123 @@ func (tv *GraphTraversalV) ShortestPathTo(m graph.Metadata, e graph.Metadata) *G
 	return sp
 }
 
+// KShortestPathsTo step, returns for each node the k lightest loop-free paths
+// to the nodes matching m, the weight of the edges being the value of the
+// weight metadata key, 1 if empty
+func (tv *GraphTraversalV) KShortestPathsTo(m graph.Metadata, e graph.Metadata, weight string, k int) *GraphTraversalShortestPath {
+	if tv.error != nil {
+		return &GraphTraversalShortestPath{error: tv.error}
+	}
+
+	sp := &GraphTraversalShortestPath{GraphTraversal: tv.GraphTraversal, paths: [][]*graph.Node{}}
+
+	tv.GraphTraversal.RLock()
+	defer tv.GraphTraversal.RUnlock()
+
+	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalShortestPath{error: err}
+		}
+
+		for _, path := range tv.GraphTraversal.Graph.LookupKShortestPaths(n, m, e, weight, k) {
+			sp.paths = append(sp.paths, path.Nodes)
+		}
+	}
+	return sp
+}
+
+// AllPathsTo step, returns for each node the loop-free paths of at most
+// maxDepth edges to the nodes matching m
+func (tv *GraphTraversalV) AllPathsTo(m graph.Metadata, e graph.Metadata, maxDepth int) *GraphTraversalShortestPath {
+	if tv.error != nil {
+		return &GraphTraversalShortestPath{error: tv.error}
+	}
+
+	sp := &GraphTraversalShortestPath{GraphTraversal: tv.GraphTraversal, paths: [][]*graph.Node{}}
+
+	tv.GraphTraversal.RLock()
+	defer tv.GraphTraversal.RUnlock()
+
+	ctx := tv.GraphTraversal.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for _, n := range tv.nodes {
+		paths, err := tv.GraphTraversal.Graph.LookupAllPaths(ctx, n, m, e, maxDepth)
+		if err != nil {
+			return &GraphTraversalShortestPath{error: tv.GraphTraversal.Canceled()}
+		}
+		sp.paths = append(sp.paths, paths...)
+	}
+	return sp
+}
+
+// Reachable step, returns whether a node matching m can be reached from one
+// of the nodes
+func (tv *GraphTraversalV) Reachable(m graph.Metadata, e graph.Metadata) *GraphTraversalValue {
+	if tv.error != nil {
+		return &GraphTraversalValue{error: tv.error}
+	}
+
+	tv.GraphTraversal.RLock()
+	defer tv.GraphTraversal.RUnlock()
+
+	return &GraphTraversalValue{GraphTraversal: tv.GraphTraversal, value: tv.GraphTraversal.Graph.IsReachable(tv.nodes, m, e)}
+}
+
+// ConnectedComponents step, returns the connected components of the nodes
+// linked by edges matching e, their nodes and edges marked with ComponentID
+func (tv *GraphTraversalV) ConnectedComponents(e graph.Metadata) *GraphTraversalValue {
+	if tv.error != nil {
+		return &GraphTraversalValue{error: tv.error}
+	}
+
+	tv.GraphTraversal.RLock()
+	defer tv.GraphTraversal.RUnlock()
+
+	components := tv.GraphTraversal.Graph.ConnectedComponents(tv.nodes, e)
+	if components == nil {
+		components = []*graph.Component{}
+	}
+	return &GraphTraversalValue{GraphTraversal: tv.GraphTraversal, value: components}
+}
+
+// ArticulationPoints step, returns the nodes whose removal would split their
+// connected component, the nodes being linked by edges matching e. They are
+// marked as Critical.
+func (tv *GraphTraversalV) ArticulationPoints(e graph.Metadata) *GraphTraversalV {
+	if tv.error != nil {
+		return tv
+	}
+
+	tv.GraphTraversal.RLock()
+	defer tv.GraphTraversal.RUnlock()
+
+	nodes, _ := tv.GraphTraversal.Graph.CriticalElements(tv.nodes, e)
+	if nodes == nil {
+		nodes = []*graph.Node{}
+	}
+	return &GraphTraversalV{GraphTraversal: tv.GraphTraversal, nodes: nodes}
+}
+
+// Bridges step, returns the edges, matching e, whose removal would split
+// their connected component, marked as Critical
+func (tv *GraphTraversalV) Bridges(e graph.Metadata) *GraphTraversalE {
+	if tv.error != nil {
+		return &GraphTraversalE{error: tv.error}
+	}
+
+	tv.GraphTraversal.RLock()
+	defer tv.GraphTraversal.RUnlock()
+
+	_, edges := tv.GraphTraversal.Graph.CriticalElements(tv.nodes, e)
+	if edges == nil {
+		edges = []*graph.Edge{}
+	}
+	return &GraphTraversalE{GraphTraversal: tv.GraphTraversal, edges: edges}
+}
+
 // Has step
 func (tv *GraphTraversalV) Has(s ...interface{}) *GraphTraversalV {
 	if tv.error != nil {
@@ -1001,6 +1148,10 @@ func (tv *GraphTraversalV) Has(s ...interface{}) *GraphTraversalV {
 	defer tv.GraphTraversal.RUnlock()
 
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalV{error: err}
+		}
+
 		if it.Done() {
 			break
 		}
@@ -1031,6 +1182,10 @@ func (tv *GraphTraversalV) HasNot(s string) *GraphTraversalV {
 	defer tv.GraphTraversal.RUnlock()
 
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalV{error: err}
+		}
+
 		if it.Done() {
 			break
 		}
@@ -1061,6 +1216,10 @@ func (tv *GraphTraversalV) Both(s ...interface{}) *GraphTraversalV {
 
 nodeloop:
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalV{error: err}
+		}
+
 		for _, e := range tv.GraphTraversal.Graph.GetNodeEdges(n, nil) {
 			var nodes []*graph.Node
 			if e.GetChild() == n.ID {
@@ -1143,6 +1302,10 @@ func (tv *GraphTraversalV) Out(s ...interface{}) *GraphTraversalV {
 
 nodeloop:
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalV{error: err}
+		}
+
 		for _, child := range tv.GraphTraversal.Graph.LookupChildren(n, metadata, nil) {
 			if it.Done() {
 				break nodeloop
@@ -1174,6 +1337,10 @@ func (tv *GraphTraversalV) OutE(s ...interface{}) *GraphTraversalE {
 
 nodeloop:
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalE{error: err}
+		}
+
 		for _, e := range tv.GraphTraversal.Graph.GetNodeEdges(n, metadata) {
 			if e.GetParent() == n.ID {
 				if it.Done() {
@@ -1207,6 +1374,10 @@ func (tv *GraphTraversalV) BothE(s ...interface{}) *GraphTraversalE {
 
 nodeloop:
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalE{error: err}
+		}
+
 		for _, e := range tv.GraphTraversal.Graph.GetNodeEdges(n, metadata) {
 			if it.Done() {
 				break nodeloop
@@ -1238,6 +1409,10 @@ func (tv *GraphTraversalV) In(s ...interface{}) *GraphTraversalV {
 
 nodeloop:
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalV{error: err}
+		}
+
 		for _, parent := range tv.GraphTraversal.Graph.LookupParents(n, metadata, nil) {
 			if it.Done() {
 				break nodeloop
@@ -1269,6 +1444,10 @@ func (tv *GraphTraversalV) InE(s ...interface{}) *GraphTraversalE {
 
 nodeloop:
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalE{error: err}
+		}
+
 		for _, e := range tv.GraphTraversal.Graph.GetNodeEdges(n, metadata) {
 			if e.GetChild() == n.ID {
 				if it.Done() {
@@ -1303,6 +1482,10 @@ func (tv *GraphTraversalV) Metrics() *MetricsTraversalStep {
 
 nodeloop:
 	for _, n := range tv.nodes {
+		if err := tv.GraphTraversal.Canceled(); err != nil {
+			return &MetricsTraversalStep{error: err}
+		}
+
 		if it.Done() {
 			break nodeloop
 		}
@@ -1418,10 +1601,16 @@ func (te *GraphTraversalE) Dedup(keys ...interface{}) *GraphTraversalE {
 	defer te.GraphTraversal.RUnlock()
 
 	for _, e := range te.edges {
+		if err := te.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalE{error: err}
+		}
+
 		kvisited = e.ID
 		if key != "" {
-			if v, ok := e.Metadata()[key]; ok {
-				kvisited = v
+			if v, err := e.GetField(key); err == nil {
+				if h, err := hashstructure.Hash(v, nil); err == nil {
+					kvisited = h
+				}
 			}
 		}
 
@@ -1464,6 +1653,10 @@ func (te *GraphTraversalE) Has(s ...interface{}) *GraphTraversalE {
 	defer te.GraphTraversal.RUnlock()
 
 	for _, e := range te.edges {
+		if err := te.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalE{error: err}
+		}
+
 		if it.Done() {
 			break
 		}
@@ -1494,6 +1687,10 @@ func (te *GraphTraversalE) HasNot(s string) *GraphTraversalE {
 	defer te.GraphTraversal.RUnlock()
 
 	for _, e := range te.edges {
+		if err := te.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalE{error: err}
+		}
+
 		if it.Done() {
 			break
 		}
@@ -1523,6 +1720,10 @@ func (te *GraphTraversalE) InV(s ...interface{}) *GraphTraversalV {
 	defer te.GraphTraversal.RUnlock()
 
 	for _, e := range te.edges {
+		if err := te.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalV{error: err}
+		}
+
 		parents, _ := te.GraphTraversal.Graph.GetEdgeNodes(e, metadata, graph.Metadata{})
 		for _, parent := range parents {
 			if it.Done() {
@@ -1554,6 +1755,10 @@ func (te *GraphTraversalE) OutV(s ...interface{}) *GraphTraversalV {
 	defer te.GraphTraversal.RUnlock()
 
 	for _, e := range te.edges {
+		if err := te.GraphTraversal.Canceled(); err != nil {
+			return &GraphTraversalV{error: err}
+		}
+
 		_, children := te.GraphTraversal.Graph.GetEdgeNodes(e, graph.Metadata{}, metadata)
 		for _, child := range children {
 			if it.Done() {
@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package traversal
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/filters"
+	"github.com/skydive-project/skydive/topology/graph"
+)
+
+// GraphTraversalDiff describes the changes of the graph between two points in time
+type GraphTraversalDiff struct {
+	GraphTraversal *GraphTraversal
+	diff           *graph.GraphDiff
+	error          error
+}
+
+// Values returns the diff
+func (td *GraphTraversalDiff) Values() []interface{} {
+	return []interface{}{td.diff}
+}
+
+// MarshalJSON serialize in JSON
+func (td *GraphTraversalDiff) MarshalJSON() ([]byte, error) {
+	values := td.Values()
+	td.GraphTraversal.RLock()
+	defer td.GraphTraversal.RUnlock()
+	return json.Marshal(values)
+}
+
+// Error returns traversal error
+func (td *GraphTraversalDiff) Error() error {
+	return td.error
+}
+
+// GetDiff returns the changes of the graph
+func (td *GraphTraversalDiff) GetDiff() *graph.GraphDiff {
+	return td.diff
+}
+
+func (t *GraphTraversal) graphAt(at time.Time) (*graph.Graph, error) {
+	if at.After(time.Now().UTC()) {
+		return nil, errors.New("Sorry, I can't predict the future")
+	}
+	ms := common.UnixMillis(at)
+	return t.Graph.WithContext(graph.GraphContext{TimeSlice: common.NewTimeSlice(ms, ms)})
+}
+
+// Diff step : from, [to]
+// returns the nodes and edges added, removed or updated between from and to.
+// Without to, the changes are computed up to the current graph.
+func (t *GraphTraversal) Diff(s ...interface{}) *GraphTraversalDiff {
+	if t.error != nil {
+		return &GraphTraversalDiff{error: t.error}
+	}
+
+	t.RLock()
+	defer t.RUnlock()
+
+	from, err := t.graphAt(s[0].(time.Time))
+	if err != nil {
+		return &GraphTraversalDiff{error: err}
+	}
+
+	to := t.Graph
+	if len(s) > 1 {
+		if !s[1].(time.Time).After(s[0].(time.Time)) {
+			return &GraphTraversalDiff{error: errors.New("Diff end time must be after its start time")}
+		}
+
+		if to, err = t.graphAt(s[1].(time.Time)); err != nil {
+			return &GraphTraversalDiff{error: err}
+		}
+	}
+
+	if err := t.Canceled(); err != nil {
+		return &GraphTraversalDiff{error: err}
+	}
+
+	return &GraphTraversalDiff{GraphTraversal: t, diff: from.Diff(to)}
+}
+
+// Has step : filters the changes on the metadata of the elements, the
+// previous revision is used for removed elements
+func (td *GraphTraversalDiff) Has(s ...interface{}) *GraphTraversalDiff {
+	if td.error != nil {
+		return td
+	}
+
+	filter, err := ParamsToFilter(s...)
+	if err != nil {
+		return &GraphTraversalDiff{error: err}
+	}
+
+	td.GraphTraversal.RLock()
+	defer td.GraphTraversal.RUnlock()
+
+	return &GraphTraversalDiff{GraphTraversal: td.GraphTraversal, diff: filterDiff(td.diff, filter)}
+}
+
+func filterDiff(d *graph.GraphDiff, filter *filters.Filter) *graph.GraphDiff {
+	nd := &graph.GraphDiff{}
+	for _, n := range d.AddedNodes {
+		if filter.Eval(n) {
+			nd.AddedNodes = append(nd.AddedNodes, n)
+		}
+	}
+	for _, n := range d.RemovedNodes {
+		if filter.Eval(n) {
+			nd.RemovedNodes = append(nd.RemovedNodes, n)
+		}
+	}
+	for _, u := range d.UpdatedNodes {
+		if filter.Eval(u.Node) {
+			nd.UpdatedNodes = append(nd.UpdatedNodes, u)
+		}
+	}
+	for _, e := range d.AddedEdges {
+		if filter.Eval(e) {
+			nd.AddedEdges = append(nd.AddedEdges, e)
+		}
+	}
+	for _, e := range d.RemovedEdges {
+		if filter.Eval(e) {
+			nd.RemovedEdges = append(nd.RemovedEdges, e)
+		}
+	}
+	for _, u := range d.UpdatedEdges {
+		if filter.Eval(u.Edge) {
+			nd.UpdatedEdges = append(nd.UpdatedEdges, u)
+		}
+	}
+	return nd
+}
@@ -23,16 +23,21 @@
 package traversal
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
 	"github.com/skydive-project/skydive/topology/graph"
 )
 
@@ -41,6 +46,7 @@ type (
 	GremlinTraversalSequence struct {
 		GraphTraversal *GraphTraversal
 		steps          []GremlinTraversalStep
+		stepNames      []string
 		extensions     []GremlinTraversalExtension
 	}
 
@@ -121,6 +127,26 @@ type (
 	GremlinTraversalStepShortestPathTo struct {
 		GremlinTraversalContext
 	}
+	// GremlinTraversalStepAllPathsTo step
+	GremlinTraversalStepAllPathsTo struct {
+		GremlinTraversalContext
+	}
+	// GremlinTraversalStepReachable step
+	GremlinTraversalStepReachable struct {
+		GremlinTraversalContext
+	}
+	// GremlinTraversalStepConnectedComponents step
+	GremlinTraversalStepConnectedComponents struct {
+		GremlinTraversalContext
+	}
+	// GremlinTraversalStepArticulationPoints step
+	GremlinTraversalStepArticulationPoints struct {
+		GremlinTraversalContext
+	}
+	// GremlinTraversalStepBridges step
+	GremlinTraversalStepBridges struct {
+		GremlinTraversalContext
+	}
 	// GremlinTraversalStepBoth step
 	GremlinTraversalStepBoth struct {
 		GremlinTraversalContext
@@ -157,11 +183,23 @@ type (
 	GremlinTraversalStepMetrics struct {
 		GremlinTraversalContext
 	}
+	// GremlinTraversalStepProfile step
+	GremlinTraversalStepProfile struct {
+		GremlinTraversalContext
+	}
+	// GremlinTraversalStepDiff step
+	GremlinTraversalStepDiff struct {
+		GremlinTraversalContext
+	}
 )
 
 var (
 	// ErrExecutionError execution error
 	ErrExecutionError = errors.New("Error while executing the query")
+	// ErrTimeout the query has exceeded its deadline
+	ErrTimeout = errors.New("Query execution timed out")
+	// ErrCanceled the query has been canceled
+	ErrCanceled = errors.New("Query execution canceled")
 )
 
 // GremlinTraversalParser describes a parser of gremlin graph expression
@@ -176,6 +214,7 @@ type GremlinTraversalParser struct {
 		n   int
 	}
 	extensions []GremlinTraversalExtension
+	bindings   map[string]interface{}
 }
 
 func invokeStepFnc(last GraphTraversalStep, name string, gremlinStep GremlinTraversalStep) (GraphTraversalStep, error) {
@@ -299,19 +338,8 @@ func (s *GremlinTraversalStepContext) Exec(last GraphTraversalStep) (_ GraphTrav
 		}
 		fallthrough
 	case 1:
-		switch param := s.Params[0].(type) {
-		case string:
-			if s.Params[0], err = parseTimeContext(param); err != nil {
-				return nil, err
-			}
-		case int64:
-			if param > math.MaxInt32 {
-				s.Params[0] = time.Unix(0, param*1000000)
-			} else {
-				s.Params[0] = time.Unix(param, 0)
-			}
-		default:
-			return nil, errors.New("Key must be either an integer or a string")
+		if s.Params[0], err = timeParam(s.Params[0]); err != nil {
+			return nil, err
 		}
 	default:
 		return nil, errors.New("At most two parameters must be provided")
@@ -325,6 +353,44 @@ func (s *GremlinTraversalStepContext) Reduce(next GremlinTraversalStep) GremlinT
 	return next
 }
 
+// timeParam converts a time given either as a string, in RFC1123 or Go
+// duration format, or as a timestamp in seconds or milliseconds
+func timeParam(param interface{}) (time.Time, error) {
+	switch param := param.(type) {
+	case time.Time:
+		return param, nil
+	case string:
+		return parseTimeContext(param)
+	case int64:
+		if param > math.MaxInt32 {
+			return time.Unix(0, param*1000000), nil
+		}
+		return time.Unix(param, 0), nil
+	}
+	return time.Time{}, errors.New("Key must be either an integer or a string")
+}
+
+// Exec Diff step
+func (s *GremlinTraversalStepDiff) Exec(last GraphTraversalStep) (_ GraphTraversalStep, err error) {
+	g, ok := last.(*GraphTraversal)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	for i := range s.Params {
+		if s.Params[i], err = timeParam(s.Params[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return g.Diff(s.Params...), nil
+}
+
+// Reduce Diff step
+func (s *GremlinTraversalStepDiff) Reduce(next GremlinTraversalStep) GremlinTraversalStep {
+	return next
+}
+
 // Exec Has step
 func (s *GremlinTraversalStepHas) Exec(last GraphTraversalStep) (GraphTraversalStep, error) {
 	switch last.(type) {
@@ -581,23 +647,45 @@ func (s *GremlinTraversalStepBothE) Reduce(next GremlinTraversalStep) GremlinTra
 	return next
 }
 
-// Exec ShortestPathTo step
+// Exec ShortestPathTo step, an edge weight metadata key and a number of
+// paths can be given after the metadata to compute the k shortest paths
 func (s *GremlinTraversalStepShortestPathTo) Exec(last GraphTraversalStep) (GraphTraversalStep, error) {
-	switch last.(type) {
-	case *GraphTraversalV:
-		if _, ok := s.Params[0].(graph.Metadata); !ok {
-			return nil, ErrExecutionError
+	tv, ok := last.(*GraphTraversalV)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	m, ok := s.Params[0].(graph.Metadata)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	params := s.Params[1:]
+	var em graph.Metadata
+	if len(params) > 0 {
+		if em, ok = params[0].(graph.Metadata); ok {
+			params = params[1:]
 		}
-		if len(s.Params) > 1 {
-			if _, ok := s.Params[1].(graph.Metadata); !ok {
-				return nil, ErrExecutionError
-			}
-			return last.(*GraphTraversalV).ShortestPathTo(s.Params[0].(graph.Metadata), s.Params[1].(graph.Metadata)), nil
+	}
+
+	if len(params) == 0 {
+		return tv.ShortestPathTo(m, em), nil
+	}
+
+	weight, ok := params[0].(string)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	k := int64(1)
+	if len(params) > 1 {
+		var err error
+		if k, err = common.ToInt64(params[1]); err != nil || k <= 0 {
+			return nil, ErrExecutionError
 		}
-		return last.(*GraphTraversalV).ShortestPathTo(s.Params[0].(graph.Metadata), nil), nil
 	}
 
-	return nil, ErrExecutionError
+	return tv.KShortestPathsTo(m, em, weight, int(k)), nil
 }
 
 // Reduce ShortestPathTo step
@@ -605,6 +693,135 @@ func (s *GremlinTraversalStepShortestPathTo) Reduce(next GremlinTraversalStep) G
 	return next
 }
 
+// Exec AllPathsTo step, the edge metadata are optional
+func (s *GremlinTraversalStepAllPathsTo) Exec(last GraphTraversalStep) (GraphTraversalStep, error) {
+	tv, ok := last.(*GraphTraversalV)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	m, ok := s.Params[0].(graph.Metadata)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	var em graph.Metadata
+	depth := s.Params[len(s.Params)-1]
+	if len(s.Params) == 3 {
+		if em, ok = s.Params[1].(graph.Metadata); !ok {
+			return nil, ErrExecutionError
+		}
+	}
+
+	maxDepth, err := common.ToInt64(depth)
+	if err != nil || maxDepth <= 0 {
+		return nil, ErrExecutionError
+	}
+
+	return tv.AllPathsTo(m, em, int(maxDepth)), nil
+}
+
+// Reduce AllPathsTo step
+func (s *GremlinTraversalStepAllPathsTo) Reduce(next GremlinTraversalStep) GremlinTraversalStep {
+	return next
+}
+
+// Exec Reachable step
+func (s *GremlinTraversalStepReachable) Exec(last GraphTraversalStep) (GraphTraversalStep, error) {
+	tv, ok := last.(*GraphTraversalV)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	m, ok := s.Params[0].(graph.Metadata)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	var em graph.Metadata
+	if len(s.Params) > 1 {
+		if em, ok = s.Params[1].(graph.Metadata); !ok {
+			return nil, ErrExecutionError
+		}
+	}
+
+	return tv.Reachable(m, em), nil
+}
+
+// Reduce Reachable step
+func (s *GremlinTraversalStepReachable) Reduce(next GremlinTraversalStep) GremlinTraversalStep {
+	return next
+}
+
+// edgeMetadataParam returns the optional edge metadata parameter of the
+// analysis steps
+func edgeMetadataParam(params []interface{}) (graph.Metadata, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	if m, ok := params[0].(graph.Metadata); ok {
+		return m, nil
+	}
+	return nil, ErrExecutionError
+}
+
+// Exec ConnectedComponents step
+func (s *GremlinTraversalStepConnectedComponents) Exec(last GraphTraversalStep) (GraphTraversalStep, error) {
+	tv, ok := last.(*GraphTraversalV)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	em, err := edgeMetadataParam(s.Params)
+	if err != nil {
+		return nil, err
+	}
+	return tv.ConnectedComponents(em), nil
+}
+
+// Reduce ConnectedComponents step
+func (s *GremlinTraversalStepConnectedComponents) Reduce(next GremlinTraversalStep) GremlinTraversalStep {
+	return next
+}
+
+// Exec ArticulationPoints step
+func (s *GremlinTraversalStepArticulationPoints) Exec(last GraphTraversalStep) (GraphTraversalStep, error) {
+	tv, ok := last.(*GraphTraversalV)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	em, err := edgeMetadataParam(s.Params)
+	if err != nil {
+		return nil, err
+	}
+	return tv.ArticulationPoints(em), nil
+}
+
+// Reduce ArticulationPoints step
+func (s *GremlinTraversalStepArticulationPoints) Reduce(next GremlinTraversalStep) GremlinTraversalStep {
+	return next
+}
+
+// Exec Bridges step
+func (s *GremlinTraversalStepBridges) Exec(last GraphTraversalStep) (GraphTraversalStep, error) {
+	tv, ok := last.(*GraphTraversalV)
+	if !ok {
+		return nil, ErrExecutionError
+	}
+
+	em, err := edgeMetadataParam(s.Params)
+	if err != nil {
+		return nil, err
+	}
+	return tv.Bridges(em), nil
+}
+
+// Reduce Bridges step
+func (s *GremlinTraversalStepBridges) Reduce(next GremlinTraversalStep) GremlinTraversalStep {
+	return next
+}
+
 // Exec Both step
 func (s *GremlinTraversalStepBoth) Exec(last GraphTraversalStep) (GraphTraversalStep, error) {
 	switch last.(type) {
@@ -735,14 +952,43 @@ func (s *GremlinTraversalStepMetrics) Reduce(next GremlinTraversalStep) GremlinT
 	return next
 }
 
-// Exec sequence step
-func (s *GremlinTraversalSequence) Exec() (GraphTraversalStep, error) {
+// Exec Profile step, the profiling itself is done by the sequence
+func (s *GremlinTraversalStepProfile) Exec(last GraphTraversalStep) (GraphTraversalStep, error) {
+	return last, nil
+}
+
+// Reduce Profile step
+func (s *GremlinTraversalStepProfile) Reduce(next GremlinTraversalStep) GremlinTraversalStep {
+	return next
+}
+
+func (s *GremlinTraversalSequence) exec(ctx context.Context, g *graph.Graph, profile *TraversalProfile, recorder *graph.BackendCallRecorder) (GraphTraversalStep, error) {
 	var step GremlinTraversalStep
 	var last GraphTraversalStep
 	var err error
 
-	last = s.GraphTraversal
+	if _, ok := ctx.Deadline(); !ok {
+		if timeout := config.GetConfig().GetInt("analyzer.gremlin_timeout"); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+			defer cancel()
+		}
+	}
+
+	gt := &GraphTraversal{
+		Graph:       g,
+		lockGraph:   s.GraphTraversal.lockGraph,
+		lockedGraph: s.GraphTraversal.lockedGraph,
+		ctx:         ctx,
+	}
+
+	last = gt
 	for i := 0; i < len(s.steps); {
+		if err := gt.Canceled(); err != nil {
+			return nil, err
+		}
+
+		first := i
 		step = s.steps[i]
 
 		for i = i + 1; i < len(s.steps); i = i + 1 {
@@ -751,8 +997,25 @@ func (s *GremlinTraversalSequence) Exec() (GraphTraversalStep, error) {
 			}
 		}
 
-		if last, err = step.Exec(last); err != nil {
-			return nil, err
+		if _, ok := step.(*GremlinTraversalStepProfile); ok || profile == nil {
+			if last, err = step.Exec(last); err != nil {
+				return nil, err
+			}
+		} else {
+			stepProfile := &TraversalStepProfile{
+				Name:    strings.Join(s.stepNames[first:i], "."),
+				InCount: elementCount(last),
+			}
+			profile.Steps = append(profile.Steps, stepProfile)
+
+			start := time.Now()
+			last, err = step.Exec(last)
+			stepProfile.Duration = time.Since(start)
+			stepProfile.BackendCalls = recorder.Flush()
+			if err != nil {
+				return nil, err
+			}
+			stepProfile.OutCount = elementCount(last)
 		}
 
 		if err := last.Error(); err != nil {
@@ -768,6 +1031,47 @@ func (s *GremlinTraversalSequence) Exec() (GraphTraversalStep, error) {
 	return res, nil
 }
 
+// Exec sequence step
+func (s *GremlinTraversalSequence) Exec() (GraphTraversalStep, error) {
+	return s.ExecWithContext(context.Background())
+}
+
+// ExecWithContext executes the sequence until ctx is done. Unless ctx
+// already has a deadline, the configured query timeout is applied.
+func (s *GremlinTraversalSequence) ExecWithContext(ctx context.Context) (GraphTraversalStep, error) {
+	if n := len(s.steps); n > 0 {
+		if _, ok := s.steps[n-1].(*GremlinTraversalStepProfile); ok {
+			_, profile, err := s.ProfileWithContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return &GraphTraversalProfile{profile: profile}, nil
+		}
+	}
+
+	return s.exec(ctx, s.GraphTraversal.Graph, nil, nil)
+}
+
+// Profile executes the sequence and returns its result along with the
+// duration, the number of elements in and out and the backend calls of
+// every step
+func (s *GremlinTraversalSequence) Profile() (GraphTraversalStep, *TraversalProfile, error) {
+	return s.ProfileWithContext(context.Background())
+}
+
+// ProfileWithContext profiles the sequence until ctx is done
+func (s *GremlinTraversalSequence) ProfileWithContext(ctx context.Context) (GraphTraversalStep, *TraversalProfile, error) {
+	recorder := graph.NewBackendCallRecorder()
+	g := s.GraphTraversal.Graph.WithBackendCallRecorder(recorder)
+
+	profile := &TraversalProfile{}
+	start := time.Now()
+	res, err := s.exec(ctx, g, profile, recorder)
+	profile.Duration = time.Since(start)
+
+	return res, profile, err
+}
+
 // AddTraversalExtension register a new gremlin traversal extension
 func (p *GremlinTraversalParser) AddTraversalExtension(e GremlinTraversalExtension) {
 	p.extensions = append(p.extensions, e)
@@ -780,6 +1084,71 @@ func NewGremlinTraversalParser(g *graph.Graph) *GremlinTraversalParser {
 	}
 }
 
+func bindingToParam(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case float32:
+		return bindingToParam(float64(v))
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < math.MaxInt64 {
+			return int64(v), nil
+		}
+		return v, nil
+	case int, int32, int64, uint, uint32, uint64:
+		return common.ToInt64(v)
+	}
+
+	return nil, fmt.Errorf("Unsupported binding type %T", v)
+}
+
+// boundParam returns the parameter of a bound variable, a list is bound
+// as a single Within parameter
+func (p *GremlinTraversalParser) boundParam(name string) (interface{}, error) {
+	value, ok := p.bindings[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown binding '%s'", name)
+	}
+
+	v := reflect.ValueOf(value)
+	if value == nil || v.Kind() != reflect.Slice {
+		param, err := bindingToParam(value)
+		if err != nil {
+			return nil, fmt.Errorf("Binding '%s': %s", name, err.Error())
+		}
+		return param, nil
+	}
+
+	params := make([]interface{}, v.Len())
+	for i := range params {
+		param, err := bindingToParam(v.Index(i).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("Binding '%s': %s", name, err.Error())
+		}
+		params[i] = param
+	}
+
+	return Within(params...), nil
+}
+
+// expandLists replaces the bound lists by their elements
+func expandLists(params []interface{}) []interface{} {
+	var expanded []interface{}
+	for _, param := range params {
+		if within, ok := param.(*WithinMetadataMatcher); ok {
+			expanded = append(expanded, within.List...)
+		} else {
+			expanded = append(expanded, param)
+		}
+	}
+	return expanded
+}
+
 func (p *GremlinTraversalParser) parseStepParams() ([]interface{}, error) {
 	tok, lit := p.scanIgnoreWhitespace()
 	if tok != LEFT_PARENTHESIS {
@@ -819,13 +1188,13 @@ func (p *GremlinTraversalParser) parseStepParams() ([]interface{}, error) {
 			if err != nil {
 				return nil, err
 			}
-			params = append(params, Within(withParams...))
+			params = append(params, Within(expandLists(withParams)...))
 		case WITHOUT:
 			withoutParams, err := p.parseStepParams()
 			if err != nil {
 				return nil, err
 			}
-			params = append(params, Without(withoutParams...))
+			params = append(params, Without(expandLists(withoutParams)...))
 		case LT:
 			ltParams, err := p.parseStepParams()
 			if err != nil {
@@ -926,7 +1295,15 @@ func (p *GremlinTraversalParser) parseStepParams() ([]interface{}, error) {
 			}
 			params = append(params, Contains(containsParams[0]))
 		default:
-			return nil, fmt.Errorf("Unexpected token while parsing parameters, got: %s", lit)
+			// identifiers refer to bindings, which may also be named as a keyword
+			if _, ok := p.bindings[lit]; !ok && tok != IDENT {
+				return nil, fmt.Errorf("Unexpected token while parsing parameters, got: %s", lit)
+			}
+			param, err := p.boundParam(lit)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, param)
 		}
 		tok, lit = p.scanIgnoreWhitespace()
 	}
@@ -1019,10 +1396,34 @@ func (p *GremlinTraversalParser) parserStep() (GremlinTraversalStep, error) {
 			return nil, fmt.Errorf("HasKey accepts only one parameter of type string")
 		}
 	case SHORTESTPATHTO:
-		if len(params) == 0 || len(params) > 2 {
-			return nil, fmt.Errorf("ShortestPathTo predicate accepts only 1 or 2 parameters")
+		if len(params) == 0 || len(params) > 4 {
+			return nil, fmt.Errorf("ShortestPathTo predicate accepts only 1 to 4 parameters")
 		}
 		return &GremlinTraversalStepShortestPathTo{gremlinStepContext}, nil
+	case ALLPATHSTO:
+		if len(params) < 2 || len(params) > 3 {
+			return nil, fmt.Errorf("AllPathsTo predicate accepts only 2 or 3 parameters")
+		}
+		if depth, err := common.ToInt64(params[len(params)-1]); err != nil || depth <= 0 {
+			return nil, fmt.Errorf("AllPathsTo expects a positive maximum depth as last parameter")
+		}
+		return &GremlinTraversalStepAllPathsTo{gremlinStepContext}, nil
+	case CONNECTEDCOMPONENTS, ARTICULATIONPOINTS, BRIDGES:
+		if len(params) > 1 {
+			return nil, fmt.Errorf("%s accepts only an optional edge metadata parameter", lit)
+		}
+		switch tok {
+		case CONNECTEDCOMPONENTS:
+			return &GremlinTraversalStepConnectedComponents{gremlinStepContext}, nil
+		case ARTICULATIONPOINTS:
+			return &GremlinTraversalStepArticulationPoints{gremlinStepContext}, nil
+		}
+		return &GremlinTraversalStepBridges{gremlinStepContext}, nil
+	case REACHABLE:
+		if len(params) == 0 || len(params) > 2 {
+			return nil, fmt.Errorf("Reachable predicate accepts only 1 or 2 parameters")
+		}
+		return &GremlinTraversalStepReachable{gremlinStepContext}, nil
 	case BOTH:
 		return &GremlinTraversalStepBoth{gremlinStepContext}, nil
 	case CONTEXT:
@@ -1077,6 +1478,16 @@ func (p *GremlinTraversalParser) parserStep() (GremlinTraversalStep, error) {
 		return &GremlinTraversalStepSum{gremlinStepContext}, nil
 	case METRICS:
 		return &GremlinTraversalStepMetrics{gremlinStepContext}, nil
+	case PROFILE:
+		if len(params) != 0 {
+			return nil, fmt.Errorf("Profile accepts no parameter")
+		}
+		return &GremlinTraversalStepProfile{gremlinStepContext}, nil
+	case DIFF:
+		if len(params) == 0 || len(params) > 2 {
+			return nil, fmt.Errorf("Diff accepts only 1 or 2 parameters")
+		}
+		return &GremlinTraversalStepDiff{gremlinStepContext}, nil
 	}
 
 	// extensions
@@ -1095,10 +1506,19 @@ func (p *GremlinTraversalParser) parserStep() (GremlinTraversalStep, error) {
 
 // Parse the Gremlin language and return a traversal sequence
 func (p *GremlinTraversalParser) Parse(r io.Reader, lockGraph bool) (*GremlinTraversalSequence, error) {
+	return p.ParseWithBindings(r, lockGraph, nil)
+}
+
+// ParseWithBindings parses the Gremlin language, the identifiers used as step
+// parameters are replaced by their value in bindings. Strings and numbers are
+// supported, a list matches any of its elements.
+func (p *GremlinTraversalParser) ParseWithBindings(r io.Reader, lockGraph bool, bindings map[string]interface{}) (*GremlinTraversalSequence, error) {
 	p.Lock()
 	defer p.Unlock()
 
 	p.scanner = NewGremlinTraversalScanner(r, p.extensions)
+	p.bindings = bindings
+	defer func() { p.bindings = nil }()
 
 	seq := &GremlinTraversalSequence{
 		GraphTraversal: NewGraphTraversal(p.Graph, lockGraph),
@@ -1120,11 +1540,21 @@ func (p *GremlinTraversalParser) Parse(r io.Reader, lockGraph bool) (*GremlinTra
 			return nil, fmt.Errorf("found %q, expected `.`", lit)
 		}
 
+		if n := len(seq.steps); n > 0 {
+			if _, ok := seq.steps[n-1].(*GremlinTraversalStepProfile); ok {
+				return nil, errors.New("Profile has to be the last step")
+			}
+		}
+
+		_, name := p.scanIgnoreWhitespace()
+		p.unscan()
+
 		step, err := p.parserStep()
 		if err != nil {
 			return nil, err
 		}
 		seq.steps = append(seq.steps, step)
+		seq.stepNames = append(seq.stepNames, name)
 	}
 
 	return seq, nil
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package traversal
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/skydive-project/skydive/topology/graph"
+)
+
+// TraversalStepProfile describes the execution of a step, reduced steps
+// are reported as a single one, ie: V.Has
+type TraversalStepProfile struct {
+	Name         string
+	Duration     time.Duration
+	InCount      int
+	OutCount     int
+	BackendCalls map[string]graph.BackendCall
+}
+
+// TraversalProfile describes the execution of a whole gremlin query
+type TraversalProfile struct {
+	Steps    []*TraversalStepProfile
+	Duration time.Duration
+}
+
+// GraphTraversalProfile is the result of a query ending with the Profile step
+type GraphTraversalProfile struct {
+	profile *TraversalProfile
+}
+
+// Values returns the profile
+func (p *GraphTraversalProfile) Values() []interface{} {
+	return []interface{}{p.profile}
+}
+
+// MarshalJSON serialize in JSON
+func (p *GraphTraversalProfile) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Values())
+}
+
+// Error returns traversal error
+func (p *GraphTraversalProfile) Error() error {
+	return nil
+}
+
+// Profile returns the profile
+func (p *GraphTraversalProfile) Profile() *TraversalProfile {
+	return p.profile
+}
+
+func elementCount(step GraphTraversalStep) int {
+	switch s := step.(type) {
+	case nil, *GraphTraversal:
+		return 0
+	case *GraphTraversalV:
+		return len(s.nodes)
+	case *GraphTraversalE:
+		return len(s.edges)
+	case *GraphTraversalShortestPath:
+		return len(s.paths)
+	}
+	return len(step.Values())
+}
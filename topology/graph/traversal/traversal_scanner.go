@@ -69,6 +69,11 @@ const (
 	WITHOUT
 	METADATA
 	SHORTESTPATHTO
+	ALLPATHSTO
+	REACHABLE
+	CONNECTEDCOMPONENTS
+	ARTICULATIONPOINTS
+	BRIDGES
 	NE
 	BOTH
 	CONTEXT
@@ -91,6 +96,8 @@ const (
 	ASC
 	DESC
 	CONTAINS
+	PROFILE
+	DIFF
 
 	// extensions token have to start after 1000
 )
@@ -244,6 +251,16 @@ func (s *GremlinTraversalScanner) scanIdent() (tok Token, lit string) {
 		return METADATA, buf.String()
 	case "SHORTESTPATHTO":
 		return SHORTESTPATHTO, buf.String()
+	case "ALLPATHSTO":
+		return ALLPATHSTO, buf.String()
+	case "REACHABLE":
+		return REACHABLE, buf.String()
+	case "CONNECTEDCOMPONENTS":
+		return CONNECTEDCOMPONENTS, buf.String()
+	case "ARTICULATIONPOINTS":
+		return ARTICULATIONPOINTS, buf.String()
+	case "BRIDGES":
+		return BRIDGES, buf.String()
 	case "NE":
 		return NE, buf.String()
 	case "BOTH":
@@ -286,6 +303,10 @@ func (s *GremlinTraversalScanner) scanIdent() (tok Token, lit string) {
 		return DESC, buf.String()
 	case "CONTAINS":
 		return CONTAINS, buf.String()
+	case "PROFILE":
+		return PROFILE, buf.String()
+	case "DIFF":
+		return DIFF, buf.String()
 	}
 
 	for _, e := range s.extensions {
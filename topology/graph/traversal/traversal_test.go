@@ -23,9 +23,17 @@
 package traversal
 
 import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/net/context"
+
+	"github.com/skydive-project/skydive/common"
 	"github.com/skydive-project/skydive/topology/graph"
 )
 
@@ -512,3 +520,418 @@ func TestTraversalParser(t *testing.T) {
 		t.Fatalf("Should return 2 node, returned: %v", res.Values())
 	}
 }
+
+func TestTraversalProfile(t *testing.T) {
+	g := newTransversalGraph(t)
+
+	query := `G.V().Has("Type", "intf").Out().Profile()`
+	res := execTraversalQuery(t, g, query)
+	if len(res.Values()) != 1 {
+		t.Fatalf("Should return 1 profile, returned: %v", res.Values())
+	}
+
+	profile := res.Values()[0].(*TraversalProfile)
+	if len(profile.Steps) != 2 {
+		t.Fatalf("Should return 2 steps, returned: %v", profile.Steps)
+	}
+
+	step := profile.Steps[0]
+	if step.Name != "V.Has" || step.InCount != 0 || step.OutCount != 2 {
+		t.Fatalf("Wrong profile for the first step: %+v", step)
+	}
+	if step.BackendCalls["GetNodes"].Count != 1 {
+		t.Fatalf("Should call GetNodes once, returned: %v", step.BackendCalls)
+	}
+
+	step = profile.Steps[1]
+	if step.Name != "Out" || step.InCount != 2 || step.OutCount != 4 {
+		t.Fatalf("Wrong profile for the second step: %+v", step)
+	}
+	if step.BackendCalls["GetNodeEdges"].Count == 0 {
+		t.Fatalf("Should call GetNodeEdges, returned: %v", step.BackendCalls)
+	}
+
+	query = `G.V().Profile().Count()`
+	if _, err := NewGremlinTraversalParser(g).Parse(strings.NewReader(query), false); err == nil {
+		t.Fatalf("Profile should be the last step: %s", query)
+	}
+}
+
+func TestTraversalCancel(t *testing.T) {
+	g := newTransversalGraph(t)
+
+	query := `G.V().Has("Type", "intf").Out()`
+	ts, err := NewGremlinTraversalParser(g).Parse(strings.NewReader(query), false)
+	if err != nil {
+		t.Fatalf("%s: %s", query, err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err = ts.ExecWithContext(ctx); err != ErrCanceled {
+		t.Fatalf("Should return a cancel error, returned: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	if _, err = ts.ExecWithContext(ctx); err != ErrTimeout {
+		t.Fatalf("Should return a timeout error, returned: %v", err)
+	}
+
+	res, err := ts.ExecWithContext(context.Background())
+	if err != nil || len(res.Values()) != 4 {
+		t.Fatalf("Should return 4 nodes, returned: %v, %v", res, err)
+	}
+}
+
+func TestTraversalBindings(t *testing.T) {
+	g := newTransversalGraph(t)
+
+	bindings := map[string]interface{}{
+		"type":   "intf",
+		"name":   `Node"4'`,
+		"value":  json.Number("2"),
+		"values": []interface{}{float64(1), json.Number("4")},
+		"types":  []string{"intf", "host"},
+	}
+
+	query := `G.V().Has("Type", type).Has("Value", value)`
+	ts, err := NewGremlinTraversalParser(g).ParseWithBindings(strings.NewReader(query), false, bindings)
+	if err != nil {
+		t.Fatalf("%s: %s", query, err.Error())
+	}
+
+	res, err := ts.Exec()
+	if err != nil || len(res.Values()) != 1 {
+		t.Fatalf("Should return 1 node, returned: %v, %v", res, err)
+	}
+
+	query = `G.V().Has("Value", Within(values))`
+	if ts, err = NewGremlinTraversalParser(g).ParseWithBindings(strings.NewReader(query), false, bindings); err != nil {
+		t.Fatalf("%s: %s", query, err.Error())
+	}
+
+	if res, err = ts.Exec(); err != nil || len(res.Values()) != 2 {
+		t.Fatalf("Should return 2 nodes, returned: %v, %v", res, err)
+	}
+
+	// a list matches any of its elements
+	query = `G.V().Has("Type", types)`
+	if ts, err = NewGremlinTraversalParser(g).ParseWithBindings(strings.NewReader(query), false, bindings); err != nil {
+		t.Fatalf("%s: %s", query, err.Error())
+	}
+
+	if res, err = ts.Exec(); err != nil || len(res.Values()) != 2 {
+		t.Fatalf("Should return 2 nodes, returned: %v, %v", res, err)
+	}
+
+	query = `G.V().Has("Type", types, "Value", values)`
+	if ts, err = NewGremlinTraversalParser(g).ParseWithBindings(strings.NewReader(query), false, bindings); err != nil {
+		t.Fatalf("%s: %s", query, err.Error())
+	}
+
+	if res, err = ts.Exec(); err != nil || len(res.Values()) != 1 {
+		t.Fatalf("Should return 1 node, returned: %v, %v", res, err)
+	}
+
+	query = `G.V().Has("Name", name)`
+	if ts, err = NewGremlinTraversalParser(g).ParseWithBindings(strings.NewReader(query), false, bindings); err != nil {
+		t.Fatalf("%s: %s", query, err.Error())
+	}
+
+	if res, err = ts.Exec(); err != nil || len(res.Values()) != 0 {
+		t.Fatalf("Should return no node, returned: %v, %v", res, err)
+	}
+
+	query = `G.V().Has("Name", unknown)`
+	if _, err = NewGremlinTraversalParser(g).ParseWithBindings(strings.NewReader(query), false, bindings); err == nil {
+		t.Fatalf("Should return an error for an unknown binding: %s", query)
+	}
+}
+
+func TestTraversalNestedMetadata(t *testing.T) {
+	g := newGraph(t)
+
+	n1 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "tap1", "Neutron": map[string]interface{}{"NetworkName": "private", "PortID": "1"}})
+	n2 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "tap2", "Neutron": map[string]interface{}{"NetworkName": "public", "PortID": "2"}})
+	g.NewNode(graph.GenID(), graph.Metadata{"Name": "vxlan", "Ovs": graph.Metadata{"Options": map[string]string{"remote_ip": "10.0.0.1"}}})
+	g.Link(n1, n2, graph.Metadata{"Link": map[string]interface{}{"Type": "veth"}})
+	g.Link(n2, n1, graph.Metadata{"Link": map[string]interface{}{"Type": "veth"}})
+
+	res := execTraversalQuery(t, g, `G.V().Has("Neutron.NetworkName", "private")`)
+	if len(res.Values()) != 1 || res.Values()[0].(*graph.Node).ID != n1.ID {
+		t.Fatalf("Should return tap1, returned: %v", res.Values())
+	}
+
+	res = execTraversalQuery(t, g, `G.V().Has("Ovs.Options.remote_ip", "10.0.0.1")`)
+	if len(res.Values()) != 1 {
+		t.Fatalf("Should return vxlan, returned: %v", res.Values())
+	}
+
+	res = execTraversalQuery(t, g, `G.V().Has("Neutron.NetworkName").Sort(DESC, "Neutron.NetworkName")`)
+	if len(res.Values()) != 2 || res.Values()[0].(*graph.Node).ID != n2.ID {
+		t.Fatalf("Should return tap2 first, returned: %v", res.Values())
+	}
+
+	res = execTraversalQuery(t, g, `G.E().Dedup("Link.Type")`)
+	if len(res.Values()) != 1 {
+		t.Fatalf("Should return 1 edge, returned: %v", res.Values())
+	}
+
+	if nodes := g.GetNodes(graph.Metadata{"Neutron.PortID": "2"}); len(nodes) != 1 || nodes[0].ID != n2.ID {
+		t.Fatalf("Should return tap2, returned: %v", nodes)
+	}
+
+	if nodes := g.GetNodes(graph.Metadata{"Neutron": map[string]interface{}{"NetworkName": "public"}}); len(nodes) != 1 || nodes[0].ID != n2.ID {
+		t.Fatalf("Should return tap2, returned: %v", nodes)
+	}
+}
+
+func TestTraversalKShortestPaths(t *testing.T) {
+	g := newTransversalGraph(t)
+
+	res := execTraversalQuery(t, g, `G.V().Has("Value", 1).ShortestPathTo(Metadata("Value", 4), "Weight", 3)`)
+	if len(res.Values()) != 3 {
+		t.Fatalf("Should return 3 paths, returned: %v", res.Values())
+	}
+
+	if len(res.Values()[0].([]*graph.Node)) != 2 {
+		t.Fatalf("The direct path should be the shortest, returned: %v", res.Values()[0])
+	}
+
+	res = execTraversalQuery(t, g, `G.V().Has("Value", 1).ShortestPathTo(Metadata("Value", 4), Metadata("Direction", "Left"), "Weight", 3)`)
+	if len(res.Values()) != 0 {
+		t.Fatalf("Should return no path, returned: %v", res.Values())
+	}
+}
+
+func TestTraversalAllPathsTo(t *testing.T) {
+	g := newTransversalGraph(t)
+
+	res := execTraversalQuery(t, g, `G.V().Has("Value", 1).AllPathsTo(Metadata("Value", 4), 3)`)
+	if len(res.Values()) != 3 {
+		t.Fatalf("Should return 3 paths, returned: %v", res.Values())
+	}
+
+	res = execTraversalQuery(t, g, `G.V().Has("Value", 1).AllPathsTo(Metadata("Value", 4), 2)`)
+	if len(res.Values()) != 2 {
+		t.Fatalf("Should return 2 paths, returned: %v", res.Values())
+	}
+
+	res = execTraversalQuery(t, g, `G.V().Has("Value", 1).AllPathsTo(Metadata("Value", 3), Metadata("Direction", "Left"), 5)`)
+	if len(res.Values()) != 1 || len(res.Values()[0].([]*graph.Node)) != 3 {
+		t.Fatalf("Should return 1 path through the left edges, returned: %v", res.Values())
+	}
+
+	for _, query := range []string{
+		`G.V().AllPathsTo(Metadata("Value", 4), 0)`,
+		`G.V().AllPathsTo(Metadata("Value", 4), -1)`,
+	} {
+		if _, err := NewGremlinTraversalParser(g).Parse(strings.NewReader(query), false); err == nil {
+			t.Errorf("Should reject the maximum depth: %s", query)
+		}
+	}
+}
+
+func TestTraversalReachable(t *testing.T) {
+	g := newTransversalGraph(t)
+
+	res := execTraversalQuery(t, g, `G.V().Has("Value", 1).Reachable(Metadata("Value", 4))`)
+	if len(res.Values()) != 1 || res.Values()[0] != true {
+		t.Fatalf("Value 4 should be reachable, returned: %v", res.Values())
+	}
+
+	res = execTraversalQuery(t, g, `G.V().Has("Value", 1).Reachable(Metadata("Value", 4), Metadata("Direction", "Left"))`)
+	if len(res.Values()) != 1 || res.Values()[0] != false {
+		t.Fatalf("Value 4 should not be reachable through the left edges, returned: %v", res.Values())
+	}
+}
+
+func TestTraversalCriticalElements(t *testing.T) {
+	g := newGraph(t)
+
+	// a - b - c and a c - d - e - c loop, f is isolated
+	nodes := make(map[string]*graph.Node)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		nodes[name] = g.NewNode(graph.GenID(), graph.Metadata{"Name": name, "Type": "device"})
+	}
+	g.Link(nodes["a"], nodes["b"], graph.Metadata{"RelationType": "layer2"})
+	g.Link(nodes["b"], nodes["c"], graph.Metadata{"RelationType": "layer2"})
+	g.Link(nodes["c"], nodes["d"], graph.Metadata{"RelationType": "layer2"})
+	g.Link(nodes["d"], nodes["e"], graph.Metadata{"RelationType": "layer2"})
+	g.Link(nodes["e"], nodes["c"], graph.Metadata{"RelationType": "ownership"})
+
+	res := execTraversalQuery(t, g, `G.V().Has("Type", "device").ConnectedComponents()`)
+	components := res.Values()[0].([]*graph.Component)
+	if len(components) != 2 || len(components[0].Nodes) != 5 || len(components[0].Edges) != 5 || len(components[1].Nodes) != 1 {
+		t.Fatalf("Should return 2 components, returned: %v", res.Values())
+	}
+
+	// the elements are marked with their component ID
+	for _, c := range components {
+		for _, n := range c.Nodes {
+			if id, _ := n.GetFieldInt64("ComponentID"); id != int64(c.ID) {
+				t.Errorf("Node %s should be marked with component %d, got: %v", n.ID, c.ID, n.Metadata())
+			}
+		}
+		for _, e := range c.Edges {
+			if id, _ := e.GetFieldInt64("ComponentID"); id != int64(c.ID) {
+				t.Errorf("Edge %s should be marked with component %d, got: %v", e.ID, c.ID, e.Metadata())
+			}
+		}
+	}
+	if name, _ := components[1].Nodes[0].GetFieldString("Name"); name != "f" {
+		t.Errorf("The isolated node should be the second component, got: %v", components[1].Nodes[0])
+	}
+
+	names := func(res GraphTraversalStep) (s []string) {
+		for _, v := range res.Values() {
+			name, _ := v.(*graph.Node).GetFieldString("Name")
+			s = append(s, name)
+		}
+		sort.Strings(s)
+		return
+	}
+
+	res = execTraversalQuery(t, g, `G.V().Has("Type", "device").ArticulationPoints()`)
+	if n := names(res); !reflect.DeepEqual(n, []string{"b", "c"}) {
+		t.Fatalf("Should return b and c, returned: %v", n)
+	}
+
+	for _, v := range res.Values() {
+		if critical, _ := v.(*graph.Node).GetField("Critical"); critical != true {
+			t.Errorf("Articulation points should be marked as critical, got: %v", v)
+		}
+	}
+
+	res = execTraversalQuery(t, g, `G.V().Has("Type", "device").Bridges()`)
+	if len(res.Values()) != 2 {
+		t.Fatalf("Should return 2 bridges, returned: %v", res.Values())
+	}
+	for _, v := range res.Values() {
+		if critical, _ := v.(*graph.Edge).GetField("Critical"); critical != true {
+			t.Errorf("Bridges should be marked as critical, got: %v", v)
+		}
+	}
+
+	// only copies are marked, not the elements of the graph
+	for _, n := range g.GetNodes(nil) {
+		if _, err := n.GetField("Critical"); err == nil {
+			t.Errorf("The node %s of the graph should not be marked", n.ID)
+		}
+		if _, err := n.GetField("ComponentID"); err == nil {
+			t.Errorf("The node %s of the graph should not be marked", n.ID)
+		}
+	}
+
+	// without the ownership link the loop is broken
+	res = execTraversalQuery(t, g, `G.V().Has("Type", "device").ArticulationPoints(Metadata("RelationType", "layer2"))`)
+	if n := names(res); !reflect.DeepEqual(n, []string{"b", "c", "d"}) {
+		t.Fatalf("Should return b, c and d, returned: %v", n)
+	}
+
+	res = execTraversalQuery(t, g, `G.V().Has("Type", "device").Bridges(Metadata("RelationType", "layer2"))`)
+	if len(res.Values()) != 4 {
+		t.Fatalf("Should return 4 bridges, returned: %v", res.Values())
+	}
+}
+
+func diffIDs(nodes []*graph.Node) string {
+	var ids []string
+	for _, n := range nodes {
+		ids = append(ids, string(n.ID))
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestTraversalDiff(t *testing.T) {
+	b, err := graph.NewMemoryBackendWithHistory(time.Hour, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	g := graph.NewGraphFromConfig(b)
+
+	// returns the current time in milliseconds, distinct from the events
+	now := func() int64 {
+		time.Sleep(10 * time.Millisecond)
+		ms := common.UnixMillis(time.Now())
+		time.Sleep(10 * time.Millisecond)
+		return ms
+	}
+
+	host := g.NewNode(graph.Identifier("host1"), graph.Metadata{"Type": "host"})
+	n1 := g.NewNode(graph.Identifier("n1"), graph.Metadata{"Type": "intf", "State": "UP"})
+	n2 := g.NewNode(graph.Identifier("n2"), graph.Metadata{"Type": "intf"})
+	g.Link(host, n1, graph.Metadata{"RelationType": "ownership"})
+
+	from := now()
+
+	g.AddMetadata(n1, "State", "DOWN")
+	g.DelNode(n2)
+	n3 := g.NewNode(graph.Identifier("n3"), graph.Metadata{"Type": "intf"})
+	g.NewNode(graph.Identifier("host2"), graph.Metadata{"Type": "host"})
+	g.Link(host, n3, graph.Metadata{"RelationType": "ownership"})
+
+	to := now()
+
+	g.NewNode(graph.Identifier("n4"), graph.Metadata{"Type": "intf"})
+
+	getDiff := func(query string) *graph.GraphDiff {
+		res := execTraversalQuery(t, g, query)
+		if len(res.Values()) != 1 {
+			t.Fatalf("%s: should return one diff, returned: %v", query, res.Values())
+		}
+		return res.Values()[0].(*graph.GraphDiff)
+	}
+
+	query := fmt.Sprintf("G.Diff(%d, %d)", from, to)
+	d := getDiff(query)
+	if ids := diffIDs(d.AddedNodes); ids != "host2,n3" {
+		t.Errorf("%s: expected host2 and n3 added, got: %s", query, ids)
+	}
+	if ids := diffIDs(d.RemovedNodes); ids != "n2" {
+		t.Errorf("%s: expected n2 removed, got: %s", query, ids)
+	}
+	if len(d.UpdatedNodes) != 1 || d.UpdatedNodes[0].Node.ID != "n1" || d.UpdatedNodes[0].Changes["State"].New != "DOWN" {
+		t.Errorf("%s: expected the state of n1 updated, got: %+v", query, d.UpdatedNodes)
+	}
+	if len(d.AddedEdges) != 1 || len(d.RemovedEdges) != 0 {
+		t.Errorf("%s: expected 1 edge added, got: %+v", query, d)
+	}
+
+	// the removed nodes are filtered on their previous revision
+	query = fmt.Sprintf("G.Diff(%d, %d).Has('Type', 'intf')", from, to)
+	d = getDiff(query)
+	if ids := diffIDs(d.AddedNodes); ids != "n3" || diffIDs(d.RemovedNodes) != "n2" || len(d.UpdatedNodes) != 1 || len(d.AddedEdges) != 0 {
+		t.Errorf("%s: expected only the interfaces, got: %+v", query, d)
+	}
+
+	query = fmt.Sprintf("G.Diff(%d, %d).Has('State', 'DOWN')", from, to)
+	d = getDiff(query)
+	if len(d.AddedNodes) != 0 || len(d.RemovedNodes) != 0 || len(d.UpdatedNodes) != 1 {
+		t.Errorf("%s: expected only n1, got: %+v", query, d)
+	}
+
+	// without end time, the changes are computed up to the current graph
+	query = fmt.Sprintf("G.Diff(%d).Has('Type', 'intf')", from)
+	if ids := diffIDs(getDiff(query).AddedNodes); ids != "n3,n4" {
+		t.Errorf("%s: expected n3 and n4 added, got: %s", query, ids)
+	}
+
+	for _, query := range []string{
+		fmt.Sprintf("G.Diff(%d, %d)", to, from),
+		fmt.Sprintf("G.Diff(%d)", common.UnixMillis(time.Now().Add(time.Hour))),
+	} {
+		ts, err := NewGremlinTraversalParser(g).Parse(strings.NewReader(query), false)
+		if err != nil {
+			t.Fatalf("%s: %s", query, err.Error())
+		}
+		if _, err = ts.Exec(); err == nil {
+			t.Errorf("%s: should return an error", query)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package traversal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skydive-project/skydive/filters"
+	shttp "github.com/skydive-project/skydive/http"
+	"github.com/skydive-project/skydive/topology/graph"
+)
+
+// GremlinViewFilter selects the nodes returned by a Gremlin query, and the
+// nodes of the edges it returns
+type GremlinViewFilter struct {
+	parser *GremlinTraversalParser
+	query  string
+}
+
+// Select executes the query
+func (f *GremlinViewFilter) Select() ([]*graph.Node, error) {
+	ts, err := f.parser.Parse(strings.NewReader(f.query), true)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ts.Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	values := res.Values()
+
+	f.parser.Graph.RLock()
+	defer f.parser.Graph.RUnlock()
+
+	var nodes []*graph.Node
+	for _, value := range values {
+		switch value := value.(type) {
+		case *graph.Node:
+			nodes = append(nodes, value)
+		case *graph.Edge:
+			for _, id := range []graph.Identifier{value.GetParent(), value.GetChild()} {
+				if n := f.parser.Graph.GetNode(id); n != nil {
+					nodes = append(nodes, n)
+				}
+			}
+		}
+	}
+
+	return nodes, nil
+}
+
+// GremlinNodeViewFilter is a Gremlin view filter whose query only filters the
+// nodes on their own metadata, like G.V().Has('Type', 'veth'). The nodes are
+// then matched one by one.
+type GremlinNodeViewFilter struct {
+	GremlinViewFilter
+	id      graph.Identifier
+	filters []*filters.Filter
+}
+
+// MatchNode returns whether the node is selected by the query
+func (f *GremlinNodeViewFilter) MatchNode(n *graph.Node) bool {
+	if f.id != "" && n.ID != f.id {
+		return false
+	}
+
+	for _, filter := range f.filters {
+		if !filter.Eval(n) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newGremlinNodeViewFilter returns a node filter if the query is made of a V
+// step followed by Has, HasKey or HasNot steps only
+func newGremlinNodeViewFilter(f *GremlinViewFilter, seq *GremlinTraversalSequence) *GremlinNodeViewFilter {
+	if len(seq.steps) == 0 {
+		return nil
+	}
+
+	v, ok := seq.steps[0].(*GremlinTraversalStepV)
+	if !ok {
+		return nil
+	}
+
+	nf := &GremlinNodeViewFilter{GremlinViewFilter: *f}
+	switch len(v.Params) {
+	case 0:
+	case 1:
+		id, ok := v.Params[0].(string)
+		if !ok {
+			return nil
+		}
+		nf.id = graph.Identifier(id)
+	default:
+		filter, err := ParamsToFilter(v.Params...)
+		if err != nil {
+			return nil
+		}
+		nf.filters = append(nf.filters, filter)
+	}
+
+	for _, step := range seq.steps[1:] {
+		var filter *filters.Filter
+		var err error
+
+		switch step := step.(type) {
+		case *GremlinTraversalStepHas:
+			if len(step.Params) == 1 {
+				k, ok := step.Params[0].(string)
+				if !ok {
+					return nil
+				}
+				filter = filters.NewNotFilter(filters.NewNullFilter(k))
+			} else if filter, err = ParamsToFilter(step.Params...); err != nil {
+				return nil
+			}
+		case *GremlinTraversalStepHasKey:
+			filter = filters.NewNotFilter(filters.NewNullFilter(step.Params[0].(string)))
+		case *GremlinTraversalStepHasNot:
+			filter = filters.NewNullFilter(step.Params[0].(string))
+		default:
+			return nil
+		}
+
+		nf.filters = append(nf.filters, filter)
+	}
+
+	return nf
+}
+
+// NewGremlinViewFilterFactory returns the factory of the filters set by the
+// X-Gremlin-Filter header, for instance G.V().Has('Host', 'compute-3')
+func NewGremlinViewFilterFactory(parser *GremlinTraversalParser) graph.ViewFilterFactory {
+	return func(c *shttp.WSClient) (graph.ViewFilter, error) {
+		query := c.Option("X-Gremlin-Filter")
+		if query == "" {
+			return nil, nil
+		}
+
+		seq, err := parser.Parse(strings.NewReader(query), true)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Gremlin filter %s: %s", query, err.Error())
+		}
+
+		f := &GremlinViewFilter{parser: parser, query: query}
+		if nf := newGremlinNodeViewFilter(f, seq); nf != nil {
+			return nf, nil
+		}
+		return f, nil
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package traversal
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/skydive-project/skydive/topology/graph"
+)
+
+func newTestViewFilter(t *testing.T, g *graph.Graph, query string) (*GremlinViewFilter, *GremlinNodeViewFilter) {
+	parser := NewGremlinTraversalParser(g)
+	seq, err := parser.Parse(strings.NewReader(query), true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	f := &GremlinViewFilter{parser: parser, query: query}
+	return f, newGremlinNodeViewFilter(f, seq)
+}
+
+func selectedNames(t *testing.T, f graph.ViewFilter) string {
+	nodes, err := f.Select()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var names []string
+	for _, n := range nodes {
+		name, _ := n.GetFieldString("Name")
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestGremlinViewFilter(t *testing.T) {
+	g := newGraph(t)
+	n1 := g.NewNode(graph.Identifier("n1"), graph.Metadata{"Name": "n1", "Type": "intf", "MTU": 1500})
+	n2 := g.NewNode(graph.Identifier("n2"), graph.Metadata{"Name": "n2", "Type": "intf", "MTU": 9000, "Driver": "veth"})
+	n3 := g.NewNode(graph.Identifier("n3"), graph.Metadata{"Name": "n3", "Type": "host"})
+	g.Link(n3, n1, graph.Metadata{"Name": "e1"})
+	g.Link(n3, n2, graph.Metadata{"Name": "e2", "Type": "veth"})
+
+	// the node filters match the nodes the query selects
+	for query, expected := range map[string]string{
+		"G.V()":                     "n1,n2,n3",
+		"G.V('n2')":                 "n2",
+		"G.V().Has('Type', 'intf')": "n1,n2",
+		"G.V().Has('Type', 'intf').HasNot('Driver')":                            "n1",
+		"G.V().HasKey('Driver')":                                                "n2",
+		"G.V().Has('MTU', GT(2000))":                                            "n2",
+		"G.V().Has('Type', Within('host', 'intf')).Has('Name', Regex('n[13]'))": "n1,n3",
+	} {
+		f, nf := newTestViewFilter(t, g, query)
+		if nf == nil {
+			t.Fatalf("Expected a node filter for %s", query)
+		}
+
+		if names := selectedNames(t, f); names != expected {
+			t.Errorf("Expected %s for %s, got: %s", expected, query, names)
+		}
+
+		var matched []string
+		for _, n := range []*graph.Node{n1, n2, n3} {
+			if nf.MatchNode(n) {
+				matched = append(matched, string(n.ID))
+			}
+		}
+		if names := strings.Join(matched, ","); names != expected {
+			t.Errorf("Expected %s to match %s, got: %s", query, expected, names)
+		}
+	}
+
+	// the other queries are evaluated as a whole, edges select their nodes
+	for query, expected := range map[string]string{
+		"G.V().Has('Type', 'host').Out()":  "n1,n2",
+		"G.E().Has('Type', 'veth')":        "n2,n3",
+		"G.V().Has('Name', 'n1').Limit(1)": "n1",
+	} {
+		f, nf := newTestViewFilter(t, g, query)
+		if nf != nil {
+			t.Errorf("Expected no node filter for %s", query)
+		}
+
+		if names := selectedNames(t, f); names != expected {
+			t.Errorf("Expected %s for %s, got: %s", expected, query, names)
+		}
+	}
+}
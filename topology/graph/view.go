@@ -0,0 +1,362 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/skydive-project/skydive/common"
+	shttp "github.com/skydive-project/skydive/http"
+	"github.com/skydive-project/skydive/logging"
+)
+
+// FilterErrorMsgType is sent to a client whose view filter is invalid, the
+// client then receives no graph event
+const FilterErrorMsgType = "FilterError"
+
+// ViewFilter selects the nodes of the graph a websocket client receives, the
+// client view is the subgraph made of these nodes and the edges between them
+type ViewFilter interface {
+	Select() ([]*Node, error)
+}
+
+// NodeViewFilter is a view filter able to tell whether a single node belongs
+// to the view, the views using it are updated from the graph events without
+// evaluating the whole filter again. MatchNode is called with the graph locked.
+type NodeViewFilter interface {
+	ViewFilter
+	MatchNode(n *Node) bool
+}
+
+// ViewFilterFactory returns the filter requested by a websocket client on
+// connection, nil if the client didn't request one
+type ViewFilterFactory func(c *shttp.WSClient) (ViewFilter, error)
+
+// MetadataViewFilter selects the nodes matching metadata
+type MetadataViewFilter struct {
+	Graph    *Graph
+	Metadata Metadata
+}
+
+// Select returns the nodes matching the metadata
+func (f *MetadataViewFilter) Select() ([]*Node, error) {
+	f.Graph.RLock()
+	defer f.Graph.RUnlock()
+
+	return f.Graph.GetNodes(f.Metadata), nil
+}
+
+// MatchNode returns whether the node matches the metadata
+func (f *MetadataViewFilter) MatchNode(n *Node) bool {
+	return n.MatchMetadata(f.Metadata)
+}
+
+// NewMetadataViewFilterFactory returns the factory of the filters set by the
+// X-Metadata-Filter header, a JSON object of the metadata to match
+func NewMetadataViewFilterFactory(g *Graph) ViewFilterFactory {
+	return func(c *shttp.WSClient) (ViewFilter, error) {
+		filter := c.Option("X-Metadata-Filter")
+		if filter == "" {
+			return nil, nil
+		}
+
+		var m map[string]interface{}
+		if err := common.JSONDecode(strings.NewReader(filter), &m); err != nil {
+			return nil, errors.New("Invalid metadata filter: " + err.Error())
+		}
+		decodeMap(m)
+
+		return &MetadataViewFilter{Graph: g, Metadata: Metadata(m)}, nil
+	}
+}
+
+// clientView keeps track of the nodes and edges sent to a filtered client
+// along with their revisions
+type clientView struct {
+	sync.Mutex
+	client    *shttp.WSClient
+	filter    ViewFilter
+	nodes     map[Identifier]*Node
+	edges     map[Identifier]*Edge
+	revisions map[Identifier]int64
+}
+
+// selectView returns the nodes and edges of the view, the graph has to be
+// read locked
+func (v *clientView) selectView(g *Graph, selected []*Node) (map[Identifier]*Node, map[Identifier]*Edge) {
+	nodes := make(map[Identifier]*Node, len(selected))
+	for _, n := range selected {
+		nodes[n.ID] = n
+	}
+
+	edges := make(map[Identifier]*Edge)
+	for _, n := range nodes {
+		for _, e := range g.GetNodeEdges(n, nil) {
+			if _, ok := nodes[e.parent]; !ok {
+				continue
+			}
+			if _, ok := nodes[e.child]; ok {
+				edges[e.ID] = e
+			}
+		}
+	}
+
+	return nodes, edges
+}
+
+func (v *clientView) set(nodes map[Identifier]*Node, edges map[Identifier]*Edge) {
+	v.nodes, v.edges = nodes, edges
+	v.revisions = make(map[Identifier]int64, len(nodes)+len(edges))
+	for id, n := range nodes {
+		v.revisions[id] = n.revision
+	}
+	for id, e := range edges {
+		v.revisions[id] = e.revision
+	}
+}
+
+// diff returns the messages changing the view to the selected nodes,
+// deletions first so that no edge refers to a missing node. The graph has to
+// be read locked.
+func (v *clientView) diff(g *Graph, selected []*Node) []*shttp.WSMessage {
+	v.Lock()
+	defer v.Unlock()
+
+	nodes, edges := v.selectView(g, selected)
+
+	var msgs []*shttp.WSMessage
+	for id, e := range v.edges {
+		if _, ok := edges[id]; !ok {
+			msgs = append(msgs, shttp.NewWSMessage(Namespace, EdgeDeletedMsgType, e))
+		}
+	}
+	for id, n := range v.nodes {
+		if _, ok := nodes[id]; !ok {
+			msgs = append(msgs, shttp.NewWSMessage(Namespace, NodeDeletedMsgType, n))
+		}
+	}
+	for id, n := range nodes {
+		if _, ok := v.nodes[id]; !ok {
+			msgs = append(msgs, shttp.NewWSMessage(Namespace, NodeAddedMsgType, n))
+		} else if v.revisions[id] != n.revision {
+			msg := shttp.NewWSMessage(Namespace, NodeUpdatedMsgType, n)
+			msg.CoalesceKey = string(id)
+			msgs = append(msgs, msg)
+		}
+	}
+	for id, e := range edges {
+		if _, ok := v.edges[id]; !ok {
+			msgs = append(msgs, shttp.NewWSMessage(Namespace, EdgeAddedMsgType, e))
+		} else if v.revisions[id] != e.revision {
+			msg := shttp.NewWSMessage(Namespace, EdgeUpdatedMsgType, e)
+			msg.CoalesceKey = string(id)
+			msgs = append(msgs, msg)
+		}
+	}
+
+	v.set(nodes, edges)
+
+	return msgs
+}
+
+// incremental returns whether the view is updated from the graph events
+func (v *clientView) incremental() bool {
+	_, ok := v.filter.(NodeViewFilter)
+	return ok
+}
+
+// removeNode returns the messages removing a node and its edges from the view
+func (v *clientView) removeNode(n *Node) (msgs []*shttp.WSMessage) {
+	for id, e := range v.edges {
+		if e.parent == n.ID || e.child == n.ID {
+			msgs = append(msgs, shttp.NewWSMessage(Namespace, EdgeDeletedMsgType, e))
+			delete(v.edges, id)
+			delete(v.revisions, id)
+		}
+	}
+
+	msgs = append(msgs, shttp.NewWSMessage(Namespace, NodeDeletedMsgType, v.nodes[n.ID]))
+	delete(v.nodes, n.ID)
+	delete(v.revisions, n.ID)
+
+	return msgs
+}
+
+// nodeChanged returns the messages changing the view after a node was added
+// or updated, only the node and its edges are evaluated. The graph has to be
+// locked.
+func (v *clientView) nodeChanged(g *Graph, n *Node) (msgs []*shttp.WSMessage) {
+	v.Lock()
+	defer v.Unlock()
+
+	_, ok := v.nodes[n.ID]
+	if !v.filter.(NodeViewFilter).MatchNode(n) {
+		if ok {
+			msgs = v.removeNode(n)
+		}
+		return msgs
+	}
+
+	if ok {
+		if v.revisions[n.ID] != n.revision {
+			msg := shttp.NewWSMessage(Namespace, NodeUpdatedMsgType, n)
+			msg.CoalesceKey = string(n.ID)
+			msgs = append(msgs, msg)
+		}
+		v.nodes[n.ID], v.revisions[n.ID] = n, n.revision
+		return msgs
+	}
+
+	msgs = append(msgs, shttp.NewWSMessage(Namespace, NodeAddedMsgType, n))
+	v.nodes[n.ID], v.revisions[n.ID] = n, n.revision
+
+	for _, e := range g.GetNodeEdges(n, nil) {
+		if _, ok := v.nodes[e.parent]; !ok {
+			continue
+		}
+		if _, ok := v.nodes[e.child]; ok {
+			msgs = append(msgs, shttp.NewWSMessage(Namespace, EdgeAddedMsgType, e))
+			v.edges[e.ID], v.revisions[e.ID] = e, e.revision
+		}
+	}
+
+	return msgs
+}
+
+// nodeDeleted returns the messages removing a deleted node from the view
+func (v *clientView) nodeDeleted(n *Node) []*shttp.WSMessage {
+	v.Lock()
+	defer v.Unlock()
+
+	if _, ok := v.nodes[n.ID]; !ok {
+		return nil
+	}
+	return v.removeNode(n)
+}
+
+// edgeChanged returns the messages changing the view after an edge was added
+// or updated, the edge belongs to the view if both its nodes do
+func (v *clientView) edgeChanged(e *Edge) []*shttp.WSMessage {
+	v.Lock()
+	defer v.Unlock()
+
+	if _, ok := v.nodes[e.parent]; !ok {
+		return nil
+	}
+	if _, ok := v.nodes[e.child]; !ok {
+		return nil
+	}
+
+	var msg *shttp.WSMessage
+	if _, ok := v.edges[e.ID]; !ok {
+		msg = shttp.NewWSMessage(Namespace, EdgeAddedMsgType, e)
+	} else if v.revisions[e.ID] != e.revision {
+		msg = shttp.NewWSMessage(Namespace, EdgeUpdatedMsgType, e)
+		msg.CoalesceKey = string(e.ID)
+	}
+	v.edges[e.ID], v.revisions[e.ID] = e, e.revision
+
+	if msg == nil {
+		return nil
+	}
+	return []*shttp.WSMessage{msg}
+}
+
+// edgeDeleted returns the messages removing a deleted edge from the view
+func (v *clientView) edgeDeleted(e *Edge) []*shttp.WSMessage {
+	v.Lock()
+	defer v.Unlock()
+
+	old, ok := v.edges[e.ID]
+	if !ok {
+		return nil
+	}
+	delete(v.edges, e.ID)
+	delete(v.revisions, e.ID)
+
+	return []*shttp.WSMessage{shttp.NewWSMessage(Namespace, EdgeDeletedMsgType, old)}
+}
+
+// update sends to the client the changes of its view
+func (v *clientView) update(g *Graph) {
+	if v.filter == nil {
+		return
+	}
+
+	selected, err := v.filter.Select()
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to evaluate the view filter of %s: %s", v.client.Host, err.Error())
+		return
+	}
+
+	g.RLock()
+	defer g.RUnlock()
+
+	for _, msg := range v.diff(g, selected) {
+		v.client.SendWSMessage(msg)
+	}
+}
+
+// sync replies to a sync request with the whole view
+func (v *clientView) sync(g *Graph, msg shttp.WSMessage, context GraphContext) {
+	if context.TimeSlice != nil {
+		v.client.SendWSMessage(msg.Reply("Filtered views only support the live graph", SyncReplyMsgType, http.StatusBadRequest))
+		return
+	}
+
+	reply := &SyncReplyMsg{}
+	if v.filter != nil {
+		selected, err := v.filter.Select()
+		if err != nil {
+			v.client.SendWSMessage(msg.Reply(err.Error(), SyncReplyMsgType, http.StatusBadRequest))
+			return
+		}
+
+		g.RLock()
+		defer g.RUnlock()
+
+		v.Lock()
+		defer v.Unlock()
+
+		nodes, edges := v.selectView(g, selected)
+		v.set(nodes, edges)
+
+		for _, n := range nodes {
+			reply.Nodes = append(reply.Nodes, n)
+		}
+		for _, e := range edges {
+			reply.Edges = append(reply.Edges, e)
+		}
+	}
+
+	v.client.SendWSMessage(msg.Reply(reply, SyncReplyMsgType, http.StatusOK))
+}
+
+func newClientView(c *shttp.WSClient, filter ViewFilter) *clientView {
+	v := &clientView{client: c, filter: filter}
+	v.set(make(map[Identifier]*Node), make(map[Identifier]*Edge))
+	return v
+}
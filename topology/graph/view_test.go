@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package graph
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	shttp "github.com/skydive-project/skydive/http"
+)
+
+func diffView(t *testing.T, g *Graph, v *clientView) string {
+	selected, err := v.filter.Select()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g.RLock()
+	defer g.RUnlock()
+
+	var types []string
+	for _, msg := range v.diff(g, selected) {
+		types = append(types, msg.Type)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ",")
+}
+
+func TestMetadataView(t *testing.T) {
+	g := newGraph(t)
+	v := newClientView(nil, &MetadataViewFilter{Graph: g, Metadata: Metadata{"Host": "compute-3"}})
+
+	n1 := g.NewNode(GenID(), Metadata{"Host": "compute-3"})
+	n2 := g.NewNode(GenID(), Metadata{"Host": "compute-3"})
+	n3 := g.NewNode(GenID(), Metadata{"Host": "compute-4"})
+	g.NewEdge(GenID(), n1, n2, nil)
+	g.NewEdge(GenID(), n2, n3, nil)
+
+	if types := diffView(t, g, v); types != "EdgeAdded,NodeAdded,NodeAdded" {
+		t.Errorf("Expected the nodes of compute-3 and the edge between them, got %s", types)
+	}
+
+	g.AddMetadata(n1, "Name", "eth0")
+	g.AddMetadata(n3, "Name", "eth1")
+	if types := diffView(t, g, v); types != "NodeUpdated" {
+		t.Errorf("Expected only the update of the node in the view, got %s", types)
+	}
+
+	// leaving the view deletes the node and its edges
+	g.AddMetadata(n2, "Host", "compute-4")
+	if types := diffView(t, g, v); types != "EdgeDeleted,NodeDeleted" {
+		t.Errorf("Expected the node leaving the view to be deleted, got %s", types)
+	}
+
+	g.DelNode(n1)
+	if types := diffView(t, g, v); types != "NodeDeleted" {
+		t.Errorf("Expected the node deletion, got %s", types)
+	}
+
+	if types := diffView(t, g, v); types != "" {
+		t.Errorf("Expected no change, got %s", types)
+	}
+}
+
+type viewListener struct {
+	DefaultGraphListener
+	g     *Graph
+	v     *clientView
+	types []string
+}
+
+func (l *viewListener) record(msgs []*shttp.WSMessage) {
+	for _, msg := range msgs {
+		l.types = append(l.types, msg.Type)
+	}
+}
+
+func (l *viewListener) OnNodeUpdated(n *Node) { l.record(l.v.nodeChanged(l.g, n)) }
+func (l *viewListener) OnNodeAdded(n *Node)   { l.record(l.v.nodeChanged(l.g, n)) }
+func (l *viewListener) OnNodeDeleted(n *Node) { l.record(l.v.nodeDeleted(n)) }
+func (l *viewListener) OnEdgeUpdated(e *Edge) { l.record(l.v.edgeChanged(e)) }
+func (l *viewListener) OnEdgeAdded(e *Edge)   { l.record(l.v.edgeChanged(e)) }
+func (l *viewListener) OnEdgeDeleted(e *Edge) { l.record(l.v.edgeDeleted(e)) }
+
+func (l *viewListener) flush() string {
+	types := l.types
+	l.types = nil
+	sort.Strings(types)
+	return strings.Join(types, ",")
+}
+
+func TestIncrementalView(t *testing.T) {
+	g := newGraph(t)
+	v := newClientView(nil, &MetadataViewFilter{Graph: g, Metadata: Metadata{"Host": "compute-3"}})
+	if !v.incremental() {
+		t.Fatal("Metadata views should be updated incrementally")
+	}
+
+	l := &viewListener{g: g, v: v}
+	g.AddEventListener(l)
+
+	n1 := g.NewNode(GenID(), Metadata{"Host": "compute-3"})
+	n2 := g.NewNode(GenID(), Metadata{"Host": "compute-3"})
+	n3 := g.NewNode(GenID(), Metadata{"Host": "compute-4"})
+	g.NewEdge(GenID(), n1, n2, nil)
+	g.NewEdge(GenID(), n2, n3, nil)
+
+	if types := l.flush(); types != "EdgeAdded,NodeAdded,NodeAdded" {
+		t.Errorf("Expected the nodes of compute-3 and the edge between them, got %s", types)
+	}
+
+	g.AddMetadata(n1, "Name", "eth0")
+	g.AddMetadata(n3, "Name", "eth1")
+	if types := l.flush(); types != "NodeUpdated" {
+		t.Errorf("Expected only the update of the node in the view, got %s", types)
+	}
+
+	// joining the view adds the node and its edges to the nodes of the view
+	g.AddMetadata(n3, "Host", "compute-3")
+	if types := l.flush(); types != "EdgeAdded,NodeAdded" {
+		t.Errorf("Expected the node joining the view to be added, got %s", types)
+	}
+
+	// leaving the view deletes the node and its edges
+	g.AddMetadata(n2, "Host", "compute-4")
+	if types := l.flush(); types != "EdgeDeleted,EdgeDeleted,NodeDeleted" {
+		t.Errorf("Expected the node leaving the view to be deleted, got %s", types)
+	}
+
+	g.DelNode(n1)
+	if types := l.flush(); types != "NodeDeleted" {
+		t.Errorf("Expected the node deletion, got %s", types)
+	}
+
+	// the incremental view is the one of the whole filter
+	if types := diffView(t, g, v); types != "" {
+		t.Errorf("Expected no change, got %s", types)
+	}
+}
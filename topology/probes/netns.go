@@ -129,7 +129,7 @@ func (u *NetNSProbe) Register(path string, extraMetadata graph.Metadata) *graph.
 	u.Graph.Lock()
 
 	logging.GetLogger().Debugf("Network Namespace added: %s", nsString)
-	metadata := graph.Metadata{"Name": getNetNSName(path), "Type": "netns", "Path": path}
+	metadata := graph.Metadata{"Name": getNetNSName(path), "Type": "netns", "Path": path, "Inode": int64(newns.ino)}
 	if extraMetadata != nil {
 		for k, v := range extraMetadata {
 			metadata[k] = v
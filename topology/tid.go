@@ -23,28 +23,253 @@
 package topology
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/nu7hatch/gouuid"
 
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
 	"github.com/skydive-project/skydive/logging"
 	"github.com/skydive-project/skydive/topology/graph"
 )
 
+const tidStoreFlushInterval = 5 * time.Second
+
+// TIDRecord describes the incarnation of the topology a TID was given to, the
+// time range allows to link the stored flows to it
+type TIDRecord struct {
+	Type       string
+	Key        string
+	Generation string `json:",omitempty"`
+	ParentTID  string `json:",omitempty"`
+	FirstSeen  int64
+	LastSeen   int64
+}
+
+// TIDStats describes the TIDs known by the mapper
+type TIDStats struct {
+	Collisions int64
+	Records    map[string]*TIDRecord
+}
+
 // TIDMapper describes the hostID nodes stored in a graph
-// the mapper will broadcast node event to the registered listeners
+// the mapper will broadcast node event to the registered listeners.
+// With generations, the TIDs of the netns, containers and interfaces
+// include the netns inode, the container ID or the ifindex so that a
+// recreated element gets a new TID.
 type TIDMapper struct {
 	graph.DefaultGraphListener
-	Graph  *graph.Graph
-	hostID graph.Identifier
+	Graph       *graph.Graph
+	Generations bool
+	hostID      graph.Identifier
+	owners      map[string]graph.Identifier
+	nodeTIDs    map[graph.Identifier]string
+	collisions  int64
+	recordsLock sync.RWMutex
+	records     map[string]*TIDRecord
+	live        map[string]bool
+	storePath   string
+	retention   time.Duration
+	dirty       bool
+	quit        chan bool
+	wg          sync.WaitGroup
 }
 
 // Start the mapper
 func (t *TIDMapper) Start() {
 	t.Graph.AddEventListener(t)
+
+	if t.storePath != "" {
+		t.wg.Add(1)
+		go t.flushLoop()
+	}
 }
 
 // Stop the mapper
 func (t *TIDMapper) Stop() {
 	t.Graph.RemoveEventListener(t)
+
+	if t.storePath != "" {
+		close(t.quit)
+		t.wg.Wait()
+	}
+}
+
+// Stats returns the number of collisions and the records of the TIDs
+func (t *TIDMapper) Stats() TIDStats {
+	t.recordsLock.RLock()
+	defer t.recordsLock.RUnlock()
+
+	records := make(map[string]*TIDRecord, len(t.records))
+	for tid, r := range t.records {
+		record := *r
+		records[tid] = &record
+	}
+
+	return TIDStats{
+		Collisions: atomic.LoadInt64(&t.collisions),
+		Records:    records,
+	}
+}
+
+func (t *TIDMapper) load() error {
+	data, err := ioutil.ReadFile(t.storePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err = json.Unmarshal(data, &t.records); err != nil {
+		return err
+	}
+	if t.records == nil {
+		t.records = make(map[string]*TIDRecord)
+	}
+	return nil
+}
+
+// prune removes the records of the TIDs not seen for longer than the
+// retention, the records lock has to be held
+func (t *TIDMapper) prune() {
+	if t.retention <= 0 {
+		return
+	}
+
+	expired := common.UnixMillis(time.Now().Add(-t.retention))
+	for tid, r := range t.records {
+		if !t.live[tid] && r.LastSeen < expired {
+			delete(t.records, tid)
+			t.dirty = true
+		}
+	}
+}
+
+func (t *TIDMapper) flush() {
+	t.recordsLock.Lock()
+	t.prune()
+	if !t.dirty {
+		t.recordsLock.Unlock()
+		return
+	}
+	data, err := json.Marshal(t.records)
+	t.dirty = false
+	t.recordsLock.Unlock()
+
+	if err == nil {
+		// replace the store at once so that it is never truncated
+		tmp := t.storePath + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, t.storePath)
+		}
+	}
+
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to write the TID store %s: %s", t.storePath, err.Error())
+	}
+}
+
+func (t *TIDMapper) flushLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(tidStoreFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.quit:
+			t.flush()
+			return
+		}
+	}
+}
+
+func (t *TIDMapper) record(tid string, record TIDRecord) {
+	now := common.UnixMillis(time.Now())
+
+	t.recordsLock.Lock()
+	defer t.recordsLock.Unlock()
+
+	// the store is only written for a new TID or a TID seen again, the
+	// LastSeen of a live TID is set once its node is deleted
+	if r, ok := t.records[tid]; !ok {
+		record.FirstSeen, record.LastSeen = now, now
+		t.records[tid] = &record
+		t.dirty = true
+	} else if !t.live[tid] {
+		r.LastSeen = now
+		t.dirty = true
+	}
+	t.live[tid] = true
+}
+
+// release frees a TID no longer used by its node, its record is kept for the
+// retention
+func (t *TIDMapper) release(tid string) {
+	delete(t.owners, tid)
+
+	if t.storePath != "" {
+		t.recordsLock.Lock()
+		if r, ok := t.records[tid]; ok {
+			r.LastSeen = common.UnixMillis(time.Now())
+			t.dirty = true
+		}
+		delete(t.live, tid)
+		t.recordsLock.Unlock()
+	}
+}
+
+// generation returns the component identifying the incarnation of a node
+func (t *TIDMapper) generation(n *graph.Node, tp string) string {
+	if !t.Generations {
+		return ""
+	}
+
+	switch tp {
+	case "netns":
+		if inode, err := n.GetFieldInt64("Inode"); err == nil {
+			return strconv.FormatInt(inode, 10)
+		}
+	case "container":
+		if id, _ := n.GetFieldString("Docker.ContainerID"); id != "" {
+			return id
+		}
+	default:
+		if index, err := n.GetFieldInt64("IfIndex"); err == nil {
+			return strconv.FormatInt(index, 10)
+		}
+	}
+	return ""
+}
+
+// assign sets the TID of a node, a TID already owned by another node of the
+// graph is reported as a collision
+func (t *TIDMapper) assign(n *graph.Node, tid string, record TIDRecord) {
+	if owner, ok := t.owners[tid]; ok && owner != n.ID && t.Graph.GetNode(owner) != nil {
+		atomic.AddInt64(&t.collisions, 1)
+		logging.GetLogger().Errorf("TID %s of node %s (%s %s) collides with node %s", tid, n.ID, record.Type, record.Key, owner)
+	}
+
+	if old, ok := t.nodeTIDs[n.ID]; ok && old != tid && t.owners[old] == n.ID {
+		t.release(old)
+	}
+	t.owners[tid] = n.ID
+	t.nodeTIDs[n.ID] = tid
+
+	if t.storePath != "" {
+		t.record(tid, record)
+	}
+
+	t.Graph.AddMetadata(n, "TID", tid)
 }
 
 func (t *TIDMapper) setTID(parent, child *graph.Node) {
@@ -66,15 +291,16 @@ func (t *TIDMapper) setTID(parent, child *graph.Node) {
 	}
 
 	if tid, _ := parent.GetFieldString("TID"); tid != "" {
-		tid = tid + key + tp
-		u, _ := uuid.NewV5(uuid.NamespaceOID, []byte(tid))
-		t.Graph.AddMetadata(child, "TID", u.String())
+		generation := t.generation(child, tp)
+		u, _ := uuid.NewV5(uuid.NamespaceOID, []byte(tid+key+tp+generation))
+		t.assign(child, u.String(), TIDRecord{Type: tp, Key: key, Generation: generation, ParentTID: tid})
 	}
 }
 
 // onNodeEvent set TID
 // TID is UUIDV5(ID/UUID) of "root" node like host, netns, ovsport, fabric
-// for other nodes TID is UUIDV5(rootTID + Name + Type)
+// for other nodes TID is UUIDV5(rootTID + Name + Type), followed by the
+// generation if enabled
 func (t *TIDMapper) onNodeEvent(n *graph.Node) {
 	if _, err := n.GetFieldString("TID"); err != nil {
 		if tp, err := n.GetFieldString("Type"); err == nil {
@@ -83,19 +309,20 @@ func (t *TIDMapper) onNodeEvent(n *graph.Node) {
 				if name, err := n.GetFieldString("Name"); err == nil {
 					u, _ := uuid.NewV5(uuid.NamespaceOID, []byte(name))
 					t.hostID = graph.Identifier(u.String())
-					t.Graph.AddMetadata(n, "TID", u.String())
+					t.assign(n, u.String(), TIDRecord{Type: tp, Key: name})
 				}
 			case "netns":
 				if path, _ := n.GetFieldString("Path"); path != "" {
-					tid := string(t.hostID) + path + tp
+					generation := t.generation(n, tp)
+					tid := string(t.hostID) + path + tp + generation
 					u, _ := uuid.NewV5(uuid.NamespaceOID, []byte(tid))
-					t.Graph.AddMetadata(n, "TID", u.String())
+					t.assign(n, u.String(), TIDRecord{Type: tp, Key: path, Generation: generation, ParentTID: string(t.hostID)})
 				}
 			case "ovsport":
 				if u, _ := n.GetFieldString("UUID"); u != "" {
 					tid := string(t.hostID) + u + tp
-					u, _ := uuid.NewV5(uuid.NamespaceOID, []byte(tid))
-					t.Graph.AddMetadata(n, "TID", u.String())
+					id, _ := uuid.NewV5(uuid.NamespaceOID, []byte(tid))
+					t.assign(n, id.String(), TIDRecord{Type: tp, Key: u, ParentTID: string(t.hostID)})
 				}
 			default:
 				if probe, _ := n.GetFieldString("Probe"); probe == "fabric" {
@@ -123,6 +350,19 @@ func (t *TIDMapper) OnNodeAdded(n *graph.Node) {
 	t.onNodeEvent(n)
 }
 
+// OnNodeDeleted event, the TID is released
+func (t *TIDMapper) OnNodeDeleted(n *graph.Node) {
+	tid, ok := t.nodeTIDs[n.ID]
+	if !ok {
+		return
+	}
+
+	if t.owners[tid] == n.ID {
+		t.release(tid)
+	}
+	delete(t.nodeTIDs, n.ID)
+}
+
 // onEdgeEvent set TID for child TID nodes which is composed of the name
 // the TID of the parent node and the type.
 func (t *TIDMapper) onEdgeEvent(e *graph.Edge) {
@@ -165,6 +405,29 @@ func (t *TIDMapper) OnEdgeDeleted(e *graph.Edge) {
 // NewTIDMapper create a new node mapper in the graph g
 func NewTIDMapper(g *graph.Graph) *TIDMapper {
 	return &TIDMapper{
-		Graph: g,
+		Graph:    g,
+		owners:   make(map[string]graph.Identifier),
+		nodeTIDs: make(map[graph.Identifier]string),
+		records:  make(map[string]*TIDRecord),
+		live:     make(map[string]bool),
+		quit:     make(chan bool),
+	}
+}
+
+// NewTIDMapperFromConfig creates a new node mapper, the TID records are
+// persisted in the store file if configured and kept for the retention once
+// their node is deleted
+func NewTIDMapperFromConfig(g *graph.Graph) (*TIDMapper, error) {
+	t := NewTIDMapper(g)
+	t.Generations = config.GetConfig().GetBool("agent.topology.tid.generations")
+	t.storePath = config.GetConfig().GetString("agent.topology.tid.store")
+	t.retention = time.Duration(config.GetConfig().GetInt("agent.topology.tid.retention")) * time.Second
+
+	if t.storePath != "" {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
 	}
+
+	return t, nil
 }
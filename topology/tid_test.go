@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2017 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package topology
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skydive-project/skydive/topology/graph"
+)
+
+func newTIDMapperGraph(t *testing.T, generations bool) (*graph.Graph, *TIDMapper, *graph.Node) {
+	g := newGraph(t)
+
+	tm := NewTIDMapper(g)
+	tm.Generations = generations
+	tm.Start()
+
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	return g, tm, host
+}
+
+func netnsTID(g *graph.Graph, host *graph.Node, inode int64) string {
+	n := g.NewNode(graph.GenID(), graph.Metadata{"Name": "ns1", "Type": "netns", "Path": "/var/run/netns/ns1", "Inode": inode})
+	AddOwnershipLink(g, host, n, nil)
+
+	tid, _ := n.GetFieldString("TID")
+	g.DelNode(n)
+	return tid
+}
+
+func TestTIDGenerations(t *testing.T) {
+	g, tm, host := newTIDMapperGraph(t, false)
+	if tid1, tid2 := netnsTID(g, host, 1), netnsTID(g, host, 2); tid1 == "" || tid1 != tid2 {
+		t.Errorf("Expected the same TID without generations, got %s and %s", tid1, tid2)
+	}
+	tm.Stop()
+
+	g, tm, host = newTIDMapperGraph(t, true)
+	tid1, tid2 := netnsTID(g, host, 1), netnsTID(g, host, 2)
+	if tid1 == "" || tid1 == tid2 {
+		t.Errorf("Expected a new TID for a new netns generation, got %s and %s", tid1, tid2)
+	}
+	if tid := netnsTID(g, host, 1); tid != tid1 {
+		t.Errorf("Expected a stable TID for the same generation, got %s and %s", tid1, tid)
+	}
+	tm.Stop()
+}
+
+func TestTIDCollision(t *testing.T) {
+	g, tm, host := newTIDMapperGraph(t, false)
+	defer tm.Stop()
+
+	n1 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device"})
+	AddOwnershipLink(g, host, n1, nil)
+
+	if tm.Stats().Collisions != 0 {
+		t.Fatalf("No collision expected")
+	}
+
+	n2 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device"})
+	AddOwnershipLink(g, host, n2, nil)
+
+	if c := tm.Stats().Collisions; c != 1 {
+		t.Errorf("Expected a collision, got %d", c)
+	}
+
+	// the TID is released once the node is deleted
+	g.DelNode(n1)
+	g.DelNode(n2)
+
+	n3 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device"})
+	AddOwnershipLink(g, host, n3, nil)
+
+	if c := tm.Stats().Collisions; c != 1 {
+		t.Errorf("Expected no new collision, got %d", c)
+	}
+}
+
+func TestTIDStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skydive-tid")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	g := newGraph(t)
+
+	tm := NewTIDMapper(g)
+	tm.storePath = filepath.Join(dir, "tids.json")
+	tm.retention = time.Hour
+	tm.Start()
+	defer tm.Stop()
+
+	host := g.NewNode(graph.GenID(), graph.Metadata{"Name": "host1", "Type": "host"})
+	n1 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth0", "Type": "device"})
+	AddOwnershipLink(g, host, n1, nil)
+	n2 := g.NewNode(graph.GenID(), graph.Metadata{"Name": "eth1", "Type": "device"})
+	AddOwnershipLink(g, host, n2, nil)
+
+	tm.flush()
+
+	tm2 := NewTIDMapper(g)
+	tm2.storePath = tm.storePath
+	if err = tm2.load(); err != nil || len(tm2.records) != 3 {
+		t.Fatalf("Expected 3 stored records, got: %v, %v", tm2.records, err)
+	}
+
+	// the store is not written again without change
+	os.Remove(tm.storePath)
+	g.AddMetadata(n1, "MTU", 1500)
+	tm.flush()
+	if _, err = os.Stat(tm.storePath); !os.IsNotExist(err) {
+		t.Fatalf("The store should not be written without change: %v", err)
+	}
+
+	// the record of a deleted node is pruned once expired
+	tid, _ := n2.GetFieldString("TID")
+	g.DelNode(n2)
+
+	tm.flush()
+	if _, ok := tm.Stats().Records[tid]; !ok {
+		t.Fatalf("The record of %s should be kept for the retention", tid)
+	}
+
+	tm.recordsLock.Lock()
+	tm.records[tid].LastSeen -= int64(2 * time.Hour / time.Millisecond)
+	tm.recordsLock.Unlock()
+
+	tm.flush()
+	if records := tm.Stats().Records; len(records) != 2 || records[tid] != nil {
+		t.Fatalf("Expected the record of %s to be pruned, got: %v", tid, records)
+	}
+
+	tm2.records = nil
+	if err = tm2.load(); err != nil || len(tm2.records) != 2 {
+		t.Fatalf("Expected 2 stored records, got: %v, %v", tm2.records, err)
+	}
+}